@@ -0,0 +1,100 @@
+package goai
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Admission limits the complexity of the requests before calling Gemini, to
+// protect shared deployments from pathological prompts. Zero limits are
+// unlimited.
+type Admission struct {
+	// MaxPromptTokens limits the estimated number of prompt tokens.
+	MaxPromptTokens int
+
+	// MaxImages limits the number of images and files.
+	MaxImages int
+
+	// MaxTokens limits the requested max_tokens.
+	MaxTokens int
+
+	// MaxScore limits the admission score, the estimated prompt tokens plus
+	// the requested max_tokens.
+	MaxScore int
+
+	// Model is the model used for the requests over the limits instead of
+	// rejecting them, e.g. a cheaper model.
+	Model string
+}
+
+// SetAdmission sets the complexity limits of the requests.
+func (a *Adapter) SetAdmission(adm Admission) {
+	a.update(func(s *adapterSettings) {
+		s.admission = adm
+	})
+}
+
+// admit returns the model to use for the request, or an error if the request
+// is over the limits and there is no model to route it to.
+func (a *Adapter) admit(ctx context.Context, req openai.ChatCompletionRequest, contents []*genai.Content, model string) (string, error) {
+	adm := a.settings().admission
+	err := adm.check(req, contents)
+	if err == nil {
+		return model, nil
+	}
+
+	if a.logger != nil {
+		a.logger.WarnContext(ctx, "request over the admission limits",
+			slog.String("model", model),
+			slog.String("error", err.Message),
+		)
+	}
+
+	if adm.Model == "" {
+		return "", err
+	}
+
+	addWarning(ctx, "admission_model", "%s, using %q", err.Message, adm.Model)
+	return adm.Model, nil
+}
+
+func (adm Admission) check(req openai.ChatCompletionRequest, contents []*genai.Content) *openai.APIError {
+	promptTokens := estimateTokens(contents)
+	if adm.MaxPromptTokens > 0 && promptTokens > adm.MaxPromptTokens {
+		return invalidRequestError("request_too_complex", "messages", "estimated prompt tokens %d exceed the limit of %d", promptTokens, adm.MaxPromptTokens)
+	}
+
+	images := countMedia(contents)
+	if adm.MaxImages > 0 && images > adm.MaxImages {
+		return invalidRequestError("request_too_complex", "messages", "%d images exceed the limit of %d", images, adm.MaxImages)
+	}
+
+	if adm.MaxTokens > 0 && req.MaxTokens > adm.MaxTokens {
+		return invalidRequestError("request_too_complex", "max_tokens", "max_tokens %d exceeds the limit of %d", req.MaxTokens, adm.MaxTokens)
+	}
+
+	score := promptTokens + req.MaxTokens
+	if adm.MaxScore > 0 && score > adm.MaxScore {
+		return invalidRequestError("request_too_complex", "messages", "request score %d exceeds the limit of %d", score, adm.MaxScore)
+	}
+
+	return nil
+}
+
+// countMedia counts the inline and uploaded media.
+func countMedia(contents []*genai.Content) int {
+	var n int
+	for _, c := range contents {
+		for _, p := range c.Parts {
+			switch p.(type) {
+			case genai.Blob, genai.FileData:
+				n++
+			}
+		}
+	}
+
+	return n
+}
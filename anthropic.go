@@ -0,0 +1,653 @@
+package goai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	anthropicBaseURL = "https://api.anthropic.com"
+
+	// anthropicVersion is the version of the Messages API.
+	anthropicVersion = "2023-06-01"
+
+	// anthropicMaxTokens is the max_tokens of the requests without one,
+	// which Anthropic requires.
+	anthropicMaxTokens = 4096
+)
+
+// Anthropic is the Provider of the Claude models, which converts the OpenAI
+// requests to the Anthropic Messages API.
+type Anthropic struct {
+	// APIKey returns the API key of the calls, e.g. of a rotated secret.
+	APIKey func() string
+
+	// BaseURL replaces https://api.anthropic.com, e.g. with a gateway.
+	BaseURL string
+
+	// HTTPClient sends the calls, http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+var _ Provider = (*Anthropic)(nil)
+
+// NewAnthropic returns the provider of the Claude models with the API key.
+func NewAnthropic(apiKey string) *Anthropic {
+	return &Anthropic{
+		APIKey: func() string { return apiKey },
+	}
+}
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	System        string               `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float32             `json:"temperature,omitempty"`
+	TopP          *float32             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *anthropicMetadata   `json:"metadata,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block of the messages, of type text, image,
+// tool_use or tool_result.
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Source    *anthropicSource `json:"source,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   string           `json:"content,omitempty"`
+}
+
+// anthropicSource is the source of an image, inline or by URL.
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// toOpenaiUsage returns the usage, with the cached input tokens in the
+// prompt tokens, like OpenAI.
+func (u anthropicUsage) toOpenaiUsage() openai.Usage {
+	prompt := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	return openai.Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+		PromptTokensDetails: &openai.PromptTokensDetails{
+			CachedTokens: u.CacheReadInputTokens,
+		},
+	}
+}
+
+// anthropicFinishReasons are the OpenAI finish reasons of the stop reasons.
+var anthropicFinishReasons = map[string]openai.FinishReason{
+	"end_turn":      openai.FinishReasonStop,
+	"stop_sequence": openai.FinishReasonStop,
+	"max_tokens":    openai.FinishReasonLength,
+	"tool_use":      openai.FinishReasonToolCalls,
+	"refusal":       openai.FinishReasonContentFilter,
+}
+
+// toAnthropicRequest converts the request. The system messages are joined
+// in the system prompt, and the tool results are sent in user messages.
+func toAnthropicRequest(ctx context.Context, req openai.ChatCompletionRequest) (*anthropicRequest, error) {
+	params := []struct {
+		name string
+		set  bool
+	}{
+		{"n", req.N > 1},
+		{"seed", req.Seed != nil},
+		{"logit_bias", len(req.LogitBias) > 0},
+		{"logprobs", req.LogProbs},
+		{"presence_penalty", req.PresencePenalty != 0},
+		{"frequency_penalty", req.FrequencyPenalty != 0},
+		{"response_format", req.ResponseFormat != nil},
+	}
+	for _, p := range params {
+		if !p.set {
+			continue
+		}
+
+		if err := DropParams(ctx, p.name); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &anthropicRequest{
+		Model:         req.Model,
+		MaxTokens:     req.MaxCompletionTokens,
+		StopSequences: req.Stop,
+		Stream:        req.Stream,
+	}
+	if r.MaxTokens == 0 {
+		r.MaxTokens = req.MaxTokens
+	}
+	if r.MaxTokens == 0 {
+		r.MaxTokens = anthropicMaxTokens
+	}
+	if req.Temperature != 0 {
+		// Anthropic's temperature ranges from 0 to 1.
+		t := min(req.Temperature, 1)
+		if t != req.Temperature {
+			addWarning(ctx, "normalized_parameter", "temperature %v was converted to %v", req.Temperature, t)
+		}
+		r.Temperature = &t
+	}
+	if req.TopP != 0 {
+		r.TopP = &req.TopP
+	}
+	if req.User != "" {
+		r.Metadata = &anthropicMetadata{UserID: req.User}
+	}
+
+	for _, t := range req.Tools {
+		if t.Function == nil {
+			continue
+		}
+
+		schema := t.Function.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		r.Tools = append(r.Tools, anthropicTool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			InputSchema: schema,
+		})
+	}
+
+	choice, err := toAnthropicToolChoice(req.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+	r.ToolChoice = choice
+
+	var system []string
+	for i, m := range req.Messages {
+		var (
+			role   string
+			blocks []anthropicBlock
+		)
+		switch m.Role {
+		case openai.ChatMessageRoleSystem, "developer":
+			for _, b := range messageBlocks(m) {
+				if b.Type == "text" {
+					system = append(system, b.Text)
+				}
+			}
+			continue
+		case openai.ChatMessageRoleUser:
+			role, blocks = "user", messageBlocks(m)
+		case openai.ChatMessageRoleAssistant:
+			role, blocks = "assistant", messageBlocks(m)
+			for _, tc := range m.ToolCalls {
+				input := json.RawMessage(tc.Function.Arguments)
+				if len(bytes.TrimSpace(input)) == 0 {
+					input = json.RawMessage("{}")
+				}
+				if !json.Valid(input) {
+					return nil, invalidRequestError("invalid_value", fmt.Sprintf("messages[%d].tool_calls", i), "the arguments of the tool call %q are not valid JSON", tc.ID)
+				}
+
+				blocks = append(blocks, anthropicBlock{
+					Type:  "tool_use",
+					ID:    tc.ID,
+					Name:  tc.Function.Name,
+					Input: input,
+				})
+			}
+		case openai.ChatMessageRoleTool:
+			role = "user"
+			blocks = []anthropicBlock{{
+				Type:      "tool_result",
+				ToolUseID: m.ToolCallID,
+				Content:   messageText(m),
+			}}
+		default:
+			return nil, invalidRequestError("invalid_value", fmt.Sprintf("messages[%d].role", i), "role %q is not supported", m.Role)
+		}
+
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// The consecutive messages of a role are merged, e.g. the results of
+		// the parallel tool calls.
+		if n := len(r.Messages); n > 0 && r.Messages[n-1].Role == role {
+			r.Messages[n-1].Content = append(r.Messages[n-1].Content, blocks...)
+			continue
+		}
+
+		r.Messages = append(r.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+	r.System = strings.Join(system, "\n\n")
+
+	return r, nil
+}
+
+// messageBlocks returns the text and image blocks of the message.
+func messageBlocks(m openai.ChatCompletionMessage) []anthropicBlock {
+	if len(m.MultiContent) == 0 {
+		if m.Content == "" {
+			return nil
+		}
+
+		return []anthropicBlock{{Type: "text", Text: m.Content}}
+	}
+
+	var blocks []anthropicBlock
+	for _, part := range m.MultiContent {
+		switch {
+		case part.Type == openai.ChatMessagePartTypeText && part.Text != "":
+			blocks = append(blocks, anthropicBlock{Type: "text", Text: part.Text})
+		case part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil:
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: toAnthropicSource(part.ImageURL.URL)})
+		}
+	}
+
+	return blocks
+}
+
+// messageText returns the text of the message, e.g. of a tool result.
+func messageText(m openai.ChatCompletionMessage) string {
+	var texts []string
+	for _, b := range messageBlocks(m) {
+		if b.Type == "text" {
+			texts = append(texts, b.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// toAnthropicSource returns the source of the data URLs inline, and of the
+// other URLs by URL, which Anthropic fetches.
+func toAnthropicSource(url string) *anthropicSource {
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if mediaType, data, ok := strings.Cut(rest, ";base64,"); ok {
+			return &anthropicSource{Type: "base64", MediaType: mediaType, Data: data}
+		}
+	}
+
+	return &anthropicSource{Type: "url", URL: url}
+}
+
+// toAnthropicToolChoice converts the tool choice, a string or a function,
+// as decoded from JSON or set with openai.ToolChoice.
+func toAnthropicToolChoice(choice any) (*anthropicToolChoice, error) {
+	var name string
+	switch v := choice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch v {
+		case "auto":
+			return &anthropicToolChoice{Type: "auto"}, nil
+		case "required":
+			return &anthropicToolChoice{Type: "any"}, nil
+		case "none":
+			return &anthropicToolChoice{Type: "none"}, nil
+		}
+	case openai.ToolChoice:
+		name = v.Function.Name
+	case *openai.ToolChoice:
+		name = v.Function.Name
+	case map[string]any:
+		if f, ok := v["function"].(map[string]any); ok {
+			name, _ = f["name"].(string)
+		}
+	}
+
+	if name == "" {
+		return nil, invalidRequestError("invalid_value", "tool_choice", "tool_choice must be auto, required, none or a function")
+	}
+
+	return &anthropicToolChoice{Type: "tool", Name: name}, nil
+}
+
+func (p *Anthropic) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+// do sends the call, and returns the errors of Anthropic as OpenAI errors.
+func (p *Anthropic) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	base := anthropicBaseURL
+	if p.BaseURL != "" {
+		base = strings.TrimRight(p.BaseURL, "/")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if p.APIKey != nil {
+		req.Header.Set("x-api-key", p.APIKey())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := p.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("anthropic: %w", err)
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		return nil, anthropicError(res)
+	}
+
+	return res, nil
+}
+
+// anthropicError returns the error of the response. Its types, e.g.
+// rate_limit_error, are the same as OpenAI's.
+func anthropicError(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil || body.Error.Message == "" {
+		body.Error.Type = "api_error"
+		body.Error.Message = strings.TrimSpace(string(b))
+		if body.Error.Message == "" {
+			body.Error.Message = http.StatusText(res.StatusCode)
+		}
+	}
+
+	return &openai.APIError{
+		Message:        "anthropic: " + body.Error.Message,
+		Type:           body.Error.Type,
+		HTTPStatusCode: res.StatusCode,
+	}
+}
+
+// ChatCompletion sends the request to the Messages API.
+func (p *Anthropic) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	req.Stream = false
+	body, err := toAnthropicRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.do(ctx, http.MethodPost, "/v1/messages", body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resp anthropicResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("anthropic: %w", err)
+	}
+
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	for _, b := range resp.Content {
+		switch b.Type {
+		case "text":
+			msg.Content += b.Text
+		case "tool_use":
+			msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{
+				ID:   b.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      b.Name,
+					Arguments: string(b.Input),
+				},
+			})
+		}
+	}
+
+	return &openai.ChatCompletionResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      msg,
+			FinishReason: anthropicFinishReasons[resp.StopReason],
+		}},
+		Usage: resp.Usage.toOpenaiUsage(),
+	}, nil
+}
+
+// anthropicEvent is an event of the streams, of which the message, the
+// content blocks and their deltas are read.
+type anthropicEvent struct {
+	Type         string             `json:"type"`
+	Message      *anthropicResponse `json:"message"`
+	Index        int                `json:"index"`
+	ContentBlock *anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+}
+
+// ChatCompletionStream streams the response of the Messages API. The stream
+// ends early when the call fails once started.
+func (p *Anthropic) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	req.Stream = true
+	body, err := toAnthropicRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.do(ctx, http.MethodPost, "/v1/messages", body)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+
+		var (
+			id      string
+			usage   anthropicUsage
+			created = time.Now().Unix()
+		)
+		// emit stops when the consumer is gone, after which the stream
+		// ends at the next event.
+		emit := func(res openai.ChatCompletionStreamResponse) {
+			select {
+			case ch <- res:
+			case <-ctx.Done():
+			}
+		}
+		send := func(delta openai.ChatCompletionStreamChoiceDelta, reason openai.FinishReason) {
+			emit(openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionStreamChoice{{
+					Delta:        delta,
+					FinishReason: reason,
+				}},
+			})
+		}
+
+		// The index of the OpenAI tool call of the content blocks.
+		toolCalls := make(map[int]int)
+
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 10<<20)
+		for ctx.Err() == nil && scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+
+			var e anthropicEvent
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &e); err != nil {
+				return
+			}
+
+			switch e.Type {
+			case "message_start":
+				if e.Message != nil {
+					id = e.Message.ID
+					usage = e.Message.Usage
+				}
+				send(openai.ChatCompletionStreamChoiceDelta{Role: openai.ChatMessageRoleAssistant}, "")
+			case "content_block_start":
+				if e.ContentBlock != nil && e.ContentBlock.Type == "tool_use" {
+					index := len(toolCalls)
+					toolCalls[e.Index] = index
+					send(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+						Index:    &index,
+						ID:       e.ContentBlock.ID,
+						Type:     openai.ToolTypeFunction,
+						Function: openai.FunctionCall{Name: e.ContentBlock.Name},
+					}}}, "")
+				}
+			case "content_block_delta":
+				switch e.Delta.Type {
+				case "text_delta":
+					send(openai.ChatCompletionStreamChoiceDelta{Content: e.Delta.Text}, "")
+				case "input_json_delta":
+					index, ok := toolCalls[e.Index]
+					if !ok || e.Delta.PartialJSON == "" {
+						continue
+					}
+					send(openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+						Index:    &index,
+						Function: openai.FunctionCall{Arguments: e.Delta.PartialJSON},
+					}}}, "")
+				}
+			case "message_delta":
+				if e.Usage != nil {
+					usage.OutputTokens = e.Usage.OutputTokens
+				}
+				if e.Delta.StopReason != "" {
+					send(openai.ChatCompletionStreamChoiceDelta{}, anthropicFinishReasons[e.Delta.StopReason])
+				}
+			case "message_stop", "error":
+				if e.Type == "message_stop" && req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+					u := usage.toOpenaiUsage()
+					emit(openai.ChatCompletionStreamResponse{
+						ID:      id,
+						Object:  "chat.completion.chunk",
+						Created: created,
+						Model:   req.Model,
+						Choices: []openai.ChatCompletionStreamChoice{},
+						Usage:   &u,
+					})
+				}
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Embeddings is not supported, since Anthropic has no embedding models.
+func (p *Anthropic) Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	return nil, invalidRequestError("invalid_value", "model", "the Anthropic models don't support embeddings")
+}
+
+// ListModels lists the Claude models.
+func (p *Anthropic) ListModels(ctx context.Context) ([]openai.Model, error) {
+	res, err := p.do(ctx, http.MethodGet, "/v1/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Data []struct {
+			ID        string    `json:"id"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("anthropic: %w", err)
+	}
+
+	models := make([]openai.Model, len(body.Data))
+	for i, m := range body.Data {
+		models[i] = openai.Model{
+			ID:        m.ID,
+			Object:    "model",
+			OwnedBy:   "anthropic",
+			CreatedAt: m.CreatedAt.Unix(),
+		}
+	}
+
+	return models, nil
+}
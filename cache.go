@@ -0,0 +1,287 @@
+package goai
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache stores values that are shared by the proxy replicas, such as the
+// cached completions, the model lists and the rate limit counters. A ttl of 0
+// keeps the value until it is overwritten.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+
+	// Incr increments the counter and returns its new value. The ttl is set
+	// when the counter is created.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// NewCache returns a Redis cache for redis:// URLs, and an in-memory cache
+// when the URL is empty.
+func NewCache(url string) (Cache, error) {
+	if url == "" {
+		return NewMemoryCache(), nil
+	}
+
+	if !strings.HasPrefix(url, "redis://") && !strings.HasPrefix(url, "rediss://") {
+		return nil, errors.New("cache url must start with redis:// or rediss://")
+	}
+
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisCache{client: redis.NewClient(opt)}, nil
+}
+
+// keyHash identifies an API key in the cache keys without storing the key
+// itself.
+func keyHash(apiKey string) string {
+	h := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(h[:])
+}
+
+const (
+	// defaultMemoryCacheSize is the number of entries above which the least
+	// recently used ones are evicted, so that the keys seen once, e.g. the
+	// rate limit counters of past windows, don't pile up.
+	defaultMemoryCacheSize = 100_000
+
+	// memoryCacheSweepInterval is how often the expired entries are removed,
+	// since the entries that are never read again aren't removed by Get.
+	memoryCacheSweepInterval = time.Minute
+)
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// memoryCache is the LRU cache of the entries, whose expired entries are
+// removed periodically.
+type memoryCache struct {
+	mu      sync.Mutex
+	maxSize int
+	lru     *list.List
+	entries map[string]*list.Element
+
+	sweep     sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryCache returns a cache that is not shared by the replicas. It keeps
+// up to 100000 entries, and implements io.Closer to stop removing the expired
+// ones.
+func NewMemoryCache() Cache {
+	return newMemoryCache(defaultMemoryCacheSize)
+}
+
+func newMemoryCache(maxSize int) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entry(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	return e.value, true, nil
+}
+
+// entry returns the entry if it is not expired, as the most recently used.
+// c.mu must be held.
+func (c *memoryCache) entry(key string) (*memoryEntry, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*memoryEntry)
+	if e.expired(time.Now()) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// put stores the entry as the most recently used, and evicts the least
+// recently used ones above the max size. c.mu must be held.
+func (c *memoryCache) put(e *memoryEntry) {
+	c.sweep.Do(func() {
+		go c.sweepExpired()
+	})
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the entry. c.mu must be held.
+func (c *memoryCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*memoryEntry).key)
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	c.mu.Lock()
+	c.put(&memoryEntry{key: key, value: value, expiresAt: expiresAt})
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *memoryCache) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		n         int64
+		expiresAt time.Time
+	)
+	if e, ok := c.entry(key); ok {
+		var err error
+		n, err = strconv.ParseInt(string(e.value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("incr %q: %w", key, err)
+		}
+
+		expiresAt = e.expiresAt
+	} else if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	n++
+	c.put(&memoryEntry{key: key, value: []byte(strconv.FormatInt(n, 10)), expiresAt: expiresAt})
+
+	return n, nil
+}
+
+// sweepExpired removes the expired entries periodically, until the cache is
+// closed.
+func (c *memoryCache) sweepExpired() {
+	t := time.NewTicker(memoryCacheSweepInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		c.removeExpired(time.Now())
+	}
+}
+
+func (c *memoryCache) removeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*memoryEntry).expired(now) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// Close stops removing the expired entries periodically.
+func (c *memoryCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	return nil
+}
+
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	b, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, key).Err()
+}
+
+func (c *redisCache) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	// The counter is created with its expiry in the same transaction, so
+	// that a counter is never left without expiry.
+	pipe := c.client.TxPipeline()
+	pipe.SetNX(ctx, key, 0, ttl)
+	incr := pipe.Incr(ctx, key)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	return incr.Val(), nil
+}
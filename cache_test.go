@@ -0,0 +1,82 @@
+package goai
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCache(3)
+	t.Cleanup(func() { c.Close() })
+
+	for i := 0; i < 3; i++ {
+		if err := c.Set(ctx, fmt.Sprint(i), []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 0 is used again, so 1 is the least recently used one.
+	if _, ok, _ := c.Get(ctx, "0"); !ok {
+		t.Fatal("0 is missing")
+	}
+	if _, err := c.Incr(ctx, "3", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "3": true} {
+		if _, ok, _ := c.Get(ctx, key); ok != want {
+			t.Errorf("%s cached: got %t, want %t", key, ok, want)
+		}
+	}
+}
+
+func TestMemoryCacheRemoveExpired(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCache(defaultMemoryCacheSize)
+	t.Cleanup(func() { c.Close() })
+
+	if err := c.Set(ctx, "expiring", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Incr(ctx, "counter", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "kept", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	c.removeExpired(time.Now().Add(2 * time.Minute))
+
+	if n := c.lru.Len(); n != 1 || len(c.entries) != 1 {
+		t.Fatalf("got %d entries, %d keys, want only the one without ttl", n, len(c.entries))
+	}
+	if _, ok := c.entries["kept"]; !ok {
+		t.Fatal("the entry without ttl was removed")
+	}
+}
+
+func TestMemoryCacheIncrKeepsTTL(t *testing.T) {
+	ctx := context.Background()
+	c := newMemoryCache(defaultMemoryCacheSize)
+	t.Cleanup(func() { c.Close() })
+
+	for want := int64(1); want <= 3; want++ {
+		n, err := c.Incr(ctx, "counter", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("got %d, want %d", n, want)
+		}
+	}
+
+	// The counter expires with the ttl of its creation, not of the last
+	// increment.
+	e := c.entries["counter"].Value.(*memoryEntry)
+	if e.expiresAt.IsZero() || time.Until(e.expiresAt) > time.Minute {
+		t.Fatalf("expires at %v, want within a minute", e.expiresAt)
+	}
+}
@@ -0,0 +1,255 @@
+package goai
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	defaultClientCacheSize   = 1000
+	defaultClientTTL         = 24 * time.Hour
+	defaultClientIdleTimeout = 30 * time.Minute
+)
+
+// ClientCache limits the Gemini clients that the adapter keeps, one per API
+// key, so that the clients of the keys seen once, e.g. invalid ones, don't
+// pile up.
+type ClientCache struct {
+	// MaxSize is the number of clients above which the least recently used
+	// ones are closed. Defaults to 1000.
+	MaxSize int
+
+	// TTL is the age from which the clients are created again, e.g. to
+	// connect to the new addresses of Gemini. Defaults to 24h.
+	TTL time.Duration
+
+	// IdleTimeout is how long the unused clients are kept. Defaults to 30m.
+	IdleTimeout time.Duration
+}
+
+// ClientStats are the number of clients, and of the clients evicted so far.
+type ClientStats struct {
+	Clients   int   `json:"clients"`
+	Evictions int64 `json:"evictions"`
+}
+
+type clientEntry struct {
+	key      string
+	client   *genai.Client
+	created  time.Time
+	lastUsed time.Time
+}
+
+// clientCache is the LRU cache of the clients. The evicted clients are
+// closed, which doesn't interrupt the requests that still use them, since
+// the Gemini calls are REST calls.
+type clientCache struct {
+	mu        sync.Mutex
+	limits    ClientCache
+	lru       *list.List
+	entries   map[string]*list.Element
+	evictions int64
+
+	sweep sync.Once
+	done  chan struct{}
+}
+
+func newClientCache() *clientCache {
+	c := &clientCache{
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		done:    make(chan struct{}),
+	}
+	c.setLimits(ClientCache{})
+
+	return c
+}
+
+func (c *clientCache) setLimits(limits ClientCache) {
+	if limits.MaxSize <= 0 {
+		limits.MaxSize = defaultClientCacheSize
+	}
+	if limits.TTL <= 0 {
+		limits.TTL = defaultClientTTL
+	}
+	if limits.IdleTimeout <= 0 {
+		limits.IdleTimeout = defaultClientIdleTimeout
+	}
+
+	c.mu.Lock()
+	c.limits = limits
+	evicted := c.evict(time.Now())
+	c.mu.Unlock()
+
+	closeClients(evicted)
+}
+
+// get returns the client of the key, unless it is too old.
+func (c *clientCache) get(key string) (*genai.Client, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	now := time.Now()
+	e := el.Value.(*clientEntry)
+	if now.Sub(e.created) >= c.limits.TTL {
+		c.remove(el)
+		c.mu.Unlock()
+
+		closeClients([]*genai.Client{e.client})
+		return nil, false
+	}
+
+	e.lastUsed = now
+	c.lru.MoveToFront(el)
+	c.mu.Unlock()
+
+	return e.client, true
+}
+
+// add stores the client of the key, unless another one was stored since,
+// which is returned instead. The least recently used clients are evicted.
+func (c *clientCache) add(key string, client *genai.Client) *genai.Client {
+	c.sweep.Do(func() {
+		go c.sweepIdle()
+	})
+
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*clientEntry)
+		e.lastUsed = now
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+
+		closeClients([]*genai.Client{client})
+		return e.client
+	}
+
+	c.entries[key] = c.lru.PushFront(&clientEntry{
+		key:      key,
+		client:   client,
+		created:  now,
+		lastUsed: now,
+	})
+	evicted := c.evict(now)
+	c.mu.Unlock()
+
+	closeClients(evicted)
+	return client
+}
+
+// delete evicts the client of the key, e.g. of an invalid API key.
+func (c *clientCache) delete(key string) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		closeClients([]*genai.Client{el.Value.(*clientEntry).client})
+	}
+}
+
+// evict removes the clients above the max size and the idle ones, from the
+// least recently used, and returns them. c.mu must be held.
+func (c *clientCache) evict(now time.Time) []*genai.Client {
+	var evicted []*genai.Client
+	for el := c.lru.Back(); el != nil; el = c.lru.Back() {
+		e := el.Value.(*clientEntry)
+		if c.lru.Len() <= c.limits.MaxSize && now.Sub(e.lastUsed) < c.limits.IdleTimeout {
+			break
+		}
+
+		c.remove(el)
+		evicted = append(evicted, e.client)
+	}
+
+	return evicted
+}
+
+// remove removes the entry. c.mu must be held.
+func (c *clientCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*clientEntry).key)
+	c.evictions++
+}
+
+// sweepIdle closes the idle clients periodically, until the cache is
+// closed.
+func (c *clientCache) sweepIdle() {
+	c.mu.Lock()
+	interval := c.limits.IdleTimeout / 2
+	c.mu.Unlock()
+
+	t := time.NewTicker(max(interval, time.Second))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		c.mu.Lock()
+		evicted := c.evict(time.Now())
+		c.mu.Unlock()
+
+		closeClients(evicted)
+	}
+}
+
+func (c *clientCache) stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ClientStats{
+		Clients:   c.lru.Len(),
+		Evictions: c.evictions,
+	}
+}
+
+// close closes all the clients, and stops the sweeping.
+func (c *clientCache) close() {
+	c.mu.Lock()
+	var clients []*genai.Client
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		clients = append(clients, el.Value.(*clientEntry).client)
+	}
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+
+	closeClients(clients)
+}
+
+func closeClients(clients []*genai.Client) {
+	for _, client := range clients {
+		_ = client.Close()
+	}
+}
+
+// SetClientCache limits the Gemini clients that are kept, see ClientCache.
+func (a *Adapter) SetClientCache(limits ClientCache) {
+	a.clients.setLimits(limits)
+}
+
+// ClientStats returns the number of Gemini clients and evictions.
+func (a *Adapter) ClientStats() ClientStats {
+	return a.clients.stats()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+var accessLogContextKey contextKey = "access_log"
+
+// accessLogEntry collects what the handlers know about the request for its
+// access log line.
+type accessLogEntry struct {
+	// info is the request info of the handler, if any.
+	info *goai.RequestInfo
+
+	// key is the fingerprint of the client key.
+	key    string
+	client string
+	labels map[string]string
+	usage  *openai.Usage
+	cost   float64
+}
+
+// accessLogFromContext returns the access log entry of the request, or a
+// discarded one if there is none.
+func accessLogFromContext(ctx context.Context) *accessLogEntry {
+	e, ok := ctx.Value(accessLogContextKey).(*accessLogEntry)
+	if !ok {
+		return new(accessLogEntry)
+	}
+
+	return e
+}
+
+// accessLog logs one line per request when it is done, streams included, with
+// its status, duration, size, model, tokens and key fingerprint, but not its
+// content. The health checks and metric scrapes are not logged.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		e := new(accessLogEntry)
+		ctx := context.WithValue(r.Context(), accessLogContextKey, e)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int64("bytes", rec.bytes),
+		}
+		if e.key != "" {
+			attrs = append(attrs, slog.String("key", e.key))
+		}
+		if e.client != "" {
+			attrs = append(attrs, slog.String("client", e.client))
+		}
+		if info := e.info; info != nil {
+			for _, a := range []slog.Attr{
+				slog.String("virtual_key", info.VirtualKey),
+				slog.String("tenant", info.Tenant),
+				slog.String("model", info.Model),
+				slog.String("gemini_model", info.GeminiModel),
+			} {
+				if a.Value.String() != "" {
+					attrs = append(attrs, a)
+				}
+			}
+			if info.Retries > 0 {
+				attrs = append(attrs, slog.Int("retries", info.Retries))
+			}
+		}
+		if len(e.labels) > 0 {
+			attrs = append(attrs, slog.Any("labels", e.labels))
+		}
+		if u := e.usage; u != nil {
+			attrs = append(attrs,
+				slog.Int("prompt_tokens", u.PromptTokens),
+				slog.Int("completion_tokens", u.CompletionTokens),
+				slog.Float64("cost", e.cost),
+			)
+		}
+
+		logger.LogAttrs(ctx, slog.LevelInfo, "access", attrs...)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var errUnsupportedFormat = errors.New("unsupported export format")
+
+// usageContentTypes lists the supported export formats.
+var usageContentTypes = map[string]string{
+	"csv":     "text/csv",
+	"jsonl":   "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// requireAdmin guards the admin endpoints with a static bearer token. The
+// endpoints are disabled when no token is configured.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type adminHandler struct {
+	usage         *usageStore
+	contextCaches contextCacher
+	responses     *responseCache
+	upstreamKeys  *keyPool
+	virtualKeys   *virtualKeyStore
+	budgets       *budgetTracker
+	dumps         dumpStore
+}
+
+// Usage returns the usage aggregated per key, tenant, model and day, filtered
+// by the key, tenant and date range, e.g. ?key=vk_123&from=2024-01-01.
+func (h adminHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseUsageFilter(q.Get("from"), q.Get("to"), q.Get("tenant"), q.Get("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := h.usage.List(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Object string     `json:"object"`
+		Data   []usageRow `json:"data"`
+	}{"list", aggregateUsage(records)})
+}
+
+func (h adminHandler) ExportUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseUsageFilter(q.Get("from"), q.Get("to"), q.Get("tenant"), q.Get("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	contentType, ok := usageContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s: %q", errUnsupportedFormat, format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage.%s"`, format))
+	if err := exportUsage(w, format, h.usage, filter); err != nil {
+		logger.ErrorContext(r.Context(), "export usage failed", slog.String("error", err.Error()))
+	}
+}
+
+// exportUsageCmd implements the usage-export subcommand, which reads the
+// usage file directly without a running server.
+func exportUsageCmd(args []string) error {
+	fs := flag.NewFlagSet("usage-export", flag.ExitOnError)
+	var (
+		path   = fs.String("usage-path", usagePath(), "path to the usage file")
+		format = fs.String("format", "csv", "export format, csv, parquet or jsonl")
+		from   = fs.String("from", "", "start date (YYYY-MM-DD or RFC3339), inclusive")
+		to     = fs.String("to", "", "end date (YYYY-MM-DD or RFC3339), inclusive for dates")
+		tenant = fs.String("tenant", "", "only export the given tenant")
+		key    = fs.String("key", "", "only export the given key fingerprint or virtual key ID")
+		out    = fs.String("o", "", "output file, defaults to stdout")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := parseUsageFilter(*from, *to, *tenant, *key)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	return exportUsage(w, *format, newUsageStore(*path), filter)
+}
+
+// exportUsage writes the usage aggregated per key, tenant, model and day as
+// CSV or Parquet, or streams the records as JSON lines.
+func exportUsage(w io.Writer, format string, s *usageStore, filter usageFilter) error {
+	switch format {
+	case "csv":
+		records, err := s.List(filter)
+		if err != nil {
+			return err
+		}
+
+		return writeUsageCSV(w, aggregateUsage(records))
+	case "parquet":
+		records, err := s.List(filter)
+		if err != nil {
+			return err
+		}
+
+		return writeUsageParquet(w, aggregateUsage(records))
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		return s.Each(filter, func(r usageRecord) error {
+			return enc.Encode(r)
+		})
+	default:
+		return fmt.Errorf("%w: %q", errUnsupportedFormat, format)
+	}
+}
+
+func parseUsageFilter(from, to, tenant, key string) (usageFilter, error) {
+	f := usageFilter{Tenant: tenant, Key: key}
+
+	if from != "" {
+		t, _, err := parseTime(from)
+		if err != nil {
+			return f, fmt.Errorf("invalid from: %w", err)
+		}
+
+		f.From = t
+	}
+
+	if to != "" {
+		t, dateOnly, err := parseTime(to)
+		if err != nil {
+			return f, fmt.Errorf("invalid to: %w", err)
+		}
+
+		// Include the whole day when only the date is given.
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+
+		f.To = t
+	}
+
+	return f, nil
+}
+
+func parseTime(s string) (t time.Time, dateOnly bool, err error) {
+	t, err = time.Parse(time.DateOnly, s)
+	if err == nil {
+		return t, true, nil
+	}
+
+	t, err = time.Parse(time.RFC3339, s)
+	return t, false, err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// toAudioMIMEType maps the OpenAI input audio formats to the MIME types
+// supported by Gemini.
+var toAudioMIMEType = map[string]string{
+	"wav":  "audio/wav",
+	"mp3":  "audio/mp3",
+	"aiff": "audio/aiff",
+	"aac":  "audio/aac",
+	"ogg":  "audio/ogg",
+	"flac": "audio/flac",
+}
+
+// inputAudioURL returns the data URL of an input_audio part.
+func inputAudioURL(raw json.RawMessage) (string, error) {
+	var audio struct {
+		Data   string `json:"data"`
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(raw, &audio); err != nil {
+		return "", fmt.Errorf("invalid input_audio: %w", err)
+	}
+
+	mimeType, ok := toAudioMIMEType[audio.Format]
+	if !ok {
+		return "", fmt.Errorf("unsupported input_audio format: %q", audio.Format)
+	}
+
+	return "data:" + mimeType + ";base64," + audio.Data, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// azureRoutes serves the routes of the Azure OpenAI API, e.g.
+// /openai/deployments/{deployment}/chat/completions?api-version=..., with
+// the OpenAI routes. The deployment is the requested model, and the api-key
+// header is the API key. The api-version is ignored.
+func azureRoutes(maxBodySize int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("api-key"); key != "" {
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "Bearer "+key)
+			}
+			r.Header.Del("api-key")
+		}
+
+		// The prefix is already stripped when it is the base path.
+		path := strings.TrimPrefix(r.URL.Path, "/openai")
+		if path == "/models" {
+			r.URL.Path = "/v1/models"
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rest, ok := strings.CutPrefix(path, "/deployments/")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		deployment, op, ok := strings.Cut(rest, "/")
+		if !ok || deployment == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.URL.Path = "/v1/" + op
+		r.URL.RawPath = ""
+
+		if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := setRequestModel(w, r, maxBodySize, deployment); err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRequestModel sets the model of the JSON request body, since the Azure
+// requests name the model in their path.
+func setRequestModel(w http.ResponseWriter, r *http.Request, maxBodySize int64, model string) error {
+	if maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(b, &body); err != nil {
+		return err
+	}
+
+	body["model"], err = json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	return nil
+}
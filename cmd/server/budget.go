@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// budgetPeriod is the window of a budget, which resets at the start of every
+// UTC day or month.
+type budgetPeriod string
+
+const (
+	budgetDaily   budgetPeriod = "daily"
+	budgetMonthly budgetPeriod = "monthly"
+)
+
+// start returns the start of the window of the time.
+func (p budgetPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p == budgetDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// end returns the end of the window of the time, when the budget resets.
+func (p budgetPeriod) end(t time.Time) time.Time {
+	if p == budgetDaily {
+		return p.start(t).AddDate(0, 0, 1)
+	}
+
+	return p.start(t).AddDate(0, 1, 0)
+}
+
+// budget limits the estimated cost in USD or the tokens per period. Zero
+// limits are unlimited.
+type budget struct {
+	Period    budgetPeriod `json:"period" yaml:"period"`
+	MaxCost   float64      `json:"max_cost,omitempty" yaml:"max_cost"`
+	MaxTokens int          `json:"max_tokens,omitempty" yaml:"max_tokens"`
+}
+
+func (b *budget) limited() bool {
+	return b != nil && (b.MaxCost > 0 || b.MaxTokens > 0)
+}
+
+func (b *budget) validate() error {
+	switch b.Period {
+	case budgetDaily, budgetMonthly:
+	default:
+		return fmt.Errorf("unknown period %q, expected daily or monthly", b.Period)
+	}
+
+	if b.MaxCost < 0 || b.MaxTokens < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	return nil
+}
+
+// spend is the usage of a budget window.
+type spend struct {
+	Cost   float64 `json:"cost"`
+	Tokens int     `json:"tokens"`
+}
+
+// exceeds reports whether the spend reached the budget.
+func (s spend) exceeds(b *budget) bool {
+	return (b.MaxCost > 0 && s.Cost >= b.MaxCost) || (b.MaxTokens > 0 && s.Tokens >= b.MaxTokens)
+}
+
+// budgetScope is who a budget applies to: a virtual key or a tenant.
+type budgetScope string
+
+const (
+	budgetScopeKey    budgetScope = "key"
+	budgetScopeTenant budgetScope = "tenant"
+)
+
+type spendKey struct {
+	scope  budgetScope
+	id     string
+	period budgetPeriod
+	start  time.Time
+}
+
+// budgetTracker enforces the budgets of the virtual keys and tenants. The
+// spend of each window is summed from the usage records the first time it is
+// needed, then kept up to date in memory, so replicas with separate usage
+// files enforce their own share.
+type budgetTracker struct {
+	usage *usageStore
+
+	mu      sync.Mutex
+	tenants map[string]budget
+	spends  map[spendKey]*spend
+}
+
+func newBudgetTracker(usage *usageStore, tenants map[string]budget) *budgetTracker {
+	if tenants == nil {
+		tenants = make(map[string]budget)
+	}
+
+	return &budgetTracker{
+		usage:   usage,
+		tenants: tenants,
+		spends:  make(map[spendKey]*spend),
+	}
+}
+
+// SetTenantBudget sets the budget of the tenant until the restart, e.g. to
+// raise the limit of a tenant that exceeded it. An unlimited budget removes
+// it.
+func (t *budgetTracker) SetTenantBudget(tenant string, b budget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !b.limited() {
+		delete(t.tenants, tenant)
+		return
+	}
+
+	t.tenants[tenant] = b
+}
+
+// spend returns the spend of the current window of the budget. The caller
+// holds the lock.
+func (t *budgetTracker) spend(scope budgetScope, id string, period budgetPeriod, now time.Time) (*spend, error) {
+	k := spendKey{scope: scope, id: id, period: period, start: period.start(now)}
+	if s, ok := t.spends[k]; ok {
+		return s, nil
+	}
+
+	filter := usageFilter{From: k.start}
+	if scope == budgetScopeKey {
+		filter.Key = id
+	} else {
+		filter.Tenant = id
+	}
+
+	records, err := t.usage.List(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(spend)
+	for _, r := range records {
+		// The key filter also matches the upstream key fingerprints.
+		if scope == budgetScopeKey && r.VirtualKey != id {
+			continue
+		}
+
+		s.Cost += r.Cost
+		s.Tokens += r.PromptTokens + r.CompletionTokens
+	}
+
+	// Forget the previous windows.
+	for old := range t.spends {
+		if old.scope == k.scope && old.id == k.id && old.period == k.period {
+			delete(t.spends, old)
+		}
+	}
+	t.spends[k] = s
+
+	return s, nil
+}
+
+// budgetExceeded is the budget that a request exceeds.
+type budgetExceeded struct {
+	scope  budgetScope
+	id     string
+	budget budget
+	spend  spend
+	reset  time.Time
+}
+
+// Check returns the first budget of the virtual key or tenant that is
+// exceeded, if any.
+func (t *budgetTracker) Check(info *goai.RequestInfo, key *budget) (*budgetExceeded, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range t.budgets(info, key) {
+		s, err := t.spend(c.scope, c.id, c.budget.Period, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.exceeds(&c.budget) {
+			c.spend = *s
+			c.reset = c.budget.Period.end(now)
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Add adds the usage of a request to the spend of its budgets.
+func (t *budgetTracker) Add(info *goai.RequestInfo, key *budget, cost float64, u openai.Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range t.budgets(info, key) {
+		// The usage is already recorded, so a window loaded now includes it.
+		k := spendKey{scope: c.scope, id: c.id, period: c.budget.Period, start: c.budget.Period.start(now)}
+		if s, ok := t.spends[k]; ok {
+			s.Cost += cost
+			s.Tokens += u.PromptTokens + u.CompletionTokens
+		}
+	}
+}
+
+// budgets returns the budgets of the virtual key and tenant of the request.
+func (t *budgetTracker) budgets(info *goai.RequestInfo, key *budget) []budgetExceeded {
+	var res []budgetExceeded
+	if info.VirtualKey != "" && key.limited() {
+		res = append(res, budgetExceeded{scope: budgetScopeKey, id: info.VirtualKey, budget: *key})
+	}
+
+	if b, ok := t.tenants[info.Tenant]; ok && info.Tenant != "" {
+		res = append(res, budgetExceeded{scope: budgetScopeTenant, id: info.Tenant, budget: b})
+	}
+
+	return res
+}
+
+// keyBudget returns the budget of the virtual key of the request, if any.
+func keyBudget(r *http.Request) *budget {
+	vk, _, ok := virtualKeyFromRequest(r)
+	if !ok {
+		return nil
+	}
+
+	return vk.Budget
+}
+
+// checkBudget rejects the requests of the virtual keys and tenants that
+// exceeded their budget, like the OpenAI quota errors.
+func (h openaiHandler) checkBudget(w http.ResponseWriter, r *http.Request, info *goai.RequestInfo) bool {
+	if h.budgets == nil {
+		return true
+	}
+
+	exceeded, err := h.budgets.Check(info, keyBudget(r))
+	if err != nil {
+		// Let the requests through rather than failing them when the usage
+		// can't be read.
+		logger.ErrorContext(r.Context(), "check budget failed", slog.String("error", err.Error()))
+		return true
+	}
+
+	if exceeded == nil {
+		return true
+	}
+
+	logger.WarnContext(r.Context(), "budget exceeded",
+		slog.String("scope", string(exceeded.scope)),
+		slog.String("id", exceeded.id),
+		slog.String("period", string(exceeded.budget.Period)),
+		slog.Float64("cost", exceeded.spend.Cost),
+		slog.Int("tokens", exceeded.spend.Tokens),
+	)
+
+	writeAPIError(w, &openai.APIError{
+		Code:           "insufficient_quota",
+		Message:        fmt.Sprintf("You exceeded the %s budget of your %s. It resets at %s.", exceeded.budget.Period, exceeded.scope, exceeded.reset.Format(time.RFC3339)),
+		Type:           "insufficient_quota",
+		HTTPStatusCode: http.StatusTooManyRequests,
+	})
+	return false
+}
+
+// addBudgetSpend adds the usage of the request to its budgets.
+func (h openaiHandler) addBudgetSpend(r *http.Request, info *goai.RequestInfo, cost float64, u openai.Usage) {
+	if h.budgets == nil {
+		return
+	}
+
+	h.budgets.Add(info, keyBudget(r), cost, u)
+}
+
+// tenantBudget is a budget of a tenant with the spend of its current window.
+type tenantBudget struct {
+	Tenant string `json:"tenant"`
+	budget
+	Spend spend `json:"spend"`
+}
+
+// Budgets serves the tenant budgets admin API: listing the budgets with their
+// spend on /admin/budgets, and setting the budget of a tenant on
+// /admin/budgets/{tenant}, e.g. to raise the limit until the restart. The
+// budgets of the virtual keys are set with the keys.
+func (h adminHandler) Budgets(w http.ResponseWriter, r *http.Request) {
+	if h.budgets == nil {
+		http.Error(w, "budgets are disabled", http.StatusNotFound)
+		return
+	}
+
+	tenant := strings.TrimPrefix(r.URL.Path, "/admin/budgets/")
+	switch {
+	case r.URL.Path == "/admin/budgets" && r.Method == http.MethodGet:
+		h.listBudgets(w, r)
+	case r.URL.Path == "/admin/budgets":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case tenant == "" || strings.Contains(tenant, "/"):
+		catchAll(w, r)
+	case r.Method == http.MethodPut:
+		h.setTenantBudget(w, r, tenant)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h adminHandler) listBudgets(w http.ResponseWriter, r *http.Request) {
+	t := h.budgets
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data := make([]tenantBudget, 0, len(t.tenants))
+	for tenant, b := range t.tenants {
+		s, err := t.spend(budgetScopeTenant, tenant, b.Period, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data = append(data, tenantBudget{Tenant: tenant, budget: b, Spend: *s})
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Tenant < data[j].Tenant
+	})
+
+	writeJSON(w, struct {
+		Object string         `json:"object"`
+		Data   []tenantBudget `json:"data"`
+	}{"list", data})
+}
+
+// setTenantBudget sets the budget of the tenant, e.g. with
+// {"period": "monthly", "max_cost": 100}.
+func (h adminHandler) setTenantBudget(w http.ResponseWriter, r *http.Request, tenant string) {
+	var b budget
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if b.Period == "" {
+		b.Period = budgetMonthly
+	}
+
+	if err := b.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.budgets.SetTenantBudget(tenant, b)
+	logger.InfoContext(r.Context(), "tenant budget updated",
+		slog.String("tenant", tenant),
+		slog.String("period", string(b.Period)),
+		slog.Float64("max_cost", b.MaxCost),
+		slog.Int("max_tokens", b.MaxTokens),
+	)
+
+	writeJSON(w, b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBudgetTenant(t *testing.T) {
+	h := newTestHandler(t)
+	h.tenants = map[string]string{fingerprint("acme-key"): "acme"}
+	h.budgets = newBudgetTracker(h.usage, map[string]budget{
+		"acme": {Period: budgetDaily, MaxTokens: 100},
+	})
+
+	err := h.usage.Add(usageRecord{Time: time.Now(), Tenant: "acme", PromptTokens: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/chat/completions", h.ChatCompletion, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`},
+		{"/embeddings", h.Embeddings, `{"model": "text-embedding-3-small", "input": ["hi"]}`},
+		{"/images/generations", h.ImageGeneration, `{"prompt": "a cat"}`},
+		{"/moderations", h.Moderations, `{"input": "hi"}`},
+	}
+	for _, e := range endpoints {
+		t.Run(e.path, func(t *testing.T) {
+			w := serve(e.handler, "acme-key", e.path, e.body)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("got %d %s, want 429 for the tenant of the key", w.Code, w.Body)
+			}
+		})
+	}
+
+	t.Run("other key", func(t *testing.T) {
+		w := serve(h.ChatCompletion, "other-key", "/chat/completions", endpoints[0].body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+		}
+	})
+
+	t.Run("organization header", func(t *testing.T) {
+		// The header doesn't select the tenant, so it neither applies nor
+		// skips the budget.
+		r := newRequest("other-key", "/chat/completions", "")
+		r.Header.Set("OpenAI-Organization", "acme")
+		if got := h.tenant(r); got != "" {
+			t.Fatalf("tenant = %q, want none", got)
+		}
+
+		r = newRequest("acme-key", "/chat/completions", "")
+		r.Header.Set("OpenAI-Organization", "globex")
+		if got := h.tenant(r); got != "acme" {
+			t.Fatalf("tenant = %q, want acme", got)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// The faults injected by the chaos middleware.
+const (
+	chaosLatency   = "latency"
+	chaosError     = "error"
+	chaosTruncate  = "truncate"
+	chaosMalformed = "malformed"
+)
+
+var chaosFaults = []string{chaosLatency, chaosError, chaosTruncate, chaosMalformed}
+
+// chaos injects faults in a fraction of the responses, so that the retries
+// and timeouts of the clients can be validated against the proxy:
+//
+//   - latency waits up to maxLatency before handling the request,
+//   - error fails the request with a 429,
+//   - truncate drops the connection after the first chunk of a stream, or
+//     half of the body otherwise,
+//   - malformed sends an invalid chunk before the stream, or half of the
+//     body otherwise.
+type chaos struct {
+	rate       float64
+	faults     []string
+	maxLatency time.Duration
+}
+
+// newChaos returns the middleware, or nil when the rate is 0.
+func newChaos(rate float64, faults []string, maxLatency time.Duration) *chaos {
+	if rate <= 0 {
+		return nil
+	}
+
+	if len(faults) == 0 {
+		faults = chaosFaults
+	}
+
+	return &chaos{
+		rate:       rate,
+		faults:     faults,
+		maxLatency: maxLatency,
+	}
+}
+
+// wrap injects a fault picked at random in the requests, at the rate. Faults
+// are disabled when there is no middleware.
+func (c *chaos) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= c.rate {
+			next(w, r)
+			return
+		}
+
+		fault := c.faults[rand.Intn(len(c.faults))]
+		logger.WarnContext(r.Context(), "chaos fault injected", slog.String("fault", fault))
+		w.Header().Set("X-Chaos-Fault", fault)
+
+		switch fault {
+		case chaosLatency:
+			if c.maxLatency > 0 {
+				select {
+				case <-time.After(time.Duration(rand.Int63n(int64(c.maxLatency)))):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			next(w, r)
+		case chaosError:
+			w.Header().Set("Retry-After", "1")
+			writeAPIError(w, &openai.APIError{
+				Code:           "rate_limit_exceeded",
+				Message:        "Rate limit reached (injected by the chaos middleware).",
+				Type:           "requests",
+				HTTPStatusCode: http.StatusTooManyRequests,
+			})
+		default:
+			cw := &chaosWriter{ResponseWriter: w, fault: fault}
+			next(cw, r)
+			cw.finish()
+		}
+	}
+}
+
+// chaosWriter corrupts the response. The streams are corrupted as they are
+// written, and the other responses once they are complete.
+type chaosWriter struct {
+	http.ResponseWriter
+	fault string
+
+	status int
+	chunks int
+	body   bytes.Buffer
+}
+
+func (w *chaosWriter) stream() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (w *chaosWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	// The length of the other responses changes.
+	if w.stream() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *chaosWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.stream() {
+		return w.body.Write(b)
+	}
+
+	w.chunks++
+	switch {
+	case w.fault == chaosMalformed && w.chunks == 1:
+		w.ResponseWriter.Write([]byte("data: {\"id\": \"chatcmpl-\n\n"))
+	case w.fault == chaosTruncate && w.chunks > 1:
+		// Drop the connection, like a proxy timing out.
+		panic(http.ErrAbortHandler)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *chaosWriter) Flush() {
+	if w.stream() {
+		w.ResponseWriter.(http.Flusher).Flush()
+	}
+}
+
+func (w *chaosWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes half of the body of the responses that are not streamed, and
+// drops the connection after it when truncating.
+func (w *chaosWriter) finish() {
+	if w.status == 0 || w.stream() {
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes()[:w.body.Len()/2])
+	if w.fault == chaosTruncate {
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
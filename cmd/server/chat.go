@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+const chatHelp = `Commands:
+  /model NAME   use the model for the next messages
+  /image PATH   attach an image file or URL to the next message
+  /reset        clear the conversation
+  /quit         exit`
+
+// chatCmd is a REPL chatting with a running proxy, or with the adapter
+// directly, to smoke test the conversions without an OpenAI SDK:
+//
+//	go run ./cmd/server chat -target http://localhost:8080 -model gpt-4o
+//
+// The replies are streamed. The direct mode configures the adapter from the
+// environment variables of the server.
+func chatCmd(args []string) error {
+	fs := flag.NewFlagSet("chat", flag.ExitOnError)
+	var (
+		target = fs.String("target", "http://localhost:8080", "base URL of the proxy")
+		apiKey = fs.String("key", os.Getenv("GEMINI_API_KEY"), "API key of the requests")
+		model  = fs.String("model", "gemini-1.5-flash", "model of the requests, changed with /model")
+		system = fs.String("system", "", "system message of the conversation")
+		direct = fs.Bool("direct", false, "call the adapter directly instead of the proxy")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var stream func(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error)
+	if *direct {
+		cfg, err := loadConfig(nil)
+		if err != nil {
+			return err
+		}
+
+		a, err := newAdapter(cfg)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		stream = func(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+			return a.ChatCompletionStream(goai.AuthContext(ctx, *apiKey), req)
+		}
+	} else {
+		config := openai.DefaultConfig(*apiKey)
+		config.BaseURL = strings.TrimSuffix(*target, "/")
+		stream = proxyStream(openai.NewClientWithConfig(config))
+	}
+
+	c := &chatSession{model: *model, system: *system}
+
+	fmt.Println(chatHelp)
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 1<<20)
+	for {
+		fmt.Printf("%s> ", c.model)
+		if !in.Scan() {
+			fmt.Println()
+			return in.Err()
+		}
+
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "/") {
+			quit, err := c.command(line)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if quit {
+				return nil
+			}
+
+			continue
+		}
+
+		if err := c.send(stream, line); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// chatSession is the conversation of the REPL.
+type chatSession struct {
+	model    string
+	system   string
+	messages []openai.ChatCompletionMessage
+
+	// images are attached to the next message.
+	images []string
+}
+
+// command runs the REPL command, and reports whether to quit.
+func (c *chatSession) command(line string) (bool, error) {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/quit", "/exit":
+		return true, nil
+	case "/reset":
+		c.messages = nil
+		c.images = nil
+	case "/model":
+		if arg == "" {
+			return false, errors.New("usage: /model NAME")
+		}
+		c.model = arg
+	case "/image":
+		if arg == "" {
+			return false, errors.New("usage: /image PATH")
+		}
+
+		url, err := imageURL(arg)
+		if err != nil {
+			return false, err
+		}
+		c.images = append(c.images, url)
+		fmt.Printf("%d image(s) attached to the next message\n", len(c.images))
+	default:
+		return false, fmt.Errorf("unknown command %s\n%s", name, chatHelp)
+	}
+
+	return false, nil
+}
+
+// send streams the reply to the message. The stream is canceled with ctrl+c,
+// keeping the partial reply.
+func (c *chatSession) send(stream func(context.Context, openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error), text string) error {
+	msg := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: text,
+	}
+	if len(c.images) > 0 {
+		msg.Content = ""
+		msg.MultiContent = []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: text}}
+		for _, url := range c.images {
+			msg.MultiContent = append(msg.MultiContent, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: url},
+			})
+		}
+	}
+
+	var messages []openai.ChatCompletionMessage
+	if c.system != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: c.system,
+		})
+	}
+	messages = append(messages, c.messages...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ch, err := stream(ctx, openai.ChatCompletionRequest{
+		Model:    c.model,
+		Messages: append(messages, msg),
+		Stream:   true,
+	})
+	if err != nil {
+		return err
+	}
+
+	var reply strings.Builder
+	for res := range ch {
+		for _, choice := range res.Choices {
+			fmt.Print(choice.Delta.Content)
+			reply.WriteString(choice.Delta.Content)
+		}
+	}
+	fmt.Println()
+
+	c.messages = append(c.messages, msg, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: reply.String(),
+	})
+	c.images = nil
+
+	return nil
+}
+
+// proxyStream streams the completions of the proxy through the OpenAI SDK.
+func proxyStream(client *openai.Client) func(context.Context, openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	return func(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+		s, err := client.CreateChatCompletionStream(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		ch := make(chan openai.ChatCompletionStreamResponse)
+		go func() {
+			defer close(ch)
+			defer s.Close()
+
+			for {
+				res, err := s.Recv()
+				if err != nil {
+					if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+						fmt.Fprintf(os.Stderr, "\nstream failed: %v", err)
+					}
+					return
+				}
+
+				select {
+				case ch <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		return ch, nil
+	}
+}
+
+// imageURL returns the URL as is, or the file as a data URL.
+func imageURL(path string) (string, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "data:") {
+		return path, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(b), base64.StdEncoding.EncodeToString(b)), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// checkpointTTL is how long the partial responses can be retrieved.
+const checkpointTTL = time.Hour
+
+// partialResponse is the content streamed so far for a chat completion.
+type partialResponse struct {
+	*openai.ChatCompletionResponse
+
+	// Done is false until the stream is complete.
+	Done bool `json:"done"`
+}
+
+// partialRecord is the stored partial response, with the fingerprint of the
+// API key that created the completion.
+type partialRecord struct {
+	partialResponse
+	Key string `json:"key"`
+}
+
+func checkpointKey(id string) string {
+	return "partial:" + id
+}
+
+// checkpointer periodically stores the accumulated content of a stream, so
+// that the partial result survives a crash or a disconnect.
+type checkpointer struct {
+	cache    goai.Cache
+	interval time.Duration
+	key      string
+	last     time.Time
+
+	res      openai.ChatCompletionResponse
+	contents map[int]*strings.Builder
+}
+
+func newCheckpointer(c goai.Cache, interval time.Duration, key string) *checkpointer {
+	return &checkpointer{
+		cache:    c,
+		interval: interval,
+		key:      key,
+		last:     time.Now(),
+		contents: make(map[int]*strings.Builder),
+	}
+}
+
+// Add accumulates the chunk, and stores the checkpoint when the interval has
+// passed.
+func (c *checkpointer) Add(ctx context.Context, chunk openai.ChatCompletionStreamResponse) {
+	if c.res.ID == "" {
+		c.res.ID = chunk.ID
+		c.res.Object = "chat.completion"
+		c.res.Created = chunk.Created
+		c.res.Model = chunk.Model
+		c.res.SystemFingerprint = chunk.SystemFingerprint
+	}
+
+	for _, choice := range chunk.Choices {
+		b, ok := c.contents[choice.Index]
+		if !ok {
+			b = new(strings.Builder)
+			c.contents[choice.Index] = b
+			c.res.Choices = append(c.res.Choices, openai.ChatCompletionChoice{
+				Index: choice.Index,
+				Message: openai.ChatCompletionMessage{
+					Role: openai.ChatMessageRoleAssistant,
+				},
+			})
+		}
+
+		b.WriteString(choice.Delta.Content)
+		if choice.FinishReason != "" && choice.FinishReason != openai.FinishReasonNull {
+			c.choice(choice.Index).FinishReason = choice.FinishReason
+		}
+	}
+
+	if time.Since(c.last) >= c.interval {
+		c.save(ctx, false)
+	}
+}
+
+// Done stores the complete response. It is stored even if the client is gone.
+func (c *checkpointer) Done(ctx context.Context) {
+	c.save(context.WithoutCancel(ctx), true)
+}
+
+func (c *checkpointer) choice(index int) *openai.ChatCompletionChoice {
+	for i := range c.res.Choices {
+		if c.res.Choices[i].Index == index {
+			return &c.res.Choices[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *checkpointer) save(ctx context.Context, done bool) {
+	c.last = time.Now()
+	if c.res.ID == "" {
+		return
+	}
+
+	for i, choice := range c.res.Choices {
+		c.res.Choices[i].Message.Content = c.contents[choice.Index].String()
+	}
+
+	b, err := json.Marshal(partialRecord{
+		partialResponse: partialResponse{
+			ChatCompletionResponse: &c.res,
+			Done:                   done,
+		},
+		Key: c.key,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "encode checkpoint failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if err := c.cache.Set(ctx, checkpointKey(c.res.ID), b, checkpointTTL); err != nil {
+		logger.ErrorContext(ctx, "save checkpoint failed", slog.String("error", err.Error()))
+	}
+}
+
+// Partial returns the content streamed so far for the completion, for the
+// path /v1/chat/completions/{id}/partial, with or without the /v1.
+func (h openaiHandler) Partial(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/chat/completions/"), "/partial")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		catchAll(w, r)
+		return
+	}
+
+	b, ok, err := h.checkpoints.Get(r.Context(), checkpointKey(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var rec partialRecord
+	if ok {
+		if err := json.Unmarshal(b, &rec); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only the owner of the completion can retrieve it.
+	apiKey := h.clientKey(r)
+	if !ok || rec.Key != fingerprint(apiKey) {
+		http.Error(w, "completion not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rec.partialResponse); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// clientInfo identifies the library and platform of the caller, to find which
+// client versions hit compatibility problems.
+type clientInfo struct {
+	Name    string
+	Version string
+	OS      string
+	Arch    string
+	Runtime string
+}
+
+// parseClientInfo reads the X-Stainless-* headers sent by the official OpenAI
+// SDKs, falling back to the first product of the User-Agent.
+func parseClientInfo(h http.Header) clientInfo {
+	if lang := h.Get("X-Stainless-Lang"); lang != "" {
+		return clientInfo{
+			Name:    "openai-" + lang,
+			Version: h.Get("X-Stainless-Package-Version"),
+			OS:      h.Get("X-Stainless-OS"),
+			Arch:    h.Get("X-Stainless-Arch"),
+			Runtime: strings.TrimSpace(h.Get("X-Stainless-Runtime") + " " + h.Get("X-Stainless-Runtime-Version")),
+		}
+	}
+
+	product, _, _ := strings.Cut(h.Get("User-Agent"), " ")
+	name, version, _ := strings.Cut(product, "/")
+
+	return clientInfo{
+		Name:    name,
+		Version: version,
+	}
+}
+
+// String formats the client as "name/version (os; arch; runtime)".
+func (c clientInfo) String() string {
+	if c.Name == "" {
+		return ""
+	}
+
+	s := c.Name
+	if c.Version != "" {
+		s += "/" + c.Version
+	}
+
+	var platform []string
+	for _, p := range []string{c.OS, c.Arch, c.Runtime} {
+		if p != "" {
+			platform = append(platform, p)
+		}
+	}
+
+	if len(platform) > 0 {
+		s += fmt.Sprintf(" (%s)", strings.Join(platform, "; "))
+	}
+
+	return s
+}
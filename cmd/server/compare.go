@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// compareCmd implements the compare subcommand, which converts a corpus of
+// recorded requests with two configs and reports the field-level
+// differences of the Gemini requests, and optionally of the responses.
+func compareCmd(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	var (
+		corpus = fs.String("corpus", "", "JSON lines file of chat completion requests")
+		flagsA = fs.String("a", "", "server flags of the first config, e.g. \"-model-mapping gpt-4=gemini-1.5-pro\"")
+		flagsB = fs.String("b", "", "server flags of the second config")
+		live   = fs.Bool("live", false, "also send the requests to Gemini with GEMINI_API_KEY and compare the responses")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *corpus == "" {
+		return fmt.Errorf("-corpus is required")
+	}
+
+	a, err := compareAdapter(*flagsA)
+	if err != nil {
+		return fmt.Errorf("config a: %w", err)
+	}
+
+	b, err := compareAdapter(*flagsB)
+	if err != nil {
+		return fmt.Errorf("config b: %w", err)
+	}
+
+	reqs, err := readCorpus(*corpus)
+	if err != nil {
+		return err
+	}
+
+	// The requests are converted without calling Gemini, but the client
+	// requires a key.
+	apiKey := "compare"
+	if *live {
+		apiKey = os.Getenv("GEMINI_API_KEY")
+		if apiKey == "" {
+			return fmt.Errorf("GEMINI_API_KEY is required for -live")
+		}
+	}
+	ctx := goai.AuthContext(context.Background(), apiKey)
+
+	var differ int
+	var batchErr goai.BatchError
+	for i, req := range reqs {
+		diffs, err := compareRequest(ctx, a, b, req, *live)
+		if err != nil {
+			batchErr.Add(i, err)
+			fmt.Printf("request %d: error: %v\n", i, err)
+			continue
+		}
+
+		if len(diffs) > 0 {
+			differ++
+		}
+
+		for _, d := range diffs {
+			fmt.Printf("request %d: %s\n", i, d)
+		}
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return fmt.Errorf("%d of %d requests differ, %d failed", differ, len(reqs), len(batchErr.Errors))
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("%d of %d requests differ", differ, len(reqs))
+	}
+
+	fmt.Printf("%d requests are identical\n", len(reqs))
+	return nil
+}
+
+func compareAdapter(flags string) (*goai.Adapter, error) {
+	cfg, err := loadConfig(strings.Fields(flags))
+	if err != nil {
+		return nil, err
+	}
+
+	return newAdapter(cfg)
+}
+
+func readCorpus(path string) ([]openai.ChatCompletionRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var reqs []openai.ChatCompletionRequest
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var req openai.ChatCompletionRequest
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: request %d: %w", path, len(reqs), err)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+func compareRequest(ctx context.Context, a, b *goai.Adapter, req openai.ChatCompletionRequest, live bool) ([]string, error) {
+	ra, err := a.ConvertRequest(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("config a: %w", err)
+	}
+
+	rb, err := b.ConvertRequest(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("config b: %w", err)
+	}
+
+	diffs, err := diffJSON("request", ra, rb)
+	if err != nil || !live {
+		return diffs, err
+	}
+
+	resA, err := a.ChatCompletion(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("config a: %w", err)
+	}
+
+	resB, err := b.ChatCompletion(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("config b: %w", err)
+	}
+
+	// The generated fields always differ.
+	for _, res := range []*openai.ChatCompletionResponse{resA, resB} {
+		res.ID = ""
+		res.Created = 0
+		res.SystemFingerprint = ""
+	}
+
+	resDiffs, err := diffJSON("response", resA, resB)
+	return append(diffs, resDiffs...), err
+}
+
+// diffJSON returns the differences between the JSON fields of a and b, one
+// per field path.
+func diffJSON(prefix string, a, b any) ([]string, error) {
+	fa, err := flattenJSON(prefix, a)
+	if err != nil {
+		return nil, err
+	}
+
+	fb, err := flattenJSON(prefix, b)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]bool)
+	for k := range fa {
+		paths[k] = true
+	}
+	for k := range fb {
+		paths[k] = true
+	}
+
+	var diffs []string
+	for p := range paths {
+		va, oka := fa[p]
+		vb, okb := fb[p]
+		switch {
+		case !oka:
+			diffs = append(diffs, fmt.Sprintf("%s: only in b: %s", p, vb))
+		case !okb:
+			diffs = append(diffs, fmt.Sprintf("%s: only in a: %s", p, va))
+		case va != vb:
+			diffs = append(diffs, fmt.Sprintf("%s: %s != %s", p, va, vb))
+		}
+	}
+	sort.Strings(diffs)
+
+	return diffs, nil
+}
+
+func flattenJSON(prefix string, v any) (map[string]string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var data any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	flatten(m, prefix, data)
+
+	return m, nil
+}
+
+func flatten(m map[string]string, path string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			flatten(m, path+"."+k, val)
+		}
+	case []any:
+		for i, val := range v {
+			flatten(m, fmt.Sprintf("%s[%d]", path, i), val)
+		}
+	case nil:
+		// Null is the same as a missing field.
+	default:
+		b, _ := json.Marshal(v)
+		m[path] = string(b)
+	}
+}
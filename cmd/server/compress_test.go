@@ -0,0 +1,60 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("a", 2*compressMinSize)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", body, "gzip"},
+		{"small json", "application/json", "{}", ""},
+		{"stream", "text/event-stream", body, ""},
+		{"image", "image/png", body, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+			r.Header.Set("Accept-Encoding", "gzip, deflate")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.want)
+			}
+
+			var rd io.Reader = w.Body
+			if tt.want == "gzip" {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rd = zr
+			}
+
+			b, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.body {
+				t.Fatalf("got %d bytes, want the %d bytes of the body", len(b), len(tt.body))
+			}
+		})
+	}
+}
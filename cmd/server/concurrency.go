@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// concurrencyLimiter caps the in-flight upstream requests, so that load
+// spikes don't open unbounded Gemini streams. The requests over the cap wait
+// up to wait for a slot in a queue, and are shed otherwise.
+type concurrencyLimiter struct {
+	max  int
+	wait time.Duration
+
+	mu       sync.Mutex
+	inflight int
+	queue    []waiter
+}
+
+// waiter is a request waiting for a slot.
+type waiter struct {
+	priority priority
+	ready    chan struct{}
+}
+
+// newConcurrencyLimiter returns the limiter, or nil when max is 0.
+func newConcurrencyLimiter(max int, wait time.Duration) *concurrencyLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &concurrencyLimiter{
+		max:  max,
+		wait: wait,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is none. The queue is
+// ordered by priority, then by arrival. It returns false when no slot is
+// released in time.
+func (l *concurrencyLimiter) acquire(ctx context.Context, p priority) bool {
+	l.mu.Lock()
+	if l.inflight < l.max && len(l.queue) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+
+	if l.wait <= 0 {
+		l.mu.Unlock()
+		return false
+	}
+
+	ready := make(chan struct{})
+	i := sort.Search(len(l.queue), func(i int) bool {
+		return l.queue[i].priority < p
+	})
+	l.queue = slices.Insert(l.queue, i, waiter{priority: p, ready: ready})
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot may have been handed over in the meantime.
+	select {
+	case <-ready:
+		return true
+	default:
+	}
+
+	for i, q := range l.queue {
+		if q.ready == ready {
+			l.queue = slices.Delete(l.queue, i, i+1)
+			break
+		}
+	}
+
+	return false
+}
+
+// release hands the slot over to the first request in the queue, if any.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.queue) > 0 {
+		close(l.queue[0].ready)
+		l.queue = l.queue[1:]
+		return
+	}
+
+	l.inflight--
+}
+
+// limitConcurrency sheds the requests with a 503 when the concurrency cap is
+// reached. The cap is disabled when there is no limiter.
+func (h openaiHandler) limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	if h.concurrency == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := h.requestPriority(r)
+		if !h.concurrency.acquire(r.Context(), p) {
+			logger.WarnContext(r.Context(), "request shed",
+				slog.String("path", r.URL.Path),
+				slog.Int("priority", int(p)),
+				slog.Int("max_concurrency", h.concurrency.max),
+			)
+
+			retryAfter := int(math.Max(1, math.Ceil(h.concurrency.wait.Seconds())))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeAPIError(w, &openai.APIError{
+				Code:           "server_overloaded",
+				Message:        "The server is currently overloaded with other requests. Please try again later.",
+				Type:           "server_error",
+				HTTPStatusCode: http.StatusServiceUnavailable,
+			})
+			return
+		}
+		defer h.concurrency.release()
+
+		next(w, r)
+	}
+}
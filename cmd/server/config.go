@@ -0,0 +1,1058 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/alextanhongpin/go-gemini/goaitest"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	// ConfigFile is the YAML file of the flags, which is watched for
+	// changes.
+	ConfigFile string
+
+	// Addr is the address to listen on.
+	Addr string
+
+	// BasePath is the path prefix of the routes, e.g. /openai behind a
+	// reverse proxy that forwards the path as is.
+	BasePath string
+
+	// TLSCert and TLSKey are the PEM files of the certificate to serve
+	// HTTPS with. AutocertDomains are the domains whose certificates are
+	// obtained from Let's Encrypt instead, and cached in AutocertDir.
+	TLSCert         string
+	TLSKey          string
+	AutocertDomains []string
+	AutocertDir     string
+
+	// H2C serves HTTP/2 without TLS along with HTTP/1.1, so that the clients
+	// multiplex the streams over one connection.
+	H2C bool
+
+	// CORSOrigins are the origins of the browser clients allowed to call the
+	// proxy, with the CORSMethods and CORSHeaders, any requested header when
+	// empty. CORS is disabled without origins.
+	CORSOrigins []string
+	CORSMethods []string
+	CORSHeaders []string
+
+	// Compress compresses the JSON and text responses that are not streamed
+	// with gzip or deflate, as accepted by the clients.
+	Compress bool
+
+	// ModelMapping maps the requested OpenAI model names to Gemini models.
+	ModelMapping map[string]string
+
+	// ModelPassthrough uses requested model names starting with "gemini-"
+	// as is.
+	ModelPassthrough bool
+
+	// DefaultModel is the model of the requests that are not mapped, and
+	// DefaultVisionModel of those with images.
+	DefaultModel       string
+	DefaultVisionModel string
+
+	// Routes select the model based on the request properties.
+	Routes []goai.Route
+
+	// SystemPrompt is the user message prepended to the conversations that
+	// don't start with one.
+	SystemPrompt string
+
+	// SafetySettings are the safety thresholds of the chat completions.
+	SafetySettings []goai.SafetySetting
+
+	// Degraded maps the model names to the responses returned when Gemini
+	// is unavailable.
+	Degraded map[string]degradedResponse
+
+	// MediaDir stores the generated media served through signed URLs. Media
+	// is returned inline when empty.
+	MediaDir    string
+	MediaSecret string
+	MediaTTL    time.Duration
+
+	// TemperatureMode and MaxTemperature control how the OpenAI
+	// temperature is converted for Gemini.
+	TemperatureMode goai.TemperatureMode
+	MaxTemperature  float64
+
+	// ParamMode rejects the unsupported OpenAI parameters when strict, or
+	// ignores them with a warning when lenient. The virtual keys can set
+	// their own mode.
+	ParamMode goai.ParamMode
+
+	// PublicURL is the base URL of the proxy used in the signed URLs.
+	PublicURL string
+
+	// CacheURL is the Redis URL of the cache shared by the replicas. The
+	// cache is kept in memory when empty.
+	CacheURL string
+
+	// ResponseCacheTTL is how long the responses of the identical chat
+	// requests are cached. The responses are not cached when 0.
+	ResponseCacheTTL time.Duration
+
+	// LabelHeaders are the request headers recorded as labels in the logs
+	// and usage records, in addition to the OpenAI metadata.
+	LabelHeaders []string
+
+	// StreamTokensPerSecond splits the streamed chunks into words, paced at
+	// the given rate. The chunks are sent as is when 0.
+	StreamTokensPerSecond float64
+
+	// CheckpointInterval is how often the partial streamed responses are
+	// stored. Checkpointing is disabled when 0.
+	CheckpointInterval time.Duration
+
+	// ConversationMode handles the chat requests of a conversation, set by
+	// the X-Conversation-ID header, while another one is generating.
+	ConversationMode conversationMode
+
+	// WarmupKeys are the API keys to create the clients for at startup, and
+	// to warm up the mapped and routed models with.
+	WarmupKeys []string
+
+	// ReadyTTL is how long the result of the readiness check is cached.
+	ReadyTTL time.Duration
+
+	// RequestTimeout is the time limit of the chat completions that are not
+	// streamed, which the clients can shorten. There is no limit when 0.
+	RequestTimeout time.Duration
+
+	// ReadHeaderTimeout, WriteTimeout and IdleTimeout are the timeouts of
+	// the server connections, see http.Server. The write timeout doesn't
+	// apply to the streams.
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Residency pins the tenants to regions.
+	Residency map[string]residency
+
+	// FileUploadThreshold is the size in bytes above which attachments are
+	// uploaded through the Gemini File API.
+	FileUploadThreshold int
+
+	// UpstreamKeys are the secrets with the Gemini API keys for the requests
+	// without an API key, refreshed every SecretRefresh. The requests are
+	// distributed across the keys with KeyBalancing.
+	UpstreamKeys  []string
+	KeyBalancing  keyBalancing
+	SecretRefresh time.Duration
+
+	// VirtualKeysPath is the SQLite database of the keys issued by the
+	// proxy, or a JSON file when it ends with .json. Virtual keys are
+	// disabled when empty.
+	VirtualKeysPath string
+
+	// KeyCooldown is how long the upstream keys are not used after an auth
+	// or quota error.
+	KeyCooldown time.Duration
+
+	// GeminiProxy is the proxy URL of the Gemini API calls, which defaults
+	// to HTTPS_PROXY. GeminiCAFile has the PEM certificates to trust along
+	// with the system ones, e.g. of a corporate proxy.
+	GeminiProxy  string
+	GeminiCAFile string
+
+	// GeminiEndpoint is the base URL of the Gemini API, e.g. a regional or
+	// private service connect endpoint, or a local emulator.
+	GeminiEndpoint string
+
+	// VertexAI is the Vertex AI project that serves the requests instead of
+	// the Gemini API, unless their virtual key sets another backend.
+	VertexAI *goai.VertexAI
+
+	// AnthropicKey is the secret with the Anthropic API key, which serves the
+	// "anthropic/" models and the models matching AnthropicModels, e.g.
+	// claude-*, with Claude. AnthropicEndpoint replaces the Anthropic API.
+	AnthropicKey      string
+	AnthropicModels   []string
+	AnthropicEndpoint string
+
+	// LocalEndpoint is the base URL of a local server with the OpenAI API,
+	// e.g. Ollama, which serves the "local/" models and the models matching
+	// LocalModels.
+	LocalEndpoint string
+	LocalModels   []string
+
+	// OpenAIKey is the secret with the OpenAI API key, which forwards the
+	// chat requests that use the OpenAIPassthrough features, e.g. audio, to
+	// OpenAIEndpoint instead of Gemini.
+	OpenAIKey         string
+	OpenAIEndpoint    string
+	OpenAIPassthrough []string
+
+	// ClientCache limits the Gemini clients, one per API key, that are kept
+	// to reuse their connections.
+	ClientCache goai.ClientCache
+
+	// GeminiDialTimeout and GeminiHeaderTimeout limit the time to connect
+	// to Gemini and to receive the response headers. The header timeout is
+	// disabled when 0.
+	GeminiDialTimeout   time.Duration
+	GeminiHeaderTimeout time.Duration
+
+	// VideoModel is the model for the requests with videos when the selected
+	// model doesn't support video.
+	VideoModel string
+
+	// CodeExecution enables the Gemini code execution for all requests,
+	// instead of per request.
+	CodeExecution bool
+
+	// ContextCaching caches the long system messages shared by the requests
+	// of the same API key as Gemini cached contents.
+	ContextCaching goai.ContextCaching
+
+	// RPM and TPM limit the requests and the tokens per minute of each API
+	// key. Zero is unlimited.
+	RPM int
+	TPM int
+
+	// MaxConcurrency caps the in-flight upstream requests. The requests over
+	// the cap wait up to QueueTimeout, and are rejected otherwise.
+	MaxConcurrency int
+	QueueTimeout   time.Duration
+
+	// Priorities maps the API key fingerprints to the priority of their
+	// requests in the queue: high, normal or low.
+	Priorities map[string]string
+
+	// Retry retries the transient Gemini failures.
+	Retry goai.Retry
+
+	// Pricing is the price per million tokens of the models, to estimate the
+	// cost of the requests.
+	Pricing pricing
+
+	// Budgets maps the tenants to their daily or monthly spend or token
+	// budget.
+	Budgets map[string]budget
+
+	// Tenants maps the API key fingerprints to the tenant of their requests
+	// without a virtual key.
+	Tenants map[string]string
+
+	// TraceLog logs the trace spans, for the deployments without a tracing
+	// backend.
+	TraceLog bool
+
+	// Fallbacks maps the Gemini models to the models to try in order when
+	// they fail with a quota error, a safety block or a timeout.
+	Fallbacks map[string][]string
+
+	// Admission limits the complexity of the chat requests, and MaxBodySize
+	// the size of their bodies in bytes. Zero limits are unlimited.
+	Admission   goai.Admission
+	MaxBodySize int64
+
+	// LogLevel is the minimum level of the logs, and LogFormat their
+	// format, json or text. The debug level logs the steps of the message
+	// conversion.
+	LogLevel  slog.Level
+	LogFormat logFormat
+
+	// DumpStore records the requests and responses for troubleshooting, e.g.
+	// file:./data, sqlite:dumps.db, gcs:bucket/prefix or s3:bucket/prefix. They are not recorded when empty.
+	// The dumps are kept up to DumpMaxFiles and DumpMaxAge, unlimited when
+	// 0.
+	DumpStore    string
+	DumpMaxFiles int
+	DumpMaxAge   time.Duration
+
+	// DumpRedaction redacts the personal data and secrets of the dumped
+	// bodies.
+	DumpRedaction redaction
+
+	// Debug serves the pprof profiles and the runtime stats to the admin.
+	Debug bool
+
+	// DebugResponses lets all the API keys request the raw Gemini responses
+	// with X-Debug. Otherwise only the virtual keys with debug can.
+	DebugResponses bool
+
+	// PayloadLogging logs the request contents, which are redacted from the
+	// logs by default.
+	PayloadLogging goai.PayloadLogging
+
+	// FixturesDir records the Gemini API interactions as fixtures, and
+	// replays them according to FixturesMode, for the integration tests.
+	// Gemini is called directly when empty.
+	FixturesDir  string
+	FixturesMode goaitest.RecorderMode
+
+	// Mock serves the MockResponses per model instead of calling Gemini,
+	// after MockLatency and streamed at MockTPS words per second.
+	Mock          bool
+	MockResponses map[string]mockResponse
+	MockLatency   time.Duration
+	MockTPS       float64
+
+	// ChaosRate is the fraction of the chat, moderation and image requests
+	// in which one of the ChaosFaults is injected, up to ChaosLatency for
+	// the latency. Faults are not injected when 0.
+	ChaosRate    float64
+	ChaosFaults  []string
+	ChaosLatency time.Duration
+
+	// ValidateOnly exits after validating the config.
+	ValidateOnly bool
+}
+
+// loadConfig reads the config from the flags and the -config file. Each flag
+// defaults to its environment variable.
+func loadConfig(args []string) (*config, error) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	var (
+		configFile  = fs.String("config", os.Getenv("CONFIG_FILE"), "YAML file setting the flags by name, which the command line flags and the environment variables take precedence over")
+		port        = fs.Int("port", 8080, "port to listen on")
+		addr        = fs.String("addr", "", "address to listen on, e.g. localhost:8080 to only accept local connections, defaults to all the interfaces on -port")
+		basePath    = fs.String("base-path", "", "path prefix of the routes, e.g. /openai when a reverse proxy forwards /openai/v1/chat/completions as is")
+		tlsCert     = fs.String("tls-cert", "", "PEM certificate file to serve HTTPS with, along with -tls-key")
+		tlsKey      = fs.String("tls-key", "", "PEM private key file of -tls-cert")
+		acmeDomains = fs.String("autocert-domains", "", "comma-separated domains to serve HTTPS for with certificates from Let's Encrypt, which must reach the proxy on port 443")
+		acmeDir     = fs.String("autocert-dir", "autocert", "directory caching the Let's Encrypt certificates")
+		h2c         = fs.Bool("h2c", false, "serve HTTP/2 without TLS (h2c) along with HTTP/1.1")
+		corsOrigins = fs.String("cors-origins", "", "comma-separated origins of the browser clients allowed to call the proxy, * for any, CORS is disabled when empty")
+		corsMethods = fs.String("cors-methods", "GET, POST, DELETE", "comma-separated methods allowed to the browser clients")
+		corsHeaders = fs.String("cors-headers", "", "comma-separated request headers allowed to the browser clients, any requested header when empty")
+		compression = fs.Bool("compress", false, "compress the responses that are not streamed with gzip or deflate, as accepted by the clients")
+		defModel    = fs.String("default-model", os.Getenv("DEFAULT_MODEL"), "gemini model of the requests that are not mapped, defaults to gemini-pro")
+		defVision   = fs.String("default-vision-model", os.Getenv("DEFAULT_VISION_MODEL"), "gemini model of the requests with images that are not mapped, defaults to gemini-pro-vision")
+		sysPrompt   = fs.String("system-prompt", os.Getenv("SYSTEM_PROMPT"), "user message prepended to the conversations that don't start with one")
+		safety      = fs.String("safety-settings", os.Getenv("SAFETY_SETTINGS"), "comma-separated category=threshold safety settings, e.g. harassment=block_only_high")
+		mapping     = fs.String("model-mapping", os.Getenv("MODEL_MAPPING"), "comma-separated openai=gemini model names, e.g. gpt-4o=gemini-1.5-pro")
+		mappingFile = fs.String("model-mapping-file", os.Getenv("MODEL_MAPPING_FILE"), "YAML file mapping openai model names to gemini model names")
+		passthrough = fs.Bool("model-passthrough", os.Getenv("MODEL_PASSTHROUGH") == "true", "use requested model names starting with gemini- as is")
+		routesFile  = fs.String("routes-file", os.Getenv("ROUTES_FILE"), "YAML file with the model routing rules")
+		degraded    = fs.String("degraded-file", os.Getenv("DEGRADED_FILE"), "YAML file with the responses per model when Gemini is unavailable")
+		mediaDir    = fs.String("media-dir", os.Getenv("MEDIA_DIR"), "directory to store generated media served through signed URLs")
+		mediaSecret = fs.String("media-secret", os.Getenv("MEDIA_SECRET"), "secret to sign the media URLs")
+		mediaTTL    = fs.Duration("media-ttl", 15*time.Minute, "how long the signed media URLs are valid")
+		tempMode    = fs.String("temperature-mode", os.Getenv("TEMPERATURE_MODE"), "convert the temperature with clamp or scale, or send it as is when empty")
+		paramMode   = fs.String("param-mode", "lenient", "how the unsupported openai parameters are handled: lenient ignores them with a warning, strict rejects the requests")
+		maxTemp     = fs.Float64("temperature-max", 1, "maximum temperature of the Gemini models, used by the temperature mode")
+		publicURL   = fs.String("public-url", envOr("PUBLIC_URL", "http://localhost:8080"), "base URL of the proxy")
+		cacheURL    = fs.String("cache-url", os.Getenv("CACHE_URL"), "redis:// URL of the shared cache, defaults to in memory")
+		respTTL     = fs.Duration("response-cache-ttl", 0, "how long to serve identical chat requests from the cache, 0 to disable")
+		readyTTL    = fs.Duration("ready-ttl", 30*time.Second, "how long the result of the /ready check of gemini is cached")
+		reqTimeout  = fs.Duration("request-timeout", 5*time.Minute, "time limit of the chat completions that are not streamed, which the X-Request-Timeout header can shorten, 0 for no limit")
+		hdrTimeout  = fs.Duration("read-header-timeout", 10*time.Second, "time limit to read the request headers, 0 for no limit")
+		wrTimeout   = fs.Duration("write-timeout", 10*time.Minute, "time limit to read the request and write the response, except for the streams, 0 for no limit")
+		idleTimeout = fs.Duration("idle-timeout", 2*time.Minute, "how long the idle keep-alive connections are kept open")
+		labelHdrs   = fs.String("label-headers", os.Getenv("LABEL_HEADERS"), "comma-separated request headers to record as labels, e.g. X-Team,X-Feature")
+		streamTPS   = fs.Float64("stream-tps", 0, "split streamed chunks into words sent at this many per second, 0 to disable")
+		checkpoint  = fs.Duration("checkpoint-interval", 0, "how often to store the partial streamed responses, e.g. 10s, disabled when 0")
+		convMode    = fs.String("conversation-mode", string(conversationModeOff), "how to handle a chat request of an X-Conversation-ID that is already generating: off, queue, cancel the previous one, or reject with a 409")
+		warmupKeys  = fs.String("warmup-keys", os.Getenv("WARMUP_KEYS"), "comma-separated API keys to warm up the mapped models with at startup")
+		residencyF  = fs.String("residency-file", os.Getenv("RESIDENCY_FILE"), "YAML file pinning tenants to regions")
+		uploadSize  = fs.Int("file-upload-threshold", 0, "size in bytes above which attachments are uploaded through the Gemini File API, 0 for the default of 8MB, -1 to disable")
+		upstreamKey = fs.String("upstream-key", os.Getenv("UPSTREAM_KEY"), "secret with the Gemini API key for requests without one, e.g. env:GEMINI_API_KEY, file:/run/secrets/gemini or gcp:projects/p/secrets/gemini")
+		upstreamKs  = fs.String("upstream-keys", os.Getenv("UPSTREAM_KEYS"), "comma-separated secrets with more Gemini API keys for requests without one, pooled with -upstream-key")
+		balancing   = fs.String("key-balancing", envOr("KEY_BALANCING", string(keyBalancingRoundRobin)), "how to distribute the requests across the upstream keys: round-robin or least-loaded")
+		virtualKeys = fs.String("virtual-keys-path", os.Getenv("VIRTUAL_KEYS_PATH"), "SQLite database, or JSON file when it ends with .json, of the keys issued by the proxy, which map to upstream keys, the requests without one are rejected, virtual keys are disabled when empty")
+		keyCooldown = fs.Duration("key-cooldown", time.Minute, "how long an upstream key of the pool is not used after a 401, 403 or 429")
+		geminiProxy = fs.String("gemini-proxy", "", "proxy URL of the gemini api calls, e.g. http://proxy.corp:3128, defaults to HTTPS_PROXY")
+		geminiURL   = fs.String("gemini-endpoint", "", "base URL of the gemini api, e.g. a regional or private service connect endpoint, or a local emulator, defaults to https://generativelanguage.googleapis.com")
+		vertexProj  = fs.String("vertex-project", "", "google cloud project to send the requests to vertex ai instead of the gemini api, authenticated with the google credentials rather than the api keys")
+		vertexLoc   = fs.String("vertex-location", "us-central1", "region of the vertex ai calls, or global")
+		vertexCreds = fs.String("vertex-credentials", "", "JSON key file of the service account of the vertex ai calls, defaults to the application default credentials")
+		claudeKey   = fs.String("anthropic-key", "", "secret with the anthropic API key of the claude models, e.g. env:ANTHROPIC_API_KEY, defaults to it when ANTHROPIC_API_KEY is set")
+		claudeModel = fs.String("anthropic-models", "claude-*", "comma-separated patterns of the models sent to anthropic as is, along with the anthropic/ prefixed ones")
+		claudeURL   = fs.String("anthropic-endpoint", "", "base URL of the anthropic api, defaults to https://api.anthropic.com")
+		localURL    = fs.String("local-endpoint", "", "base URL of a local server with the openai api, e.g. http://localhost:11434/v1 for ollama or http://localhost:8080/v1 for llama.cpp")
+		localModels = fs.String("local-models", "", "comma-separated patterns of the models sent to the local server as is, along with the local/ prefixed ones, e.g. llama3*,qwen*")
+		openaiKey   = fs.String("openai-key", "", "secret with the openai API key of the requests forwarded to openai, e.g. env:OPENAI_API_KEY, defaults to it when OPENAI_API_KEY is set")
+		openaiURL   = fs.String("openai-endpoint", "https://api.openai.com/v1", "base URL of the openai api of the forwarded requests")
+		openaiFeats = fs.String("openai-passthrough", strings.Join(defaultPassthroughFeatures, ","), "comma-separated features that gemini can't express, which forward the requests to openai: "+strings.Join(passthroughFeatures, ", "))
+		clientSize  = fs.Int("client-cache-size", 1000, "number of gemini clients, one per API key, above which the least recently used ones are closed")
+		clientTTL   = fs.Duration("client-ttl", 24*time.Hour, "age from which the gemini clients are created again")
+		clientIdle  = fs.Duration("client-idle-timeout", 30*time.Minute, "how long the unused gemini clients are kept")
+		geminiCA    = fs.String("gemini-ca-file", "", "PEM file of the CA certificates to trust for the gemini api calls along with the system ones, e.g. of a corporate proxy")
+		dialTimeout = fs.Duration("gemini-dial-timeout", 30*time.Second, "time limit to connect to gemini")
+		respHeaders = fs.Duration("gemini-response-header-timeout", 0, "time limit to receive the response headers of gemini, 0 for none")
+		refresh     = fs.Duration("secret-refresh", 5*time.Minute, "how often to refresh the secrets")
+		videoModel  = fs.String("video-model", os.Getenv("VIDEO_MODEL"), "gemini model for the requests with videos when the selected model doesn't support video, defaults to gemini-1.5-flash")
+		codeExec    = fs.Bool("code-execution", os.Getenv("CODE_EXECUTION") == "true", "let gemini run python code for all requests, instead of per request")
+		ctxCache    = fs.Bool("context-cache", os.Getenv("CONTEXT_CACHE") == "true", "cache long system messages repeated across requests of the same API key as gemini cached contents")
+		ctxTokens   = fs.Int("context-cache-min-tokens", 0, "estimated tokens of the system messages required to cache them, 0 for the gemini minimum of 32768")
+		ctxHits     = fs.Int("context-cache-min-hits", 2, "requests with the same system messages before caching them")
+		ctxTTL      = fs.Duration("context-cache-ttl", time.Hour, "how long the cached contents live")
+		rpm         = fs.Int("rpm", 0, "maximum requests per minute of each API key, 0 for unlimited")
+		tpm         = fs.Int("tpm", 0, "maximum prompt and completion tokens per minute of each API key, 0 for unlimited")
+		maxConc     = fs.Int("max-concurrency", 0, "maximum in-flight upstream requests, 0 for unlimited")
+		priorityF   = fs.String("priority-file", os.Getenv("PRIORITY_FILE"), "YAML file mapping API key fingerprints to the high, normal or low priority of their requests")
+		queueWait   = fs.Duration("queue-timeout", 0, "how long requests over -max-concurrency wait for a slot before they are rejected with 503")
+		retries     = fs.Int("retry-attempts", 3, "attempts of the chat requests on transient gemini failures, including the first one, 1 to disable retries")
+		backoff     = fs.Duration("retry-backoff", 500*time.Millisecond, "maximum jittered wait before the first retry, doubled for every retry")
+		maxBackoff  = fs.Duration("retry-max-backoff", 10*time.Second, "maximum jittered wait between retries")
+		pricingF    = fs.String("pricing-file", os.Getenv("PRICING_FILE"), "YAML file with the input and output price per million tokens of the models, to estimate the cost of the requests")
+		budgetF     = fs.String("budget-file", os.Getenv("BUDGET_FILE"), "YAML file mapping tenants to their daily or monthly max_cost or max_tokens, over which their requests are rejected with insufficient_quota")
+		tenantF     = fs.String("tenant-file", os.Getenv("TENANT_FILE"), "YAML file mapping API key fingerprints to the tenant of their requests, which the virtual keys set with their own tenant instead")
+		fallbackF   = fs.String("fallback-file", os.Getenv("FALLBACK_FILE"), "YAML file mapping gemini models to the models to try in order on quota errors, safety blocks and timeouts")
+		maxBody     = fs.Int64("max-body-size", 0, "maximum size in bytes of the chat request bodies, 0 for unlimited")
+		maxPrompt   = fs.Int("max-prompt-tokens", 0, "maximum estimated prompt tokens per request, 0 for unlimited")
+		maxImages   = fs.Int("max-images", 0, "maximum images and files per request, 0 for unlimited")
+		maxTokens   = fs.Int("max-tokens", 0, "maximum requested max_tokens, 0 for unlimited")
+		maxScore    = fs.Int("max-request-score", 0, "maximum estimated prompt tokens plus max_tokens per request, 0 for unlimited")
+		admModel    = fs.String("admission-model", os.Getenv("ADMISSION_MODEL"), "gemini model for the requests over the limits, which are rejected when empty")
+		traceLog    = fs.Bool("trace-log", os.Getenv("TRACE_LOG") == "true", "log the opentelemetry spans of the requests when they end")
+		logLevel    = fs.String("log-level", envOr("LOG_LEVEL", "info"), "minimum level of the logs: debug, info, warn or error, where debug logs the steps of the message conversion")
+		logFmt      = fs.String("log-format", envOr("LOG_FORMAT", string(logFormatJSON)), "format of the logs: json or text")
+		dumpStore   = fs.String("dump-store", os.Getenv("DUMP_STORE"), "where the requests and responses are recorded: file: followed by a directory, sqlite: followed by a database, or gcs: or s3: followed by a bucket and prefix; they are not recorded when empty")
+		dumpFiles   = fs.Int("dump-max-files", 1000, "maximum number of recorded requests, after which the oldest are deleted, 0 for unlimited")
+		dumpAge     = fs.Duration("dump-max-age", 24*time.Hour, "how long the recorded requests are kept, 0 for unlimited")
+		redactF     = fs.String("dump-redaction-file", os.Getenv("DUMP_REDACTION_FILE"), "YAML file with the built-in detectors and the regular expressions redacted from the dumped bodies, instead of all the detectors: email, phone and api_key")
+		debug       = fs.Bool("debug-endpoints", os.Getenv("DEBUG_ENDPOINTS") == "true", "serve the pprof profiles on /debug/pprof/ and the runtime stats on /debug/vars to the admin")
+		debugResps  = fs.Bool("debug-responses", false, "let all api keys get the raw gemini responses with the X-Debug header, instead of the virtual keys with debug")
+		logPayloads = fs.Bool("log-payloads", os.Getenv("LOG_PAYLOADS") == "true", "log the contents of the requests, which hold the user data")
+		payloadMax  = fs.Int("log-payload-limit", 2048, "bytes of each logged payload after which it is truncated, 0 for no limit")
+		fixturesDir = fs.String("fixtures-dir", os.Getenv("FIXTURES_DIR"), "directory to record the gemini API interactions in and replay them from, for integration tests without network access")
+		fixturesMod = fs.String("fixtures-mode", envOr("FIXTURES_MODE", string(goaitest.RecorderModeAuto)), "how -fixtures-dir is used: replay, record, or auto to record the interactions that were not recorded yet")
+		mock        = fs.Bool("mock", os.Getenv("MOCK") == "true", "serve mock completions without calling gemini, for offline development")
+		mockFile    = fs.String("mock-file", os.Getenv("MOCK_FILE"), "YAML file with the text/template of the mock completion per model")
+		mockLatency = fs.Duration("mock-latency", 300*time.Millisecond, "wait before the mock completion or its first chunk")
+		mockTPS     = fs.Float64("mock-tps", 30, "words per second of the streamed mock completions, 0 to send them at once")
+		chaosRate   = fs.Float64("chaos-rate", 0, "fraction of the requests from 0 to 1 in which a fault is injected, for resilience testing, 0 to disable")
+		chaosFlts   = fs.String("chaos-faults", os.Getenv("CHAOS_FAULTS"), "comma-separated faults to inject: latency, error, truncate or malformed, all when empty")
+		chaosLat    = fs.Duration("chaos-latency", 5*time.Second, "maximum latency injected by the latency fault")
+		validate    = fs.Bool("validate-config", false, "validate the config and exit")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// The command line flags take precedence over the environment
+	// variables, which take precedence over the config file.
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if err := applyEnv(fs, set); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := applyConfigFile(fs, *configFile, set); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &config{
+		ModelMapping:          make(map[string]string),
+		ConfigFile:            *configFile,
+		Addr:                  listenAddr(*addr, *port),
+		BasePath:              strings.TrimRight(*basePath, "/"),
+		TLSCert:               *tlsCert,
+		TLSKey:                *tlsKey,
+		AutocertDir:           *acmeDir,
+		H2C:                   *h2c,
+		Compress:              *compression,
+		ModelPassthrough:      *passthrough,
+		DefaultModel:          *defModel,
+		DefaultVisionModel:    *defVision,
+		SystemPrompt:          *sysPrompt,
+		MediaDir:              *mediaDir,
+		MediaSecret:           *mediaSecret,
+		MediaTTL:              *mediaTTL,
+		PublicURL:             *publicURL,
+		TemperatureMode:       goai.TemperatureMode(*tempMode),
+		ParamMode:             goai.ParamMode(*paramMode),
+		MaxTemperature:        *maxTemp,
+		CacheURL:              *cacheURL,
+		ResponseCacheTTL:      *respTTL,
+		ReadyTTL:              *readyTTL,
+		RequestTimeout:        *reqTimeout,
+		ReadHeaderTimeout:     *hdrTimeout,
+		WriteTimeout:          *wrTimeout,
+		IdleTimeout:           *idleTimeout,
+		ValidateOnly:          *validate,
+		FixturesDir:           *fixturesDir,
+		FixturesMode:          goaitest.RecorderMode(*fixturesMod),
+		Mock:                  *mock,
+		MockLatency:           *mockLatency,
+		MockTPS:               *mockTPS,
+		ChaosRate:             *chaosRate,
+		ChaosLatency:          *chaosLat,
+		StreamTokensPerSecond: *streamTPS,
+		CheckpointInterval:    *checkpoint,
+		ConversationMode:      conversationMode(*convMode),
+		FileUploadThreshold:   *uploadSize,
+		KeyBalancing:          keyBalancing(*balancing),
+		KeyCooldown:           *keyCooldown,
+		GeminiProxy:           *geminiProxy,
+		GeminiCAFile:          *geminiCA,
+		GeminiEndpoint:        strings.TrimRight(*geminiURL, "/"),
+		AnthropicKey:          *claudeKey,
+		AnthropicEndpoint:     strings.TrimRight(*claudeURL, "/"),
+		LocalEndpoint:         strings.TrimRight(*localURL, "/"),
+		OpenAIKey:             *openaiKey,
+		OpenAIEndpoint:        strings.TrimRight(*openaiURL, "/"),
+		GeminiDialTimeout:     *dialTimeout,
+		GeminiHeaderTimeout:   *respHeaders,
+		VirtualKeysPath:       *virtualKeys,
+		SecretRefresh:         *refresh,
+		MaxBodySize:           *maxBody,
+		RPM:                   *rpm,
+		TPM:                   *tpm,
+		MaxConcurrency:        *maxConc,
+		TraceLog:              *traceLog,
+		LogFormat:             logFormat(*logFmt),
+		DumpStore:             *dumpStore,
+		DumpMaxFiles:          *dumpFiles,
+		DumpMaxAge:            *dumpAge,
+		DumpRedaction:         defaultRedaction(),
+		Debug:                 *debug,
+		DebugResponses:        *debugResps,
+		PayloadLogging:        goai.PayloadLogging{Enabled: *logPayloads, Limit: *payloadMax},
+		QueueTimeout:          *queueWait,
+		VideoModel:            *videoModel,
+		CodeExecution:         *codeExec,
+		ClientCache: goai.ClientCache{
+			MaxSize:     *clientSize,
+			TTL:         *clientTTL,
+			IdleTimeout: *clientIdle,
+		},
+		ContextCaching: goai.ContextCaching{
+			Enabled:   *ctxCache,
+			MinTokens: *ctxTokens,
+			MinHits:   *ctxHits,
+			TTL:       *ctxTTL,
+		},
+		Retry: goai.Retry{
+			MaxAttempts: *retries,
+			Backoff:     *backoff,
+			MaxBackoff:  *maxBackoff,
+		},
+		Admission: goai.Admission{
+			MaxPromptTokens: *maxPrompt,
+			MaxImages:       *maxImages,
+			MaxTokens:       *maxTokens,
+			MaxScore:        *maxScore,
+			Model:           *admModel,
+		},
+	}
+
+	cfg.LabelHeaders = splitList(*labelHdrs)
+	cfg.WarmupKeys = splitList(*warmupKeys)
+	cfg.ChaosFaults = splitList(*chaosFlts)
+	cfg.AutocertDomains = splitList(*acmeDomains)
+	cfg.CORSOrigins = splitList(*corsOrigins)
+	cfg.CORSMethods = splitList(*corsMethods)
+	cfg.CORSHeaders = splitList(*corsHeaders)
+	if *upstreamKey != "" {
+		cfg.UpstreamKeys = append(cfg.UpstreamKeys, *upstreamKey)
+	}
+	cfg.UpstreamKeys = append(cfg.UpstreamKeys, splitList(*upstreamKs)...)
+	if *vertexProj != "" {
+		cfg.VertexAI = &goai.VertexAI{
+			Project:         *vertexProj,
+			Location:        *vertexLoc,
+			CredentialsFile: *vertexCreds,
+		}
+	}
+
+	cfg.AnthropicModels = splitList(*claudeModel)
+	cfg.LocalModels = splitList(*localModels)
+	cfg.OpenAIPassthrough = splitList(*openaiFeats)
+	if cfg.OpenAIKey == "" && os.Getenv("OPENAI_API_KEY") != "" {
+		cfg.OpenAIKey = "env:OPENAI_API_KEY"
+	}
+	if cfg.AnthropicKey == "" && os.Getenv("ANTHROPIC_API_KEY") != "" {
+		cfg.AnthropicKey = "env:ANTHROPIC_API_KEY"
+	}
+
+	// The requests without an API key use GEMINI_API_KEY, unless the
+	// upstream keys are set, so that the proxy runs in a container with a
+	// single variable.
+	if len(cfg.UpstreamKeys) == 0 && os.Getenv("GEMINI_API_KEY") != "" {
+		cfg.UpstreamKeys = []string{"env:GEMINI_API_KEY"}
+	}
+
+	var errs []error
+
+	safetySettings, err := parseSafetySettings(*safety)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-safety-settings: %w", err))
+	}
+	cfg.SafetySettings = safetySettings
+
+	if *mappingFile != "" {
+		node, err := decodeYAMLFile(*mappingFile, &cfg.ModelMapping)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateModelMapping(*mappingFile, node, cfg.ModelMapping))
+	}
+
+	// The flag takes precedence over the file.
+	m, err := parseModelMapping(*mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	errs = append(errs, validateModelMapping("-model-mapping", nil, m))
+	for k, v := range m {
+		cfg.ModelMapping[k] = v
+	}
+
+	if *routesFile != "" {
+		node, err := decodeYAMLFile(*routesFile, &cfg.Routes)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateRoutes(*routesFile, node, cfg.Routes))
+	}
+
+	if *degraded != "" {
+		node, err := decodeYAMLFile(*degraded, &cfg.Degraded)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateDegraded(*degraded, node, cfg.Degraded))
+	}
+
+	if *residencyF != "" {
+		node, err := decodeYAMLFile(*residencyF, &cfg.Residency)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateResidency(*residencyF, node, cfg.Residency))
+	}
+
+	if *priorityF != "" {
+		node, err := decodeYAMLFile(*priorityF, &cfg.Priorities)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validatePriorities(*priorityF, node, cfg.Priorities))
+	}
+
+	if *pricingF != "" {
+		node, err := decodeYAMLFile(*pricingF, &cfg.Pricing)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validatePricing(*pricingF, node, cfg.Pricing))
+	}
+
+	if *budgetF != "" {
+		node, err := decodeYAMLFile(*budgetF, &cfg.Budgets)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateBudgets(*budgetF, node, cfg.Budgets))
+	}
+
+	if *tenantF != "" {
+		node, err := decodeYAMLFile(*tenantF, &cfg.Tenants)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateTenants(*tenantF, node, cfg.Tenants))
+	}
+
+	if *redactF != "" {
+		node, err := decodeYAMLFile(*redactF, &cfg.DumpRedaction)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateRedaction(*redactF, node, cfg.DumpRedaction))
+	}
+
+	if *fallbackF != "" {
+		node, err := decodeYAMLFile(*fallbackF, &cfg.Fallbacks)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateFallbacks(*fallbackF, node, cfg.Fallbacks))
+	}
+
+	if *mockFile != "" {
+		node, err := decodeYAMLFile(*mockFile, &cfg.MockResponses)
+		if err != nil {
+			return nil, err
+		}
+
+		errs = append(errs, validateMockResponses(*mockFile, node, cfg.MockResponses))
+	}
+
+	if m := cfg.Admission.Model; m != "" && !geminiModelPattern.MatchString(m) {
+		errs = append(errs, fmt.Errorf("-admission-model: invalid gemini model name %q", m))
+	}
+
+	if m := cfg.DefaultModel; m != "" && !geminiModelPattern.MatchString(m) {
+		errs = append(errs, fmt.Errorf("-default-model: invalid gemini model name %q", m))
+	}
+
+	if m := cfg.DefaultVisionModel; m != "" && !geminiModelPattern.MatchString(m) {
+		errs = append(errs, fmt.Errorf("-default-vision-model: invalid gemini model name %q", m))
+	}
+
+	if m := cfg.VideoModel; m != "" && !geminiModelPattern.MatchString(m) {
+		errs = append(errs, fmt.Errorf("-video-model: invalid gemini model name %q", m))
+	}
+
+	if *port < 0 || *port > 65535 {
+		errs = append(errs, fmt.Errorf("-port: %d is not a valid port", *port))
+	}
+
+	if _, p, err := net.SplitHostPort(cfg.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("-addr: invalid address %q: %w", *addr, err))
+	} else if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		errs = append(errs, fmt.Errorf("-addr: %q is not a valid port", p))
+	}
+
+	if cfg.GeminiProxy != "" {
+		if u, err := url.Parse(cfg.GeminiProxy); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("-gemini-proxy: invalid URL %q", cfg.GeminiProxy))
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			errs = append(errs, fmt.Errorf("-gemini-proxy: unsupported scheme %q, expected http, https or socks5", u.Scheme))
+		}
+	}
+
+	if cfg.GeminiEndpoint != "" {
+		if u, err := url.Parse(cfg.GeminiEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("-gemini-endpoint: invalid URL %q, expected http or https", cfg.GeminiEndpoint))
+		}
+	}
+
+	if cfg.AnthropicEndpoint != "" {
+		if u, err := url.Parse(cfg.AnthropicEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("-anthropic-endpoint: invalid URL %q, expected http or https", cfg.AnthropicEndpoint))
+		}
+	}
+
+	for _, pattern := range cfg.AnthropicModels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("-anthropic-models: invalid pattern %q", pattern))
+		}
+	}
+
+	if cfg.LocalEndpoint != "" {
+		if u, err := url.Parse(cfg.LocalEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("-local-endpoint: invalid URL %q, expected http or https", cfg.LocalEndpoint))
+		}
+	} else if len(cfg.LocalModels) > 0 {
+		errs = append(errs, errors.New("-local-models requires -local-endpoint"))
+	}
+
+	for _, pattern := range cfg.LocalModels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("-local-models: invalid pattern %q", pattern))
+		}
+	}
+
+	if u, err := url.Parse(cfg.OpenAIEndpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Errorf("-openai-endpoint: invalid URL %q, expected http or https", cfg.OpenAIEndpoint))
+	}
+
+	for _, f := range cfg.OpenAIPassthrough {
+		if !slices.Contains(passthroughFeatures, f) {
+			errs = append(errs, fmt.Errorf("-openai-passthrough: unknown feature %q, expected %s", f, strings.Join(passthroughFeatures, ", ")))
+		}
+	}
+
+	if cfg.ClientCache.MaxSize <= 0 || cfg.ClientCache.TTL <= 0 || cfg.ClientCache.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("-client-cache-size, -client-ttl and -client-idle-timeout must be positive"))
+	}
+
+	if cfg.GeminiDialTimeout < 0 || cfg.GeminiHeaderTimeout < 0 {
+		errs = append(errs, errors.New("-gemini-dial-timeout and -gemini-response-header-timeout must not be negative"))
+	}
+
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		errs = append(errs, fmt.Errorf("-base-path: %q must start with /", *basePath))
+	}
+
+	if cfg.RequestTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-request-timeout: %v is negative", cfg.RequestTimeout))
+	}
+
+	if cfg.WriteTimeout > 0 && (cfg.RequestTimeout == 0 || cfg.RequestTimeout >= cfg.WriteTimeout) {
+		errs = append(errs, fmt.Errorf("-write-timeout: %v must be longer than -request-timeout %v, or the responses are cut off", cfg.WriteTimeout, cfg.RequestTimeout))
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		errs = append(errs, errors.New("-tls-cert and -tls-key must be set together"))
+	}
+
+	if cfg.TLSCert != "" && len(cfg.AutocertDomains) > 0 {
+		errs = append(errs, errors.New("-autocert-domains can't be set with -tls-cert"))
+	}
+
+	if cfg.H2C && (cfg.TLSCert != "" || len(cfg.AutocertDomains) > 0) {
+		errs = append(errs, errors.New("-h2c can't be set with TLS, which negotiates HTTP/2 instead"))
+	}
+
+	switch cfg.KeyBalancing {
+	case keyBalancingRoundRobin, keyBalancingLeastLoaded:
+	default:
+		errs = append(errs, fmt.Errorf("-key-balancing: unknown balancing %q", cfg.KeyBalancing))
+	}
+
+	if ref := cfg.DumpStore; ref != "" {
+		scheme, name, _ := strings.Cut(ref, ":")
+		if !slices.Contains([]string{"file", "sqlite", "gcs", "s3"}, scheme) || name == "" {
+			errs = append(errs, fmt.Errorf("-dump-store: invalid store %q, expected file:, sqlite:, gcs: or s3: followed by the directory, database or bucket", ref))
+		}
+	}
+
+	switch cfg.FixturesMode {
+	case goaitest.RecorderModeReplay, goaitest.RecorderModeRecord, goaitest.RecorderModeAuto:
+	default:
+		errs = append(errs, fmt.Errorf("-fixtures-mode: unknown mode %q", cfg.FixturesMode))
+	}
+
+	if cfg.ChaosRate < 0 || cfg.ChaosRate > 1 {
+		errs = append(errs, fmt.Errorf("-chaos-rate: %v is not between 0 and 1", cfg.ChaosRate))
+	}
+
+	for _, f := range cfg.ChaosFaults {
+		if !slices.Contains(chaosFaults, f) {
+			errs = append(errs, fmt.Errorf("-chaos-faults: unknown fault %q, expected latency, error, truncate or malformed", f))
+		}
+	}
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("-log-level: unknown level %q", *logLevel))
+	}
+
+	switch cfg.LogFormat {
+	case logFormatJSON, logFormatText:
+	default:
+		errs = append(errs, fmt.Errorf("-log-format: unknown format %q", cfg.LogFormat))
+	}
+
+	switch cfg.ConversationMode {
+	case conversationModeOff, conversationModeQueue, conversationModeCancel, conversationModeReject:
+	default:
+		errs = append(errs, fmt.Errorf("-conversation-mode: unknown mode %q, expected off, queue, cancel or reject", cfg.ConversationMode))
+	}
+
+	switch cfg.TemperatureMode {
+	case goai.TemperatureModeNone, goai.TemperatureModeClamp, goai.TemperatureModeScale:
+	default:
+		errs = append(errs, fmt.Errorf("-temperature-mode: unknown mode %q", cfg.TemperatureMode))
+	}
+
+	switch cfg.ParamMode {
+	case goai.ParamModeLenient, goai.ParamModeStrict:
+	default:
+		errs = append(errs, fmt.Errorf("-param-mode: unknown mode %q, expected lenient or strict", cfg.ParamMode))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// flagEnv returns the environment variable of the flag, e.g. MAX_TOKENS for
+// -max-tokens.
+func flagEnv(name string) string {
+	if name == "config" {
+		return "CONFIG_FILE"
+	}
+
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the flags that are not set on the command line from their
+// environment variable, and marks them as set.
+func applyEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := flagEnv(f.Name)
+		v := os.Getenv(env)
+		if set[f.Name] || v == "" {
+			return
+		}
+
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			return
+		}
+		set[f.Name] = true
+	})
+
+	return errors.Join(errs...)
+}
+
+// applyConfigFile sets the flags defined in the YAML file, keyed by their
+// name, unless they are already set. The lists are joined with commas, and
+// the mappings as comma-separated key=value pairs, e.g.
+//
+//	model-mapping:
+//	  gpt-4o: gemini-1.5-pro
+//	rpm: 60
+func applyConfigFile(fs *flag.FlagSet, path string, set map[string]bool) error {
+	var m map[string]any
+	node, err := decodeYAMLFile(path, &m)
+	if err != nil {
+		return err
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return configError(path, node, "expected a mapping of flag names to values")
+	}
+
+	var errs []error
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value == "config" || fs.Lookup(key.Value) == nil {
+			errs = append(errs, configError(path, key, "unknown flag %q", key.Value))
+			continue
+		}
+
+		if set[key.Value] {
+			continue
+		}
+
+		v, err := flagValue(value)
+		if err != nil {
+			errs = append(errs, configError(path, value, "%s: %v", key.Value, err))
+			continue
+		}
+
+		if err := fs.Set(key.Value, v); err != nil {
+			errs = append(errs, configError(path, value, "%s: %v", key.Value, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// flagValue converts the YAML value to the string of a flag.
+func flagValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		vs := make([]string, len(node.Content))
+		for i, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("expected a list of values")
+			}
+			vs[i] = item.Value
+		}
+
+		return strings.Join(vs, ","), nil
+	case yaml.MappingNode:
+		var kvs []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return "", errors.New("expected a mapping of keys to values")
+			}
+			kvs = append(kvs, node.Content[i].Value+"="+node.Content[i+1].Value)
+		}
+
+		return strings.Join(kvs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value")
+	}
+}
+
+// listenAddr returns the address to listen on. The port is added to the
+// addresses without one, e.g. localhost.
+func listenAddr(addr string, port int) string {
+	if addr == "" {
+		return fmt.Sprintf(":%d", port)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(port))
+	}
+
+	return addr
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return fallback
+}
+
+// splitList splits the comma-separated values, ignoring empty values.
+func splitList(s string) []string {
+	var vs []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vs = append(vs, v)
+		}
+	}
+
+	return vs
+}
+
+// parseSafetySettings parses the comma-separated category=threshold pairs.
+func parseSafetySettings(s string) ([]goai.SafetySetting, error) {
+	var settings []goai.SafetySetting
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid safety setting %q, expected category=threshold", kv)
+		}
+
+		setting := goai.SafetySetting{
+			Category:  strings.TrimSpace(k),
+			Threshold: strings.TrimSpace(v),
+		}
+		if err := setting.Validate(); err != nil {
+			return nil, err
+		}
+
+		settings = append(settings, setting)
+	}
+
+	return settings, nil
+}
+
+func parseModelMapping(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid model mapping: %q", kv)
+		}
+
+		m[k] = v
+	}
+
+	return m, nil
+}
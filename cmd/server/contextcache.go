@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+)
+
+type contextCacher interface {
+	ContextCaching() goai.ContextCaching
+	SetContextCaching(cc goai.ContextCaching)
+	ContextCaches() []goai.ContextCache
+	ExpireContextCache(ctx context.Context, id string, ttl time.Duration) (*goai.ContextCache, error)
+	DeleteContextCache(ctx context.Context, id string) error
+}
+
+// contextCachesResponse lists the cached contents with the caching settings.
+type contextCachesResponse struct {
+	Object   string              `json:"object"`
+	Settings contextCachingJSON  `json:"settings"`
+	Data     []goai.ContextCache `json:"data"`
+}
+
+// contextCachingJSON is goai.ContextCaching with the TTL as a duration
+// string, e.g. "1h".
+type contextCachingJSON struct {
+	Enabled   *bool  `json:"enabled,omitempty"`
+	MinTokens int    `json:"min_tokens,omitempty"`
+	MinHits   int    `json:"min_hits,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+}
+
+func toContextCachingJSON(cc goai.ContextCaching) contextCachingJSON {
+	return contextCachingJSON{
+		Enabled:   &cc.Enabled,
+		MinTokens: cc.MinTokens,
+		MinHits:   cc.MinHits,
+		TTL:       cc.TTL.String(),
+	}
+}
+
+// ContextCaches serves the context caching admin API: listing the cached
+// contents and updating the settings on /admin/context-caches, and changing
+// the TTL and deleting on /admin/context-caches/{id}.
+func (h adminHandler) ContextCaches(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/context-caches/")
+	switch {
+	case r.URL.Path == "/admin/context-caches" && r.Method == http.MethodGet:
+		h.listContextCaches(w, r)
+	case r.URL.Path == "/admin/context-caches" && r.Method == http.MethodPatch:
+		h.updateContextCaching(w, r)
+	case r.URL.Path == "/admin/context-caches":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case id == "" || strings.Contains(id, "/"):
+		catchAll(w, r)
+	case r.Method == http.MethodPatch:
+		h.expireContextCache(w, r, id)
+	case r.Method == http.MethodDelete:
+		h.deleteContextCache(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h adminHandler) listContextCaches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, contextCachesResponse{
+		Object:   "list",
+		Settings: toContextCachingJSON(h.contextCaches.ContextCaching()),
+		Data:     h.contextCaches.ContextCaches(),
+	})
+}
+
+// updateContextCaching updates the given settings, e.g. to pause the creation
+// of the cached contents with {"enabled": false}.
+func (h adminHandler) updateContextCaching(w http.ResponseWriter, r *http.Request) {
+	var req contextCachingJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cc := h.contextCaches.ContextCaching()
+	if req.Enabled != nil {
+		cc.Enabled = *req.Enabled
+	}
+
+	if req.MinTokens != 0 {
+		cc.MinTokens = req.MinTokens
+	}
+
+	if req.MinHits != 0 {
+		cc.MinHits = req.MinHits
+	}
+
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid ttl: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		cc.TTL = ttl
+	}
+
+	h.contextCaches.SetContextCaching(cc)
+	logger.InfoContext(r.Context(), "context caching updated",
+		slog.Bool("enabled", cc.Enabled),
+		slog.Int("min_tokens", cc.MinTokens),
+		slog.Int("min_hits", cc.MinHits),
+		slog.String("ttl", cc.TTL.String()),
+	)
+
+	writeJSON(w, toContextCachingJSON(h.contextCaches.ContextCaching()))
+}
+
+// expireContextCache changes the TTL of the cached content, e.g. with
+// {"ttl": "10m"}.
+func (h adminHandler) expireContextCache(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		http.Error(w, fmt.Sprintf("invalid ttl: %q", req.TTL), http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.contextCaches.ExpireContextCache(r.Context(), id, ttl)
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "expire context cache failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, res)
+}
+
+func (h adminHandler) deleteContextCache(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.contextCaches.DeleteContextCache(r.Context(), id); err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "delete context cache failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
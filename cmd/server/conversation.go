@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// conversationHeader identifies the conversation of a chat request, e.g. a
+// chat session of a UI.
+const conversationHeader = "X-Conversation-ID"
+
+// conversationMode is how a chat request is handled while another one of
+// the same conversation is generating, so that the conversation history of
+// the client isn't updated by both.
+type conversationMode string
+
+const (
+	// conversationModeOff doesn't track the conversations.
+	conversationModeOff conversationMode = "off"
+
+	// conversationModeQueue waits for the previous generation to end.
+	conversationModeQueue conversationMode = "queue"
+
+	// conversationModeCancel cancels the previous generation, e.g. when the
+	// user edits the message that is being answered.
+	conversationModeCancel conversationMode = "cancel"
+
+	// conversationModeReject rejects the request with a 409.
+	conversationModeReject conversationMode = "reject"
+)
+
+// generation is a chat request in flight of a conversation.
+type generation struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// conversationGuard allows a single generation at a time per conversation.
+// The conversations are scoped to the API key of the client.
+type conversationGuard struct {
+	mode conversationMode
+
+	mu     sync.Mutex
+	active map[string]*generation
+}
+
+// newConversationGuard returns the guard, or nil when the mode is off.
+func newConversationGuard(mode conversationMode) *conversationGuard {
+	if mode == conversationModeOff || mode == "" {
+		return nil
+	}
+
+	return &conversationGuard{
+		mode:   mode,
+		active: make(map[string]*generation),
+	}
+}
+
+// start registers the generation of the conversation, once the previous one
+// ended. It returns false when the request is rejected, or was canceled while
+// waiting.
+func (g *conversationGuard) start(ctx context.Context, id string, cancel context.CancelFunc) (*generation, bool) {
+	gen := &generation{cancel: cancel, done: make(chan struct{})}
+	for {
+		g.mu.Lock()
+		prev, ok := g.active[id]
+		if !ok {
+			g.active[id] = gen
+			g.mu.Unlock()
+			return gen, true
+		}
+		g.mu.Unlock()
+
+		switch g.mode {
+		case conversationModeReject:
+			return nil, false
+		case conversationModeCancel:
+			prev.cancel()
+		}
+
+		// The previous generation is awaited in both the queue and cancel
+		// modes, so that its history is complete before the next one.
+		select {
+		case <-prev.done:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// end releases the conversation for the next generation.
+func (g *conversationGuard) end(id string, gen *generation) {
+	g.mu.Lock()
+	if g.active[id] == gen {
+		delete(g.active, id)
+	}
+	g.mu.Unlock()
+
+	close(gen.done)
+}
+
+// guardConversation handles the chat requests of a conversation that is
+// already generating, see conversationMode. The requests without the
+// X-Conversation-ID header are not tracked.
+func (h openaiHandler) guardConversation(next http.HandlerFunc) http.HandlerFunc {
+	if h.conversations == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation := r.Header.Get(conversationHeader)
+		if conversation == "" {
+			next(w, r)
+			return
+		}
+
+		id := fingerprint(h.clientKey(r)) + "/" + conversation
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		gen, ok := h.conversations.start(ctx, id, cancel)
+		if !ok {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.WarnContext(ctx, "concurrent generation rejected", slog.String("conversation", conversation))
+			writeAPIError(w, &openai.APIError{
+				Code:           "conversation_in_progress",
+				Message:        "Another request of the conversation is in progress. Please try again once it completes.",
+				Type:           "invalid_request_error",
+				HTTPStatusCode: http.StatusConflict,
+			})
+			return
+		}
+		defer h.conversations.end(id, gen)
+
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingHandler is a generation that runs until it is released or
+// canceled.
+type blockingHandler struct {
+	started  chan string
+	release  chan struct{}
+	canceled chan string
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{
+		started:  make(chan string, 10),
+		release:  make(chan struct{}),
+		canceled: make(chan string, 10),
+	}
+}
+
+func (b *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get("X-Name")
+	b.started <- name
+
+	select {
+	case <-b.release:
+	case <-r.Context().Done():
+		b.canceled <- name
+	}
+}
+
+// serveConversation sends a request of the conversation in the background,
+// and returns its response once it is done.
+func serveConversation(handler http.HandlerFunc, apiKey, conversation, name string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		r := newRequest(apiKey, "/chat/completions", "")
+		r.Header.Set("X-Name", name)
+		if conversation != "" {
+			r.Header.Set(conversationHeader, conversation)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		done <- w
+	}()
+
+	return done
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+func assertPending[T any](t *testing.T, ch <-chan T) {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		t.Fatalf("got %v, want none yet", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGuardConversationReject(t *testing.T) {
+	h := newTestHandler(t)
+	h.conversations = newConversationGuard(conversationModeReject)
+	b := newBlockingHandler()
+	handler := h.guardConversation(b.ServeHTTP)
+
+	first := serveConversation(handler, "key", "c1", "first")
+	receive(t, b.started)
+
+	if w := receive(t, serveConversation(handler, "key", "c1", "second")); w.Code != http.StatusConflict {
+		t.Fatalf("got %d %s, want 409", w.Code, w.Body)
+	}
+
+	// The other conversations, the conversations of the other keys and the
+	// requests without a conversation aren't affected.
+	others := []<-chan *httptest.ResponseRecorder{
+		serveConversation(handler, "key", "c2", "other conversation"),
+		serveConversation(handler, "other-key", "c1", "other key"),
+		serveConversation(handler, "key", "", "no conversation"),
+	}
+	for range others {
+		receive(t, b.started)
+	}
+
+	close(b.release)
+	for _, done := range append(others, first) {
+		if w := receive(t, done); w.Code != http.StatusOK {
+			t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+		}
+	}
+
+	// The conversation is released once the generation ends.
+	if w := receive(t, serveConversation(handler, "key", "c1", "third")); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestGuardConversationQueue(t *testing.T) {
+	h := newTestHandler(t)
+	h.conversations = newConversationGuard(conversationModeQueue)
+	b := newBlockingHandler()
+	handler := h.guardConversation(b.ServeHTTP)
+
+	first := serveConversation(handler, "key", "c1", "first")
+	receive(t, b.started)
+
+	second := serveConversation(handler, "key", "c1", "second")
+	assertPending(t, b.started)
+
+	b.release <- struct{}{}
+	receive(t, first)
+	if got := receive(t, b.started); got != "second" {
+		t.Fatalf("started %s, want second", got)
+	}
+
+	b.release <- struct{}{}
+	if w := receive(t, second); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestGuardConversationCancel(t *testing.T) {
+	h := newTestHandler(t)
+	h.conversations = newConversationGuard(conversationModeCancel)
+	b := newBlockingHandler()
+	handler := h.guardConversation(b.ServeHTTP)
+
+	first := serveConversation(handler, "key", "c1", "first")
+	receive(t, b.started)
+
+	second := serveConversation(handler, "key", "c1", "second")
+	if got := receive(t, b.canceled); got != "first" {
+		t.Fatalf("canceled %s, want first", got)
+	}
+	receive(t, first)
+
+	// The next generation starts once the previous one has ended.
+	if got := receive(t, b.started); got != "second" {
+		t.Fatalf("started %s, want second", got)
+	}
+
+	close(b.release)
+	if w := receive(t, second); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsExposedHeaders are the response headers of the proxy that the browser
+// clients can read.
+var corsExposedHeaders = []string{
+	"X-Request-ID",
+	"X-Gemini-Model",
+	"X-Proxy-Warnings",
+	"X-Ignored-Params",
+	"X-Proxy-Degraded",
+	"X-Estimated-Cost",
+	"X-Cache",
+	"Retry-After",
+	"x-ratelimit-limit-requests",
+	"x-ratelimit-limit-tokens",
+	"x-ratelimit-remaining-requests",
+	"x-ratelimit-remaining-tokens",
+	"x-ratelimit-reset-requests",
+	"x-ratelimit-reset-tokens",
+}
+
+// corsMaxAge is how long the browsers cache the preflight responses.
+const corsMaxAge = 10 * time.Minute
+
+// cors allows the browser clients of the origins to call the proxy, and
+// answers their preflight requests.
+type cors struct {
+	// origins are the allowed origins, or "*" for any origin.
+	origins []string
+
+	// methods and headers are the allowed methods and request headers. The
+	// requested headers are allowed when empty, since the OpenAI SDKs send
+	// their own, e.g. X-Stainless-OS.
+	methods string
+	headers string
+}
+
+// newCORS returns the middleware, or nil when no origin is allowed.
+func newCORS(origins, methods, headers []string) *cors {
+	if len(origins) == 0 {
+		return nil
+	}
+
+	return &cors{
+		origins: origins,
+		methods: strings.Join(methods, ", "),
+		headers: strings.Join(headers, ", "),
+	}
+}
+
+func (c *cors) allowOrigin(origin string) string {
+	if slices.Contains(c.origins, "*") {
+		return "*"
+	}
+
+	if slices.Contains(c.origins, origin) {
+		return origin
+	}
+
+	return ""
+}
+
+// Handler sets the CORS headers of the responses to the allowed origins, and
+// answers the preflight requests. CORS is disabled when there is no
+// middleware.
+func (c *cors) Handler(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := c.allowOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allowed == "" {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", c.methods)
+		headers := c.headers
+		if headers == "" {
+			headers = r.Header.Get("Access-Control-Request-Headers")
+		}
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// handleDebug serves the pprof profiles on /debug/pprof/ and a snapshot of
+// the goroutines, clients and memory stats on /debug/vars, to diagnose leaks
+// of the streams or the clients live. They are only served to the admin, as
+// they reveal the internals of the server.
+func handleDebug(mux *http.ServeMux, adminToken string, clients func() int) {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("clients", expvar.Func(func() any {
+		return clients()
+	}))
+
+	mux.HandleFunc("/debug/pprof/", requireAdmin(adminToken, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdmin(adminToken, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdmin(adminToken, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(adminToken, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdmin(adminToken, pprof.Trace))
+	mux.HandleFunc("/debug/vars", requireAdmin(adminToken, expvar.Handler().ServeHTTP))
+}
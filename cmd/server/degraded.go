@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+// degradedResponse is returned for a model when Gemini is unavailable.
+type degradedResponse struct {
+	// Content is the canned response.
+	Content string `yaml:"content"`
+
+	// Cached returns the last successful response instead, falling back to
+	// the canned response.
+	Cached bool `yaml:"cached"`
+}
+
+// degradedMode keeps the dependent apps alive during outages by returning
+// canned or cached responses per model. The "*" model matches any model.
+type degradedMode struct {
+	responses map[string]degradedResponse
+
+	// last stores the last successful response per model.
+	last goai.Cache
+}
+
+func newDegradedMode(responses map[string]degradedResponse, last goai.Cache) *degradedMode {
+	return &degradedMode{
+		responses: responses,
+		last:      last,
+	}
+}
+
+func degradedCacheKey(model string) string {
+	return "degraded:" + model
+}
+
+func (d *degradedMode) lookup(model string) (degradedResponse, bool) {
+	if r, ok := d.responses[model]; ok {
+		return r, true
+	}
+
+	r, ok := d.responses["*"]
+	return r, ok
+}
+
+// Store keeps the successful response, if the model serves cached responses.
+func (d *degradedMode) Store(ctx context.Context, model string, res *openai.ChatCompletionResponse) error {
+	if r, ok := d.lookup(model); !ok || !r.Cached {
+		return nil
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	return d.last.Set(ctx, degradedCacheKey(model), b, 0)
+}
+
+// Response returns the response to serve for the model, if any.
+func (d *degradedMode) Response(ctx context.Context, model string) (*openai.ChatCompletionResponse, bool) {
+	r, ok := d.lookup(model)
+	if !ok {
+		return nil, false
+	}
+
+	if r.Cached {
+		if res, ok := d.cached(ctx, model); ok {
+			return res, true
+		}
+	}
+
+	if r.Content == "" {
+		return nil, false
+	}
+
+	return &openai.ChatCompletionResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: r.Content,
+			},
+			FinishReason: openai.FinishReasonStop,
+		}},
+	}, true
+}
+
+// cached returns the last successful response. Cache errors are logged, since
+// the canned response can still be served.
+func (d *degradedMode) cached(ctx context.Context, model string) (*openai.ChatCompletionResponse, bool) {
+	b, ok, err := d.last.Get(ctx, degradedCacheKey(model))
+	if err != nil {
+		logger.ErrorContext(ctx, "get cached response failed", slog.String("error", err.Error()))
+		return nil, false
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	var res openai.ChatCompletionResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		logger.ErrorContext(ctx, "decode cached response failed", slog.String("error", err.Error()))
+		return nil, false
+	}
+
+	return &res, true
+}
+
+// upstreamUnavailable reports whether the error is caused by Gemini being
+// unavailable, rather than by an invalid or blocked request.
+func upstreamUnavailable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return false
+	}
+
+	code := goai.HTTPStatusCode(err)
+	return code == 0 || code >= http.StatusInternalServerError
+}
+
+// toStream sends the response as a single chunk.
+func toStream(res *openai.ChatCompletionResponse) chan openai.ChatCompletionStreamResponse {
+	choices := make([]openai.ChatCompletionStreamChoice, len(res.Choices))
+	for i, c := range res.Choices {
+		choices[i] = openai.ChatCompletionStreamChoice{
+			Index: c.Index,
+			Delta: openai.ChatCompletionStreamChoiceDelta{
+				Role:    c.Message.Role,
+				Content: c.Message.Content,
+			},
+			FinishReason: c.FinishReason,
+		}
+	}
+
+	ch := make(chan openai.ChatCompletionStreamResponse, 1)
+	ch <- openai.ChatCompletionStreamResponse{
+		ID:      res.ID,
+		Object:  "chat.completion.chunk",
+		Created: res.Created,
+		Model:   res.Model,
+		Choices: choices,
+	}
+	close(ch)
+
+	return ch
+}
+
+func setDegradedHeader(w http.ResponseWriter) {
+	w.Header().Set("X-Proxy-Degraded", "true")
+	w.Header().Set("Warning", `199 - "degraded response, upstream unavailable"`)
+}
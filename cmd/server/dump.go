@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpQueueSize is the number of dumps waiting to be written, after which
+// they are dropped rather than slowing down the requests.
+const dumpQueueSize = 100
+
+// dumpSweepInterval is how often the dumps past the retention are deleted.
+const dumpSweepInterval = time.Minute
+
+// dump is a request and its response in the HTTP/1.1 wire format, as written
+// by httputil.DumpRequest and httputil.DumpResponse.
+type dump struct {
+	ID       string
+	Time     time.Time
+	Request  []byte
+	Response []byte
+}
+
+// dumper records the requests and responses in a store, for
+// troubleshooting. Their bodies are redacted, and the dumps are saved in the
+// background, and deleted when they are older than maxAge or past the newest
+// maxFiles. Zero limits are unlimited.
+type dumper struct {
+	store    dumpStore
+	redactor *redactor
+	maxFiles int
+	maxAge   time.Duration
+	queue    chan dump
+}
+
+func newDumper(store dumpStore, redactor *redactor, maxFiles int, maxAge time.Duration) *dumper {
+	d := &dumper{
+		store:    store,
+		redactor: redactor,
+		maxFiles: maxFiles,
+		maxAge:   maxAge,
+		queue:    make(chan dump, dumpQueueSize),
+	}
+	go d.save()
+	if maxFiles > 0 || maxAge > 0 {
+		go d.sweep(context.Background(), dumpSweepInterval)
+	}
+
+	return d
+}
+
+// Handler dumps the API requests. The admin, debug and health endpoints are
+// not dumped.
+func (d *dumper) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dumpable(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		req, err := dumpRequest(r, d.redactor)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "dump request failed", slog.String("error", err.Error()))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &dumpRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		res, err := rec.dump(d.redactor)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "dump response failed", slog.String("error", err.Error()))
+			return
+		}
+
+		select {
+		case d.queue <- dump{ID: requestID(r.Context()), Time: start, Request: req, Response: res}:
+		default:
+			logger.WarnContext(r.Context(), "dump dropped", slog.Int("queue_size", dumpQueueSize))
+		}
+	})
+}
+
+func dumpable(path string) bool {
+	switch {
+	case path == "/health", path == "/metrics",
+		strings.HasPrefix(path, "/admin/"),
+		strings.HasPrefix(path, "/debug/"),
+		strings.HasPrefix(path, "/media/"):
+		return false
+	}
+
+	return true
+}
+
+// dumpRequest dumps the request with its redacted body. The body is restored
+// for the handler, and the API key is replaced with its fingerprint.
+func dumpRequest(r *http.Request, red *redactor) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	body = red.Redact(body)
+	rc := r.Clone(r.Context())
+	rc.Body = io.NopCloser(bytes.NewReader(body))
+	rc.ContentLength = int64(len(body))
+	if rc.Header.Get("Content-Length") != "" {
+		rc.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if auth := rc.Header.Get("Authorization"); auth != "" {
+		rc.Header.Set("Authorization", "Bearer "+fingerprint(strings.TrimPrefix(auth, "Bearer ")))
+	}
+
+	return httputil.DumpRequest(rc, true)
+}
+
+// dumpRecorder records the response, streams included.
+type dumpRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *dumpRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *dumpRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *dumpRecorder) Flush() {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (r *dumpRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// dump dumps the response with its redacted body.
+func (r *dumpRecorder) dump(red *redactor) ([]byte, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+
+	// The length is the one of the redacted body.
+	r.header.Del("Content-Length")
+	body := red.Redact(r.body.Bytes())
+
+	return httputil.DumpResponse(&http.Response{
+		StatusCode:    r.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}, true)
+}
+
+// save saves the queued dumps.
+func (d *dumper) save() {
+	for dump := range d.queue {
+		if err := d.store.Save(context.Background(), dump); err != nil {
+			logger.Error("save dump failed",
+				slog.String("id", dump.ID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// sweep deletes the dumps past the retention every interval.
+func (d *dumper) sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		n, err := d.store.Prune(ctx, time.Now(), d.maxFiles, d.maxAge)
+		if err != nil {
+			logger.Error("sweep dumps failed", slog.String("error", err.Error()))
+		}
+		if n > 0 {
+			logger.Info("dumps swept", slog.Int("count", n))
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+// dumpStore stores the dumps of the requests, as request-{id}.txt and
+// response-{id}.txt.
+type dumpStore interface {
+	Save(ctx context.Context, d dump) error
+
+	// Get returns the dump of the request ID, or an error wrapping
+	// os.ErrNotExist.
+	Get(ctx context.Context, id string) (*dump, error)
+
+	// Prune deletes the dumps older than maxAge, and the oldest ones past
+	// maxFiles, and returns how many were deleted. Zero limits are
+	// unlimited.
+	Prune(ctx context.Context, now time.Time, maxFiles int, maxAge time.Duration) (int, error)
+}
+
+// newDumpStore returns the store of the reference, e.g. file:./data,
+// sqlite:dumps.db, gcs:bucket/prefix or s3:bucket/prefix.
+func newDumpStore(ref string) (dumpStore, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid dump store %q, expected file:, sqlite:, gcs: or s3: followed by the directory, database or bucket", ref)
+	}
+
+	switch scheme {
+	case "file":
+		if err := os.MkdirAll(name, 0o700); err != nil {
+			return nil, err
+		}
+
+		return fileDumps{dir: name}, nil
+	case "sqlite":
+		return openSQLiteDumps(name)
+	case "gcs":
+		bucket, prefix := splitBucket(name)
+		return &gcsDumps{bucket: bucket, prefix: prefix}, nil
+	case "s3":
+		bucket, prefix := splitBucket(name)
+		return newS3Dumps(bucket, prefix)
+	default:
+		return nil, fmt.Errorf("invalid dump store %q, expected file:, sqlite:, gcs: or s3: followed by the directory, database or bucket", ref)
+	}
+}
+
+// splitBucket splits the bucket and the prefix of its objects, which ends
+// with a slash.
+func splitBucket(name string) (bucket, prefix string) {
+	bucket, prefix, _ = strings.Cut(name, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return bucket, prefix
+}
+
+// dumpFileName returns the file name of the request ID, which is sent by the
+// clients, so that it can't escape the directory.
+func dumpFileName(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+
+		return '_'
+	}, id) + ".txt"
+}
+
+// storedDump is a dump listed by a store, by the file name of its ID.
+type storedDump struct {
+	name string
+	time time.Time
+}
+
+// expiredDumps returns the dumps older than maxAge, and the oldest ones past
+// maxFiles.
+func expiredDumps(dumps []storedDump, now time.Time, maxFiles int, maxAge time.Duration) []storedDump {
+	// Newest first.
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].time.After(dumps[j].time)
+	})
+
+	var expired []storedDump
+	for i, d := range dumps {
+		if (maxAge > 0 && now.Sub(d.time) > maxAge) || (maxFiles > 0 && i >= maxFiles) {
+			expired = append(expired, d)
+		}
+	}
+
+	return expired
+}
+
+// fileDumps stores the dumps in a directory.
+type fileDumps struct {
+	dir string
+}
+
+func (s fileDumps) Save(ctx context.Context, d dump) error {
+	name := dumpFileName(d.ID)
+
+	return errors.Join(
+		writeDumpFile(filepath.Join(s.dir, "request-"+name), d.Request, d.Time),
+		writeDumpFile(filepath.Join(s.dir, "response-"+name), d.Response, d.Time),
+	)
+}
+
+func writeDumpFile(path string, b []byte, t time.Time) error {
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+
+	// The retention uses the time of the request.
+	return os.Chtimes(path, t, t)
+}
+
+func (s fileDumps) Get(ctx context.Context, id string) (*dump, error) {
+	name := dumpFileName(id)
+
+	req, err := os.ReadFile(filepath.Join(s.dir, "request-"+name))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := os.ReadFile(filepath.Join(s.dir, "response-"+name))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filepath.Join(s.dir, "request-"+name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &dump{ID: id, Time: info.ModTime(), Request: req, Response: res}, nil
+}
+
+func (s fileDumps) Prune(ctx context.Context, now time.Time, maxFiles int, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var dumps []storedDump
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), "request-")
+		if !ok || e.IsDir() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		dumps = append(dumps, storedDump{name: name, time: info.ModTime()})
+	}
+
+	expired := expiredDumps(dumps, now, maxFiles, maxAge)
+
+	var errs []error
+	for _, d := range expired {
+		for _, prefix := range []string{"request-", "response-"} {
+			if err := os.Remove(filepath.Join(s.dir, prefix+d.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return len(expired), errors.Join(errs...)
+}
+
+// gcsDumps stores the dumps in a Google Cloud Storage bucket under a prefix,
+// authenticated with the application default credentials.
+type gcsDumps struct {
+	bucket string
+	prefix string
+
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+const gcsURL = "https://storage.googleapis.com"
+
+func (s *gcsDumps) do(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
+	s.once.Do(func() {
+		s.client, s.err = google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/devstorage.read_write")
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := googleapi.CheckResponse(res); err != nil {
+		res.Body.Close()
+
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", os.ErrNotExist, err)
+		}
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *gcsDumps) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcsURL, s.bucket, url.PathEscape(s.prefix+name))
+}
+
+func (s *gcsDumps) Save(ctx context.Context, d dump) error {
+	name := dumpFileName(d.ID)
+
+	for _, obj := range []struct {
+		name string
+		body []byte
+	}{
+		{"request-" + name, d.Request},
+		{"response-" + name, d.Response},
+	} {
+		u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", gcsURL, s.bucket, url.QueryEscape(s.prefix+obj.name))
+		res, err := s.do(ctx, http.MethodPost, u, bytes.NewReader(obj.body))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+
+	return nil
+}
+
+func (s *gcsDumps) read(ctx context.Context, name string) ([]byte, time.Time, error) {
+	res, err := s.do(ctx, http.MethodGet, s.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	t, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return b, t, nil
+}
+
+func (s *gcsDumps) Get(ctx context.Context, id string) (*dump, error) {
+	name := dumpFileName(id)
+
+	req, t, err := s.read(ctx, "request-"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := s.read(ctx, "response-"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dump{ID: id, Time: t, Request: req, Response: res}, nil
+}
+
+func (s *gcsDumps) Prune(ctx context.Context, now time.Time, maxFiles int, maxAge time.Duration) (int, error) {
+	var dumps []storedDump
+
+	var pageToken string
+	for {
+		q := url.Values{
+			"prefix": {s.prefix + "request-"},
+			"fields": {"items(name,timeCreated),nextPageToken"},
+		}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+
+		res, err := s.do(ctx, http.MethodGet, fmt.Sprintf("%s/storage/v1/b/%s/o?%s", gcsURL, s.bucket, q.Encode()), nil)
+		if err != nil {
+			return 0, err
+		}
+
+		var page struct {
+			Items []struct {
+				Name        string    `json:"name"`
+				TimeCreated time.Time `json:"timeCreated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, item := range page.Items {
+			dumps = append(dumps, storedDump{
+				name: strings.TrimPrefix(item.Name, s.prefix+"request-"),
+				time: item.TimeCreated,
+			})
+		}
+
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+
+	expired := expiredDumps(dumps, now, maxFiles, maxAge)
+
+	var errs []error
+	for _, d := range expired {
+		for _, prefix := range []string{"request-", "response-"} {
+			res, err := s.do(ctx, http.MethodDelete, s.objectURL(prefix+d.name), nil)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			res.Body.Close()
+		}
+	}
+
+	return len(expired), errors.Join(errs...)
+}
+
+// s3Dumps stores the dumps in an Amazon S3 bucket under a prefix, or in an
+// S3 compatible store such as MinIO, with the static credentials of the
+// environment.
+type s3Dumps struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint *url.URL
+	creds    awsCredentials
+
+	// pathStyle puts the bucket in the path instead of the host, for the
+	// custom endpoints.
+	pathStyle bool
+}
+
+// newS3Dumps returns the store of the bucket. The region is read from
+// AWS_REGION, and AWS_ENDPOINT_URL_S3 selects an S3 compatible store.
+func newS3Dumps(bucket, prefix string) (*s3Dumps, error) {
+	s := &s3Dumps{
+		bucket: bucket,
+		prefix: prefix,
+		region: envOr("AWS_REGION", envOr("AWS_DEFAULT_REGION", "us-east-1")),
+		creds: awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if s.creds.AccessKeyID == "" || s.creds.SecretAccessKey == "" {
+		return nil, errors.New("the s3 dump store requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := envOr("AWS_ENDPOINT_URL_S3", os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	} else {
+		s.pathStyle = true
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %q: %w", endpoint, err)
+	}
+	s.endpoint = u
+
+	return s, nil
+}
+
+// url returns the URL of the object key of the bucket, or of the bucket
+// when empty.
+func (s *s3Dumps) url(key string, q url.Values) string {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+func (s *s3Dumps) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, s.creds, s.region, "s3", sha256Hex(body), time.Now())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		var e struct {
+			Code    string
+			Message string
+		}
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		_ = xml.Unmarshal(b, &e)
+
+		err := fmt.Errorf("s3: %s %s: %s %s: %s", method, url, res.Status, e.Code, e.Message)
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", os.ErrNotExist, err)
+		}
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *s3Dumps) Save(ctx context.Context, d dump) error {
+	name := dumpFileName(d.ID)
+
+	for _, obj := range []struct {
+		name string
+		body []byte
+	}{
+		{"request-" + name, d.Request},
+		{"response-" + name, d.Response},
+	} {
+		res, err := s.do(ctx, http.MethodPut, s.url(s.prefix+obj.name, nil), obj.body)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+	}
+
+	return nil
+}
+
+func (s *s3Dumps) read(ctx context.Context, name string) ([]byte, time.Time, error) {
+	res, err := s.do(ctx, http.MethodGet, s.url(s.prefix+name, nil), nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	t, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return b, t, nil
+}
+
+func (s *s3Dumps) Get(ctx context.Context, id string) (*dump, error) {
+	name := dumpFileName(id)
+
+	req, t, err := s.read(ctx, "request-"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := s.read(ctx, "response-"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dump{ID: id, Time: t, Request: req, Response: res}, nil
+}
+
+func (s *s3Dumps) Prune(ctx context.Context, now time.Time, maxFiles int, maxAge time.Duration) (int, error) {
+	var dumps []storedDump
+
+	var token string
+	for {
+		q := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.prefix + "request-"},
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		res, err := s.do(ctx, http.MethodGet, s.url("", q), nil)
+		if err != nil {
+			return 0, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, obj := range page.Contents {
+			dumps = append(dumps, storedDump{
+				name: strings.TrimPrefix(obj.Key, s.prefix+"request-"),
+				time: obj.LastModified,
+			})
+		}
+
+		if token = page.NextContinuationToken; !page.IsTruncated || token == "" {
+			break
+		}
+	}
+
+	expired := expiredDumps(dumps, now, maxFiles, maxAge)
+
+	var errs []error
+	for _, d := range expired {
+		for _, prefix := range []string{"request-", "response-"} {
+			res, err := s.do(ctx, http.MethodDelete, s.url(s.prefix+prefix+d.name, nil), nil)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			res.Body.Close()
+		}
+	}
+
+	return len(expired), errors.Join(errs...)
+}
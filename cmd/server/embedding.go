@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// base64Embedding is an embedding encoded as the base64 of its
+// little-endian float32 values, which the OpenAI SDKs request by default.
+type base64Embedding struct {
+	Object    string `json:"object"`
+	Embedding string `json:"embedding"`
+	Index     int    `json:"index"`
+}
+
+type base64EmbeddingResponse struct {
+	Object string                `json:"object"`
+	Data   []base64Embedding     `json:"data"`
+	Model  openai.EmbeddingModel `json:"model"`
+	Usage  openai.Usage          `json:"usage"`
+}
+
+func encodeEmbedding(values []float32) string {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(v))
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func (h openaiHandler) Embeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.allowResidency(w, r) {
+		return
+	}
+
+	ctx := h.requestContext(r)
+	info := goai.RequestInfoFromContext(ctx)
+
+	var req openai.EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !allowModel(w, r, string(req.Model)) {
+		return
+	}
+
+	if !h.checkBudget(w, r, info) {
+		return
+	}
+
+	res, err := h.adapter.Embeddings(ctx, req)
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "embeddings failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	h.recordUsage(r, info, openai.ChatCompletionRequest{Model: string(req.Model), User: req.User}, res.Usage)
+
+	if req.EncodingFormat != openai.EmbeddingEncodingFormatBase64 {
+		writeJSON(w, res)
+		return
+	}
+
+	b64 := base64EmbeddingResponse{
+		Object: res.Object,
+		Data:   make([]base64Embedding, len(res.Data)),
+		Model:  res.Model,
+		Usage:  res.Usage,
+	}
+	for i, e := range res.Data {
+		b64.Data[i] = base64Embedding{
+			Object:    e.Object,
+			Embedding: encodeEmbedding(e.Embedding),
+			Index:     e.Index,
+		}
+	}
+
+	writeJSON(w, b64)
+}
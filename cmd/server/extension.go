@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// requestExtensions are the non-OpenAI fields accepted in the request body.
+type requestExtensions struct {
+	TopK *int32 `json:"top_k"`
+
+	// Google are the Gemini parameters of the request, applied to the model
+	// along with the OpenAI parameters.
+	Google struct {
+		Grounding     bool   `json:"grounding"`
+		CodeExecution bool   `json:"code_execution"`
+		TopK          *int32 `json:"top_k"`
+		CachedContent string `json:"cached_content"`
+
+		// SafetySettings accept the Gemini names, e.g.
+		// HARM_CATEGORY_HARASSMENT and BLOCK_NONE, or the short ones.
+		SafetySettings []goai.SafetySetting `json:"safety_settings"`
+	} `json:"google"`
+}
+
+// parseExtensions reads the extensions from the request body and the
+// X-Gemini-* headers. The body takes precedence over the headers.
+func parseExtensions(body []byte, h http.Header) (goai.Extensions, error) {
+	var ext requestExtensions
+	if err := json.Unmarshal(body, &ext); err != nil {
+		return goai.Extensions{}, err
+	}
+
+	if ext.TopK == nil {
+		ext.TopK = ext.Google.TopK
+	}
+
+	if ext.TopK == nil {
+		if v := h.Get("X-Gemini-Top-K"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return goai.Extensions{}, fmt.Errorf("invalid X-Gemini-Top-K: %q", v)
+			}
+
+			topK := int32(n)
+			ext.TopK = &topK
+		}
+	}
+
+	if ext.TopK != nil && *ext.TopK < 1 {
+		return goai.Extensions{}, fmt.Errorf("top_k must be positive, got %d", *ext.TopK)
+	}
+
+	for i, s := range ext.Google.SafetySettings {
+		if err := s.Validate(); err != nil {
+			return goai.Extensions{}, fmt.Errorf("google.safety_settings[%d]: %w", i, err)
+		}
+	}
+
+	return goai.Extensions{
+		TopK:           ext.TopK,
+		Grounding:      ext.Google.Grounding,
+		CodeExecution:  ext.Google.CodeExecution,
+		SafetySettings: ext.Google.SafetySettings,
+		CachedContent:  ext.Google.CachedContent,
+	}, nil
+}
+
+// knownParams are the fields of the request body that are decoded, either
+// as OpenAI parameters or as extensions.
+var knownParams = sync.OnceValue(func() map[string]bool {
+	known := make(map[string]bool)
+	for _, t := range []reflect.Type{
+		reflect.TypeOf(openai.ChatCompletionRequest{}),
+		reflect.TypeOf(requestExtensions{}),
+	} {
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				known[name] = true
+			}
+		}
+	}
+
+	return known
+})
+
+// unknownParams returns the fields of the request body that are not
+// decoded, e.g. the best_of and suffix parameters of the completions API,
+// sorted by name.
+func unknownParams(body []byte) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	var params []string
+	for name := range fields {
+		if !knownParams()[name] {
+			params = append(params, name)
+		}
+	}
+	sort.Strings(params)
+
+	return params, nil
+}
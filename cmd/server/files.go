@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// maxFileSize is the largest file accepted by the Gemini File API.
+	maxFileSize = 2 << 30
+
+	// maxFileMemory is the part of an upload kept in memory, the rest is
+	// stored in temporary files.
+	maxFileMemory = 32 << 20
+)
+
+// filesResponse is the OpenAI list files response.
+type filesResponse struct {
+	Object string        `json:"object"`
+	Data   []openai.File `json:"data"`
+}
+
+// deleteFileResponse is the OpenAI delete file response.
+type deleteFileResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// Files serves the OpenAI files API, backed by the Gemini File API:
+// uploading and listing on /v1/files, and retrieving and deleting on
+// /v1/files/{id}.
+func (h openaiHandler) Files(w http.ResponseWriter, r *http.Request) {
+	if !h.allowResidency(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	id := strings.TrimPrefix(path, "/files/")
+	switch {
+	case path == "/files" && r.Method == http.MethodPost:
+		h.uploadFile(w, r)
+	case path == "/files" && r.Method == http.MethodGet:
+		h.listFiles(w, r)
+	case path == "/files":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case id == "" || strings.Contains(id, "/"):
+		catchAll(w, r)
+	case r.Method == http.MethodGet:
+		h.getFile(w, r, id)
+	case r.Method == http.MethodDelete:
+		h.deleteFile(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h openaiHandler) uploadFile(w http.ResponseWriter, r *http.Request) {
+	ctx := h.requestContext(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
+	if err := r.ParseMultipartForm(maxFileMemory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	purpose := r.FormValue("purpose")
+	if purpose == "" {
+		http.Error(w, "purpose is required", http.StatusBadRequest)
+		return
+	}
+
+	// Clients usually send application/octet-stream, so the extension is
+	// more reliable.
+	mimeType := mime.TypeByExtension(filepath.Ext(header.Filename))
+	if mimeType == "" {
+		mimeType = header.Header.Get("Content-Type")
+	}
+
+	res, err := h.adapter.UploadFile(ctx, header.Filename, mimeType, purpose, f)
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "upload file failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, res)
+}
+
+func (h openaiHandler) listFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := h.requestContext(r)
+
+	files, err := h.adapter.ListFiles(ctx)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "list files failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, filesResponse{
+		Object: "list",
+		Data:   files,
+	})
+}
+
+func (h openaiHandler) getFile(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := h.requestContext(r)
+
+	res, err := h.adapter.GetFile(ctx, id)
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "get file failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, res)
+}
+
+func (h openaiHandler) deleteFile(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := h.requestContext(r)
+
+	if err := h.adapter.DeleteFile(ctx, id); err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "delete file failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, deleteFileResponse{
+		ID:      id,
+		Object:  "file",
+		Deleted: true,
+	})
+}
+
+// fileURL returns the URL of a file part, either the file data URL or the
+// Gemini URI of the uploaded file.
+func fileURL(raw json.RawMessage, fileURI func(id string) string) (string, error) {
+	var file struct {
+		FileID   string `json:"file_id"`
+		FileData string `json:"file_data"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return "", fmt.Errorf("invalid file: %w", err)
+	}
+
+	switch {
+	case file.FileID != "":
+		return fileURI(file.FileID), nil
+	case strings.HasPrefix(file.FileData, "data:"):
+		return file.FileData, nil
+	default:
+		return "", fmt.Errorf("file must have a file_id or a file_data data URL")
+	}
+}
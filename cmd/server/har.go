@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/.
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// harTimings are zero, as the dumps don't record them.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// toHAR converts a dumped request and response to a HAR file with a single
+// entry.
+func toHAR(d *dump) (*har, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(d.Request)))
+	if err != nil {
+		return nil, fmt.Errorf("read dumped request: %w", err)
+	}
+
+	reqBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read dumped request: %w", err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(d.Response)), req)
+	if err != nil {
+		return nil, fmt.Errorf("read dumped response: %w", err)
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read dumped response: %w", err)
+	}
+
+	entry := harEntry{
+		StartedDateTime: d.Time,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         "http://" + req.Host + req.RequestURI,
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  http.StatusText(res.StatusCode),
+			HTTPVersion: res.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(res.Header),
+			Content: harContent{
+				Size:     len(resBody),
+				MimeType: res.Header.Get("Content-Type"),
+				Text:     string(resBody),
+			},
+			HeadersSize: -1,
+			BodySize:    len(resBody),
+		},
+		Comment: "request ID " + d.ID,
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	if len(reqBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(reqBody),
+		}
+	}
+
+	return &har{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "go-gemini", Version: "1.0"},
+			Entries: []harEntry{entry},
+		},
+	}, nil
+}
+
+// harHeaders returns the headers in the order of their names.
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for _, k := range sortedKeys(h) {
+		for _, v := range h[k] {
+			headers = append(headers, harNameValue{Name: k, Value: v})
+		}
+	}
+
+	return headers
+}
+
+// Requests returns the recorded request of the ID as a HAR file, e.g.
+// GET /admin/requests/{id}.har, to inspect it in the browser devtools.
+func (h adminHandler) Requests(w http.ResponseWriter, r *http.Request) {
+	if h.dumps == nil {
+		http.Error(w, "The requests are not recorded, see -dump-store.", http.StatusNotFound)
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/requests/"), ".har")
+	switch {
+	case !ok || id == "" || strings.Contains(id, "/"):
+		catchAll(w, r)
+		return
+	case r.Method != http.MethodGet:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	d, err := h.dumps.Get(r.Context(), id)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Request %q not found.", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "get dump failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := toHAR(d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(dumpFileName(id), ".txt")+".har"))
+	writeJSON(w, res)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+func (h openaiHandler) ImageGeneration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.allowResidency(w, r) {
+		return
+	}
+
+	ctx := h.requestContext(r)
+	info := goai.RequestInfoFromContext(ctx)
+
+	var req openai.ImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !allowModel(w, r, req.Model) {
+		return
+	}
+
+	if !h.checkBudget(w, r, info) {
+		return
+	}
+
+	images, err := h.adapter.GenerateImages(ctx, req)
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "image generation failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	res := openai.ImageResponse{
+		Created: time.Now().Unix(),
+		Data:    make([]openai.ImageResponseDataInner, len(images)),
+	}
+	for i, img := range images {
+		data, err := h.imageData(req.ResponseFormat, img)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Data[i] = data
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// imageData returns the image inline for b64_json, and as a signed URL
+// otherwise. Without a media store, the URL is a data URL.
+func (h openaiHandler) imageData(format string, img goai.Image) (openai.ImageResponseDataInner, error) {
+	b64 := base64.StdEncoding.EncodeToString(img.Data)
+	if format == openai.CreateImageResponseFormatB64JSON {
+		return openai.ImageResponseDataInner{B64JSON: b64}, nil
+	}
+
+	if h.media == nil {
+		return openai.ImageResponseDataInner{URL: "data:" + img.MIMEType + ";base64," + b64}, nil
+	}
+
+	id, err := h.media.Put(img.Data, img.MIMEType)
+	if err != nil {
+		return openai.ImageResponseDataInner{}, err
+	}
+
+	return openai.ImageResponseDataInner{URL: h.media.SignedURL(id)}, nil
+}
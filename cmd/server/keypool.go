@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// keyBalancing is how the key pool distributes the requests.
+type keyBalancing string
+
+const (
+	// keyBalancingRoundRobin picks the keys in turn.
+	keyBalancingRoundRobin keyBalancing = "round-robin"
+
+	// keyBalancingLeastLoaded picks the key with the fewest in-flight
+	// requests, in turn when they are equal.
+	keyBalancingLeastLoaded keyBalancing = "least-loaded"
+)
+
+// keyPool distributes the requests without an API key across the upstream
+// keys, e.g. to aggregate the free tier quotas of several projects. The keys
+// that are exhausted or revoked cool down, and their requests are sent again
+// with another key.
+type keyPool struct {
+	balancing keyBalancing
+	cooldown  time.Duration
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+// pooledKey is an upstream key and its load.
+type pooledKey struct {
+	secret      *secret
+	inflight    int
+	requests    int64
+	quotaErrors int64
+
+	// coolUntil is when the key is used again after it failed with
+	// lastError.
+	coolUntil time.Time
+	lastError string
+}
+
+func (k *pooledKey) cooling(now time.Time) bool {
+	return now.Before(k.coolUntil)
+}
+
+// newKeyPool returns the pool of the keys, or nil when there are none.
+func newKeyPool(balancing keyBalancing, cooldown time.Duration, secrets []*secret) *keyPool {
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	p := &keyPool{balancing: balancing, cooldown: cooldown}
+	for _, s := range secrets {
+		p.keys = append(p.keys, &pooledKey{secret: s})
+	}
+
+	return p
+}
+
+// Default returns the first key. It identifies the requests without an API
+// key in the rate limits, priorities and checkpoints, whichever key serves
+// them.
+func (p *keyPool) Default() string {
+	return p.keys[0].secret.Value()
+}
+
+// Values returns the current values of the keys.
+func (p *keyPool) Values() []string {
+	vs := make([]string, len(p.keys))
+	for i, k := range p.keys {
+		vs[i] = k.secret.Value()
+	}
+
+	return vs
+}
+
+// Secrets returns the secrets of the keys, to refresh them.
+func (p *keyPool) Secrets() []*secret {
+	ss := make([]*secret, len(p.keys))
+	for i, k := range p.keys {
+		ss[i] = k.secret
+	}
+
+	return ss
+}
+
+func (p *keyPool) has(apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+
+	for _, k := range p.keys {
+		if k.secret.Value() == apiKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acquire picks a key that was not tried and is not cooling down, and counts
+// the request in flight until it is released. The first key is picked among
+// all keys when they are all cooling down, rather than failing the request.
+// It returns nil when there is no key left.
+func (p *keyPool) acquire(tried map[*pooledKey]bool) *pooledKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var k *pooledKey
+	for _, cooling := range []bool{false, true} {
+		if cooling && len(tried) > 0 {
+			break
+		}
+
+		for i := range p.keys {
+			c := p.keys[(p.next+i)%len(p.keys)]
+			if tried[c] || (!cooling && c.cooling(now)) {
+				continue
+			}
+
+			if k == nil || (p.balancing == keyBalancingLeastLoaded && c.inflight < k.inflight) {
+				k = c
+			}
+		}
+
+		if k != nil {
+			break
+		}
+	}
+	if k == nil {
+		return nil
+	}
+	p.next++
+
+	k.inflight++
+	k.requests++
+
+	return k
+}
+
+// release ends the request of the key. The keys that fail with an auth or
+// quota error cool down, and it reports whether the request should be sent
+// again with another key.
+func (p *keyPool) release(ctx context.Context, k *pooledKey, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k.inflight--
+
+	status := goai.HTTPStatusCode(err)
+	if status == http.StatusTooManyRequests {
+		k.quotaErrors++
+	}
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+	default:
+		if err == nil && k.lastError != "" && !k.cooling(time.Now()) {
+			logger.InfoContext(ctx, "upstream key recovered",
+				slog.String("key", fingerprint(k.secret.Value())),
+				slog.String("secret", k.secret.ref),
+			)
+			k.lastError = ""
+		}
+
+		return false
+	}
+
+	// Only the first failure is logged, as the concurrent requests of the
+	// key fail too.
+	if !k.cooling(time.Now()) {
+		logger.WarnContext(ctx, "upstream key unhealthy",
+			slog.String("key", fingerprint(k.secret.Value())),
+			slog.String("secret", k.secret.ref),
+			slog.Int("status", status),
+			slog.Duration("cooldown", p.cooldown),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	k.coolUntil = time.Now().Add(p.cooldown)
+	k.lastError = err.Error()
+
+	return true
+}
+
+// do calls fn with a key of the pool when the request uses one, and again
+// with another key while the keys are exhausted or revoked. The key that
+// succeeded stays in flight until done is called with the result.
+func (p *keyPool) do(ctx context.Context, fn func() error) (done func(error), err error) {
+	info := goai.RequestInfoFromContext(ctx)
+	if !p.has(info.APIKey) {
+		return func(error) {}, fn()
+	}
+
+	tried := make(map[*pooledKey]bool)
+	for {
+		k := p.acquire(tried)
+		if k == nil {
+			return func(error) {}, err
+		}
+		tried[k] = true
+
+		info.APIKey = k.secret.Value()
+		if err = fn(); err == nil {
+			return func(err error) {
+				p.release(ctx, k, err)
+			}, nil
+		}
+
+		if !p.release(ctx, k, err) || ctx.Err() != nil {
+			return func(error) {}, err
+		}
+	}
+}
+
+// keyStats is the load of an upstream key. The key is identified by its
+// fingerprint and secret reference, never its value.
+type keyStats struct {
+	Key         string     `json:"key"`
+	Secret      string     `json:"secret"`
+	Healthy     bool       `json:"healthy"`
+	InFlight    int        `json:"in_flight"`
+	Requests    int64      `json:"requests"`
+	QuotaErrors int64      `json:"quota_errors"`
+	CoolUntil   *time.Time `json:"cool_until,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+func (p *keyPool) Stats() []keyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]keyStats, len(p.keys))
+	for i, k := range p.keys {
+		stats[i] = keyStats{
+			Key:         fingerprint(k.secret.Value()),
+			Secret:      k.secret.ref,
+			Healthy:     !k.cooling(now),
+			InFlight:    k.inflight,
+			Requests:    k.requests,
+			QuotaErrors: k.quotaErrors,
+			LastError:   k.lastError,
+		}
+		if k.cooling(now) {
+			coolUntil := k.coolUntil
+			stats[i].CoolUntil = &coolUntil
+		}
+	}
+
+	return stats
+}
+
+// pooledClient sends the requests that use a key of the pool with the key
+// picked by the pool. The files are stored per project, so the file
+// endpoints always use the default key.
+type pooledClient struct {
+	openaiClient
+	pool *keyPool
+}
+
+func (c pooledClient) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	var res *openai.ChatCompletionResponse
+	done, err := c.pool.do(ctx, func() (err error) {
+		res, err = c.openaiClient.ChatCompletion(ctx, req)
+		return err
+	})
+	done(nil)
+
+	return res, err
+}
+
+// ChatCompletionStream counts the stream in flight until it ends. Streams
+// fail over to another key until the first chunk, which the adapter receives
+// before returning.
+func (c pooledClient) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	var ch chan openai.ChatCompletionStreamResponse
+	done, err := c.pool.do(ctx, func() (err error) {
+		ch, err = c.openaiClient.ChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		defer done(nil)
+
+		for res := range ch {
+			select {
+			case out <- res:
+			case <-ctx.Done():
+				// The stream of the key ends with the context.
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (c pooledClient) CountPromptTokens(ctx context.Context, req openai.ChatCompletionRequest) (int, error) {
+	var n int
+	done, err := c.pool.do(ctx, func() (err error) {
+		n, err = c.openaiClient.CountPromptTokens(ctx, req)
+		return err
+	})
+	done(nil)
+
+	return n, err
+}
+
+func (c pooledClient) Moderations(ctx context.Context, inputs []string) (*openai.ModerationResponse, error) {
+	var res *openai.ModerationResponse
+	done, err := c.pool.do(ctx, func() (err error) {
+		res, err = c.openaiClient.Moderations(ctx, inputs)
+		return err
+	})
+	done(nil)
+
+	return res, err
+}
+
+func (c pooledClient) GenerateImages(ctx context.Context, req openai.ImageRequest) ([]goai.Image, error) {
+	var images []goai.Image
+	done, err := c.pool.do(ctx, func() (err error) {
+		images, err = c.openaiClient.GenerateImages(ctx, req)
+		return err
+	})
+	done(nil)
+
+	return images, err
+}
+
+// UpstreamKeys returns the load of the upstream keys.
+func (h adminHandler) UpstreamKeys(w http.ResponseWriter, r *http.Request) {
+	if h.upstreamKeys == nil {
+		http.Error(w, "no upstream keys are configured", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, h.upstreamKeys.Stats())
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// requestLabels returns the labels used to attribute the request, from the
+// OpenAI metadata and the configured headers. The metadata takes precedence.
+func requestLabels(r *http.Request, req openai.ChatCompletionRequest, headers []string) map[string]string {
+	labels := make(map[string]string)
+	for _, h := range headers {
+		if v := r.Header.Get(h); v != "" {
+			labels[strings.ToLower(h)] = v
+		}
+	}
+
+	for k, v := range req.Metadata {
+		labels[k] = v
+	}
+
+	if len(labels) == 0 {
+		return nil
+	}
+
+	return labels
+}
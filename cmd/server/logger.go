@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+type logFormat string
+
+const (
+	logFormatJSON logFormat = "json"
+	logFormatText logFormat = "text"
+)
+
+// newLogger returns the logger of the server, which adds the request IDs to
+// the lines.
+func newLogger(format logFormat, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == logFormatText {
+		return slog.New(contextHandler{slog.NewTextHandler(os.Stdout, opts)})
+	}
+
+	return slog.New(contextHandler{slog.NewJSONHandler(os.Stdout, opts)})
+}
@@ -2,45 +2,448 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/alextanhongpin/go-gemini/goaitest"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type openaiClient interface {
 	ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)
 	ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error)
+	Moderations(ctx context.Context, inputs []string) (*openai.ModerationResponse, error)
+	GenerateImages(ctx context.Context, req openai.ImageRequest) ([]goai.Image, error)
+	UploadFile(ctx context.Context, filename, mimeType, purpose string, r io.Reader) (*openai.File, error)
+	ListFiles(ctx context.Context) ([]openai.File, error)
+	GetFile(ctx context.Context, id string) (*openai.File, error)
+	DeleteFile(ctx context.Context, id string) error
+	FileURI(id string) string
+	Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error)
+	ListModels(ctx context.Context) ([]openai.Model, error)
+	CountPromptTokens(ctx context.Context, req openai.ChatCompletionRequest) (int, error)
 }
 
 var logger *slog.Logger
 
 func init() {
-	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	logger = newLogger(logFormatJSON, slog.LevelInfo)
+}
+
+func usagePath() string {
+	return envOr("USAGE_PATH", "usage.jsonl")
 }
 
 func main() {
-	a := goai.NewAdapter()
+	if len(os.Args) > 1 && os.Args[1] == "usage-export" {
+		if err := exportUsageCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "virtual-keys" {
+		if err := virtualKeysCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		if err := compareCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replayCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "chat" {
+		if err := chatCmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if cfg.ValidateOnly {
+		fmt.Println("config is valid")
+		return
+	}
+
+	logger = newLogger(cfg.LogFormat, cfg.LogLevel)
+	setupTracing(cfg.TraceLog)
+
+	usage := newUsageStore(usagePath())
+
+	c, err := goai.NewCache(cfg.CacheURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	a, err := newAdapter(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	a.SetLogger(logger)
+	a.SetCache(c)
+
+	var upstreamKeys []*secret
+	for _, ref := range cfg.UpstreamKeys {
+		s, err := newSecret(context.Background(), ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		upstreamKeys = append(upstreamKeys, s)
+	}
+
+	pool := newKeyPool(cfg.KeyBalancing, cfg.KeyCooldown, upstreamKeys)
+	if pool != nil {
+		go refreshSecrets(context.Background(), cfg.SecretRefresh, pool.Secrets())
+		cfg.WarmupKeys = append(cfg.WarmupKeys, pool.Values()...)
+	}
+
+	if len(cfg.WarmupKeys) > 0 && !cfg.Mock {
+		go warmup(a, cfg.WarmupKeys)
+	}
+
+	m := newMetrics()
+	m.GaugeFunc("gemini_proxy_clients", "Gemini clients, one per upstream API key.", func() float64 {
+		return float64(a.Clients())
+	})
+	m.CounterFunc("gemini_proxy_client_evictions_total", "Gemini clients closed when idle, too old, above the cache size or of an invalid API key.", func() float64 {
+		return float64(a.ClientStats().Evictions)
+	})
+
+	var client openaiClient = a
+	if cfg.Mock {
+		client, err = newMockClient(cfg.MockResponses, cfg.MockLatency, cfg.MockTPS)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.Warn("mock mode enabled, the completions are not sent to gemini")
+	}
+
 	h := new(openaiHandler)
-	h.adapter = a
+	h.metrics = m
+	h.adapter = instrumentedClient{openaiClient: client, metrics: m}
+	if pool != nil {
+		h.adapter = pooledClient{openaiClient: h.adapter, pool: pool}
+	}
+	h.usage = usage
+	h.degraded = newDegradedMode(cfg.Degraded, c)
+	h.labelHeaders = cfg.LabelHeaders
+	h.payloadLogging = cfg.PayloadLogging
+	h.streamTPS = cfg.StreamTokensPerSecond
+	h.checkpoints = c
+	h.checkpointInterval = cfg.CheckpointInterval
+	h.conversations = newConversationGuard(cfg.ConversationMode)
+	h.residency = cfg.Residency
+	h.upstreamKeys = pool
+	h.maxBodySize = cfg.MaxBodySize
+	h.writeTimeout = cfg.WriteTimeout
+	h.codeExecution = cfg.CodeExecution
+	h.responses = newResponseCache(c, cfg.ResponseCacheTTL)
+	if h.responses != nil {
+		m.CounterFunc("gemini_proxy_response_cache_hits_total", "Chat responses served from the response cache.", func() float64 {
+			return float64(h.responses.Stats().Hits)
+		})
+		m.CounterFunc("gemini_proxy_response_cache_misses_total", "Chat responses not found in the response cache.", func() float64 {
+			return float64(h.responses.Stats().Misses)
+		})
+	}
+	h.limiter = newRateLimiter(c, cfg.RPM, cfg.TPM)
+	go watchConfig(context.Background(), os.Args[1:], cfg.ConfigFile, a, h.limiter)
+	h.concurrency = newConcurrencyLimiter(cfg.MaxConcurrency, cfg.QueueTimeout)
+	h.timeout = cfg.RequestTimeout
+	h.paramMode = cfg.ParamMode
+	h.debugResponses = cfg.DebugResponses
+	h.passthrough, err = newPassthrough(context.Background(), cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if h.passthrough != nil {
+		go refreshSecrets(context.Background(), cfg.SecretRefresh, []*secret{h.passthrough.key})
+	}
+	h.priorities = cfg.Priorities
+	h.tenants = cfg.Tenants
+	h.pricing = cfg.Pricing
+	if cfg.Budgets != nil || cfg.VirtualKeysPath != "" {
+		h.budgets = newBudgetTracker(usage, cfg.Budgets)
+	}
+	if cfg.VirtualKeysPath != "" {
+		h.virtualKeys, err = newVirtualKeyStore(cfg.VirtualKeysPath, cfg.SecretRefresh)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if cfg.MediaDir != "" {
+		h.media, err = newMediaStore(cfg.MediaDir, cfg.MediaSecret, cfg.PublicURL, cfg.MediaTTL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	admin := adminHandler{
+		usage:         usage,
+		contextCaches: a,
+		responses:     h.responses,
+		upstreamKeys:  pool,
+		virtualKeys:   h.virtualKeys,
+		budgets:       h.budgets,
+	}
+	if cfg.DumpStore != "" {
+		admin.dumps, err = newDumpStore(cfg.DumpStore)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	faults := newChaos(cfg.ChaosRate, cfg.ChaosFaults, cfg.ChaosLatency)
+	if faults != nil {
+		logger.Warn("chaos enabled, faults are injected in the responses", slog.Float64("rate", faults.rate))
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/chat/completions", h.ChatCompletion)
+	handleAPI(mux, "/chat/completions", faults.wrap(h.authenticate(h.relaxStreamWrites(h.guardConversation(h.limitRequests(h.limitConcurrency(h.ChatCompletion)))))))
+	handleAPI(mux, "/moderations", faults.wrap(h.authenticate(h.limitRequests(h.limitConcurrency(h.Moderations)))))
+	handleAPI(mux, "/embeddings", faults.wrap(h.authenticate(h.limitRequests(h.limitConcurrency(h.Embeddings)))))
+	handleAPI(mux, "/images/generations", faults.wrap(h.authenticate(h.limitRequests(h.limitConcurrency(h.ImageGeneration)))))
+	handleAPI(mux, "/models", h.authenticate(h.Models))
+	handleAPI(mux, "/files", h.authenticate(h.Files))
+	handleAPI(mux, "/files/", h.authenticate(h.Files))
+	if cfg.CheckpointInterval > 0 {
+		handleAPI(mux, "/chat/completions/", h.authenticate(h.Partial))
+	}
+	mux.HandleFunc("/admin/usage", requireAdmin(adminToken, admin.Usage))
+	mux.HandleFunc("/admin/usage/export", requireAdmin(adminToken, admin.ExportUsage))
+	mux.HandleFunc("/admin/response-cache", requireAdmin(adminToken, admin.ResponseCacheStats))
+	mux.HandleFunc("/admin/context-caches", requireAdmin(adminToken, admin.ContextCaches))
+	mux.HandleFunc("/admin/context-caches/", requireAdmin(adminToken, admin.ContextCaches))
+	mux.HandleFunc("/admin/upstream-keys", requireAdmin(adminToken, admin.UpstreamKeys))
+	mux.HandleFunc("/admin/keys", requireAdmin(adminToken, admin.VirtualKeys))
+	mux.HandleFunc("/admin/keys/", requireAdmin(adminToken, admin.VirtualKeys))
+	mux.HandleFunc("/admin/budgets", requireAdmin(adminToken, admin.Budgets))
+	mux.HandleFunc("/admin/budgets/", requireAdmin(adminToken, admin.Budgets))
+	mux.HandleFunc("/admin/requests/", requireAdmin(adminToken, admin.Requests))
+	if h.media != nil {
+		mux.Handle("/media/", h.media)
+	}
+	if cfg.Debug {
+		handleDebug(mux, adminToken, a.Clients)
+	}
+
+	// The readiness is checked with the upstream keys, which are refreshed.
+	var ready *readiness
+	if !cfg.Mock {
+		keys := func() []string { return cfg.WarmupKeys }
+		switch {
+		case cfg.VertexAI != nil:
+			// Vertex AI uses the credentials of the proxy.
+			keys = func() []string { return []string{""} }
+		case pool != nil:
+			keys = pool.Values
+		}
+		ready = newReadiness(a, keys, cfg.ReadyTTL)
+	}
+	mux.Handle("/metrics", m)
 	mux.HandleFunc("/health", health)
+	mux.HandleFunc("/ready", ready.Ready)
+	mux.HandleFunc("/version", versionHandler)
 	mux.HandleFunc("/", catchAll)
 
-	logger.Info("Listening on port *:8080. press ctrl + c to cancel")
-	panic(http.ListenAndServe(":8080", mux))
+	handler := m.instrument(mux)
+	if admin.dumps != nil {
+		red, err := newRedactor(cfg.DumpRedaction)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		handler = newDumper(admin.dumps, red, cfg.DumpMaxFiles, cfg.DumpMaxAge).Handler(handler)
+	}
+	if cfg.Compress {
+		handler = compress(handler)
+	}
+	handler = newCORS(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders).Handler(handler)
+
+	tc, err := newTLSConfig(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ln, err := listen(cfg.Addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	srv := &http.Server{
+		Handler:           stripBasePath(cfg.BasePath, azureRoutes(cfg.MaxBodySize, serverHeader(traceRequests(mux, withRequestID(accessLog(handler)))))),
+		TLSConfig:         tc,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+
+	logger.Info("listening, press ctrl + c to cancel", slog.String("addr", ln.Addr().String()), slog.String("base_path", cfg.BasePath), slog.Bool("tls", tc != nil), slog.Bool("h2c", cfg.H2C), slog.String("version", getBuildInfo().Version))
+	if tc != nil {
+		// HTTP/2 is negotiated over TLS.
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil {
+		logger.Error("serve failed", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+}
+
+// listen listens on the address, explaining how to change it when the port
+// is taken.
+func listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("listen on %s: the port is already in use, set another one with -port or -addr", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+
+	return ln, nil
+}
+
+// newAdapter returns the adapter configured with the config.
+func newAdapter(cfg *config) (*goai.Adapter, error) {
+	a := goai.NewAdapter()
+	if err := a.SetConfig(adapterConfig(cfg)); err != nil {
+		return nil, err
+	}
+
+	t, err := newGeminiTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.SetHTTPClient(&http.Client{Transport: t})
+	a.SetClientCache(cfg.ClientCache)
+	if cfg.GeminiEndpoint != "" {
+		a.SetEndpoint(cfg.GeminiEndpoint)
+	}
+	if err := a.SetVertexAI(cfg.VertexAI); err != nil {
+		return nil, err
+	}
+	if cfg.FixturesDir != "" {
+		a.SetTransport(goaitest.NewRecorder(cfg.FixturesDir, cfg.FixturesMode, t))
+	}
+
+	if cfg.AnthropicKey != "" {
+		key, err := newSecret(context.Background(), cfg.AnthropicKey)
+		if err != nil {
+			return nil, err
+		}
+		go refreshSecrets(context.Background(), cfg.SecretRefresh, []*secret{key})
+
+		p := &goai.Anthropic{APIKey: key.Value, BaseURL: cfg.AnthropicEndpoint}
+		if err := a.RegisterProvider("anthropic", p, cfg.AnthropicModels...); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.LocalEndpoint != "" {
+		p := goai.NewOpenAICompatible(cfg.LocalEndpoint, "", nil)
+		if err := a.RegisterProvider("local", p, cfg.LocalModels...); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// adapterConfig returns the settings of the adapter in the config.
+func adapterConfig(cfg *config) goai.Config {
+	return goai.Config{
+		ModelMapping:        cfg.ModelMapping,
+		ModelPassthrough:    cfg.ModelPassthrough,
+		DefaultModel:        cfg.DefaultModel,
+		DefaultVisionModel:  cfg.DefaultVisionModel,
+		Routes:              cfg.Routes,
+		SystemPrompt:        cfg.SystemPrompt,
+		SafetySettings:      cfg.SafetySettings,
+		TemperatureMode:     cfg.TemperatureMode,
+		MaxTemperature:      float32(cfg.MaxTemperature),
+		FileUploadThreshold: cfg.FileUploadThreshold,
+		Admission:           cfg.Admission,
+		VideoModel:          cfg.VideoModel,
+		ContextCaching:      cfg.ContextCaching,
+		Retry:               cfg.Retry,
+		Fallbacks:           cfg.Fallbacks,
+		PayloadLogging:      cfg.PayloadLogging,
+	}
+}
+
+// warmup warms up the adapter in the background, so that the server starts
+// immediately.
+func warmup(a *goai.Adapter, apiKeys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := a.Warmup(ctx, apiKeys); err != nil {
+		logger.Error("warm up failed", slog.String("error", err.Error()))
+	}
 }
 
 func catchAll(w http.ResponseWriter, r *http.Request) {
-	logger.Error("not found", slog.Any("path", r.RequestURI))
+	logger.ErrorContext(r.Context(), "not found", slog.String("path", r.URL.Path))
 
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("404 - Not Found"))
@@ -52,67 +455,632 @@ func health(w http.ResponseWriter, r *http.Request) {
 }
 
 type openaiHandler struct {
-	adapter openaiClient
+	adapter  openaiClient
+	usage    *usageStore
+	degraded *degradedMode
+
+	// labelHeaders are the request headers recorded as labels.
+	labelHeaders []string
+
+	// payloadLogging logs the failed requests, which are redacted otherwise.
+	payloadLogging goai.PayloadLogging
+
+	// streamTPS paces the streamed words, see smoothStream.
+	streamTPS float64
+
+	// checkpoints stores the partial streamed responses every
+	// checkpointInterval, see checkpointer.
+	checkpoints        goai.Cache
+	checkpointInterval time.Duration
+
+	// conversations allows a single generation at a time per conversation,
+	// if configured.
+	conversations *conversationGuard
+
+	// media serves the generated images, if configured.
+	media *mediaStore
+
+	// timeout is the default time limit of the chat completions that are
+	// not streamed, see requestTimeout.
+	timeout time.Duration
+
+	// writeTimeout is the write timeout of the server, which is lifted for
+	// the streams, see relaxStreamWrites.
+	writeTimeout time.Duration
+
+	// paramMode handles the unsupported parameters of the requests without
+	// their own mode, see paramModeOf.
+	paramMode goai.ParamMode
+
+	// debugResponses lets all the API keys get the raw Gemini responses, see
+	// debugRequested.
+	debugResponses bool
+
+	// passthrough forwards the requests with the features that Gemini can't
+	// express to OpenAI.
+	passthrough *passthrough
+
+	// residency pins the tenants to regions.
+	residency map[string]residency
+
+	// upstreamKeys are the Gemini API keys used for the requests without one.
+	upstreamKeys *keyPool
+
+	// maxBodySize limits the size of the chat request bodies.
+	maxBodySize int64
+
+	// codeExecution enables the Gemini code execution for all requests.
+	codeExecution bool
+
+	// responses caches the identical requests, if configured.
+	responses *responseCache
+
+	// limiter limits the requests and tokens per minute of each API key.
+	limiter *rateLimiter
+
+	// concurrency caps the in-flight upstream requests, if configured, and
+	// priorities maps the API key fingerprints to the priority of their
+	// requests.
+	concurrency *concurrencyLimiter
+	priorities  map[string]string
+
+	// virtualKeys are the keys issued by the proxy, if configured.
+	virtualKeys *virtualKeyStore
+
+	// pricing estimates the cost of the requests, if configured.
+	pricing pricing
+
+	// metrics counts the tokens of the requests.
+	metrics *metrics
+
+	// budgets rejects the requests of the virtual keys and tenants over
+	// their budget, if configured.
+	budgets *budgetTracker
+
+	// tenants maps the API key fingerprints to the tenant of their requests
+	// without a virtual key.
+	tenants map[string]string
 }
 
-func (h openaiHandler) ChatCompletion(w http.ResponseWriter, r *http.Request) {
+// apiKey returns the Gemini API key of the request: the upstream key of its
+// virtual key, or the default upstream key when the request has none. The key
+// pool may send the request with another upstream key.
+func (h openaiHandler) apiKey(r *http.Request) string {
+	if _, upstream, ok := virtualKeyFromRequest(r); ok {
+		return upstream
+	}
+
+	return h.clientKey(r)
+}
+
+// clientKey returns the key the client authenticated with, or the default
+// upstream key when the request has none. It identifies the client in the
+// rate limits, priorities, response cache and checkpoints.
+func (h openaiHandler) clientKey(r *http.Request) string {
 	apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if apiKey == "" && h.upstreamKeys != nil {
+		return h.upstreamKeys.Default()
+	}
+
+	return apiKey
+}
+
+// requestContext returns the context of the request with its request info,
+// see goai.RequestInfo.
+func (h openaiHandler) requestContext(r *http.Request) context.Context {
+	info := &goai.RequestInfo{
+		ID:     requestID(r.Context()),
+		Tenant: h.tenant(r),
+		APIKey: h.apiKey(r),
+	}
 
 	ctx := r.Context()
-	ctx = goai.AuthContext(ctx, apiKey)
+	if vk, _, ok := virtualKeyFromRequest(r); ok {
+		info.VirtualKey = vk.ID
+
+		// The key sends its requests to its own Vertex AI project, or to the
+		// Gemini API with its own upstream key.
+		switch {
+		case vk.VertexAI != nil:
+			ctx = goai.VertexAIContext(ctx, vk.VertexAI)
+		case vk.Upstream != "":
+			ctx = goai.VertexAIContext(ctx, nil)
+		}
+	}
+
+	e := accessLogFromContext(ctx)
+	e.info = info
+	e.key = fingerprint(h.clientKey(r))
+	e.client = parseClientInfo(r.Header).String()
+
+	return goai.RequestInfoContext(ctx, info)
+}
+
+// tenant returns the tenant of the virtual key of the request, or of its API
+// key in the tenant file. It is never read from the request, e.g. the
+// OpenAI-Organization header, so that the clients can't pick the budget and
+// residency that apply to them.
+func (h openaiHandler) tenant(r *http.Request) string {
+	if vk, _, ok := virtualKeyFromRequest(r); ok {
+		return vk.Tenant
+	}
+
+	return h.tenants[fingerprint(h.clientKey(r))]
+}
+
+// fingerprint identifies an API key without storing the key itself.
+func fingerprint(apiKey string) string {
+	h := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(h[:8])
+}
+
+// recordUsage records the usage of the request with its estimated cost, and
+// returns the cost.
+func (h openaiHandler) recordUsage(r *http.Request, info *goai.RequestInfo, req openai.ChatCompletionRequest, u openai.Usage) float64 {
+	cost := h.pricing.Cost(info, u)
+	err := h.usage.Add(usageRecord{
+		Time:             time.Now(),
+		Key:              fingerprint(info.APIKey),
+		VirtualKey:       info.VirtualKey,
+		Tenant:           info.Tenant,
+		Model:            req.Model,
+		Client:           parseClientInfo(r.Header).String(),
+		Labels:           requestLabels(r, req, h.labelHeaders),
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		Cost:             cost,
+	})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "record usage failed", slog.String("error", err.Error()))
+	}
+
+	e := accessLogFromContext(r.Context())
+	e.usage = &u
+	e.cost = cost
+	h.addBudgetSpend(r, info, cost, u)
+	h.metrics.addTokens(info, req.Stream, u)
+
+	return cost
+}
+
+func (h openaiHandler) ChatCompletion(w http.ResponseWriter, r *http.Request) {
+	if !h.allowResidency(w, r) {
+		return
+	}
+
+	ctx := h.requestContext(r)
+	info := goai.RequestInfoFromContext(ctx)
+	ctx = goai.HeaderContext(ctx, r.Header)
+	ctx, warnings := goai.WarningsContext(ctx)
+
+	_, parseSpan := tracer.Start(ctx, "parseRequest")
+	endParse := sync.OnceFunc(func() { parseSpan.End() })
+	defer endParse()
+
+	if h.maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 
-	var req openai.ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	body, err = rewriteParts(body, h.adapter.FileURI)
+	if err != nil {
+		writeAPIError(w, invalidJSONError(err))
+		return
+	}
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAPIError(w, invalidJSONError(err))
+		return
+	}
+	info.Model = req.Model
+	parseSpan.SetAttributes(
+		attribute.String("openai.model", req.Model),
+		attribute.Bool("openai.stream", req.Stream),
+	)
+
+	if !allowModel(w, r, req.Model) {
+		return
+	}
+
+	if !h.checkBudget(w, r, info) {
+		return
+	}
+
+	// The requests that Gemini can't serve are forwarded as is.
+	if feature, ok := h.passthrough.feature(body); ok {
+		endParse()
+		h.forwardToOpenAI(w, r, info, req, body, feature)
+		return
+	}
+
+	ext, err := parseExtensions(body, r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ext.CodeExecution = ext.CodeExecution || h.codeExecution
+	ctx = goai.ExtensionsContext(ctx, ext)
+
+	// The unknown parameters are rejected in strict mode, or ignored with a
+	// warning.
+	ctx = goai.ParamModeContext(ctx, h.paramModeOf(r))
+	params, err := unknownParams(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := goai.DropParams(ctx, params...); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	endParse()
+
+	var groundings *goai.Groundings
+	if ext.Grounding {
+		ctx, groundings = goai.GroundingContext(ctx)
+	}
+
+	debug, err := h.debugRequested(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	var raw *goai.RawResponses
+	if debug {
+		ctx, raw = goai.RawResponsesContext(ctx)
+	}
+
+	client := parseClientInfo(r.Header).String()
+	labels := requestLabels(r, req, h.labelHeaders)
+	accessLogFromContext(ctx).labels = labels
+
+	var cacheKey string
+	if h.responses != nil && !req.Stream && !debug {
+		cacheKey, err = responseCacheKey(h.clientKey(r), req, ext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if b, ok := h.responses.Get(ctx, cacheKey); ok {
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
+			return
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	tokens, ok := h.limitTokens(ctx, w, r, req)
+	if !ok {
+		return
+	}
+
 	if req.Stream {
-		h.streamResponse(ctx, w, req)
+		// The cost is only known once the stream is done, so it is sent as a
+		// trailer.
+		if h.pricing != nil {
+			w.Header().Set("Trailer", "X-Estimated-Cost")
+		}
+
+		u := h.streamResponse(ctx, w, r, req, warnings, groundings, raw)
+		h.chargeTokens(r, tokens, u)
+		cost := h.recordUsage(r, info, req, u)
+		h.setCostHeader(w, cost)
 		return
 	}
 
-	res, err := h.adapter.ChatCompletion(ctx, req)
+	callCtx, cancel := h.upstreamContext(ctx, r)
+	defer cancel()
+
+	res, err := h.adapter.ChatCompletion(callCtx, req)
 	if err != nil {
-		logger.Error("chat completion failed",
+		h.chargeTokens(r, tokens, openai.Usage{})
+		if writeAPIError(w, err) {
+			return
+		}
+
+		attrs := []any{
 			slog.String("error", err.Error()),
-			slog.Any("request", req),
-		)
+			slog.Int("retries", info.Retries),
+			slog.String("client", client),
+			slog.Any("labels", labels),
+		}
+		if h.payloadLogging.Enabled {
+			attrs = append(attrs, h.payloadLogging.Attr("request", req))
+		}
+		logger.ErrorContext(ctx, "chat completion failed", attrs...)
+
+		res, ok := h.degradedResponse(ctx, err, req.Model)
+		if !ok {
+			if errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+				writeAPIError(w, errRequestTimeout)
+				return
+			}
+
+			http.Error(w, errorMessage(w, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+
+		setDegradedHeader(w)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
-	logger.Info("request", slog.Any("req", req), slog.Any("res", res))
-	if err := json.NewEncoder(w).Encode(res); err != nil {
+	if err := h.degraded.Store(ctx, req.Model, res); err != nil {
+		logger.ErrorContext(ctx, "store degraded response failed", slog.String("error", err.Error()))
+	}
+
+	h.chargeTokens(r, tokens, res.Usage)
+	cost := h.recordUsage(r, info, req, res.Usage)
+	h.setCostHeader(w, cost)
+
+	_, encodeSpan := tracer.Start(ctx, "encodeResponse")
+	defer encodeSpan.End()
+
+	w.Header().Set("X-Gemini-Model", info.GeminiModel)
+	ws := setWarningsHeader(w, warnings)
+	b, err := json.Marshal(chatCompletionResponse{
+		ChatCompletionResponse: res,
+		Warnings:               ws,
+		Grounding:              groundings.List(),
+		GeminiResponses:        raw.List(),
+	})
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if cacheKey != "" {
+		h.responses.Set(ctx, cacheKey, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (h openaiHandler) degradedResponse(ctx context.Context, err error, model string) (*openai.ChatCompletionResponse, bool) {
+	if !upstreamUnavailable(err) {
+		return nil, false
+	}
+
+	return h.degraded.Response(ctx, model)
+}
+
+// chatCompletionResponse extends the response with the warnings about the
+// changes made to the request, the Google Search grounding, and the raw
+// Gemini responses when debugging.
+type chatCompletionResponse struct {
+	*openai.ChatCompletionResponse
+	Warnings        []goai.Warning    `json:"x_proxy_warnings,omitempty"`
+	Grounding       []goai.Grounding  `json:"x_grounding,omitempty"`
+	GeminiResponses []json.RawMessage `json:"x_gemini_responses,omitempty"`
+}
+
+type chatCompletionStreamResponse struct {
+	openai.ChatCompletionStreamResponse
+	Warnings        []goai.Warning    `json:"x_proxy_warnings,omitempty"`
+	Grounding       []goai.Grounding  `json:"x_grounding,omitempty"`
+	GeminiResponses []json.RawMessage `json:"x_gemini_responses,omitempty"`
+}
+
+// setWarningsHeader sets the warning codes in the X-Proxy-Warnings header, and
+// returns the warnings to include in the response body.
+func setWarningsHeader(w http.ResponseWriter, warnings *goai.Warnings) []goai.Warning {
+	ws := warnings.List()
+	if len(ws) == 0 {
+		return nil
+	}
+
+	codes := make([]string, len(ws))
+	for i, warning := range ws {
+		codes[i] = warning.Code
+	}
+
+	w.Header().Set("X-Proxy-Warnings", strings.Join(codes, ", "))
+	if params := goai.IgnoredParams(ws); len(params) > 0 {
+		w.Header().Set("X-Ignored-Params", strings.Join(params, ", "))
+	}
+
+	return ws
+}
+
+// paramModeOf returns how the unsupported parameters of the request are
+// handled: the mode of its virtual key, or the default one.
+func (h openaiHandler) paramModeOf(r *http.Request) goai.ParamMode {
+	if vk, _, ok := virtualKeyFromRequest(r); ok && vk.ParamMode != "" {
+		return vk.ParamMode
+	}
+
+	return h.paramMode
+}
+
+var errDebugNotAllowed = &openai.APIError{
+	Code:           "debug_not_allowed",
+	Message:        "The API key is not allowed to debug the Gemini responses.",
+	Type:           "invalid_request_error",
+	HTTPStatusCode: http.StatusForbidden,
+}
+
+// invalidJSONError returns the error of a request body that can't be decoded.
+func invalidJSONError(err error) *openai.APIError {
+	return &openai.APIError{
+		Code:           "invalid_json",
+		Message:        fmt.Sprintf("We could not parse the JSON body of your request: %s", err),
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusBadRequest,
+	}
+}
+
+// debugRequested reports whether the request asks for the raw Gemini
+// responses with X-Debug: true, which only the virtual keys with debug may
+// do, unless all the keys can.
+func (h openaiHandler) debugRequested(r *http.Request) (bool, error) {
+	if ok, _ := strconv.ParseBool(r.Header.Get("X-Debug")); !ok {
+		return false, nil
+	}
+
+	if h.debugResponses {
+		return true, nil
+	}
+
+	if vk, _, ok := virtualKeyFromRequest(r); ok && vk.Debug {
+		return true, nil
+	}
+
+	return false, errDebugNotAllowed
 }
 
-func (h openaiHandler) streamResponse(ctx context.Context, w http.ResponseWriter, req openai.ChatCompletionRequest) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// writeJSON writes the response as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeAPIError writes the OpenAI API errors returned by the adapter, e.g. for
+// invalid parameters, in the OpenAI error format.
+func writeAPIError(w http.ResponseWriter, err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	// The error may be shared, e.g. by the admission limits.
+	res := *apiErr
+	res.Message = errorMessage(w, res.Message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.HTTPStatusCode)
+	if err := json.NewEncoder(w).Encode(openai.ErrorResponse{Error: &res}); err != nil {
+		logger.Error("write error failed", slog.String("error", err.Error()))
+	}
+
+	return true
+}
+
+// streamResponse streams the response and returns its usage, which is only
+// sent to the client when it asks for it with stream_options.
+func (h openaiHandler) streamResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, req openai.ChatCompletionRequest, warnings *goai.Warnings, groundings *goai.Groundings, raw *goai.RawResponses) openai.Usage {
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Content-Type", "text/event-stream")
 
+	// The stream is canceled when it is not read to the end, e.g. when the
+	// writes fail, so that the upstream stream doesn't leak.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	ch, err := h.adapter.ChatCompletionStream(ctx, req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusPreconditionFailed)
-		return
+		if writeAPIError(w, err) {
+			return openai.Usage{}
+		}
+
+		res, ok := h.degradedResponse(ctx, err, req.Model)
+		if !ok {
+			http.Error(w, errorMessage(w, err.Error()), http.StatusPreconditionFailed)
+			return openai.Usage{}
+		}
+
+		setDegradedHeader(w)
+		ch = toStream(res)
+	}
+
+	ch = smoothStream(ctx, ch, h.streamTPS)
+
+	var cp *checkpointer
+	if h.checkpointInterval > 0 {
+		cp = newCheckpointer(h.checkpoints, h.checkpointInterval, fingerprint(h.clientKey(r)))
+		defer cp.Done(ctx)
 	}
 
+	// The warnings are only sent with the first chunk.
+	w.Header().Set("X-Gemini-Model", goai.RequestInfoFromContext(ctx).GeminiModel)
+	ws := setWarningsHeader(w, warnings)
+
+	// The stream is written as it is received, so the span shows how long
+	// the client waited for the chunks.
+	_, span := tracer.Start(ctx, "writeStream")
+	defer span.End()
+
+	var (
+		last  openai.ChatCompletionStreamResponse
+		usage openai.Usage
+	)
 	for res := range ch {
-		b, err := json.Marshal(res)
+		if res.Usage != nil {
+			usage = *res.Usage
+			if !includeUsage {
+				continue
+			}
+		}
+
+		last = res
+		if cp != nil {
+			cp.Add(ctx, res)
+		}
+
+		b, err := json.Marshal(chatCompletionStreamResponse{
+			ChatCompletionStreamResponse: res,
+			Warnings:                     ws,
+		})
+		ws = nil
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return usage
 		}
 
 		fmt.Fprintf(w, "data: %s \n\n", b)
 		w.(http.Flusher).Flush()
 	}
 
+	// The grounding and the raw responses are complete once the stream is
+	// done, so they are sent in a last chunk without choices, like the usage.
+	gs, raws := groundings.List(), raw.List()
+	if len(gs) > 0 || len(raws) > 0 {
+		b, err := json.Marshal(chatCompletionStreamResponse{
+			ChatCompletionStreamResponse: openai.ChatCompletionStreamResponse{
+				ID:      last.ID,
+				Object:  last.Object,
+				Created: last.Created,
+				Model:   last.Model,
+				Choices: []openai.ChatCompletionStreamChoice{},
+			},
+			Grounding:       gs,
+			GeminiResponses: raws,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return usage
+		}
+
+		fmt.Fprintf(w, "data: %s \n\n", b)
+	}
+
 	fmt.Fprint(w, "data: [DONE] \n\n")
 	w.(http.Flusher).Flush()
+
+	return usage
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	goai "github.com/alextanhongpin/go-gemini"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// newTestHandler returns a handler serving the mock completions, with the
+// usage recorded in a temporary file.
+func newTestHandler(t *testing.T) *openaiHandler {
+	t.Helper()
+
+	m, err := newMockClient(nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := goai.NewMemoryCache()
+	h := new(openaiHandler)
+	h.metrics = newMetrics()
+	h.adapter = m
+	h.usage = newUsageStore(filepath.Join(t.TempDir(), "usage.jsonl"))
+	h.degraded = newDegradedMode(nil, c)
+	h.checkpoints = c
+	h.limiter = newRateLimiter(c, 0, 0)
+	h.concurrency = newConcurrencyLimiter(0, 0)
+	return h
+}
+
+// newRequest returns a POST request with the API key.
+func newRequest(apiKey, path, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if apiKey != "" {
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	return r
+}
+
+// serve sends the request with the API key to the handler.
+func serve(handler http.HandlerFunc, apiKey, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, newRequest(apiKey, path, body))
+	return w
+}
+
+func TestChatCompletionInvalidJSON(t *testing.T) {
+	h := newTestHandler(t)
+
+	for _, body := range []string{`{"model": "gpt-4o",`, `{"messages": "hi"}`} {
+		w := serve(h.ChatCompletion, "key", "/chat/completions", body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d %s, want 400", body, w.Code, w.Body)
+		}
+
+		if err := decodeAPIError(t, w.Body.String()); err.Type != "invalid_request_error" {
+			t.Fatalf("%s: got type %q, want invalid_request_error", body, err.Type)
+		}
+	}
+}
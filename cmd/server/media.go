@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// mediaStore stores generated media on disk and serves it through short-lived
+// signed URLs, so that responses don't carry large base64 blobs.
+type mediaStore struct {
+	dir     string
+	secret  []byte
+	baseURL string
+	ttl     time.Duration
+}
+
+func newMediaStore(dir, secret, baseURL string, ttl time.Duration) (*mediaStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("media secret is required")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &mediaStore{
+		dir:     dir,
+		secret:  []byte(secret),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		ttl:     ttl,
+	}, nil
+}
+
+// Put stores the media and returns its id.
+func (s *mediaStore) Put(data []byte, mimeType string) (string, error) {
+	var ext string
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+
+	id := uuid.New().String() + ext
+	if err := os.WriteFile(filepath.Join(s.dir, id), data, 0o600); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// SignedURL returns the URL to download the media until the TTL expires.
+func (s *mediaStore) SignedURL(id string) string {
+	expires := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	return fmt.Sprintf("%s/media/%s?expires=%s&signature=%s", s.baseURL, id, expires, s.sign(id, expires))
+}
+
+func (s *mediaStore) sign(id, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id + ":" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *mediaStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/media/")
+	expires := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+
+	if id == "" || id != filepath.Base(id) || !hmac.Equal([]byte(signature), []byte(s.sign(id, expires))) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		http.Error(w, "signed url expired", http.StatusForbidden)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(s.dir, id))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// durationBuckets are the upper bounds in seconds of the latency histograms,
+// which are longer than the usual HTTP ones since the generations take
+// seconds.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// metrics exposes the request, upstream and token metrics in the Prometheus
+// text format on /metrics. The client library isn't used, as the few metric
+// types needed are simple to write.
+type metrics struct {
+	requests       *counterVec
+	duration       *histogramVec
+	upstreamErrors *counterVec
+	retries        *counterVec
+	tokens         *counterVec
+
+	mu    sync.Mutex
+	funcs []metricFunc
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:       newCounterVec("gemini_proxy_requests_total", "Requests by route, method and status code.", "route", "method", "code"),
+		duration:       newHistogramVec("gemini_proxy_request_duration_seconds", "Latency of the requests by route, until the end of the stream.", durationBuckets, "route"),
+		upstreamErrors: newCounterVec("gemini_proxy_upstream_errors_total", "Failed upstream calls by operation and upstream status code, 0 when there is none.", "operation", "status"),
+		retries:        newCounterVec("gemini_proxy_retries_total", "Retries of the transient Gemini failures by Gemini model.", "model"),
+		tokens:         newCounterVec("gemini_proxy_tokens_total", "Prompt and completion tokens by Gemini model, and whether they were streamed.", "model", "type", "stream"),
+	}
+}
+
+// metricFunc is a metric whose value is read when it is scraped, e.g. the
+// size of a cache.
+type metricFunc struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+// GaugeFunc adds a gauge read from fn.
+func (m *metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.funcs = append(m.funcs, metricFunc{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// CounterFunc adds a counter read from fn.
+func (m *metrics) CounterFunc(name, help string, fn func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.funcs = append(m.funcs, metricFunc{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.requests.write(w)
+	m.duration.write(w)
+	m.upstreamErrors.write(w)
+	m.retries.write(w)
+	m.tokens.write(w)
+
+	m.mu.Lock()
+	funcs := m.funcs
+	m.mu.Unlock()
+
+	for _, f := range funcs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", f.name, f.help, f.name, f.typ, f.name, formatFloat(f.fn()))
+	}
+}
+
+// instrument counts the requests and their latency by the route pattern that
+// serves them, rather than their path, to bound the number of series.
+func (m *metrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.requests.Add(1, route, r.Method, strconv.Itoa(rec.status))
+		m.duration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// addTokens counts the tokens of a chat request.
+func (m *metrics) addTokens(info *goai.RequestInfo, stream bool, u openai.Usage) {
+	streamed := strconv.FormatBool(stream)
+	m.tokens.Add(float64(u.PromptTokens), info.GeminiModel, "prompt", streamed)
+	m.tokens.Add(float64(u.CompletionTokens), info.GeminiModel, "completion", streamed)
+}
+
+// statusRecorder records the status code and size of the response. It
+// flushes like the response writer it wraps, for the streams.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentedClient counts the failed upstream calls and the retries. It
+// wraps the adapter inside the key pool, so that every key that fails is
+// counted.
+type instrumentedClient struct {
+	openaiClient
+	metrics *metrics
+}
+
+func (c instrumentedClient) observe(ctx context.Context, operation string, retries int, err error) {
+	info := goai.RequestInfoFromContext(ctx)
+	if n := info.Retries - retries; n > 0 {
+		c.metrics.retries.Add(float64(n), info.GeminiModel)
+	}
+
+	if err != nil {
+		c.metrics.upstreamErrors.Add(1, operation, strconv.Itoa(goai.HTTPStatusCode(err)))
+	}
+}
+
+func (c instrumentedClient) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	retries := goai.RequestInfoFromContext(ctx).Retries
+	res, err := c.openaiClient.ChatCompletion(ctx, req)
+	c.observe(ctx, "chat_completion", retries, err)
+
+	return res, err
+}
+
+func (c instrumentedClient) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	retries := goai.RequestInfoFromContext(ctx).Retries
+	ch, err := c.openaiClient.ChatCompletionStream(ctx, req)
+	c.observe(ctx, "chat_completion_stream", retries, err)
+
+	return ch, err
+}
+
+func (c instrumentedClient) Moderations(ctx context.Context, inputs []string) (*openai.ModerationResponse, error) {
+	res, err := c.openaiClient.Moderations(ctx, inputs)
+	c.observe(ctx, "moderation", 0, err)
+
+	return res, err
+}
+
+func (c instrumentedClient) GenerateImages(ctx context.Context, req openai.ImageRequest) ([]goai.Image, error) {
+	images, err := c.openaiClient.GenerateImages(ctx, req)
+	c.observe(ctx, "image_generation", 0, err)
+
+	return images, err
+}
+
+// counterVec is a counter per label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	k := formatLabels(c.labels, values)
+
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, k, formatFloat(c.values[k]))
+	}
+}
+
+// histogramVec is a histogram per label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	// counts are the observations per bucket, not cumulated.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) Observe(v float64, values ...string) {
+	k := formatLabels(h.labels, values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	s.count++
+	s.sum += v
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+
+		var n uint64
+		for i, b := range h.buckets {
+			n += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", h.name, k, formatFloat(b), n)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, k, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, k, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, k, s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label pairs, e.g. route="/health",code="200".
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+const defaultMockContent = "This is a mock response to: {{.Prompt}}"
+
+// mockResponse is the completion of a model in mock mode.
+type mockResponse struct {
+	// Content is a text/template of the completion, executed with the
+	// requested Model, the Prompt, i.e. the last user message, and the
+	// Messages.
+	Content string `yaml:"content"`
+}
+
+// mockClient serves canned or templated completions without calling Gemini,
+// so that the clients can be developed offline. The "*" model matches any
+// model.
+type mockClient struct {
+	templates map[string]*template.Template
+
+	// latency is the wait before the response or the first chunk, and tps
+	// the words streamed per second.
+	latency time.Duration
+	tps     float64
+}
+
+var _ openaiClient = (*mockClient)(nil)
+
+func newMockClient(responses map[string]mockResponse, latency time.Duration, tps float64) (*mockClient, error) {
+	m := &mockClient{
+		templates: make(map[string]*template.Template),
+		latency:   latency,
+		tps:       tps,
+	}
+
+	if _, ok := responses["*"]; !ok {
+		m.templates["*"] = template.Must(template.New("*").Parse(defaultMockContent))
+	}
+
+	for model, r := range responses {
+		t, err := template.New(model).Parse(r.Content)
+		if err != nil {
+			return nil, fmt.Errorf("mock response of %s: %w", model, err)
+		}
+
+		m.templates[model] = t
+	}
+
+	return m, nil
+}
+
+// content executes the template of the requested model.
+func (m *mockClient) content(req openai.ChatCompletionRequest) (string, error) {
+	t, ok := m.templates[req.Model]
+	if !ok {
+		t = m.templates["*"]
+	}
+
+	var prompt string
+	for _, msg := range req.Messages {
+		if msg.Role == openai.ChatMessageRoleUser {
+			prompt = msg.Content
+			for _, part := range msg.MultiContent {
+				if part.Type == openai.ChatMessagePartTypeText {
+					prompt = part.Text
+				}
+			}
+		}
+	}
+
+	var sb strings.Builder
+	err := t.Execute(&sb, map[string]any{
+		"Model":    req.Model,
+		"Prompt":   prompt,
+		"Messages": req.Messages,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+func (m *mockClient) usage(req openai.ChatCompletionRequest, content string) openai.Usage {
+	prompt := goai.EstimatePromptTokens(req)
+	completion := len(splitWords(content))
+
+	return openai.Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
+
+// wait waits for the latency, or until the request is canceled.
+func (m *mockClient) wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *mockClient) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	content, err := m.content(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.wait(ctx, m.latency); err != nil {
+		return nil, err
+	}
+
+	goai.RequestInfoFromContext(ctx).GeminiModel = "mock"
+
+	return &openai.ChatCompletionResponse{
+		ID:      "chatcmpl-" + uuid.New().String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: content,
+			},
+			FinishReason: openai.FinishReasonStop,
+		}},
+		Usage: m.usage(req, content),
+	}, nil
+}
+
+// ChatCompletionStream streams the completion word by word, paced at tps
+// after the latency.
+func (m *mockClient) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	content, err := m.content(req)
+	if err != nil {
+		return nil, err
+	}
+
+	goai.RequestInfoFromContext(ctx).GeminiModel = "mock"
+
+	var interval time.Duration
+	if m.tps > 0 {
+		interval = time.Duration(float64(time.Second) / m.tps)
+	}
+
+	id := "chatcmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+	words := splitWords(content)
+
+	ch := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(ch)
+
+		if m.wait(ctx, m.latency) != nil {
+			return
+		}
+
+		for i, word := range words {
+			if i > 0 && m.wait(ctx, interval) != nil {
+				return
+			}
+
+			choice := openai.ChatCompletionStreamChoice{
+				Delta: openai.ChatCompletionStreamChoiceDelta{Content: word},
+			}
+			if i == 0 {
+				choice.Delta.Role = openai.ChatMessageRoleAssistant
+			}
+			if i == len(words)-1 {
+				choice.FinishReason = openai.FinishReasonStop
+			}
+
+			select {
+			case ch <- openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionStreamChoice{choice},
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+			u := m.usage(req, content)
+			select {
+			case ch <- openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openai.ChatCompletionStreamChoice{},
+				Usage:   &u,
+			}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Moderations flags nothing.
+func (m *mockClient) Moderations(ctx context.Context, inputs []string) (*openai.ModerationResponse, error) {
+	res := &openai.ModerationResponse{
+		ID:      "modr-" + uuid.New().String(),
+		Model:   "mock",
+		Results: make([]openai.Result, len(inputs)),
+	}
+
+	return res, nil
+}
+
+// mockEmbeddingSize is the size of the mock embeddings, as of the Gemini
+// text-embedding-004.
+// CountPromptTokens returns the estimate of the prompt tokens, like the usage
+// of the completions.
+func (m *mockClient) CountPromptTokens(ctx context.Context, req openai.ChatCompletionRequest) (int, error) {
+	return goai.EstimatePromptTokens(req), nil
+}
+
+const mockEmbeddingSize = 768
+
+// Embeddings returns unit vectors derived from the hash of the inputs, so that
+// the same input always has the same embedding.
+func (m *mockClient) Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	var inputs []string
+	switch v := req.Input.(type) {
+	case string:
+		inputs = []string{v}
+	case []any:
+		for _, s := range v {
+			s, ok := s.(string)
+			if !ok {
+				return nil, errMockUnsupported
+			}
+			inputs = append(inputs, s)
+		}
+	default:
+		return nil, errMockUnsupported
+	}
+
+	res := &openai.EmbeddingResponse{
+		Object: "list",
+		Data:   make([]openai.Embedding, len(inputs)),
+		Model:  req.Model,
+	}
+	for i, s := range inputs {
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+
+		values := make([]float32, mockEmbeddingSize)
+		var norm float64
+		for j := range values {
+			values[j] = float32(rnd.NormFloat64())
+			norm += float64(values[j]) * float64(values[j])
+		}
+		for j := range values {
+			values[j] /= float32(math.Sqrt(norm))
+		}
+
+		res.Data[i] = openai.Embedding{Object: "embedding", Embedding: values, Index: i}
+		res.Usage.PromptTokens += len(splitWords(s))
+	}
+	res.Usage.TotalTokens = res.Usage.PromptTokens
+
+	return res, nil
+}
+
+// ListModels lists the models of the templates.
+func (m *mockClient) ListModels(ctx context.Context) ([]openai.Model, error) {
+	var models []openai.Model
+	for model := range m.templates {
+		if model == "*" {
+			continue
+		}
+
+		models = append(models, openai.Model{ID: model, Object: "model", OwnedBy: "mock"})
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].ID < models[j].ID
+	})
+
+	return models, nil
+}
+
+func (m *mockClient) GenerateImages(ctx context.Context, req openai.ImageRequest) ([]goai.Image, error) {
+	return nil, errMockUnsupported
+}
+
+func (m *mockClient) UploadFile(ctx context.Context, filename, mimeType, purpose string, r io.Reader) (*openai.File, error) {
+	return nil, errMockUnsupported
+}
+
+func (m *mockClient) ListFiles(ctx context.Context) ([]openai.File, error) {
+	return nil, errMockUnsupported
+}
+
+func (m *mockClient) GetFile(ctx context.Context, id string) (*openai.File, error) {
+	return nil, errMockUnsupported
+}
+
+func (m *mockClient) DeleteFile(ctx context.Context, id string) error {
+	return errMockUnsupported
+}
+
+// FileURI returns a URI that the mock doesn't resolve, since it has no
+// files.
+func (m *mockClient) FileURI(id string) string {
+	return "mock://files/" + id
+}
+
+var errMockUnsupported = &openai.APIError{
+	Code:           "not_implemented",
+	Message:        "The endpoint is not supported in mock mode.",
+	Type:           "invalid_request_error",
+	HTTPStatusCode: http.StatusNotImplemented,
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Models lists the models of the providers, without the models that the key
+// is not allowed to use.
+func (h openaiHandler) Models(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	models, err := h.adapter.ListModels(h.requestContext(r))
+	if err != nil {
+		if writeAPIError(w, err) {
+			return
+		}
+
+		logger.ErrorContext(r.Context(), "list models failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	vk, _, ok := virtualKeyFromRequest(r)
+	data := []openai.Model{}
+	for _, m := range models {
+		if !ok || vk.allows(m.ID) {
+			data = append(data, m)
+		}
+	}
+
+	writeJSON(w, map[string]any{
+		"object": "list",
+		"data":   data,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// moderationRequest is the OpenAI moderation request, whose input is either
+// a string or a list of strings.
+type moderationRequest struct {
+	Input json.RawMessage `json:"input"`
+	Model string          `json:"model"`
+}
+
+// moderationResponse is the OpenAI moderation response, with the failures of
+// the inputs whose results are flagged.
+type moderationResponse struct {
+	*openai.ModerationResponse
+	Errors []goai.ItemError `json:"errors"`
+}
+
+func (r moderationRequest) inputs() ([]string, error) {
+	var s string
+	if err := json.Unmarshal(r.Input, &s); err == nil {
+		return []string{s}, nil
+	}
+
+	var ss []string
+	if err := json.Unmarshal(r.Input, &ss); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func (h openaiHandler) Moderations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.allowResidency(w, r) {
+		return
+	}
+
+	ctx := h.requestContext(r)
+	info := goai.RequestInfoFromContext(ctx)
+
+	var req moderationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inputs, err := req.inputs()
+	if err != nil || len(inputs) == 0 {
+		http.Error(w, "input must be a string or a list of strings", http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkBudget(w, r, info) {
+		return
+	}
+
+	res, err := h.adapter.Moderations(ctx, inputs)
+
+	// Some inputs failed, they are reported in the errors.
+	var batchErr *goai.BatchError
+	if res != nil && errors.As(err, &batchErr) {
+		logger.WarnContext(r.Context(), "moderations partially failed", slog.String("error", err.Error()))
+		writeJSON(w, moderationResponse{
+			ModerationResponse: res,
+			Errors:             batchErr.Errors,
+		})
+		return
+	}
+
+	if err != nil {
+		logger.ErrorContext(r.Context(), "moderations failed", slog.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, res)
+}
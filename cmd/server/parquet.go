@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// The Parquet files are written without a third-party encoder: the usage
+// rows fit in a single row group, with one uncompressed, PLAIN encoded page
+// per column, and the metadata is encoded with the Thrift compact protocol.
+// See https://parquet.apache.org/docs/file-format/.
+
+const parquetMagic = "PAR1"
+
+// The Parquet physical types, converted types and encodings that are used.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8 = 0
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// parquetColumn is a required column, with its PLAIN encoded values.
+type parquetColumn struct {
+	name   string
+	typ    int32
+	values []byte
+}
+
+func (c *parquetColumn) appendString(s string) {
+	c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(s)))
+	c.values = append(c.values, s...)
+}
+
+func (c *parquetColumn) appendInt(n int) {
+	c.values = binary.LittleEndian.AppendUint64(c.values, uint64(n))
+}
+
+func (c *parquetColumn) appendFloat(f float64) {
+	c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(f))
+}
+
+// writeUsageParquet writes the rows as a Parquet file, with the columns of
+// the CSV export.
+func writeUsageParquet(w io.Writer, rows []usageRow) error {
+	cols := []*parquetColumn{
+		{name: "day", typ: parquetByteArray},
+		{name: "key", typ: parquetByteArray},
+		{name: "virtual_key", typ: parquetByteArray},
+		{name: "tenant", typ: parquetByteArray},
+		{name: "model", typ: parquetByteArray},
+		{name: "requests", typ: parquetInt64},
+		{name: "prompt_tokens", typ: parquetInt64},
+		{name: "completion_tokens", typ: parquetInt64},
+		{name: "total_tokens", typ: parquetInt64},
+		{name: "cost", typ: parquetDouble},
+	}
+	for _, row := range rows {
+		cols[0].appendString(row.Day)
+		cols[1].appendString(row.Key)
+		cols[2].appendString(row.VirtualKey)
+		cols[3].appendString(row.Tenant)
+		cols[4].appendString(row.Model)
+		cols[5].appendInt(row.Requests)
+		cols[6].appendInt(row.PromptTokens)
+		cols[7].appendInt(row.CompletionTokens)
+		cols[8].appendInt(row.PromptTokens + row.CompletionTokens)
+		cols[9].appendFloat(row.Cost)
+	}
+
+	return writeParquet(w, cols, len(rows))
+}
+
+func writeParquet(w io.Writer, cols []*parquetColumn, numRows int) error {
+	if _, err := io.WriteString(w, parquetMagic); err != nil {
+		return err
+	}
+	offset := int64(len(parquetMagic))
+
+	// The offsets and sizes of the column chunks, for the metadata.
+	offsets := make([]int64, len(cols))
+	sizes := make([]int64, len(cols))
+	for i, c := range cols {
+		var h thriftWriter
+		h.i32(1, 0) // DATA_PAGE
+		h.i32(2, int32(len(c.values)))
+		h.i32(3, int32(len(c.values)))
+		h.beginStruct(5)
+		h.i32(1, int32(numRows))
+		h.i32(2, parquetPlain)
+		h.i32(3, parquetRLE)
+		h.i32(4, parquetRLE)
+		h.endStruct()
+		h.stop()
+
+		if _, err := w.Write(h.b); err != nil {
+			return err
+		}
+		if _, err := w.Write(c.values); err != nil {
+			return err
+		}
+
+		offsets[i] = offset
+		sizes[i] = int64(len(h.b) + len(c.values))
+		offset += sizes[i]
+	}
+
+	var m thriftWriter
+	m.i32(1, 1) // version
+	m.beginList(2, thriftStruct, len(cols)+1)
+	m.beginElem()
+	m.binary(4, "schema")
+	m.i32(5, int32(len(cols)))
+	m.endStruct()
+	for _, c := range cols {
+		m.beginElem()
+		m.i32(1, c.typ)
+		m.i32(3, 0) // REQUIRED
+		m.binary(4, c.name)
+		if c.typ == parquetByteArray {
+			m.i32(6, parquetUTF8)
+		}
+		m.endStruct()
+	}
+	m.i64(3, int64(numRows))
+
+	if numRows == 0 {
+		m.beginList(4, thriftStruct, 0)
+	} else {
+		var total int64
+		m.beginList(4, thriftStruct, 1)
+		m.beginElem()
+		m.beginList(1, thriftStruct, len(cols))
+		for i, c := range cols {
+			m.beginElem()
+			m.i64(2, offsets[i])
+			m.beginStruct(3)
+			m.i32(1, c.typ)
+			m.beginList(2, thriftI32, 1)
+			m.appendVarint(parquetPlain)
+			m.beginList(3, thriftBinary, 1)
+			m.appendBinary(c.name)
+			m.i32(4, 0) // UNCOMPRESSED
+			m.i64(5, int64(numRows))
+			m.i64(6, sizes[i])
+			m.i64(7, sizes[i])
+			m.i64(9, offsets[i])
+			m.endStruct()
+			m.endStruct()
+
+			total += sizes[i]
+		}
+		m.i64(2, total)
+		m.i64(3, int64(numRows))
+		m.endStruct()
+	}
+	m.binary(6, "go-gemini-proxy")
+	m.stop()
+
+	footer := binary.LittleEndian.AppendUint32(m.b, uint32(len(m.b)))
+	footer = append(footer, parquetMagic...)
+	_, err := w.Write(footer)
+	return err
+}
+
+// The Thrift compact protocol types that are used.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, in which
+// the field IDs are encoded as deltas from the previous field of the struct.
+type thriftWriter struct {
+	b     []byte
+	last  int16
+	stack []int16
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	if d := id - w.last; d > 0 && d <= 15 {
+		w.b = append(w.b, byte(d)<<4|typ)
+	} else {
+		w.b = append(w.b, typ)
+		w.appendVarint(int64(id))
+	}
+	w.last = id
+}
+
+// appendVarint appends the zigzag varint of the integer.
+func (w *thriftWriter) appendVarint(n int64) {
+	w.b = binary.AppendUvarint(w.b, uint64(n<<1^n>>63))
+}
+
+func (w *thriftWriter) appendBinary(s string) {
+	w.b = binary.AppendUvarint(w.b, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *thriftWriter) i32(id int16, n int32) {
+	w.field(id, thriftI32)
+	w.appendVarint(int64(n))
+}
+
+func (w *thriftWriter) i64(id int16, n int64) {
+	w.field(id, thriftI64)
+	w.appendVarint(n)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.appendBinary(s)
+}
+
+// beginList writes the header of a list field, whose n elements follow.
+func (w *thriftWriter) beginList(id int16, typ byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|typ)
+		return
+	}
+
+	w.b = append(w.b, 0xf0|typ)
+	w.b = binary.AppendUvarint(w.b, uint64(n))
+}
+
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.beginElem()
+}
+
+// beginElem begins a struct element of a list.
+func (w *thriftWriter) beginElem() {
+	w.stack = append(w.stack, w.last)
+	w.last = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.stop()
+	w.last = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+}
+
+func (w *thriftWriter) stop() {
+	w.b = append(w.b, 0)
+}
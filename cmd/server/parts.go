@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// rewriteParts converts the input_audio, file and video_url message parts,
+// which the OpenAI client library does not decode, to image_url parts. The adapter sends
+// data URLs as blobs with their MIME type, and Gemini file URIs as references.
+// fileURI returns the URI of the file IDs on the endpoint of the adapter.
+func rewriteParts(body []byte, fileURI func(id string) string) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal(req["messages"], &messages); err != nil {
+		// The request is validated when decoded.
+		return body, nil
+	}
+
+	var rewritten bool
+	for _, msg := range messages {
+		var parts []map[string]json.RawMessage
+		if err := json.Unmarshal(msg["content"], &parts); err != nil {
+			continue
+		}
+
+		var changed bool
+		for i, part := range parts {
+			var typ string
+			if err := json.Unmarshal(part["type"], &typ); err != nil {
+				continue
+			}
+
+			var url string
+			var err error
+			switch typ {
+			case "input_audio":
+				url, err = inputAudioURL(part["input_audio"])
+			case "file":
+				url, err = fileURL(part["file"], fileURI)
+			case "video_url":
+				url, err = videoURL(part["video_url"])
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			b, err := json.Marshal(map[string]string{
+				"url": url,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			parts[i] = map[string]json.RawMessage{
+				"type":      json.RawMessage(`"image_url"`),
+				"image_url": b,
+			}
+			changed = true
+		}
+
+		if changed {
+			b, err := json.Marshal(parts)
+			if err != nil {
+				return nil, err
+			}
+
+			msg["content"] = b
+			rewritten = true
+		}
+	}
+
+	if !rewritten {
+		return body, nil
+	}
+
+	b, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	req["messages"] = b
+
+	return json.Marshal(req)
+}
+
+// videoURL returns the URL of a video_url part, an extension of the OpenAI
+// protocol supported by some clients. The URL is either a data URL or a
+// remote URL.
+func videoURL(raw json.RawMessage) (string, error) {
+	var video struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(raw, &video); err != nil {
+		return "", fmt.Errorf("invalid video_url: %w", err)
+	}
+
+	if video.URL == "" {
+		return "", fmt.Errorf("video_url must have a url")
+	}
+
+	return video.URL, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// passthroughFeatures are the features of the chat requests that Gemini
+// can't express, which can be forwarded to OpenAI instead.
+var passthroughFeatures = []string{"audio", "tools", "prediction", "web_search_options", "n", "logit_bias"}
+
+// defaultPassthroughFeatures are forwarded by default, the others are
+// supported with a loss, e.g. n is ignored.
+var defaultPassthroughFeatures = []string{"audio", "tools", "prediction", "web_search_options"}
+
+// passthroughHeaders are the response headers of OpenAI that are returned
+// as is.
+var passthroughHeaders = []string{"Content-Type", "Openai-Processing-Ms"}
+
+// passthrough forwards the chat requests that use the features to OpenAI,
+// instead of rejecting them or ignoring the features.
+type passthrough struct {
+	key      *secret
+	endpoint string
+	features []string
+}
+
+// newPassthrough returns the passthrough, or nil when there is no OpenAI
+// API key.
+func newPassthrough(ctx context.Context, cfg *config) (*passthrough, error) {
+	if cfg.OpenAIKey == "" || len(cfg.OpenAIPassthrough) == 0 {
+		return nil, nil
+	}
+
+	key, err := newSecret(ctx, cfg.OpenAIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passthrough{
+		key:      key,
+		endpoint: cfg.OpenAIEndpoint,
+		features: cfg.OpenAIPassthrough,
+	}, nil
+}
+
+// feature returns the first passthrough feature that the request uses.
+func (p *passthrough) feature(body []byte) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	var req struct {
+		Audio      json.RawMessage `json:"audio"`
+		Modalities []string        `json:"modalities"`
+		Tools      []struct {
+			Type string `json:"type"`
+		} `json:"tools"`
+		Prediction       json.RawMessage `json:"prediction"`
+		WebSearchOptions json.RawMessage `json:"web_search_options"`
+		N                int             `json:"n"`
+		LogitBias        map[string]int  `json:"logit_bias"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", false
+	}
+
+	// Gemini only supports the function tools.
+	var tools bool
+	for _, t := range req.Tools {
+		tools = tools || (t.Type != "" && t.Type != string(openai.ToolTypeFunction))
+	}
+
+	used := map[string]bool{
+		"audio":              (len(req.Audio) > 0 && string(req.Audio) != "null") || slices.Contains(req.Modalities, "audio"),
+		"tools":              tools,
+		"prediction":         len(req.Prediction) > 0 && string(req.Prediction) != "null",
+		"web_search_options": len(req.WebSearchOptions) > 0 && string(req.WebSearchOptions) != "null",
+		"n":                  req.N > 1,
+		"logit_bias":         len(req.LogitBias) > 0,
+	}
+	for _, f := range p.features {
+		if used[f] {
+			return f, true
+		}
+	}
+
+	return "", false
+}
+
+// do sends the request body to the OpenAI chat completions API.
+func (p *passthrough) do(ctx context.Context, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.key.Value())
+	req.Header.Set("Content-Type", "application/json")
+
+	return http.DefaultClient.Do(req)
+}
+
+// forwardToOpenAI sends the chat request to OpenAI as is, and returns its
+// response. The usage of the responses that are not streamed is recorded.
+func (h openaiHandler) forwardToOpenAI(w http.ResponseWriter, r *http.Request, info *goai.RequestInfo, req openai.ChatCompletionRequest, body []byte, feature string) {
+	logger.InfoContext(r.Context(), "request forwarded to openai",
+		slog.String("feature", feature),
+		slog.String("model", req.Model),
+	)
+	info.GeminiModel = "openai/" + req.Model
+	w.Header().Set("X-Gemini-Model", info.GeminiModel)
+
+	res, err := h.passthrough.do(r.Context(), body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "openai passthrough failed", slog.String("error", err.Error()))
+		http.Error(w, fmt.Sprintf("openai: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	for _, name := range passthroughHeaders {
+		if v := res.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	for name, v := range res.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ratelimit-") {
+			w.Header()[name] = v
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+
+	if req.Stream {
+		buf := make([]byte, 4096)
+		for {
+			n, err := res.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "read openai response failed", slog.String("error", err.Error()))
+		return
+	}
+	w.Write(b)
+
+	var resp openai.ChatCompletionResponse
+	if res.StatusCode == http.StatusOK && json.Unmarshal(b, &resp) == nil {
+		h.recordUsage(r, info, req, resp.Usage)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// modelPrice is the price of a model in USD per million tokens.
+type modelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+
+	// CachedInput is the price of the prompt tokens read from a context
+	// cache, the input price by default.
+	CachedInput *float64 `yaml:"cached_input"`
+}
+
+// pricing maps the Gemini or OpenAI model names to their price.
+type pricing map[string]modelPrice
+
+// Cost estimates the spend of the usage. The price of the Gemini model that
+// served the request is used, or the price of the requested model. The cost
+// is 0 for the models without a price.
+func (p pricing) Cost(info *goai.RequestInfo, u openai.Usage) float64 {
+	price, ok := p[strings.TrimPrefix(info.GeminiModel, "models/")]
+	if !ok {
+		price, ok = p[info.Model]
+	}
+	if !ok {
+		return 0
+	}
+
+	var cached int
+	if u.PromptTokensDetails != nil {
+		cached = u.PromptTokensDetails.CachedTokens
+	}
+
+	cachedPrice := price.Input
+	if price.CachedInput != nil {
+		cachedPrice = *price.CachedInput
+	}
+
+	return (float64(u.PromptTokens-cached)*price.Input +
+		float64(cached)*cachedPrice +
+		float64(u.CompletionTokens)*price.Output) / 1e6
+}
+
+// setCostHeader sets the estimated cost in USD of the request, when there is
+// a pricing table.
+func (h openaiHandler) setCostHeader(w http.ResponseWriter, cost float64) {
+	if h.pricing == nil {
+		return
+	}
+
+	w.Header().Set("X-Estimated-Cost", strconv.FormatFloat(cost, 'f', -1, 64))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// priority orders the requests waiting for a concurrency slot. The higher
+// priorities are dispatched first, e.g. interactive chat before batch jobs.
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorities = map[string]priority{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+// requestPriority returns the priority of the API key in the priority file,
+// or of the X-Priority header, normal by default. The API keys are identified
+// by their fingerprint, as in the usage records.
+func (h openaiHandler) requestPriority(r *http.Request) priority {
+	if p, ok := priorities[h.priorities[fingerprint(h.clientKey(r))]]; ok {
+		return p
+	}
+
+	if p, ok := priorities[strings.ToLower(r.Header.Get("X-Priority"))]; ok {
+		return p
+	}
+
+	return priorityNormal
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// bucket is the state of a token bucket, stored in the cache.
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// rateLimiter limits the rate per API key with token buckets that hold a
+// minute of tokens and refill continuously, like the OpenAI limits. The
+// buckets are stored in the cache, so that the replicas share them. The
+// replicas don't lock the buckets, so concurrent requests on different
+// replicas may exceed the limit slightly.
+type rateLimiter struct {
+	cache goai.Cache
+
+	// mu serializes the updates of the buckets within the replica.
+	mu sync.Mutex
+
+	// rpm and tpm are the requests and tokens per minute of each API key,
+	// which can be changed when the config is reloaded. Zero is unlimited.
+	rpm atomic.Int64
+	tpm atomic.Int64
+}
+
+func newRateLimiter(c goai.Cache, rpm, tpm int) *rateLimiter {
+	l := &rateLimiter{cache: c}
+	l.SetLimits(rpm, tpm)
+
+	return l
+}
+
+// SetLimits sets the requests and tokens per minute of each API key. It is
+// safe to call while serving requests.
+func (l *rateLimiter) SetLimits(rpm, tpm int) {
+	l.rpm.Store(int64(rpm))
+	l.tpm.Store(int64(tpm))
+}
+
+func (l *rateLimiter) RPM() int {
+	return int(l.rpm.Load())
+}
+
+func (l *rateLimiter) TPM() int {
+	return int(l.tpm.Load())
+}
+
+// rateLimit is the result of taking tokens from a bucket.
+type rateLimit struct {
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full, and RetryAfter the time
+	// until the tokens are available when they are not.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+func (rl rateLimit) Allowed() bool {
+	return rl.RetryAfter == 0
+}
+
+// Take takes n tokens from the bucket of the key, which refills limit tokens
+// per minute. Nothing is taken when there are not enough tokens.
+func (l *rateLimiter) Take(ctx context.Context, key string, n, limit int) (rateLimit, error) {
+	return l.update(ctx, key, limit, func(b *bucket) float64 {
+		if b.Tokens < float64(n) {
+			return float64(n) - b.Tokens
+		}
+
+		b.Tokens -= float64(n)
+		return 0
+	})
+}
+
+// Charge takes n tokens from the bucket of the key even when there are not
+// enough, e.g. to charge the tokens used over the estimate. A negative n
+// returns the tokens.
+func (l *rateLimiter) Charge(ctx context.Context, key string, n, limit int) error {
+	_, err := l.update(ctx, key, limit, func(b *bucket) float64 {
+		b.Tokens = math.Min(float64(limit), b.Tokens-float64(n))
+		return 0
+	})
+
+	return err
+}
+
+// update refills the bucket of the key and applies fn, which returns the
+// missing tokens when it can't take them.
+func (l *rateLimiter) update(ctx context.Context, key string, limit int, fn func(b *bucket) float64) (rateLimit, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(limit) / 60
+
+	b := bucket{Tokens: float64(limit), Updated: now}
+	v, ok, err := l.cache.Get(ctx, key)
+	if err != nil {
+		return rateLimit{}, err
+	}
+
+	if ok {
+		if err := json.Unmarshal(v, &b); err != nil {
+			return rateLimit{}, err
+		}
+
+		elapsed := now.Sub(b.Updated).Seconds()
+		b.Tokens = math.Min(float64(limit), b.Tokens+math.Max(0, elapsed)*perSecond)
+		b.Updated = now
+	}
+
+	rl := rateLimit{Limit: limit}
+	if missing := fn(&b); missing > 0 {
+		rl.RetryAfter = seconds(missing / perSecond)
+	}
+
+	rl.Remaining = int(math.Max(0, b.Tokens))
+	rl.Reset = seconds((float64(limit) - b.Tokens) / perSecond)
+
+	v, err = json.Marshal(b)
+	if err != nil {
+		return rateLimit{}, err
+	}
+
+	// The bucket is full again after a minute without requests, unless it is
+	// in debt.
+	ttl := time.Minute
+	if b.Tokens < 0 {
+		ttl = rl.Reset
+	}
+
+	if err := l.cache.Set(ctx, key, v, ttl); err != nil {
+		return rateLimit{}, err
+	}
+
+	return rl, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// limitRequests limits the requests per minute of each API key. The limit is
+// disabled when rpm is 0.
+func (h openaiHandler) limitRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rpm := h.limiter.RPM()
+		if rpm <= 0 {
+			next(w, r)
+			return
+		}
+
+		key := "ratelimit:requests:" + fingerprint(h.clientKey(r))
+		rl, err := h.limiter.Take(r.Context(), key, 1, rpm)
+		if err != nil {
+			// Let the requests through rather than failing them when the
+			// cache is unavailable.
+			logger.ErrorContext(r.Context(), "rate limit failed", slog.String("error", err.Error()))
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(rl.Limit))
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(rl.Remaining))
+		w.Header().Set("x-ratelimit-reset-requests", formatReset(rl.Reset))
+
+		if !rl.Allowed() {
+			writeRateLimitError(w, rl, "requests", fmt.Sprintf("Rate limit reached for requests per min (RPM): Limit %d. Please try again in %s.", rl.Limit, formatReset(rl.RetryAfter)))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeRateLimitError(w http.ResponseWriter, rl rateLimit, typ, msg string) {
+	if rl.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rl.RetryAfter.Seconds()))))
+	}
+
+	writeAPIError(w, &openai.APIError{
+		Code:           "rate_limit_exceeded",
+		Message:        msg,
+		Type:           typ,
+		HTTPStatusCode: http.StatusTooManyRequests,
+	})
+}
+
+// formatReset formats the duration like the OpenAI reset headers, e.g. "1s"
+// or "6m0s".
+func formatReset(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+
+	return d.Round(time.Second).String()
+}
+
+// countTokensTimeout is how long the token limit waits for the CountTokens
+// API before it estimates the prompt tokens instead.
+const countTokensTimeout = 2 * time.Second
+
+// limitTokens takes the tokens of the request, the prompt tokens plus
+// max_tokens, from the tokens per minute of the API key. It returns the
+// tokens taken, or false when the response was written.
+func (h openaiHandler) limitTokens(ctx context.Context, w http.ResponseWriter, r *http.Request, req openai.ChatCompletionRequest) (int, bool) {
+	tpm := h.limiter.TPM()
+	if tpm <= 0 {
+		return 0, true
+	}
+
+	tokens := h.promptTokens(ctx, req) + req.MaxTokens
+	rl, err := h.limiter.Take(r.Context(), tokensKey(h.clientKey(r)), tokens, tpm)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "rate limit failed", slog.String("error", err.Error()))
+		return 0, true
+	}
+
+	w.Header().Set("x-ratelimit-limit-tokens", strconv.Itoa(rl.Limit))
+	w.Header().Set("x-ratelimit-remaining-tokens", strconv.Itoa(rl.Remaining))
+	w.Header().Set("x-ratelimit-reset-tokens", formatReset(rl.Reset))
+
+	if !rl.Allowed() {
+		msg := fmt.Sprintf("Rate limit reached for tokens per min (TPM): Limit %d, Requested %d. Please try again in %s.", rl.Limit, tokens, formatReset(rl.RetryAfter))
+		if tokens > rl.Limit {
+			// Retrying doesn't help.
+			msg = fmt.Sprintf("Request too large for tokens per min (TPM): Limit %d, Requested %d. Reduce the messages or max_tokens.", rl.Limit, tokens)
+			rl.RetryAfter = 0
+		}
+
+		writeRateLimitError(w, rl, "tokens", msg)
+		return 0, false
+	}
+
+	return tokens, true
+}
+
+// promptTokens counts the prompt tokens with the CountTokens API of Gemini,
+// whose counts the adapter caches. It estimates them when the API fails or is
+// slow, and for the models of the other providers.
+func (h openaiHandler) promptTokens(ctx context.Context, req openai.ChatCompletionRequest) int {
+	ctx, cancel := context.WithTimeout(ctx, countTokensTimeout)
+	defer cancel()
+
+	n, err := h.adapter.CountPromptTokens(ctx, req)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			logger.WarnContext(ctx, "count tokens failed, estimating them", slog.String("error", err.Error()))
+		}
+
+		return goai.EstimatePromptTokens(req)
+	}
+
+	return n
+}
+
+// chargeTokens charges the difference between the tokens used and the tokens
+// taken by limitTokens. Failed requests return the tokens taken.
+func (h openaiHandler) chargeTokens(r *http.Request, taken int, u openai.Usage) {
+	tpm := h.limiter.TPM()
+	if tpm <= 0 {
+		return
+	}
+
+	if err := h.limiter.Charge(r.Context(), tokensKey(h.clientKey(r)), u.TotalTokens-taken, tpm); err != nil {
+		logger.ErrorContext(r.Context(), "rate limit failed", slog.String("error", err.Error()))
+	}
+}
+
+func tokensKey(apiKey string) string {
+	return "ratelimit:tokens:" + fingerprint(apiKey)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// decodeAPIError returns the OpenAI error of the response body.
+func decodeAPIError(t *testing.T, body string) *openai.APIError {
+	t.Helper()
+
+	var res openai.ErrorResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.Error == nil {
+		t.Fatalf("got %s, want an error response: %v", body, err)
+	}
+
+	return res.Error
+}
+
+func TestLimitRequests(t *testing.T) {
+	h := newTestHandler(t)
+	h.limiter.SetLimits(2, 0)
+
+	handler := h.limitRequests(func(w http.ResponseWriter, r *http.Request) {})
+
+	for i, want := range []string{"1", "0"} {
+		w := serve(handler, "key", "/chat/completions", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d, want 200", i, w.Code)
+		}
+		if got := w.Header().Get("x-ratelimit-remaining-requests"); got != want {
+			t.Errorf("request %d: remaining = %s, want %s", i, got, want)
+		}
+	}
+
+	w := serve(handler, "key", "/chat/completions", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30, the time to refill a request", got)
+	}
+	if err := decodeAPIError(t, w.Body.String()); err.Code != "rate_limit_exceeded" || err.Type != "requests" {
+		t.Errorf("got %+v, want a rate_limit_exceeded error of the requests", err)
+	}
+
+	// The other keys have their own bucket.
+	if w := serve(handler, "other-key", "/chat/completions", ""); w.Code != http.StatusOK {
+		t.Fatalf("other key: got %d, want 200", w.Code)
+	}
+
+	// The limit is disabled with 0.
+	h.limiter.SetLimits(0, 0)
+	if w := serve(handler, "key", "/chat/completions", ""); w.Code != http.StatusOK {
+		t.Fatalf("no limit: got %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHandler(t)
+
+	rl, err := h.limiter.Take(ctx, "bucket", 60, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl.Allowed() || rl.Remaining != 0 {
+		t.Fatalf("got %+v, want all the tokens taken", rl)
+	}
+
+	// The bucket refills a token per second.
+	b, err := json.Marshal(bucket{Tokens: 0, Updated: time.Now().Add(-30 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.limiter.cache.Set(ctx, "bucket", b, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	rl, err = h.limiter.Take(ctx, "bucket", 40, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.Allowed() || rl.RetryAfter < 9*time.Second || rl.RetryAfter > 10*time.Second {
+		t.Fatalf("got %+v, want to wait 10s for the missing tokens", rl)
+	}
+
+	rl, err = h.limiter.Take(ctx, "bucket", 30, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl.Allowed() || rl.Remaining != 0 {
+		t.Fatalf("got %+v, want the 30 refilled tokens taken", rl)
+	}
+}
+
+func TestLimitTokens(t *testing.T) {
+	h := newTestHandler(t)
+	h.limiter.SetLimits(0, 100)
+
+	req := openai.ChatCompletionRequest{
+		Model:     "gpt-4o",
+		Messages:  []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("word ", 40)}},
+		MaxTokens: 40,
+	}
+	limit := func(apiKey string, req openai.ChatCompletionRequest) (*http.Request, int, bool, *httptest.ResponseRecorder) {
+		r := newRequest(apiKey, "/chat/completions", "")
+		w := httptest.NewRecorder()
+		tokens, ok := h.limitTokens(r.Context(), w, r, req)
+		return r, tokens, ok, w
+	}
+
+	r, tokens, ok, w := limit("key", req)
+	if !ok || tokens < 40 {
+		t.Fatalf("got %d tokens, %t, want the prompt and max tokens taken", tokens, ok)
+	}
+	if got := w.Header().Get("x-ratelimit-remaining-tokens"); got == "" || got == "100" {
+		t.Errorf("remaining = %q, want the tokens left", got)
+	}
+
+	_, _, ok, w = limit("key", req)
+	if ok || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", w.Code)
+	}
+	if err := decodeAPIError(t, w.Body.String()); err.Type != "tokens" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %+v, want a tokens error to retry", err)
+	}
+
+	// The failed requests return their tokens.
+	h.chargeTokens(r, tokens, openai.Usage{})
+	if _, _, ok, w = limit("key", req); !ok {
+		t.Fatalf("got %d %s after the refund, want the tokens taken", w.Code, w.Body)
+	}
+
+	// The requests above the limit can't be retried.
+	req.MaxTokens = 200
+	_, _, ok, w = limit("other-key", req)
+	if ok || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q, want none", got)
+	}
+	if err := decodeAPIError(t, w.Body.String()); !strings.HasPrefix(err.Message, "Request too large") {
+		t.Errorf("message = %q, want a request too large", err.Message)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+)
+
+// readyTimeout bounds the upstream check of the readiness probe.
+const readyTimeout = 5 * time.Second
+
+// readiness checks that Gemini is reachable with the configured keys, so
+// that the orchestrators don't route traffic to an instance with a bad key
+// or a blocked egress. The result is cached for ttl, so that the probes
+// don't hit the Gemini quota.
+type readiness struct {
+	adapter *goai.Adapter
+	keys    func() []string
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	err       error
+	checkedAt time.Time
+}
+
+func newReadiness(a *goai.Adapter, keys func() []string, ttl time.Duration) *readiness {
+	return &readiness{adapter: a, keys: keys, ttl: ttl}
+}
+
+// check reports whether Gemini is reachable with any of the keys. The
+// instance is ready without keys, since the requests bring their own.
+func (r *readiness) check(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.checkedAt.IsZero() && time.Since(r.checkedAt) < r.ttl {
+		return r.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, key := range r.keys() {
+		err := r.adapter.Ping(goai.AuthContext(ctx, key))
+		if err == nil {
+			errs = nil
+			break
+		}
+
+		errs = append(errs, err)
+	}
+
+	r.err = errors.Join(errs...)
+	r.checkedAt = time.Now()
+
+	return r.err
+}
+
+// Ready responds 503 when Gemini is not reachable. Every instance is ready
+// when there is no check, e.g. in mock mode.
+func (r *readiness) Ready(w http.ResponseWriter, req *http.Request) {
+	if r != nil {
+		if err := r.check(req.Context()); err != nil {
+			logger.WarnContext(req.Context(), "not ready", slog.String("error", err.Error()))
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Not ready: gemini is not reachable"))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactionDetectors are the built-in detectors of the personal data and the
+// secrets. The phone numbers require a separator or a leading +, so that the
+// numbers of the JSON bodies, e.g. the timestamps, aren't redacted.
+var redactionDetectors = map[string]*regexp.Regexp{
+	"email":   regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	"phone":   regexp.MustCompile(`\+\d{8,15}\b|(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]\d{4}\b`),
+	"api_key": regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}|\bsk-[A-Za-z0-9_-]{20,}|\bAKIA[0-9A-Z]{16}\b`),
+}
+
+// redaction configures the redaction of the dumped bodies, e.g.
+//
+//	detectors: [email, api_key]
+//	patterns:
+//	  employee_id: 'EMP-\d{6}'
+type redaction struct {
+	// Detectors are the built-in detectors to use: email, phone and api_key.
+	// All are used by default.
+	Detectors []string `yaml:"detectors"`
+
+	// Patterns are the custom regular expressions by name.
+	Patterns map[string]string `yaml:"patterns"`
+}
+
+func defaultRedaction() redaction {
+	return redaction{Detectors: sortedKeys(redactionDetectors)}
+}
+
+type redactionRule struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+// redactor replaces the matches of the rules with [REDACTED:{name}], which
+// keeps the JSON bodies valid.
+type redactor struct {
+	rules []redactionRule
+}
+
+func newRedactor(r redaction) (*redactor, error) {
+	res := new(redactor)
+	for _, name := range r.Detectors {
+		re, ok := redactionDetectors[name]
+		if !ok {
+			return nil, errors.New("unknown detector " + name)
+		}
+
+		res.add(name, re)
+	}
+
+	// The patterns are applied in the order of their names, for the
+	// overlapping matches to be redacted the same way across restarts.
+	for _, name := range sortedKeys(r.Patterns) {
+		re, err := regexp.Compile(r.Patterns[name])
+		if err != nil {
+			return nil, err
+		}
+
+		res.add(name, re)
+	}
+
+	return res, nil
+}
+
+func (r *redactor) add(name string, re *regexp.Regexp) {
+	r.rules = append(r.rules, redactionRule{re: re, replacement: []byte("[REDACTED:" + name + "]")})
+}
+
+// Redact returns b without the matches of the rules.
+func (r *redactor) Redact(b []byte) []byte {
+	for _, rule := range r.rules {
+		b = rule.re.ReplaceAllLiteral(b, rule.replacement)
+	}
+
+	return b
+}
+
+func validateRedaction(path string, node *yaml.Node, r redaction) error {
+	var errs []error
+	for _, name := range r.Detectors {
+		if _, ok := redactionDetectors[name]; !ok {
+			errs = append(errs, configError(path, mappingValue(node, "detectors"), "unknown detector %q, expected email, phone or api_key", name))
+		}
+	}
+
+	for name, pattern := range r.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, configError(path, mappingValue(mappingValue(node, "patterns"), name), "%s: %v", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
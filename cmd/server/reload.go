@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// watchConfig reloads the config on SIGHUP, or when the config file changes,
+// until the context is canceled. The model mapping, routes, adapter settings
+// and rate limits are swapped without dropping the requests in flight; the
+// other settings require a restart. An invalid config is logged and the
+// previous one kept.
+func watchConfig(ctx context.Context, args []string, path string, a *goai.Adapter, limiter *rateLimiter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			modTime = fileModTime(path)
+		case <-ticker.C:
+			t := fileModTime(path)
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+		}
+
+		if err := reloadConfig(args, a, limiter); err != nil {
+			logger.ErrorContext(ctx, "config reload failed", slog.String("error", err.Error()))
+			continue
+		}
+
+		logger.InfoContext(ctx, "config reloaded")
+	}
+}
+
+// reloadConfig loads the config again from the args, the environment and
+// the config file, and applies it.
+func reloadConfig(args []string, a *goai.Adapter, limiter *rateLimiter) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	if err := a.SetConfig(adapterConfig(cfg)); err != nil {
+		return err
+	}
+	limiter.SetLimits(cfg.RPM, cfg.TPM)
+
+	return nil
+}
+
+// fileModTime returns the modification time of the file, or the zero time
+// when there is no file.
+func fileModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	goai "github.com/alextanhongpin/go-gemini"
+)
+
+// replayCmd sends the dumped requests to a proxy again, and diffs the new
+// responses against the dumped ones, e.g. to check that a conversion change
+// doesn't break the recorded traffic:
+//
+//	go run ./cmd/server replay -target http://localhost:8080 ./data/request-*.txt
+func replayCmd(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		target = fs.String("target", "http://localhost:8080", "base URL of the proxy to send the requests to")
+		apiKey = fs.String("key", os.Getenv("GEMINI_API_KEY"), "API key of the requests, as the dumps only have its fingerprint")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, pattern := range fs.Args() {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no dumped requests, expected request-{id}.txt files")
+	}
+
+	var differ int
+	var batchErr goai.BatchError
+	for i, path := range paths {
+		diffs, err := replayRequest(*target, *apiKey, path)
+		if err != nil {
+			batchErr.Add(i, err)
+			fmt.Printf("%s: error: %v\n", path, err)
+			continue
+		}
+
+		if len(diffs) > 0 {
+			differ++
+		}
+
+		for _, d := range diffs {
+			fmt.Printf("%s: %s\n", path, d)
+		}
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return fmt.Errorf("%d of %d responses differ, %d failed", differ, len(paths), len(batchErr.Errors))
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("%d of %d responses differ", differ, len(paths))
+	}
+
+	fmt.Printf("%d responses are identical\n", len(paths))
+	return nil
+}
+
+// replayRequest sends the dumped request of the path, and diffs the response
+// with the dumped response next to it.
+func replayRequest(target, apiKey, path string) ([]string, error) {
+	dir, name := filepath.Split(path)
+	id, ok := strings.CutPrefix(name, "request-")
+	if !ok {
+		return nil, fmt.Errorf("not a dumped request, expected request-{id}.txt")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dumped, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(dumped.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = os.ReadFile(filepath.Join(dir, "response-"+id))
+	if err != nil {
+		return nil, err
+	}
+
+	want, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), dumped)
+	if err != nil {
+		return nil, err
+	}
+	defer want.Body.Close()
+
+	req, err := http.NewRequest(dumped.Method, strings.TrimSuffix(target, "/")+dumped.RequestURI, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = dumped.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Del("Authorization")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	// Correlates the replayed request with the dumped one in the logs, and
+	// restores its ID in the response, e.g. in the error messages.
+	ids := strings.NewReplacer()
+	if rid := req.Header.Get("X-Request-ID"); rid != "" {
+		req.Header.Set("X-Request-ID", rid+"-replay")
+		ids = strings.NewReplacer(rid+"-replay", rid)
+	}
+
+	got, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer got.Body.Close()
+
+	var diffs []string
+	if got.StatusCode != want.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", want.StatusCode, got.StatusCode))
+	}
+
+	wantBody, err := replayBody(want, strings.NewReplacer())
+	if err != nil {
+		return nil, fmt.Errorf("dumped response: %w", err)
+	}
+
+	gotBody, err := replayBody(got, ids)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+
+	bodyDiffs, err := diffJSON("response", wantBody, gotBody)
+	return append(diffs, bodyDiffs...), err
+}
+
+// replayBody decodes the JSON body, or the chunks of the event stream,
+// without the generated fields that always differ. The request IDs are
+// replaced with ids.
+func replayBody(res *http.Response, ids *strings.Replacer) (any, error) {
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	body := ids.Replace(string(b))
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		var v any
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			return strings.TrimSpace(body), nil
+		}
+
+		return withoutGeneratedFields(v), nil
+	}
+
+	var chunks []any
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data:")
+		if data = strings.TrimSpace(data); !ok || data == "[DONE]" {
+			continue
+		}
+
+		var v any
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, withoutGeneratedFields(v))
+	}
+
+	return chunks, nil
+}
+
+func withoutGeneratedFields(v any) any {
+	if m, ok := v.(map[string]any); ok {
+		delete(m, "id")
+		delete(m, "created")
+		delete(m, "system_fingerprint")
+	}
+
+	return v
+}
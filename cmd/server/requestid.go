@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var requestIDContextKey contextKey = "request_id"
+
+// maxRequestIDLength bounds the request IDs sent by the clients, which are
+// logged as is.
+const maxRequestIDLength = 128
+
+// withRequestID identifies the requests with their X-Request-ID header, or a
+// generated ID when it is missing or invalid. The ID is returned in the
+// X-Request-ID header, and added to the logs, the span and the error messages,
+// so that the users can correlate a failed request with the server logs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.NewString()
+			r.Header.Set("X-Request-ID", id)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request_id", id))
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// validRequestID accepts the printable ASCII IDs, so that the clients can't
+// inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// errorMessage adds the request ID of the response to the error message.
+func errorMessage(w http.ResponseWriter, msg string) string {
+	if id := w.Header().Get("X-Request-ID"); id != "" {
+		return fmt.Sprintf("%s (request ID: %s)", msg, id)
+	}
+
+	return msg
+}
+
+// contextHandler adds the request ID of the context to the log records, for
+// the logs written with the *Context methods.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
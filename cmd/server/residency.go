@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// residency pins tenants to the regions where their prompts may be processed.
+type residency struct {
+	// Region is the Vertex region, e.g. europe-west4.
+	Region string `yaml:"region"`
+}
+
+// allowResidency writes the residency error when the tenant can't be served.
+func (h openaiHandler) allowResidency(w http.ResponseWriter, r *http.Request) bool {
+	if err := checkResidency(h.residency, r, h.tenant(r)); err != nil {
+		writeAPIError(w, err)
+		return false
+	}
+
+	return true
+}
+
+// checkResidency enforces the region the tenant is pinned to, and logs the
+// region of every pinned request for auditing. The Gemini API processes
+// prompts in any region, so pinned tenants are rejected until a regional
+// backend is configured.
+func checkResidency(pins map[string]residency, r *http.Request, tenant string) *openai.APIError {
+	pin, ok := pins[tenant]
+	if !ok {
+		return nil
+	}
+
+	logger.InfoContext(r.Context(), "residency",
+		slog.String("tenant", tenant),
+		slog.String("region", pin.Region),
+		slog.String("path", r.URL.Path),
+		slog.Bool("allowed", false),
+	)
+
+	return &openai.APIError{
+		Code:           "region_unavailable",
+		Message:        fmt.Sprintf("tenant %q is pinned to region %q, which is not available", tenant, pin.Region),
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusForbidden,
+	}
+}
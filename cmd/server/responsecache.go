@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// responseCache serves the identical chat requests of the same API key from
+// the cache, e.g. for dev environments and retry storms. Streamed requests are
+// not cached.
+type responseCache struct {
+	cache goai.Cache
+	ttl   time.Duration
+
+	// hits and misses count the cache lookups.
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// newResponseCache returns the response cache, or nil when the ttl is 0.
+func newResponseCache(c goai.Cache, ttl time.Duration) *responseCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &responseCache{
+		cache: c,
+		ttl:   ttl,
+	}
+}
+
+// responseCacheKey hashes the request with the API key, so that responses are
+// never shared across keys. The fields that don't change the response, like
+// the end-user ID and the metadata, are ignored.
+func responseCacheKey(apiKey string, req openai.ChatCompletionRequest, ext goai.Extensions) (string, error) {
+	req.User = ""
+	req.Metadata = nil
+	req.Store = false
+
+	b, err := json.Marshal(struct {
+		Request    openai.ChatCompletionRequest `json:"request"`
+		Extensions goai.Extensions              `json:"extensions"`
+	}{req, ext})
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(apiKey))
+	h.Write([]byte{0})
+	h.Write(b)
+
+	return "response:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get returns the cached response body. Cache errors are logged and counted
+// as misses.
+func (c *responseCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	b, ok, err := c.cache.Get(ctx, key)
+	if err != nil {
+		logger.ErrorContext(ctx, "get cached response failed", slog.String("error", err.Error()))
+	}
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+
+	return b, ok
+}
+
+// Set caches the response body.
+func (c *responseCache) Set(ctx context.Context, key string, b []byte) {
+	if err := c.cache.Set(ctx, key, b, c.ttl); err != nil {
+		logger.ErrorContext(ctx, "cache response failed", slog.String("error", err.Error()))
+	}
+}
+
+// responseCacheStats are the response cache metrics.
+type responseCacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func (c *responseCache) Stats() responseCacheStats {
+	s := responseCacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+	if n := s.Hits + s.Misses; n > 0 {
+		s.HitRate = float64(s.Hits) / float64(n)
+	}
+
+	return s
+}
+
+// ResponseCacheStats returns the response cache metrics.
+func (h adminHandler) ResponseCacheStats(w http.ResponseWriter, r *http.Request) {
+	if h.responses == nil {
+		http.Error(w, "response cache is disabled", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, h.responses.Stats())
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handleAPI serves the OpenAI endpoint on its path, and on its /v1 path,
+// which the OpenAI SDKs append to their base URL.
+func handleAPI(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, handler)
+	mux.HandleFunc("/v1"+pattern, handler)
+}
+
+// stripBasePath removes the base path of the requests, so that the routes
+// are served under it. The requests without it are served as is, e.g. the
+// health checks that reach the proxy directly.
+func stripBasePath(base string, next http.Handler) http.Handler {
+	if base == "" {
+		return next
+	}
+
+	stripped := http.StripPrefix(base, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base || strings.HasPrefix(r.URL.Path, base+"/") {
+			stripped.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+// secretSource reads secrets from an external store.
+type secretSource interface {
+	// Access returns the value of the secret and its version.
+	Access(ctx context.Context, name string) (value, version string, err error)
+}
+
+// contentVersion identifies the value of the secrets that have no version.
+func contentVersion(value string) string {
+	h := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(h[:4])
+}
+
+// envSecrets reads the secrets from environment variables.
+type envSecrets struct{}
+
+func (envSecrets) Access(ctx context.Context, name string) (string, string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return v, contentVersion(v), nil
+}
+
+// fileSecrets reads the secrets from files, e.g. mounted Kubernetes secrets.
+type fileSecrets struct{}
+
+func (fileSecrets) Access(ctx context.Context, name string) (string, string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	v := strings.TrimSpace(string(b))
+	return v, contentVersion(v), nil
+}
+
+// gcpSecrets reads the secrets from GCP Secret Manager, authenticated with
+// the application default credentials.
+type gcpSecrets struct {
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+func (s *gcpSecrets) Access(ctx context.Context, name string) (string, string, error) {
+	s.once.Do(func() {
+		s.client, s.err = google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/cloud-platform")
+	})
+	if s.err != nil {
+		return "", "", s.err
+	}
+
+	// Use the latest version, unless the name has one.
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	url := "https://secretmanager.googleapis.com/v1/" + name + ":access"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if err := googleapi.CheckResponse(res); err != nil {
+		return "", "", err
+	}
+
+	var body struct {
+		Name    string `json:"name"`
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", "", err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(body.Payload.Data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(b), path.Base(body.Name), nil
+}
+
+var secretSources = map[string]secretSource{
+	"env":  envSecrets{},
+	"file": fileSecrets{},
+	"gcp":  new(gcpSecrets),
+}
+
+// secret is a value read from a secret source, e.g. env:GEMINI_API_KEY,
+// file:/run/secrets/gemini or gcp:projects/p/secrets/gemini. It is refreshed
+// periodically, so that rotated secrets don't require a restart.
+type secret struct {
+	ref    string
+	source secretSource
+	name   string
+
+	mu      sync.RWMutex
+	value   string
+	version string
+}
+
+func newSecret(ctx context.Context, ref string) (*secret, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	source, known := secretSources[scheme]
+	if !ok || !known || name == "" {
+		return nil, fmt.Errorf("invalid secret %q, expected env:, file: or gcp: followed by the name", ref)
+	}
+
+	s := &secret{
+		ref:    ref,
+		source: source,
+		name:   name,
+	}
+	if err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Value returns the latest value of the secret.
+func (s *secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.value
+}
+
+// Refresh reads the secret again, and logs the new version when it changed.
+func (s *secret) Refresh(ctx context.Context) error {
+	value, version, err := s.source.Access(ctx, s.name)
+	if err != nil {
+		return fmt.Errorf("secret %s: %w", s.ref, err)
+	}
+
+	s.mu.Lock()
+	prev := s.version
+	s.value, s.version = value, version
+	s.mu.Unlock()
+
+	if prev != version {
+		logger.Info("secret loaded",
+			slog.String("secret", s.ref),
+			slog.String("version", version),
+			slog.String("previous_version", prev),
+		)
+	}
+
+	return nil
+}
+
+// refreshSecrets refreshes the secrets every interval until the context is
+// done. The previous values are kept when a refresh fails.
+func refreshSecrets(ctx context.Context, interval time.Duration, secrets []*secret) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		var errs []error
+		for _, s := range secrets {
+			errs = append(errs, s.Refresh(ctx))
+		}
+
+		if err := errors.Join(errs...); err != nil {
+			logger.Error("refresh secrets failed", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// smoothStream splits the content of large chunks into words, and paces them
+// at the given rate, so that typewriter UIs render naturally. Each word is
+// counted as a token.
+func smoothStream(ctx context.Context, in chan openai.ChatCompletionStreamResponse, tokensPerSecond float64) chan openai.ChatCompletionStreamResponse {
+	if tokensPerSecond <= 0 {
+		return in
+	}
+
+	interval := time.Duration(float64(time.Second) / tokensPerSecond)
+
+	out := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+
+		for res := range in {
+			for i, r := range splitChunk(res) {
+				if i > 0 {
+					select {
+					case <-time.After(interval):
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				// The upstream stream ends with the context too.
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// splitChunk splits a chunk with a single content delta into one chunk per
+// word. The finish reason is kept on the last chunk.
+func splitChunk(res openai.ChatCompletionStreamResponse) []openai.ChatCompletionStreamResponse {
+	if len(res.Choices) != 1 || len(res.Choices[0].Delta.ToolCalls) > 0 {
+		return []openai.ChatCompletionStreamResponse{res}
+	}
+
+	words := splitWords(res.Choices[0].Delta.Content)
+	if len(words) < 2 {
+		return []openai.ChatCompletionStreamResponse{res}
+	}
+
+	chunks := make([]openai.ChatCompletionStreamResponse, len(words))
+	for i, w := range words {
+		c := res
+		c.Choices = []openai.ChatCompletionStreamChoice{res.Choices[0]}
+		c.Choices[0].Delta.Content = w
+
+		// Only the first delta has the role, and only the last one the
+		// finish reason.
+		if i > 0 {
+			c.Choices[0].Delta.Role = ""
+		}
+
+		if i < len(words)-1 {
+			c.Choices[0].FinishReason = openai.FinishReasonNull
+		}
+
+		chunks[i] = c
+	}
+
+	return chunks
+}
+
+// splitWords splits the text after each run of whitespace, so that every
+// word keeps its trailing whitespace. The text is only split on rune
+// boundaries.
+func splitWords(s string) []string {
+	var words []string
+
+	start := 0
+	space := false
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+
+		if space {
+			words = append(words, s[start:i])
+			start = i
+			space = false
+		}
+	}
+
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+
+	return words
+}
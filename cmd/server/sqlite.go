@@ -0,0 +1,198 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteVirtualKeys stores the keys in an SQLite database, which the server
+// and the CLI can change concurrently without losing the writes of the
+// other.
+type sqliteVirtualKeys struct {
+	db *sql.DB
+}
+
+// openSQLiteVirtualKeys opens the database of the path, and creates it when
+// it doesn't exist.
+func openSQLiteVirtualKeys(path string) (*sqliteVirtualKeys, error) {
+	// The writers wait for each other instead of failing with SQLITE_BUSY,
+	// and WAL lets the server look up the keys while the CLI writes.
+	q := url.Values{
+		"_busy_timeout": {"5000"},
+		"_journal_mode": {"WAL"},
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys are stored as JSON, so that adding a setting doesn't need a
+	// migration. The hash is indexed to be unique.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS virtual_keys (
+		id   TEXT PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		data TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &sqliteVirtualKeys{db: db}, nil
+}
+
+func (s *sqliteVirtualKeys) Load() ([]*virtualKey, error) {
+	rows, err := s.db.Query(`SELECT data FROM virtual_keys ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*virtualKey
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var k virtualKey
+		if err := json.Unmarshal(data, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+
+	return keys, rows.Err()
+}
+
+// Find queries the key by the index of its hash, instead of loading them
+// all on every request.
+func (s *sqliteVirtualKeys) Find(hash string) (*virtualKey, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM virtual_keys WHERE hash = ?`, hash).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var k virtualKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+func (s *sqliteVirtualKeys) Put(k *virtualKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO virtual_keys (id, hash, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET hash = excluded.hash, data = excluded.data`,
+		k.ID, k.Hash, string(data))
+	return err
+}
+
+// sqliteDumps stores the dumps in an SQLite database, e.g. to query them
+// with the sqlite3 CLI.
+type sqliteDumps struct {
+	db *sql.DB
+}
+
+func openSQLiteDumps(path string) (*sqliteDumps, error) {
+	q := url.Values{
+		"_busy_timeout": {"5000"},
+		"_journal_mode": {"WAL"},
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// The time is in Unix nanoseconds, indexed for the retention.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dumps (
+		id       TEXT PRIMARY KEY,
+		time     INTEGER NOT NULL,
+		request  BLOB NOT NULL,
+		response BLOB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS dumps_time ON dumps (time)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &sqliteDumps{db: db}, nil
+}
+
+func (s *sqliteDumps) Save(ctx context.Context, d dump) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO dumps (id, time, request, response) VALUES (?, ?, ?, ?)`,
+		d.ID, d.Time.UnixNano(), d.Request, d.Response)
+	return err
+}
+
+func (s *sqliteDumps) Get(ctx context.Context, id string) (*dump, error) {
+	d := dump{ID: id}
+
+	var t int64
+	err := s.db.QueryRowContext(ctx, `SELECT time, request, response FROM dumps WHERE id = ?`, id).Scan(&t, &d.Request, &d.Response)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: dump %q", os.ErrNotExist, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.Time = time.Unix(0, t)
+	return &d, nil
+}
+
+func (s *sqliteDumps) Prune(ctx context.Context, now time.Time, maxFiles int, maxAge time.Duration) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time FROM dumps`)
+	if err != nil {
+		return 0, err
+	}
+
+	var dumps []storedDump
+	for rows.Next() {
+		var (
+			id string
+			t  int64
+		)
+		if err := rows.Scan(&id, &t); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		dumps = append(dumps, storedDump{name: id, time: time.Unix(0, t)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := expiredDumps(dumps, now, maxFiles, maxAge)
+
+	var errs []error
+	for _, d := range expired {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM dumps WHERE id = ?`, d.name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return len(expired), errors.Join(errs...)
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package main
+
+import "fmt"
+
+// openSQLiteVirtualKeys fails, since the SQLite driver of sqlite.go needs
+// cgo.
+func openSQLiteVirtualKeys(path string) (virtualKeyBackend, error) {
+	return nil, fmt.Errorf("%s: %w, or use a .json file", path, errNoSQLite)
+}
+
+func openSQLiteDumps(path string) (dumpStore, error) {
+	return nil, fmt.Errorf("%s: %w, or use a file:, gcs: or s3: store", path, errNoSQLite)
+}
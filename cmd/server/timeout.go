@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// timeoutHeaders are the request headers with the client timeout, in
+// seconds or as a duration, e.g. 30 or 30s. The OpenAI SDKs send
+// X-Stainless-Timeout.
+var timeoutHeaders = []string{"X-Request-Timeout", "X-Stainless-Timeout"}
+
+// requestTimeout returns the time limit of the upstream call: the client
+// timeout when shorter than the configured one, which is the default.
+// There is no limit when neither is set.
+func (h openaiHandler) requestTimeout(r *http.Request) time.Duration {
+	timeout := h.timeout
+	for _, name := range timeoutHeaders {
+		d, ok := parseTimeout(r.Header.Get(name))
+		if !ok {
+			continue
+		}
+
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+		break
+	}
+
+	return timeout
+}
+
+// upstreamContext bounds the upstream call with the request timeout.
+func (h openaiHandler) upstreamContext(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := h.requestTimeout(r)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+func parseTimeout(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		if secs <= 0 {
+			return 0, false
+		}
+
+		return time.Duration(secs * float64(time.Second)), true
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+
+	return d, true
+}
+
+var errRequestTimeout = &openai.APIError{
+	Code:           "timeout",
+	Message:        "Request timed out waiting for Gemini.",
+	Type:           "server_error",
+	HTTPStatusCode: http.StatusGatewayTimeout,
+}
+
+// maxStreamPeekSize bounds the body read by relaxStreamWrites without
+// -max-body-size. The streams with larger bodies keep the write timeout.
+const maxStreamPeekSize = 10 << 20
+
+// relaxStreamWrites lifts the write timeout of the server for the streamed
+// chat completions, which last as long as the completion. The deadline runs
+// from the end of the request headers, so it is cleared before the request
+// waits in the conversation and concurrency queues, or for the retries of
+// the upstream call. It runs after the authentication, so that only the
+// clients with a key buffer their body and hold the connections open.
+func (h openaiHandler) relaxStreamWrites(next http.HandlerFunc) http.HandlerFunc {
+	if h.writeTimeout <= 0 {
+		return next
+	}
+
+	limit := h.maxBodySize
+	if limit <= 0 {
+		limit = maxStreamPeekSize
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The body is read up to its size limit, which is enforced by the
+		// handler on the whole body. The rest of a larger body is left to
+		// the handler, and the truncated JSON isn't a stream.
+		body := io.LimitReader(r.Body, limit)
+
+		b, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		if json.Unmarshal(b, &req) == nil && req.Stream {
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+				logger.WarnContext(r.Context(), "lift write timeout failed", slog.String("error", err.Error()))
+			}
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelaxStreamWrites(t *testing.T) {
+	h := newTestHandler(t)
+	h.writeTimeout = 50 * time.Millisecond
+	h.maxBodySize = 1 << 10
+	h.virtualKeys = newTestVirtualKeys(t, filepath.Join(t.TempDir(), "keys.json"))
+
+	key, _, err := h.virtualKeys.Create(virtualKey{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler writes after the write timeout, which only the relaxed
+	// streams survive.
+	handler := h.authenticate(h.relaxStreamWrites(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		time.Sleep(2 * h.writeTimeout)
+		w.Write(b)
+	}))
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.WriteTimeout = h.writeTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	stream := `{"stream": true, "messages": []}`
+	tests := []struct {
+		name   string
+		apiKey string
+		body   string
+		want   bool
+	}{
+		{"stream", key, stream, true},
+		{"not streamed", key, `{"stream": false}`, false},
+		{"unauthenticated", "sk-gemini", stream, false},
+		{"body above the max size", key, `{"stream": true, "padding": "` + strings.Repeat("x", 2<<10) + `"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Authorization", "Bearer "+tt.apiKey)
+
+			res, err := http.DefaultClient.Do(r)
+			var got string
+			if err == nil {
+				b, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				got = string(b)
+			}
+
+			if relaxed := got == tt.body; relaxed != tt.want {
+				t.Fatalf("relaxed = %t, want %t (%v)", relaxed, tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newTLSConfig returns the TLS config of the server, or nil to serve plain
+// HTTP when neither the certificate files nor the autocert domains are set.
+func newTLSConfig(cfg *config) (*tls.Config, error) {
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertDir),
+		}
+
+		tc := m.TLSConfig()
+		tc.MinVersion = tls.VersionTLS12
+		return tc, nil
+	case cfg.TLSCert != "":
+		c := &certFile{certFile: cfg.TLSCert, keyFile: cfg.TLSKey}
+		if _, err := c.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: c.GetCertificate,
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// certFile loads the certificate from the files again when they change, so
+// that the renewed certificates are served without a restart.
+type certFile struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := fileModTime(c.certFile)
+	if c.cert != nil && t.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// The files may be written one after the other.
+			logger.Warn("reload certificate failed", slog.String("error", err.Error()))
+			return c.cert, nil
+		}
+
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+
+	if c.cert != nil {
+		logger.Info("certificate reloaded", slog.String("file", c.certFile))
+	}
+	c.cert = &cert
+	c.modTime = t
+
+	return c.cert, nil
+}
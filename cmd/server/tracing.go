@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+)
+
+// tracer creates the spans of the handlers.
+var tracer = otel.Tracer("github.com/alextanhongpin/go-gemini/cmd/server")
+
+// setupTracing continues the traces of the incoming traceparent headers, and
+// propagates them to Gemini. The spans are dropped unless logSpans is set,
+// which logs them when they end.
+func setupTracing(logSpans bool) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if logSpans {
+		otel.SetTracerProvider(&logTracerProvider{})
+	}
+}
+
+// traceRequests starts a server span per request, named after the route
+// pattern that serves it.
+func traceRequests(mux *http.ServeMux, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, "gemini-proxy",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, route := mux.Handler(r)
+			return r.Method + " " + route
+		}),
+	)
+}
+
+// logTracerProvider logs the spans, for the deployments without a tracing
+// backend.
+type logTracerProvider struct {
+	embedded.TracerProvider
+}
+
+func (p *logTracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return &logTracer{provider: p, scope: name}
+}
+
+type logTracer struct {
+	embedded.Tracer
+
+	provider *logTracerProvider
+	scope    string
+}
+
+func (t *logTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+
+	parent := trace.SpanContextFromContext(ctx)
+	if cfg.NewRoot() {
+		parent = trace.SpanContext{}
+	}
+
+	traceID := parent.TraceID()
+	if !traceID.IsValid() {
+		rand.Read(traceID[:])
+	}
+
+	var spanID trace.SpanID
+	rand.Read(spanID[:])
+
+	s := &logSpan{
+		tracer: t,
+		name:   name,
+		parent: parent,
+		kind:   cfg.SpanKind(),
+		start:  time.Now(),
+		attrs:  cfg.Attributes(),
+		sc: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}),
+	}
+	if s.kind == trace.SpanKindUnspecified {
+		s.kind = trace.SpanKindInternal
+	}
+	if !cfg.Timestamp().IsZero() {
+		s.start = cfg.Timestamp()
+	}
+
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type logSpan struct {
+	embedded.Span
+
+	tracer *logTracer
+	parent trace.SpanContext
+	sc     trace.SpanContext
+	kind   trace.SpanKind
+	start  time.Time
+
+	mu     sync.Mutex
+	name   string
+	attrs  []attribute.KeyValue
+	events []string
+	status codes.Code
+	desc   string
+	ended  bool
+}
+
+func (s *logSpan) End(options ...trace.SpanEndOption) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	end := time.Now()
+	if cfg := trace.NewSpanEndConfig(options...); !cfg.Timestamp().IsZero() {
+		end = cfg.Timestamp()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("name", s.name),
+		slog.String("scope", s.tracer.scope),
+		slog.String("kind", s.kind.String()),
+		slog.String("trace_id", s.sc.TraceID().String()),
+		slog.String("span_id", s.sc.SpanID().String()),
+		slog.Duration("duration", end.Sub(s.start)),
+	}
+	if s.parent.SpanID().IsValid() {
+		attrs = append(attrs, slog.String("parent_id", s.parent.SpanID().String()))
+	}
+	if len(s.attrs) > 0 {
+		group := make([]any, len(s.attrs))
+		for i, kv := range s.attrs {
+			group[i] = slog.Any(string(kv.Key), kv.Value.AsInterface())
+		}
+		attrs = append(attrs, slog.Group("attributes", group...))
+	}
+	if len(s.events) > 0 {
+		attrs = append(attrs, slog.Any("events", s.events))
+	}
+	if s.status == codes.Error {
+		attrs = append(attrs, slog.String("error", s.desc))
+	}
+
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "span", attrs...)
+}
+
+func (s *logSpan) AddEvent(name string, options ...trace.EventOption) {
+	s.mu.Lock()
+	s.events = append(s.events, name)
+	s.mu.Unlock()
+}
+
+func (s *logSpan) AddLink(link trace.Link) {}
+
+func (s *logSpan) IsRecording() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.ended
+}
+
+func (s *logSpan) RecordError(err error, options ...trace.EventOption) {
+	if err != nil {
+		s.AddEvent("exception: " + err.Error())
+	}
+}
+
+func (s *logSpan) SpanContext() trace.SpanContext {
+	return s.sc
+}
+
+func (s *logSpan) SetStatus(code codes.Code, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// An ok status can't be changed.
+	if s.status == codes.Ok || code < s.status {
+		return
+	}
+
+	s.status = code
+	if code == codes.Error {
+		s.desc = description
+	}
+}
+
+func (s *logSpan) SetName(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *logSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.mu.Lock()
+	s.attrs = append(s.attrs, kv...)
+	s.mu.Unlock()
+}
+
+func (s *logSpan) TracerProvider() trace.TracerProvider {
+	return s.tracer.provider
+}
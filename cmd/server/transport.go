@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// newGeminiTransport returns the transport of the Gemini API calls, with the
+// proxy, the CAs and the timeouts of the config. The proxy defaults to the
+// one of the HTTPS_PROXY and NO_PROXY environment variables.
+func newGeminiTransport(cfg *config) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.GeminiProxy != "" {
+		u, err := url.Parse(cfg.GeminiProxy)
+		if err != nil {
+			return nil, fmt.Errorf("gemini proxy: %w", err)
+		}
+
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if cfg.GeminiCAFile != "" {
+		pem, err := os.ReadFile(cfg.GeminiCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("gemini CA file: %w", err)
+		}
+
+		// The CAs are added to the system ones, so that Gemini is still
+		// trusted when the proxy is not intercepting.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("gemini CA file: no certificate in %s", cfg.GeminiCAFile)
+		}
+
+		t.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+	}
+
+	if cfg.GeminiDialTimeout > 0 {
+		d := &net.Dialer{
+			Timeout:   cfg.GeminiDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = d.DialContext
+	}
+	t.ResponseHeaderTimeout = cfg.GeminiHeaderTimeout
+
+	return t, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// usageRecord is the usage of a single chat completion request.
+type usageRecord struct {
+	Time             time.Time         `json:"time"`
+	Key              string            `json:"key"`
+	VirtualKey       string            `json:"virtual_key,omitempty"`
+	Tenant           string            `json:"tenant,omitempty"`
+	Model            string            `json:"model"`
+	Client           string            `json:"client,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	PromptTokens     int               `json:"prompt_tokens"`
+	CompletionTokens int               `json:"completion_tokens"`
+	Cost             float64           `json:"cost"`
+}
+
+type usageFilter struct {
+	From   time.Time
+	To     time.Time
+	Tenant string
+
+	// Key matches the fingerprint of the upstream key, or the ID of the
+	// virtual key.
+	Key string
+}
+
+func (f usageFilter) match(r usageRecord) bool {
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !r.Time.Before(f.To) {
+		return false
+	}
+
+	if f.Key != "" && f.Key != r.Key && f.Key != r.VirtualKey {
+		return false
+	}
+
+	return f.Tenant == "" || f.Tenant == r.Tenant
+}
+
+// usageStore appends usage records as JSON lines to a file, so that they
+// can be exported by both the server and the CLI.
+type usageStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newUsageStore(path string) *usageStore {
+	return &usageStore{path: path}
+}
+
+func (s *usageStore) Add(r usageRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *usageStore) List(filter usageFilter) ([]usageRecord, error) {
+	var res []usageRecord
+	err := s.Each(filter, func(r usageRecord) error {
+		res = append(res, r)
+		return nil
+	})
+
+	return res, err
+}
+
+// Each calls fn with the records that match the filter, in the order they
+// were added, until fn fails. The records added meanwhile are skipped, so
+// that a slow reader, e.g. an export to a remote client, doesn't block the
+// requests.
+func (s *usageStore) Each(filter usageFilter, fn func(usageRecord) error) error {
+	s.mu.Lock()
+	f, err := os.Open(s.path)
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			size = fi.Size()
+		} else {
+			f.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The records are appended whole, so the size ends with a record.
+	sc := bufio.NewScanner(io.LimitReader(f, size))
+	for sc.Scan() {
+		var r usageRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return err
+		}
+
+		if !filter.match(r) {
+			continue
+		}
+
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
+
+// usageRow is the usage aggregated per key, tenant, model and day.
+type usageRow struct {
+	Day              string  `json:"day"`
+	Key              string  `json:"key"`
+	VirtualKey       string  `json:"virtual_key,omitempty"`
+	Tenant           string  `json:"tenant,omitempty"`
+	Model            string  `json:"model"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func aggregateUsage(records []usageRecord) []usageRow {
+	type groupKey struct {
+		day, key, virtualKey, tenant, model string
+	}
+
+	rows := make(map[groupKey]*usageRow)
+	for _, r := range records {
+		k := groupKey{
+			day:        r.Time.UTC().Format(time.DateOnly),
+			key:        r.Key,
+			virtualKey: r.VirtualKey,
+			tenant:     r.Tenant,
+			model:      r.Model,
+		}
+
+		row, ok := rows[k]
+		if !ok {
+			row = &usageRow{
+				Day:        k.day,
+				Key:        k.key,
+				VirtualKey: k.virtualKey,
+				Tenant:     k.tenant,
+				Model:      k.model,
+			}
+			rows[k] = row
+		}
+
+		row.Requests++
+		row.PromptTokens += r.PromptTokens
+		row.CompletionTokens += r.CompletionTokens
+		row.Cost += r.Cost
+	}
+
+	res := make([]usageRow, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, *row)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.VirtualKey != b.VirtualKey {
+			return a.VirtualKey < b.VirtualKey
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+
+		return a.Model < b.Model
+	})
+
+	return res
+}
+
+func writeUsageCSV(w io.Writer, rows []usageRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{
+		"day",
+		"key",
+		"virtual_key",
+		"tenant",
+		"model",
+		"requests",
+		"prompt_tokens",
+		"completion_tokens",
+		"total_tokens",
+		"cost",
+	}); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := cw.Write([]string{
+			row.Day,
+			row.Key,
+			row.VirtualKey,
+			row.Tenant,
+			row.Model,
+			strconv.Itoa(row.Requests),
+			strconv.Itoa(row.PromptTokens),
+			strconv.Itoa(row.CompletionTokens),
+			strconv.Itoa(row.PromptTokens + row.CompletionTokens),
+			strconv.FormatFloat(row.Cost, 'f', -1, 64),
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
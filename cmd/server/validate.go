@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"text/template"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"gopkg.in/yaml.v3"
+)
+
+var geminiModelPattern = regexp.MustCompile(`^(models/|tunedModels/)?[a-z0-9][a-z0-9.-]*$`)
+
+// decodeYAMLFile decodes the file strictly, rejecting unknown fields, and
+// returns the parsed node to report the line of invalid values.
+func decodeYAMLFile(path string, v any) (*yaml.Node, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal(b, &node); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Unwrap the document node.
+	if len(node.Content) > 0 {
+		return node.Content[0], nil
+	}
+
+	return &node, nil
+}
+
+// configError reports an invalid value with the file and line it is defined.
+func configError(path string, node *yaml.Node, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if node == nil {
+		return fmt.Errorf("%s: %s", path, msg)
+	}
+
+	return fmt.Errorf("%s:%d: %s", path, node.Line, msg)
+}
+
+// mappingValue returns the value node of the key in the mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// sequenceItem returns the i-th item of the sequence node.
+func sequenceItem(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+
+	return node.Content[i]
+}
+
+func validateModelMapping(path string, node *yaml.Node, m map[string]string) error {
+	var errs []error
+	for k, v := range m {
+		if !geminiModelPattern.MatchString(v) {
+			errs = append(errs, configError(path, mappingValue(node, k), "%s: invalid gemini model name %q", k, v))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateRoutes(path string, node *yaml.Node, routes []goai.Route) error {
+	var errs []error
+
+	// The first route with the same conditions wins, so the others are
+	// never used.
+	seen := make(map[string]int)
+
+	for i, r := range routes {
+		item := sequenceItem(node, i)
+
+		if r.Model == "" {
+			errs = append(errs, configError(path, item, "route %d: model is required", i))
+		} else if !geminiModelPattern.MatchString(r.Model) {
+			errs = append(errs, configError(path, mappingValue(item, "model"), "route %d: invalid gemini model name %q", i, r.Model))
+		}
+
+		if r.ModelPattern != "" {
+			if _, err := regexp.Compile(r.ModelPattern); err != nil {
+				errs = append(errs, configError(path, mappingValue(item, "model_pattern"), "route %d: invalid model_pattern: %v", i, err))
+			}
+		}
+
+		if r.MaxPromptTokens > 0 && r.MinPromptTokens > r.MaxPromptTokens {
+			errs = append(errs, configError(path, mappingValue(item, "min_prompt_tokens"), "route %d: min_prompt_tokens is greater than max_prompt_tokens", i))
+		}
+
+		if r.HeaderValue != "" && r.Header == "" {
+			errs = append(errs, configError(path, mappingValue(item, "header_value"), "route %d: header_value requires header", i))
+		}
+
+		key := routeConditions(r)
+		if j, ok := seen[key]; ok {
+			errs = append(errs, configError(path, item, "route %d overlaps with route %d and is never used", i, j))
+			continue
+		}
+
+		if prev, ok := seen[""]; ok {
+			errs = append(errs, configError(path, item, "route %d is never used, route %d matches all requests", i, prev))
+			continue
+		}
+
+		seen[key] = i
+	}
+
+	return errors.Join(errs...)
+}
+
+// routeConditions returns a key identifying the conditions of the route, which
+// is empty when the route matches all requests.
+func routeConditions(r goai.Route) string {
+	var images string
+	if r.Images != nil {
+		images = fmt.Sprint(*r.Images)
+	}
+
+	if r.ModelPattern == "" && r.MinPromptTokens == 0 && r.MaxPromptTokens == 0 && images == "" && r.Header == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%q %d %d %s %q %q", r.ModelPattern, r.MinPromptTokens, r.MaxPromptTokens, images, r.Header, r.HeaderValue)
+}
+
+func validateDegraded(path string, node *yaml.Node, responses map[string]degradedResponse) error {
+	var errs []error
+	for model, r := range responses {
+		if r.Content == "" && !r.Cached {
+			errs = append(errs, configError(path, mappingValue(node, model), "%s: content or cached is required", model))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateMockResponses(path string, node *yaml.Node, responses map[string]mockResponse) error {
+	var errs []error
+	for model, r := range responses {
+		if _, err := template.New(model).Parse(r.Content); err != nil {
+			errs = append(errs, configError(path, mappingValue(node, model), "%s: invalid content template: %v", model, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateResidency(path string, node *yaml.Node, pins map[string]residency) error {
+	var errs []error
+	for tenant, pin := range pins {
+		if pin.Region == "" {
+			errs = append(errs, configError(path, mappingValue(node, tenant), "%s: region is required", tenant))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validatePriorities(path string, node *yaml.Node, keys map[string]string) error {
+	var errs []error
+	for key, p := range keys {
+		if _, ok := priorities[p]; !ok {
+			errs = append(errs, configError(path, mappingValue(node, key), "%s: unknown priority %q, expected high, normal or low", key, p))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateTenants(path string, node *yaml.Node, keys map[string]string) error {
+	var errs []error
+	for key, tenant := range keys {
+		if tenant == "" {
+			errs = append(errs, configError(path, mappingValue(node, key), "%s: tenant is required", key))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateFallbacks(path string, node *yaml.Node, fallbacks map[string][]string) error {
+	var errs []error
+	for model, chain := range fallbacks {
+		if len(chain) == 0 {
+			errs = append(errs, configError(path, mappingValue(node, model), "%s: fallback models are required", model))
+		}
+
+		for _, m := range chain {
+			if !geminiModelPattern.MatchString(m) {
+				errs = append(errs, configError(path, mappingValue(node, model), "%s: invalid gemini model name %q", model, m))
+			}
+
+			if m == model {
+				errs = append(errs, configError(path, mappingValue(node, model), "%s: the model can't fall back to itself", model))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validatePricing(path string, node *yaml.Node, prices pricing) error {
+	var errs []error
+	for model, p := range prices {
+		if p.Input < 0 || p.Output < 0 || (p.CachedInput != nil && *p.CachedInput < 0) {
+			errs = append(errs, configError(path, mappingValue(node, model), "%s: prices can't be negative", model))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateBudgets(path string, node *yaml.Node, budgets map[string]budget) error {
+	var errs []error
+	for tenant, b := range budgets {
+		if err := b.validate(); err != nil {
+			errs = append(errs, configError(path, mappingValue(node, tenant), "%s: %v", tenant, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/sashabaranov/go-openai"
+)
+
+// virtualKeyPrefix marks the keys issued by the proxy, which are looked up in
+// the virtual key store instead of being forwarded to Gemini.
+const virtualKeyPrefix = "sk-vk-"
+
+var (
+	errVirtualKeyNotFound = errors.New("virtual key not found")
+	errVirtualKeyRevoked  = errors.New("virtual key revoked")
+
+	// errNoSQLite is returned for the SQLite stores by the servers built
+	// with CGO_ENABLED=0, since the driver is written in C.
+	errNoSQLite = errors.New("SQLite needs a server built with CGO_ENABLED=1")
+)
+
+// virtualKey is a key issued by the proxy. Only the hash of the key is
+// stored, so the key is shown once when it is created.
+type virtualKey struct {
+	ID        string         `json:"id"`
+	Hash      string         `json:"hash,omitempty"`
+	Owner     string         `json:"owner"`
+	Tenant    string         `json:"tenant,omitempty"`
+	Models    []string       `json:"models,omitempty"`
+	Upstream  string         `json:"upstream,omitempty"`
+	Budget    *budget        `json:"budget,omitempty"`
+	ParamMode goai.ParamMode `json:"param_mode,omitempty"`
+	Debug     bool           `json:"debug,omitempty"`
+	VertexAI  *goai.VertexAI `json:"vertex_ai,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty"`
+	RotatedAt *time.Time     `json:"rotated_at,omitempty"`
+	RevokedAt *time.Time     `json:"revoked_at,omitempty"`
+}
+
+// allows reports whether the key may use the model. All models are allowed
+// when the key has no list.
+func (k *virtualKey) allows(model string) bool {
+	return len(k.Models) == 0 || slices.Contains(k.Models, model)
+}
+
+func (k *virtualKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// redacted returns the key without its hash, to show it in the admin API.
+func (k *virtualKey) redacted() *virtualKey {
+	c := *k
+	c.Hash = ""
+	return &c
+}
+
+func hashVirtualKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// newVirtualKey returns a random key and its ID.
+func newVirtualKey() (key, id string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	key = virtualKeyPrefix + hex.EncodeToString(b)
+	return key, "vk_" + hashVirtualKey(key)[:12], nil
+}
+
+// virtualKeyStore stores the virtual keys, so that both the server and the
+// CLI can manage them.
+type virtualKeyStore struct {
+	mu      sync.Mutex
+	backend virtualKeyBackend
+
+	// upstreams are the secrets of the upstream keys, read once per
+	// refresh interval.
+	refresh   time.Duration
+	upstreams map[string]*upstreamSecret
+}
+
+type upstreamSecret struct {
+	secret *secret
+	loaded time.Time
+}
+
+// newVirtualKeyStore returns the store of the path: a JSON file when it ends
+// with .json, e.g. for the keys kept in git, and an SQLite database
+// otherwise.
+func newVirtualKeyStore(path string, refresh time.Duration) (*virtualKeyStore, error) {
+	var backend virtualKeyBackend
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		backend = &fileVirtualKeys{path: path}
+	} else {
+		db, err := openSQLiteVirtualKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		backend = db
+	}
+
+	return &virtualKeyStore{
+		backend:   backend,
+		refresh:   refresh,
+		upstreams: make(map[string]*upstreamSecret),
+	}, nil
+}
+
+// virtualKeyBackend persists the keys. The changes are serialized by the
+// store, while Find is called concurrently by the requests.
+type virtualKeyBackend interface {
+	// Load returns all the keys, which the caller may not modify.
+	Load() ([]*virtualKey, error)
+
+	// Find returns the key of the hash, or nil when there is none, which the
+	// caller may not modify.
+	Find(hash string) (*virtualKey, error)
+
+	// Put inserts the key, or replaces the one with its ID.
+	Put(k *virtualKey) error
+}
+
+// fileVirtualKeys stores the keys in a JSON file. The file is rewritten on
+// every change, which is fine for the few keys of a proxy.
+type fileVirtualKeys struct {
+	path string
+
+	// keys are the keys read from the file, until it is modified, and
+	// byHash indexes them for the lookups.
+	mu      sync.Mutex
+	keys    []*virtualKey
+	byHash  map[string]*virtualKey
+	modTime time.Time
+}
+
+// Load returns the keys of the file, read again when it was modified, e.g.
+// by the CLI.
+func (s *fileVirtualKeys) Load() ([]*virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load()
+}
+
+func (s *fileVirtualKeys) Find(hash string) (*virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s.byHash[hash], nil
+}
+
+func (s *fileVirtualKeys) load() ([]*virtualKey, error) {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys, s.byHash, s.modTime = nil, nil, time.Time{}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.ModTime().Equal(s.modTime) {
+		return slices.Clone(s.keys), nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*virtualKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	byHash := make(map[string]*virtualKey, len(keys))
+	for _, k := range keys {
+		byHash[k.Hash] = k
+	}
+
+	s.keys, s.byHash, s.modTime = keys, byHash, fi.ModTime()
+
+	// The modification time has the resolution of the clock ticks, so a
+	// file written again within the tick looks unchanged. The files modified
+	// in the last second are read again until they are older.
+	if time.Since(fi.ModTime()) < time.Second {
+		s.modTime = time.Time{}
+	}
+
+	return slices.Clone(keys), nil
+}
+
+func (s *fileVirtualKeys) Put(k *virtualKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(keys, func(v *virtualKey) bool {
+		return v.ID == k.ID
+	})
+	if i < 0 {
+		keys = append(keys, k)
+	} else {
+		keys[i] = k
+	}
+
+	return s.save(keys)
+}
+
+// save replaces the file atomically, so that a crash never leaves it
+// truncated.
+func (s *fileVirtualKeys) save(keys []*virtualKey) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+
+	// Read the file again on the next load, even if the modification time
+	// didn't change.
+	s.modTime = time.Time{}
+
+	return nil
+}
+
+// Create issues a key. The upstream is the secret with the Gemini API key of
+// the requests, e.g. env:GEMINI_API_KEY, or the upstream keys when empty.
+func (s *virtualKeyStore) Create(k virtualKey) (string, *virtualKey, error) {
+	if k.Upstream != "" {
+		if _, _, ok := strings.Cut(k.Upstream, ":"); !ok {
+			return "", nil, fmt.Errorf("invalid upstream %q, expected env:, file: or gcp: followed by the name", k.Upstream)
+		}
+	}
+
+	switch k.ParamMode {
+	case "", goai.ParamModeLenient, goai.ParamModeStrict:
+	default:
+		return "", nil, fmt.Errorf("invalid param mode %q, expected lenient or strict", k.ParamMode)
+	}
+
+	if k.VertexAI != nil {
+		if k.Upstream != "" {
+			return "", nil, errors.New("a key can't have both an upstream and a vertex ai project")
+		}
+		if err := k.VertexAI.Validate(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	key, id, err := newVirtualKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	k.ID = id
+	k.Hash = hashVirtualKey(key)
+	k.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.backend.Put(&k); err != nil {
+		return "", nil, err
+	}
+
+	return key, &k, nil
+}
+
+// List returns the keys by creation time.
+func (s *virtualKeyStore) List() ([]*virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.backend.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+// update replaces the key with the ID by the result of fn, which returns an
+// error to leave it unchanged.
+func (s *virtualKeyStore) update(id string, fn func(k *virtualKey) error) (*virtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := s.backend.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(keys, func(k *virtualKey) bool {
+		return k.ID == id
+	})
+	if i < 0 {
+		return nil, errVirtualKeyNotFound
+	}
+
+	// The loaded keys may be shared with a cache, so they are copied before
+	// the change.
+	k := *keys[i]
+	if err := fn(&k); err != nil {
+		return nil, err
+	}
+
+	if err := s.backend.Put(&k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// Rotate replaces the key with a new one with the same ID and settings. The
+// previous key is rejected immediately.
+func (s *virtualKeyStore) Rotate(id string) (string, *virtualKey, error) {
+	key, _, err := newVirtualKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	k, err := s.update(id, func(k *virtualKey) error {
+		if k.RevokedAt != nil {
+			return errVirtualKeyRevoked
+		}
+
+		now := time.Now().UTC()
+		k.Hash = hashVirtualKey(key)
+		k.RotatedAt = &now
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return key, k, nil
+}
+
+// SetBudget replaces the budget of the key, e.g. to raise the limit of a key
+// that exceeded it. A nil budget removes it.
+func (s *virtualKeyStore) SetBudget(id string, b *budget) (*virtualKey, error) {
+	return s.update(id, func(k *virtualKey) error {
+		if k.RevokedAt != nil {
+			return errVirtualKeyRevoked
+		}
+
+		k.Budget = b
+		return nil
+	})
+}
+
+// Revoke rejects the key from now on. The key is kept, so that its usage is
+// still attributed to its owner.
+func (s *virtualKeyStore) Revoke(id string) (*virtualKey, error) {
+	return s.update(id, func(k *virtualKey) error {
+		if k.RevokedAt == nil {
+			now := time.Now().UTC()
+			k.RevokedAt = &now
+		}
+		return nil
+	})
+}
+
+// Lookup returns the key that is neither expired nor revoked. It finds the
+// key by its hash, without the lock of the changes, so that the requests
+// don't wait for each other.
+func (s *virtualKeyStore) Lookup(key string) (*virtualKey, error) {
+	k, err := s.backend.Find(hashVirtualKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if k == nil || k.expired(time.Now()) || k.RevokedAt != nil {
+		return nil, errVirtualKeyNotFound
+	}
+
+	return k, nil
+}
+
+// Upstream returns the Gemini API key of the secret, read again every refresh
+// interval.
+func (s *virtualKeyStore) Upstream(ctx context.Context, ref string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.upstreams[ref]
+	if !ok {
+		sec, err := newSecret(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+
+		u = &upstreamSecret{secret: sec, loaded: time.Now()}
+		s.upstreams[ref] = u
+	}
+
+	if time.Since(u.loaded) > s.refresh {
+		// The previous value is kept when the refresh fails.
+		if err := u.secret.Refresh(ctx); err != nil {
+			logger.ErrorContext(ctx, "refresh secrets failed", slog.String("error", err.Error()))
+		}
+		u.loaded = time.Now()
+	}
+
+	return u.secret.Value(), nil
+}
+
+type contextKey string
+
+var virtualKeyContextKey contextKey = "virtual_key"
+
+// virtualKeyFromRequest returns the virtual key the request authenticated
+// with, if any.
+func virtualKeyFromRequest(r *http.Request) (*virtualKey, string, bool) {
+	v, ok := r.Context().Value(virtualKeyContextKey).(authenticatedKey)
+	return v.key, v.upstream, ok
+}
+
+type authenticatedKey struct {
+	key      *virtualKey
+	upstream string
+}
+
+// authenticate looks up the virtual keys, and sends the requests with their
+// upstream key. The requests without a virtual key are rejected, so that the
+// clients can't bypass the budgets and model restrictions of their keys. It
+// is disabled when there is no store.
+func (h openaiHandler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	if h.virtualKeys == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var (
+			vk  *virtualKey
+			err = errVirtualKeyNotFound
+		)
+		if strings.HasPrefix(key, virtualKeyPrefix) {
+			vk, err = h.virtualKeys.Lookup(key)
+		}
+		if errors.Is(err, errVirtualKeyNotFound) {
+			writeAPIError(w, &openai.APIError{
+				Code:           "invalid_api_key",
+				Message:        "Incorrect API key provided.",
+				Type:           "invalid_request_error",
+				HTTPStatusCode: http.StatusUnauthorized,
+			})
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		upstream := ""
+		if vk.Upstream != "" {
+			upstream, err = h.virtualKeys.Upstream(r.Context(), vk.Upstream)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if h.upstreamKeys != nil {
+			upstream = h.upstreamKeys.Default()
+		}
+
+		ctx := context.WithValue(r.Context(), virtualKeyContextKey, authenticatedKey{key: vk, upstream: upstream})
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// allowModel rejects the models that the virtual key of the request may not
+// use.
+func allowModel(w http.ResponseWriter, r *http.Request, model string) bool {
+	vk, _, ok := virtualKeyFromRequest(r)
+	if !ok || vk.allows(model) {
+		return true
+	}
+
+	writeAPIError(w, &openai.APIError{
+		Code:           "model_not_allowed",
+		Message:        fmt.Sprintf("The API key is not allowed to use the model %q.", model),
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusForbidden,
+	})
+	return false
+}
+
+// virtualKeysCmd implements the virtual-keys subcommand, which manages the
+// keys directly in the store without a running server.
+func virtualKeysCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: virtual-keys create|list|rotate|revoke [flags] [id]")
+	}
+
+	fs := flag.NewFlagSet("virtual-keys", flag.ExitOnError)
+	var (
+		path     = fs.String("virtual-keys-path", os.Getenv("VIRTUAL_KEYS_PATH"), "path to the SQLite database of the virtual keys, or a JSON file when it ends with .json")
+		owner    = fs.String("owner", "", "owner of the key")
+		tenant   = fs.String("tenant", "", "tenant of the key, whose budget and residency apply to its requests")
+		models   = fs.String("models", "", "comma-separated models the key may use, all when empty")
+		upstream = fs.String("upstream", "", "secret with the Gemini API key of the key, e.g. env:GEMINI_API_KEY, defaults to the upstream keys")
+		mode     = fs.String("param-mode", "", "how the unsupported openai parameters of the key are handled, lenient or strict, defaults to -param-mode of the server")
+		debug    = fs.Bool("debug", false, "let the key get the raw gemini responses with the X-Debug header")
+		project  = fs.String("vertex-project", "", "google cloud project to send the requests of the key to vertex ai, with the credentials of the server")
+		location = fs.String("vertex-location", "", "region of the vertex ai calls of the key, defaults to us-central1")
+		creds    = fs.String("vertex-credentials", "", "JSON key file of the service account of the vertex ai calls of the key, defaults to the application default credentials")
+		expires  = fs.Duration("expires", 0, "how long the key is valid, forever when 0")
+		period   = fs.String("budget-period", string(budgetMonthly), "period of the budget of the key, daily or monthly")
+		maxCost  = fs.Float64("max-cost", 0, "maximum estimated cost in USD of the key per budget period, 0 for unlimited")
+		maxToks  = fs.Int("max-tokens", 0, "maximum prompt and completion tokens of the key per budget period, 0 for unlimited")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		return errors.New("-virtual-keys-path is required")
+	}
+
+	s, err := newVirtualKeyStore(*path, 0)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		k := virtualKey{
+			Owner:     *owner,
+			Tenant:    *tenant,
+			Models:    splitList(*models),
+			Upstream:  *upstream,
+			ParamMode: goai.ParamMode(*mode),
+			Debug:     *debug,
+		}
+		if *project != "" {
+			k.VertexAI = &goai.VertexAI{
+				Project:         *project,
+				Location:        *location,
+				CredentialsFile: *creds,
+			}
+		}
+		if *expires > 0 {
+			t := time.Now().Add(*expires).UTC()
+			k.ExpiresAt = &t
+		}
+
+		b := &budget{Period: budgetPeriod(*period), MaxCost: *maxCost, MaxTokens: *maxToks}
+		if err := b.validate(); err != nil {
+			return err
+		}
+		if b.limited() {
+			k.Budget = b
+		}
+
+		key, vk, err := s.Create(k)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\n", vk.ID, key)
+		return nil
+	case "list":
+		keys, err := s.List()
+		if err != nil {
+			return err
+		}
+
+		for i, k := range keys {
+			keys[i] = k.redacted()
+		}
+
+		return json.NewEncoder(os.Stdout).Encode(keys)
+	case "rotate":
+		key, vk, err := s.Rotate(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\t%s\n", vk.ID, key)
+		return nil
+	case "revoke":
+		_, err := s.Revoke(fs.Arg(0))
+		return err
+	default:
+		return fmt.Errorf("unknown command %q, expected create, list, rotate or revoke", args[0])
+	}
+}
+
+// createVirtualKeyRequest is the body of POST /admin/keys. ExpiresIn is a
+// duration, e.g. "720h".
+type createVirtualKeyRequest struct {
+	Owner     string         `json:"owner"`
+	Tenant    string         `json:"tenant"`
+	Models    []string       `json:"models"`
+	Upstream  string         `json:"upstream"`
+	ParamMode string         `json:"param_mode"`
+	Debug     bool           `json:"debug"`
+	VertexAI  *goai.VertexAI `json:"vertex_ai"`
+	ExpiresIn string         `json:"expires_in"`
+	Budget    *budget        `json:"budget"`
+}
+
+// updateVirtualKeyRequest is the body of PATCH /admin/keys/{id}. A null
+// budget removes it.
+type updateVirtualKeyRequest struct {
+	Budget *budget `json:"budget"`
+}
+
+// parseBudget validates the budget of the request, and returns nil for an
+// unlimited one.
+func parseBudget(b *budget) (*budget, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	if b.Period == "" {
+		b.Period = budgetMonthly
+	}
+
+	if err := b.validate(); err != nil {
+		return nil, fmt.Errorf("invalid budget: %w", err)
+	}
+
+	if !b.limited() {
+		return nil, nil
+	}
+
+	return b, nil
+}
+
+// virtualKeyResponse is a key with its value, which is only returned when it
+// is created or rotated.
+type virtualKeyResponse struct {
+	*virtualKey
+	Key string `json:"key"`
+}
+
+// VirtualKeys serves the virtual key admin API: creating and listing the keys
+// on /admin/keys, updating the budget and revoking on /admin/keys/{id}, and
+// rotating on /admin/keys/{id}/rotate.
+func (h adminHandler) VirtualKeys(w http.ResponseWriter, r *http.Request) {
+	if h.virtualKeys == nil {
+		http.Error(w, "virtual keys are disabled", http.StatusNotFound)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/keys/"), "/")
+	switch {
+	case r.URL.Path == "/admin/keys" && r.Method == http.MethodGet:
+		h.listVirtualKeys(w, r)
+	case r.URL.Path == "/admin/keys" && r.Method == http.MethodPost:
+		h.createVirtualKey(w, r)
+	case r.URL.Path == "/admin/keys":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case id == "" || (action != "" && action != "rotate"):
+		catchAll(w, r)
+	case action == "rotate" && r.Method == http.MethodPost:
+		h.rotateVirtualKey(w, r, id)
+	case action == "" && r.Method == http.MethodPatch:
+		h.updateVirtualKey(w, r, id)
+	case action == "" && r.Method == http.MethodDelete:
+		h.revokeVirtualKey(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h adminHandler) listVirtualKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.virtualKeys.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := make([]*virtualKey, len(keys))
+	for i, k := range keys {
+		data[i] = k.redacted()
+	}
+
+	writeJSON(w, struct {
+		Object string        `json:"object"`
+		Data   []*virtualKey `json:"data"`
+	}{"list", data})
+}
+
+func (h adminHandler) createVirtualKey(w http.ResponseWriter, r *http.Request) {
+	var req createVirtualKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	k := virtualKey{
+		Owner:     req.Owner,
+		Tenant:    req.Tenant,
+		Models:    req.Models,
+		Upstream:  req.Upstream,
+		ParamMode: goai.ParamMode(req.ParamMode),
+		Debug:     req.Debug,
+		VertexAI:  req.VertexAI,
+	}
+
+	b, err := parseBudget(req.Budget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k.Budget = b
+
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid expires_in: %q", req.ExpiresIn), http.StatusBadRequest)
+			return
+		}
+
+		t := time.Now().Add(d).UTC()
+		k.ExpiresAt = &t
+	}
+
+	key, vk, err := h.virtualKeys.Create(k)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.InfoContext(r.Context(), "virtual key created", slog.String("id", vk.ID), slog.String("owner", vk.Owner))
+
+	// writeJSON would write the error status after the 201 when the encoding
+	// fails.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(virtualKeyResponse{virtualKey: vk.redacted(), Key: key}); err != nil {
+		logger.ErrorContext(r.Context(), "write virtual key failed", slog.String("error", err.Error()))
+	}
+}
+
+func (h adminHandler) rotateVirtualKey(w http.ResponseWriter, r *http.Request, id string) {
+	key, vk, err := h.virtualKeys.Rotate(id)
+	if err != nil {
+		writeVirtualKeyError(w, err)
+		return
+	}
+
+	logger.InfoContext(r.Context(), "virtual key rotated", slog.String("id", vk.ID), slog.String("owner", vk.Owner))
+
+	writeJSON(w, virtualKeyResponse{virtualKey: vk.redacted(), Key: key})
+}
+
+func (h adminHandler) updateVirtualKey(w http.ResponseWriter, r *http.Request, id string) {
+	var req updateVirtualKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b, err := parseBudget(req.Budget)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vk, err := h.virtualKeys.SetBudget(id, b)
+	if err != nil {
+		writeVirtualKeyError(w, err)
+		return
+	}
+
+	logger.InfoContext(r.Context(), "virtual key budget updated", slog.String("id", vk.ID), slog.String("owner", vk.Owner))
+
+	writeJSON(w, vk.redacted())
+}
+
+func (h adminHandler) revokeVirtualKey(w http.ResponseWriter, r *http.Request, id string) {
+	vk, err := h.virtualKeys.Revoke(id)
+	if err != nil {
+		writeVirtualKeyError(w, err)
+		return
+	}
+
+	logger.InfoContext(r.Context(), "virtual key revoked", slog.String("id", vk.ID), slog.String("owner", vk.Owner))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeVirtualKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errVirtualKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errVirtualKeyRevoked):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
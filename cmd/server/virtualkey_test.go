@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestVirtualKeys returns a store of the file, skipped for SQLite when the
+// test is built without cgo.
+func newTestVirtualKeys(t *testing.T, path string) *virtualKeyStore {
+	t.Helper()
+
+	s, err := newVirtualKeyStore(path, time.Minute)
+	if errors.Is(err, errNoSQLite) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestVirtualKeyLookup(t *testing.T) {
+	for _, name := range []string{"keys.json", "keys.db"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			s := newTestVirtualKeys(t, path)
+
+			key, vk, err := s.Create(virtualKey{Owner: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.Lookup(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != vk.ID || got.Owner != "alice" {
+				t.Fatalf("got %+v, want %+v", got, vk)
+			}
+
+			if _, err := s.Lookup(virtualKeyPrefix + "unknown"); !errors.Is(err, errVirtualKeyNotFound) {
+				t.Fatalf("unknown key: got %v, want %v", err, errVirtualKeyNotFound)
+			}
+
+			// The keys changed by another process, e.g. the CLI, are seen by
+			// the lookups.
+			cli := newTestVirtualKeys(t, path)
+			rotated, _, err := cli.Rotate(vk.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Lookup(key); !errors.Is(err, errVirtualKeyNotFound) {
+				t.Fatalf("rotated key: got %v, want %v", err, errVirtualKeyNotFound)
+			}
+			if _, err := s.Lookup(rotated); err != nil {
+				t.Fatalf("new key: %v", err)
+			}
+
+			if _, err := cli.Revoke(vk.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Lookup(rotated); !errors.Is(err, errVirtualKeyNotFound) {
+				t.Fatalf("revoked key: got %v, want %v", err, errVirtualKeyNotFound)
+			}
+
+			expires := time.Now().Add(-time.Second)
+			expired, _, err := s.Create(virtualKey{Owner: "bob", ExpiresAt: &expires})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Lookup(expired); !errors.Is(err, errVirtualKeyNotFound) {
+				t.Fatalf("expired key: got %v, want %v", err, errVirtualKeyNotFound)
+			}
+		})
+	}
+}
+
+func TestVirtualKeyAuthenticate(t *testing.T) {
+	h := newTestHandler(t)
+	h.virtualKeys = newTestVirtualKeys(t, filepath.Join(t.TempDir(), "keys.json"))
+
+	key, vk, err := h.virtualKeys.Create(virtualKey{Owner: "alice", Models: []string{"gpt-4o"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(-time.Second)
+	expired, _, err := h.virtualKeys.Create(virtualKey{Owner: "bob", ExpiresAt: &expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *virtualKey
+	handler := h.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		got, _, _ = virtualKeyFromRequest(r)
+	})
+
+	tests := []struct {
+		name   string
+		apiKey string
+		want   int
+	}{
+		{"virtual key", key, http.StatusOK},
+		{"expired key", expired, http.StatusUnauthorized},
+		{"unknown virtual key", virtualKeyPrefix + "unknown", http.StatusUnauthorized},
+		{"gemini key", "AIza-gemini", http.StatusUnauthorized},
+		{"no key", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+
+			w := serve(handler, tt.apiKey, "/chat/completions", "")
+			if w.Code != tt.want {
+				t.Fatalf("got %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+			if tt.want == http.StatusOK && (got == nil || got.ID != vk.ID) {
+				t.Fatalf("got key %+v, want %s", got, vk.ID)
+			}
+			if tt.want != http.StatusOK && got != nil {
+				t.Fatalf("the handler was called with %+v", got)
+			}
+		})
+	}
+
+	t.Run("model", func(t *testing.T) {
+		handler := h.authenticate(func(w http.ResponseWriter, r *http.Request) {
+			if allowModel(w, r, "gpt-4o-mini") {
+				t.Error("gpt-4o-mini is allowed, want only gpt-4o")
+			}
+		})
+
+		w := serve(handler, key, "/chat/completions", "")
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("got %d %s, want 403", w.Code, w.Body)
+		}
+	})
+}
+
+func TestCreateVirtualKey(t *testing.T) {
+	h := adminHandler{virtualKeys: newTestVirtualKeys(t, filepath.Join(t.TempDir(), "keys.json"))}
+
+	w := serve(h.VirtualKeys, "", "/admin/keys", `{"owner": "alice", "models": ["gpt-4o"], "expires_in": "1h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %s, want 201", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var res struct {
+		ID   string `json:"id"`
+		Hash string `json:"hash"`
+		Key  string `json:"key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Hash != "" {
+		t.Error("the hash is returned")
+	}
+
+	vk, err := h.virtualKeys.Lookup(res.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vk.ID != res.ID || vk.Owner != "alice" || vk.ExpiresAt == nil {
+		t.Fatalf("got %+v, want the created key", vk)
+	}
+}
@@ -0,0 +1,245 @@
+package goai
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	// defaultModel is used for the requests whose model is not mapped, and
+	// defaultVisionModel for those with images.
+	defaultModel       = "gemini-pro"
+	defaultVisionModel = "gemini-pro-vision"
+)
+
+// Config is the settings of the adapter, to embed it with custom settings
+// rather than calling each setter. The zero values are the defaults.
+type Config struct {
+	// ModelMapping maps the requested OpenAI model names to Gemini models.
+	ModelMapping map[string]string
+
+	// ModelPassthrough uses the requested model names starting with
+	// "gemini-" as is.
+	ModelPassthrough bool
+
+	// DefaultModel is the model of the requests that are not mapped nor
+	// routed, and DefaultVisionModel of those with images. Defaults to
+	// gemini-pro and gemini-pro-vision.
+	DefaultModel       string
+	DefaultVisionModel string
+
+	// Routes select the model based on the request properties.
+	Routes []Route
+
+	// SystemPrompt is the user message prepended to the conversations that
+	// don't start with one, since Gemini requires it.
+	SystemPrompt string
+
+	// SafetySettings are the safety thresholds of the chat completions. The
+	// Gemini defaults are used for the other categories.
+	SafetySettings []SafetySetting
+
+	// TemperatureMode and MaxTemperature control how the OpenAI temperature
+	// is converted, see SetTemperatureMode.
+	TemperatureMode TemperatureMode
+	MaxTemperature  float32
+
+	// ParamMode controls how the OpenAI parameters that Gemini doesn't
+	// support are handled, ignored by default.
+	ParamMode ParamMode
+
+	FileUploadThreshold int
+	Admission           Admission
+	VideoModel          string
+	ContextCaching      ContextCaching
+	Retry               Retry
+	Fallbacks           map[string][]string
+	PayloadLogging      PayloadLogging
+}
+
+// SetConfig applies the config, after validating it. The settings are
+// replaced at once, so it is safe to call while serving requests, e.g. to
+// reload the config without dropping the streams in flight.
+func (a *Adapter) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// The settings are applied to a scratch adapter, then swapped.
+	b := NewAdapter()
+	b.SetModelMapping(cfg.ModelMapping)
+	b.SetModelPassthrough(cfg.ModelPassthrough)
+	b.SetDefaultModels(cfg.DefaultModel, cfg.DefaultVisionModel)
+	if err := b.SetRoutes(cfg.Routes); err != nil {
+		return err
+	}
+	b.SetSystemPrompt(cfg.SystemPrompt)
+	if err := b.SetSafetySettings(cfg.SafetySettings); err != nil {
+		return err
+	}
+	if err := b.SetTemperatureMode(cfg.TemperatureMode, cfg.MaxTemperature); err != nil {
+		return err
+	}
+	if err := b.SetParamMode(cfg.ParamMode); err != nil {
+		return err
+	}
+	b.SetFileUploadThreshold(cfg.FileUploadThreshold)
+	b.SetAdmission(cfg.Admission)
+	b.SetVideoModel(cfg.VideoModel)
+	b.SetRetry(cfg.Retry)
+	b.SetFallbacks(cfg.Fallbacks)
+	b.SetPayloadLogging(cfg.PayloadLogging)
+
+	a.update(func(s *adapterSettings) {
+		*s = *b.settings()
+	})
+	a.SetContextCaching(cfg.ContextCaching)
+
+	return nil
+}
+
+// Validate reports all the invalid settings of the config.
+func (cfg Config) Validate() error {
+	var errs []error
+	switch cfg.TemperatureMode {
+	case TemperatureModeNone, TemperatureModeClamp, TemperatureModeScale:
+		if cfg.TemperatureMode != TemperatureModeNone && cfg.MaxTemperature <= 0 {
+			errs = append(errs, fmt.Errorf("MaxTemperature: %v must be positive with TemperatureMode %q", cfg.MaxTemperature, cfg.TemperatureMode))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("TemperatureMode: unknown mode %q, expected clamp or scale", cfg.TemperatureMode))
+	}
+
+	if err := cfg.ParamMode.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("ParamMode: %w", err))
+	}
+
+	for i, s := range cfg.SafetySettings {
+		if err := s.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("SafetySettings[%d]: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetDefaultModels sets the models of the requests that are not mapped nor
+// routed, without and with images. The empty models keep the defaults.
+func (a *Adapter) SetDefaultModels(model, visionModel string) {
+	a.update(func(s *adapterSettings) {
+		s.defaultModel = model
+		s.defaultVisionModel = visionModel
+	})
+}
+
+// SetSystemPrompt sets the user message prepended to the conversations that
+// don't start with one. The empty prompt keeps the default.
+func (a *Adapter) SetSystemPrompt(prompt string) {
+	a.update(func(s *adapterSettings) {
+		s.systemPrompt = prompt
+	})
+}
+
+func (a *Adapter) prompt() string {
+	if p := a.settings().systemPrompt; p != "" {
+		return p
+	}
+
+	return defaultSystemPrompt
+}
+
+// SafetySetting blocks the responses of a harm category from a probability.
+type SafetySetting struct {
+	// Category is harassment, hate_speech, sexually_explicit or
+	// dangerous_content.
+	Category string
+
+	// Threshold is block_none, block_only_high, block_medium_and_above or
+	// block_low_and_above.
+	Threshold string
+}
+
+var harmCategories = map[string]genai.HarmCategory{
+	"harassment":        genai.HarmCategoryHarassment,
+	"hate_speech":       genai.HarmCategoryHateSpeech,
+	"sexually_explicit": genai.HarmCategorySexuallyExplicit,
+	"dangerous_content": genai.HarmCategoryDangerousContent,
+}
+
+var harmBlockThresholds = map[string]genai.HarmBlockThreshold{
+	"block_none":             genai.HarmBlockNone,
+	"block_only_high":        genai.HarmBlockOnlyHigh,
+	"block_medium_and_above": genai.HarmBlockMediumAndAbove,
+	"block_low_and_above":    genai.HarmBlockLowAndAbove,
+}
+
+// Validate reports whether the category or the threshold is unknown.
+func (s SafetySetting) Validate() error {
+	_, err := s.toGenai()
+	return err
+}
+
+func (s SafetySetting) toGenai() (*genai.SafetySetting, error) {
+	// The Gemini names are accepted too, e.g. HARM_CATEGORY_HARASSMENT.
+	category, ok := harmCategories[strings.TrimPrefix(strings.ToLower(s.Category), "harm_category_")]
+	if !ok {
+		return nil, fmt.Errorf("unknown category %q, expected harassment, hate_speech, sexually_explicit or dangerous_content", s.Category)
+	}
+
+	threshold, ok := harmBlockThresholds[strings.ToLower(s.Threshold)]
+	if !ok {
+		return nil, fmt.Errorf("unknown threshold %q, expected block_none, block_only_high, block_medium_and_above or block_low_and_above", s.Threshold)
+	}
+
+	return &genai.SafetySetting{Category: category, Threshold: threshold}, nil
+}
+
+// SetSafetySettings sets the safety thresholds of the chat completions. The
+// moderations always use the strictest thresholds.
+func (a *Adapter) SetSafetySettings(settings []SafetySetting) error {
+	ss := make([]*genai.SafetySetting, len(settings))
+	for i, s := range settings {
+		gs, err := s.toGenai()
+		if err != nil {
+			return err
+		}
+
+		ss[i] = gs
+	}
+
+	a.update(func(s *adapterSettings) {
+		s.safetySettings = ss
+	})
+	return nil
+}
+
+// withSafetySettings returns the safety settings with the thresholds of the
+// overrides' categories replaced.
+func withSafetySettings(base []*genai.SafetySetting, overrides []SafetySetting) ([]*genai.SafetySetting, error) {
+	if len(overrides) == 0 {
+		return base, nil
+	}
+
+	ss := slices.Clone(base)
+	for _, o := range overrides {
+		gs, err := o.toGenai()
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(ss, func(s *genai.SafetySetting) bool {
+			return s.Category == gs.Category
+		})
+		if i < 0 {
+			ss = append(ss, gs)
+		} else {
+			ss[i] = gs
+		}
+	}
+
+	return ss, nil
+}
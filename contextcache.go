@@ -0,0 +1,395 @@
+package goai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// defaultContextCacheMinTokens is the minimum number of tokens of a
+	// Gemini cached content.
+	defaultContextCacheMinTokens = 32768
+	defaultContextCacheMinHits   = 2
+	defaultContextCacheTTL       = time.Hour
+
+	// maxContextCachePrefixes bounds the prefixes counted while waiting for
+	// enough hits.
+	maxContextCachePrefixes = 10000
+)
+
+// ContextCaching caches the long prefixes shared by the requests of the same
+// API key, e.g. the system prompt or the RAG context, as Gemini cached
+// contents, to cut the latency and the prompt token cost.
+type ContextCaching struct {
+	// Enabled creates the cached contents. The existing cached contents are
+	// used until they expire when disabled.
+	Enabled bool
+
+	// MinTokens is the estimated number of prompt tokens of the prefix
+	// required to cache it. Defaults to 32768, the Gemini minimum.
+	MinTokens int
+
+	// MinHits is the number of requests with the same prefix before it is
+	// cached. Defaults to 2.
+	MinHits int
+
+	// TTL is how long the cached contents live. Defaults to 1 hour.
+	TTL time.Duration
+}
+
+// ContextCache is a Gemini cached content created for a shared prefix.
+type ContextCache struct {
+	// ID is the Gemini cached content ID.
+	ID         string    `json:"id"`
+	Model      string    `json:"model"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Tokens     int       `json:"tokens"`
+	Hits       int       `json:"hits"`
+	CreateTime time.Time `json:"create_time"`
+	ExpireTime time.Time `json:"expire_time"`
+
+	apiKey string
+	prefix string
+}
+
+type contextCaches struct {
+	mu     sync.Mutex
+	config ContextCaching
+
+	// hits counts the requests per prefix until it is cached, and caches
+	// are the cached contents by prefix.
+	hits   map[string]int
+	caches map[string]*ContextCache
+}
+
+// SetContextCaching sets the context caching, which is disabled by default.
+// It is safe to call while serving requests.
+func (a *Adapter) SetContextCaching(cc ContextCaching) {
+	if cc.MinTokens <= 0 {
+		cc.MinTokens = defaultContextCacheMinTokens
+	}
+
+	if cc.MinHits <= 0 {
+		cc.MinHits = defaultContextCacheMinHits
+	}
+
+	if cc.TTL <= 0 {
+		cc.TTL = defaultContextCacheTTL
+	}
+
+	a.contextCaches.mu.Lock()
+	a.contextCaches.config = cc
+	a.contextCaches.mu.Unlock()
+}
+
+// ContextCaching returns the context caching settings.
+func (a *Adapter) ContextCaching() ContextCaching {
+	a.contextCaches.mu.Lock()
+	defer a.contextCaches.mu.Unlock()
+
+	return a.contextCaches.config
+}
+
+// ContextCaches lists the cached contents that are not expired, the oldest
+// first.
+func (a *Adapter) ContextCaches() []ContextCache {
+	c := &a.contextCaches
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired(time.Now())
+
+	res := make([]ContextCache, 0, len(c.caches))
+	for _, cache := range c.caches {
+		res = append(res, *cache)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreateTime.Before(res[j].CreateTime)
+	})
+
+	return res
+}
+
+// ExpireContextCache changes the time to live of the cached content.
+func (a *Adapter) ExpireContextCache(ctx context.Context, id string, ttl time.Duration) (*ContextCache, error) {
+	cache, err := a.contextCache(id)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := a.createClient(AuthContext(ctx, cache.apiKey))
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := client.UpdateCachedContent(ctx, &genai.CachedContent{Name: cachedContentName(id)}, &genai.CachedContentToUpdate{
+		Expiration: &genai.ExpireTimeOrTTL{TTL: ttl},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &a.contextCaches
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cache.ExpireTime = cc.Expiration.ExpireTime
+	res := *cache
+
+	return &res, nil
+}
+
+// DeleteContextCache deletes the cached content. The next requests with the
+// same prefix are counted again.
+func (a *Adapter) DeleteContextCache(ctx context.Context, id string) error {
+	cache, err := a.contextCache(id)
+	if err != nil {
+		return err
+	}
+
+	client, err := a.createClient(AuthContext(ctx, cache.apiKey))
+	if err != nil {
+		return err
+	}
+
+	// The cached content may have been deleted by Gemini already.
+	if err := client.DeleteCachedContent(ctx, cachedContentName(id)); err != nil && HTTPStatusCode(err) != http.StatusNotFound {
+		return err
+	}
+
+	c := &a.contextCaches
+	c.mu.Lock()
+	delete(c.caches, cache.prefix)
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (a *Adapter) contextCache(id string) (*ContextCache, error) {
+	c := &a.contextCaches
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cache := range c.caches {
+		if cache.ID == id {
+			return cache, nil
+		}
+	}
+
+	return nil, &openai.APIError{
+		Code:           "context_cache_not_found",
+		Message:        "No such context cache: " + id,
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusNotFound,
+	}
+}
+
+// useContextCache returns the contents to send, without the leading system
+// messages when they are cached. Otherwise the system messages are counted,
+// and cached in the background once they have enough hits.
+func (a *Adapter) useContextCache(ctx context.Context, model *genai.GenerativeModel, modelName string, msgs []openai.ChatCompletionMessage, contents []*genai.Content) []*genai.Content {
+	// The tools can't be sent with a cached content, they must be cached
+	// too. The Vertex AI cached contents are not supported.
+	ext := extensionsFromContext(ctx)
+	if len(model.Tools) > 0 || ext.Grounding || ext.CachedContent != "" || a.vertexAIOf(ctx) != nil {
+		return contents
+	}
+
+	system, ok := systemText(msgs)
+	if !ok {
+		return contents
+	}
+
+	rest, ok := trimSystemText(contents, system, a.prompt())
+	if !ok {
+		return contents
+	}
+
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return contents
+	}
+
+	info := RequestInfoFromContext(ctx)
+	prefix := contextCachePrefix(info.APIKey, modelName, system)
+
+	c := &a.contextCaches
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cache, ok := c.caches[prefix]; ok {
+		if time.Now().Before(cache.ExpireTime) {
+			cache.Hits++
+			model.CachedContentName = cachedContentName(cache.ID)
+			return rest
+		}
+
+		delete(c.caches, prefix)
+	}
+
+	cfg := c.config
+	if !cfg.Enabled {
+		return contents
+	}
+
+	tokens := len(system) / 4
+	if tokens < cfg.MinTokens {
+		return contents
+	}
+
+	if c.hits == nil || len(c.hits) >= maxContextCachePrefixes {
+		c.hits = make(map[string]int)
+	}
+
+	// The cached content is created once, the requests in the meantime are
+	// sent without it.
+	c.hits[prefix]++
+	if c.hits[prefix] != cfg.MinHits {
+		return contents
+	}
+
+	go a.createContextCache(context.WithoutCancel(ctx), client, modelName, info.Tenant, prefix, system, tokens, cfg.TTL)
+
+	return contents
+}
+
+func (a *Adapter) createContextCache(ctx context.Context, client *genai.Client, modelName, tenant, prefix, system string, tokens int, ttl time.Duration) {
+	cc, err := client.CreateCachedContent(ctx, &genai.CachedContent{
+		Model:             modelName,
+		SystemInstruction: genai.NewUserContent(genai.Text(system)),
+		Expiration:        genai.ExpireTimeOrTTL{TTL: ttl},
+	})
+
+	c := &a.contextCaches
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The hits are kept when it fails, e.g. when the model doesn't support
+	// caching, so that it is not retried until the hits are reset.
+	if err != nil {
+		if a.logger != nil {
+			a.logger.WarnContext(ctx, "create context cache failed",
+				slog.String("model", modelName),
+				slog.String("error", err.Error()),
+			)
+		}
+
+		return
+	}
+
+	delete(c.hits, prefix)
+	if c.caches == nil {
+		c.caches = make(map[string]*ContextCache)
+	}
+
+	c.caches[prefix] = &ContextCache{
+		ID:         strings.TrimPrefix(cc.Name, "cachedContents/"),
+		Model:      modelName,
+		Tenant:     tenant,
+		Tokens:     tokens,
+		CreateTime: cc.CreateTime,
+		ExpireTime: cc.Expiration.ExpireTime,
+		apiKey:     RequestInfoFromContext(ctx).APIKey,
+		prefix:     prefix,
+	}
+
+	if a.logger != nil {
+		a.logger.InfoContext(ctx, "context cache created",
+			slog.String("id", cc.Name),
+			slog.String("model", modelName),
+			slog.Int("tokens", tokens),
+		)
+	}
+}
+
+func (c *contextCaches) removeExpired(now time.Time) {
+	for prefix, cache := range c.caches {
+		if !now.Before(cache.ExpireTime) {
+			delete(c.caches, prefix)
+		}
+	}
+}
+
+// contextCachePrefix identifies the system text of the API key and model.
+// The API key is hashed with the text, so that caches are never shared across
+// keys.
+func contextCachePrefix(apiKey, modelName, system string) string {
+	h := sha256.New()
+	h.Write([]byte(apiKey))
+	h.Write([]byte{0})
+	h.Write([]byte(modelName))
+	h.Write([]byte{0})
+	h.Write([]byte(system))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// systemText returns the text of the leading system messages, e.g. the
+// system prompt and the RAG context, joined like mergeOpenaiMessages does.
+func systemText(msgs []openai.ChatCompletionMessage) (string, bool) {
+	var texts []string
+	for _, msg := range msgs {
+		if msg.Role != openaiRoleSystem {
+			break
+		}
+
+		if len(msg.MultiContent) > 0 {
+			return "", false
+		}
+
+		texts = append(texts, msg.Content)
+	}
+
+	// The last message is the question, which is never cached.
+	if len(texts) == 0 || len(texts) == len(msgs) {
+		return "", false
+	}
+
+	return strings.Join(texts, "\n"), true
+}
+
+// trimSystemText removes the system text from the first content, where it is
+// merged with the following user message.
+func trimSystemText(contents []*genai.Content, system, systemPrompt string) ([]*genai.Content, bool) {
+	first := contents[0]
+	text, ok := first.Parts[0].(genai.Text)
+	if !ok {
+		return nil, false
+	}
+
+	var parts []genai.Part
+	switch {
+	case string(text) == system:
+		parts = first.Parts[1:]
+	case strings.HasPrefix(string(text), system+"\n"):
+		parts = append([]genai.Part{text[len(system)+1:]}, first.Parts[1:]...)
+	default:
+		return nil, false
+	}
+
+	rest := contents[1:]
+	if len(parts) > 0 {
+		rest = append([]*genai.Content{{Role: first.Role, Parts: parts}}, rest...)
+	}
+
+	if len(rest) == 0 {
+		return nil, false
+	}
+
+	rest, err := reorderContentByRole(rest, systemPrompt)
+	return rest, err == nil
+}
+
+func cachedContentName(id string) string {
+	return "cachedContents/" + id
+}
@@ -0,0 +1,50 @@
+package goai
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// GeminiRequest is the Gemini request that the adapter sends for an OpenAI
+// request.
+type GeminiRequest struct {
+	Model            string
+	Contents         []*genai.Content
+	GenerationConfig genai.GenerationConfig
+	Tools            []*genai.Tool
+
+	// ExtraConfig are the generation config fields that the genai package
+	// does not support, e.g. the penalties.
+	ExtraConfig any
+
+	Warnings []Warning
+}
+
+// ConvertRequest converts the request without sending it, e.g. to compare
+// the conversion of different configs.
+func (a *Adapter) ConvertRequest(ctx context.Context, req openai.ChatCompletionRequest) (*GeminiRequest, error) {
+	ctx, warnings := WarningsContext(ctx)
+
+	contents, err := buildContent(req.Messages, a.prompt())
+	if err != nil {
+		return nil, err
+	}
+
+	model, modelName, err := a.loadOrStoreModel(ctx, req, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := toGenerationConfig(ctx, modelName, req)
+
+	return &GeminiRequest{
+		Model:            modelName,
+		Contents:         contents,
+		GenerationConfig: model.GenerationConfig,
+		Tools:            model.Tools,
+		ExtraConfig:      cfg,
+		Warnings:         warnings.List(),
+	}, nil
+}
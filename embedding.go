@@ -0,0 +1,110 @@
+package goai
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// defaultEmbeddingModel is the Gemini model of the OpenAI embedding models,
+// e.g. text-embedding-3-small, unless they are mapped.
+const defaultEmbeddingModel = "text-embedding-004"
+
+// embeddingInputs returns the texts of the input, a string or a list of
+// strings. The token arrays are not supported, since Gemini has another
+// tokenizer.
+func embeddingInputs(input any) ([]string, error) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []any:
+		inputs := make([]string, len(v))
+		for i, s := range v {
+			s, ok := s.(string)
+			if !ok {
+				return nil, invalidRequestError("invalid_value", "input", "input must be a string or a list of strings")
+			}
+			inputs[i] = s
+		}
+
+		return inputs, nil
+	default:
+		return nil, invalidRequestError("invalid_value", "input", "input must be a string or a list of strings")
+	}
+}
+
+// embeddingModel returns the Gemini embedding model of the requested model.
+func (a *Adapter) embeddingModel(model string) string {
+	if m, ok := a.settings().modelMapping[model]; ok {
+		return m
+	}
+
+	if strings.HasPrefix(model, "text-embedding-00") || strings.HasPrefix(model, "embedding-") {
+		return model
+	}
+
+	return defaultEmbeddingModel
+}
+
+// embeddings returns the Gemini embeddings of the inputs, in a batch.
+func (a *Adapter) embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	inputs, err := embeddingInputs(req.Input)
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, invalidRequestError("invalid_value", "input", "input must not be empty")
+	}
+
+	if req.Dimensions > 0 {
+		if err := dropParam(ctx, a.paramMode(ctx), "dimensions", "dimensions is not supported"); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := a.embeddingModel(string(req.Model))
+	info := RequestInfoFromContext(ctx)
+	info.Model = string(req.Model)
+	info.GeminiModel = name
+
+	model := client.EmbeddingModel(name)
+	batch := model.NewBatch()
+	for _, s := range inputs {
+		batch.AddContent(genai.Text(s))
+	}
+
+	resp, err := model.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &openai.EmbeddingResponse{
+		Object: "list",
+		Data:   make([]openai.Embedding, len(resp.Embeddings)),
+		Model:  req.Model,
+	}
+	for i, e := range resp.Embeddings {
+		res.Data[i] = openai.Embedding{
+			Object:    "embedding",
+			Embedding: e.Values,
+			Index:     i,
+		}
+	}
+
+	// Gemini doesn't count the tokens of the embeddings.
+	for _, s := range inputs {
+		res.Usage.PromptTokens += len(s) / 4
+	}
+	res.Usage.TotalTokens = res.Usage.PromptTokens
+
+	return res, nil
+}
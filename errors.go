@@ -0,0 +1,105 @@
+package goai
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+// HTTPStatusCode returns the HTTP status code of an error returned by the
+// Gemini API, or 0 if the error did not come from the API.
+func HTTPStatusCode(err error) int {
+	var ae *apierror.APIError
+	if errors.As(err, &ae) && ae.HTTPCode() > 0 {
+		return ae.HTTPCode()
+	}
+
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		return ge.Code
+	}
+
+	return 0
+}
+
+// invalidParamError returns an OpenAI invalid request error for an
+// unsupported parameter, which the server returns as is.
+func invalidParamError(param, format string, args ...any) *openai.APIError {
+	return invalidRequestError("unsupported_parameter", param, format, args...)
+}
+
+// invalidRequestError returns an OpenAI invalid request error with the code.
+func invalidRequestError(code, param, format string, args ...any) *openai.APIError {
+	return &openai.APIError{
+		Code:           code,
+		Message:        fmt.Sprintf(format, args...),
+		Param:          &param,
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusBadRequest,
+	}
+}
+
+// ItemError is the failure of one item of a batch.
+type ItemError struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchError aggregates the failures of the items of a batch, so that one
+// failure doesn't fail the whole batch.
+type BatchError struct {
+	Errors []ItemError `json:"errors"`
+}
+
+// Add records the failure of the item at the index.
+func (e *BatchError) Add(index int, err error) {
+	e.Errors = append(e.Errors, ItemError{
+		Index:   index,
+		Code:    errorCode(err),
+		Message: err.Error(),
+	})
+}
+
+// Err returns the error if any item failed, or nil.
+func (e *BatchError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, ie := range e.Errors {
+		msgs[i] = fmt.Sprintf("item %d: %s", ie.Index, ie.Message)
+	}
+
+	return fmt.Sprintf("%d items failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// errorCode returns the OpenAI error code of the error, or a generic code
+// based on the Gemini status.
+func errorCode(err error) string {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		if code, ok := apiErr.Code.(string); ok && code != "" {
+			return code
+		}
+	}
+
+	switch code := HTTPStatusCode(err); {
+	case code == http.StatusTooManyRequests:
+		return "rate_limit_exceeded"
+	case code >= 400 && code < 500:
+		return "invalid_request"
+	default:
+		return "upstream_error"
+	}
+}
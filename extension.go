@@ -0,0 +1,40 @@
+package goai
+
+import "context"
+
+var extensionsContextKey contextKey = "extensions"
+
+// Extensions are the Gemini parameters that have no equivalent in the OpenAI
+// request.
+type Extensions struct {
+	// TopK samples from the K most likely tokens. When both TopK and TopP are
+	// set, Gemini applies TopK first, then TopP to the remaining tokens.
+	TopK *int32
+
+	// Grounding enables the Google Search grounding, whose sources and
+	// citations are collected with GroundingContext.
+	Grounding bool
+
+	// CodeExecution lets Gemini run Python in its sandbox. The code and its
+	// output are returned as fenced code blocks in the message content.
+	CodeExecution bool
+
+	// SafetySettings override the configured thresholds of their
+	// categories.
+	SafetySettings []SafetySetting
+
+	// CachedContent is the name of a Gemini cached content, e.g.
+	// cachedContents/abc, which precedes the messages. The context caching
+	// of the adapter is skipped.
+	CachedContent string
+}
+
+// ExtensionsContext stores the extensions to apply to the request.
+func ExtensionsContext(ctx context.Context, ext Extensions) context.Context {
+	return context.WithValue(ctx, extensionsContextKey, ext)
+}
+
+func extensionsFromContext(ctx context.Context) Extensions {
+	ext, _ := ctx.Value(extensionsContextKey).(Extensions)
+	return ext
+}
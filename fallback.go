@@ -0,0 +1,103 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/sashabaranov/go-openai"
+)
+
+// SetFallbacks sets the fallback chains of the Gemini models, e.g.
+// gemini-1.5-pro to gemini-1.5-flash then gemini-2.0-flash. A request that
+// fails on its model with a quota error, a safety block or a timeout, after
+// the retries, is sent to the next model of the chain.
+func (a *Adapter) SetFallbacks(fallbacks map[string][]string) {
+	a.update(func(s *adapterSettings) {
+		s.fallbacks = fallbacks
+	})
+}
+
+// withFallbacks calls fn with the model, then with the fallback models in
+// order until it succeeds or fails with an error that another model won't
+// fix. It returns the name of the last model called, which is also set in the
+// request info.
+func (a *Adapter) withFallbacks(ctx context.Context, model *genai.GenerativeModel, modelName string, req openai.ChatCompletionRequest, fn func(ctx context.Context, model *genai.GenerativeModel) error) (string, error) {
+	err := fn(generationConfigContext(ctx, toGenerationConfig(ctx, modelName, req)), model)
+	for _, name := range a.settings().fallbacks[modelName] {
+		if err == nil || !isFallbackable(ctx, err) {
+			break
+		}
+
+		// The request may use parameters that the fallback doesn't accept.
+		if validatePenalties(name, req) != nil {
+			continue
+		}
+
+		fallback, ferr := a.fallbackModel(ctx, model, name)
+		if ferr != nil {
+			break
+		}
+
+		if a.logger != nil {
+			a.logger.WarnContext(ctx, "falling back",
+				slog.String("model", modelName),
+				slog.String("fallback", name),
+				slog.String("error", err.Error()),
+			)
+		}
+		addWarning(ctx, "fallback_model", "model %q failed and the request was sent to %q: %v", modelName, name, err)
+
+		modelName = name
+		RequestInfoFromContext(ctx).GeminiModel = name
+		err = fn(generationConfigContext(ctx, toGenerationConfig(ctx, name, req)), fallback)
+	}
+
+	return modelName, err
+}
+
+// fallbackModel returns the model with the parameters of model. The context
+// cache is not copied, since it belongs to the model that created it.
+func (a *Adapter) fallbackModel(ctx context.Context, model *genai.GenerativeModel, name string) (*genai.GenerativeModel, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m := client.GenerativeModel(name)
+	m.GenerationConfig = model.GenerationConfig
+	m.SafetySettings = model.SafetySettings
+	m.Tools = model.Tools
+	m.ToolConfig = model.ToolConfig
+	m.SystemInstruction = model.SystemInstruction
+
+	return m, nil
+}
+
+// isFallbackable reports whether another model may succeed where the model
+// failed: it ran out of quota, blocked the content or timed out.
+func isFallbackable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return true
+	}
+
+	switch HTTPStatusCode(err) {
+	case http.StatusTooManyRequests, http.StatusGatewayTimeout:
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
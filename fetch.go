@@ -0,0 +1,164 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	// maxImageSize is the largest remote image that is fetched. Gemini limits
+	// the inline data to 20MB per request.
+	maxImageSize = 20 << 20
+
+	// maxVideoSize is the largest remote video that is fetched. Videos above
+	// the upload threshold are sent through the File API.
+	maxVideoSize = 100 << 20
+
+	// imageFetchTimeout is the time limit to fetch a remote image, including
+	// the redirects, and videoFetchTimeout the limit for the videos.
+	imageFetchTimeout = 10 * time.Second
+	videoFetchTimeout = time.Minute
+)
+
+// deniedPrefixes are the non-public ranges that are not covered by
+// netip.Addr.IsPrivate: "this network" and the carrier-grade NAT.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// mediaClient fetches the remote images and videos. The addresses are checked when
+// connecting, after the DNS resolution and for every redirect, so that
+// requests can't reach the internal network. Proxies are not used, since the
+// proxy address would be checked instead.
+var mediaClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: imageFetchTimeout,
+			Control: denyPrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   imageFetchTimeout,
+		ResponseHeaderTimeout: imageFetchTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+}
+
+var errPrivateAddress = errors.New("private address")
+
+func denyPrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr := addrPort.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return fmt.Errorf("%w: %s", errPrivateAddress, addr)
+	}
+
+	for _, p := range deniedPrefixes {
+		if p.Contains(addr) {
+			return fmt.Errorf("%w: %s", errPrivateAddress, addr)
+		}
+	}
+
+	return nil
+}
+
+func isRemoteURL(url string) bool {
+	return strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")
+}
+
+// fetchMedia replaces the remote image and video URLs, which are kept as file
+// references when the messages are converted, with the downloaded media.
+func (a *Adapter) fetchMedia(ctx context.Context, contents []*genai.Content) error {
+	for _, c := range contents {
+		for i, p := range c.Parts {
+			fd, ok := p.(genai.FileData)
+			if !ok || a.isFileURI(ctx, fd.URI) {
+				continue
+			}
+
+			blob, err := fetchURL(ctx, fd.URI)
+			if err != nil {
+				return invalidRequestError("invalid_image_url", "messages", "failed to fetch %s: %v", fd.URI, err)
+			}
+
+			c.Parts[i] = blob
+		}
+	}
+
+	return nil
+}
+
+func fetchURL(ctx context.Context, url string) (genai.Blob, error) {
+	// The time limit depends on the content type, so the body is canceled
+	// once it is known.
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return genai.Blob{}, err
+	}
+
+	resp, err := mediaClient.Do(req)
+	if err != nil {
+		return genai.Blob{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return genai.Blob{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !imageMIMETypes[mimeType] && !videoMIMETypes[mimeType] {
+		return genai.Blob{}, fmt.Errorf("unsupported content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	maxSize, timeout := maxImageSize, imageFetchTimeout
+	if videoMIMETypes[mimeType] {
+		maxSize, timeout = maxVideoSize, videoFetchTimeout
+	}
+
+	timer := time.AfterFunc(timeout-time.Since(start), cancel)
+	defer timer.Stop()
+
+	if resp.ContentLength > int64(maxSize) {
+		return genai.Blob{}, fmt.Errorf("%s is larger than %d bytes", mimeType, maxSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return genai.Blob{}, err
+	}
+	if len(data) > maxSize {
+		return genai.Blob{}, fmt.Errorf("%s is larger than %d bytes", mimeType, maxSize)
+	}
+
+	if videoMIMETypes[mimeType] {
+		return genai.Blob{MIMEType: mimeType, Data: data}, nil
+	}
+
+	// The Content-Type may be more generic than the data, e.g. image/jpeg for
+	// an HEIC image.
+	if detected := detectImageMIMEType(data); imageMIMETypes[detected] {
+		mimeType = detected
+	}
+
+	return genai.ImageData(strings.TrimPrefix(mimeType, "image/"), data), nil
+}
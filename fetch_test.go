@@ -0,0 +1,98 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestDenyPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		denied  bool
+	}{
+		{"8.8.8.8:443", false},
+		{"[2001:4860:4860::8888]:443", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.0.0.1:80", true},
+		{"172.16.0.1:80", true},
+		{"192.168.1.1:80", true},
+		{"100.64.0.1:80", true},
+		{"100.127.255.254:80", true},
+		{"0.0.0.0:80", true},
+		{"0.1.2.3:80", true},
+		{"169.254.169.254:80", true},
+		{"[fe80::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"[::ffff:169.254.169.254]:80", true},
+		{"224.0.0.1:80", true},
+		{"[::]:80", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := denyPrivateAddress("tcp", tt.address, nil)
+			if denied := errors.Is(err, errPrivateAddress); denied != tt.denied {
+				t.Fatalf("denied = %t (%v), want %t", denied, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestFetchURLPrivateAddress(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the internal server was reached")
+	}))
+	t.Cleanup(internal.Close)
+
+	t.Run("direct", func(t *testing.T) {
+		_, err := fetchURL(context.Background(), internal.URL+"/image.png")
+		if !errors.Is(err, errPrivateAddress) {
+			t.Fatalf("got %v, want %v", err, errPrivateAddress)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		// The test server stands for a public one, which redirects to the
+		// internal network.
+		var redirected atomic.Bool
+		public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			redirected.Store(true)
+			http.Redirect(w, r, internal.URL+"/image.png", http.StatusFound)
+		}))
+		t.Cleanup(public.Close)
+
+		client := mediaClient
+		t.Cleanup(func() { mediaClient = client })
+
+		publicAddr := public.Listener.Addr().String()
+		mediaClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Control: func(network, address string, c syscall.RawConn) error {
+						if address == publicAddr {
+							return nil
+						}
+
+						return denyPrivateAddress(network, address, c)
+					},
+				}).DialContext,
+			},
+		}
+
+		_, err := fetchURL(context.Background(), public.URL+"/image.png")
+		if !errors.Is(err, errPrivateAddress) {
+			t.Fatalf("got %v, want %v", err, errPrivateAddress)
+		}
+		if !redirected.Load() {
+			t.Fatal("the public server wasn't reached")
+		}
+	})
+}
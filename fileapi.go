@@ -0,0 +1,160 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/iterator"
+)
+
+// openaiFileIDPrefix is prepended to the Gemini file IDs, so that the IDs
+// look like the OpenAI ones.
+const openaiFileIDPrefix = "file-"
+
+// FileURI returns the Gemini URI of the file with the given OpenAI file ID,
+// on the endpoint of the adapter. Image URL parts with a file URI are sent as
+// file references.
+func (a *Adapter) FileURI(id string) string {
+	return a.baseURL() + "/files/" + strings.TrimPrefix(id, openaiFileIDPrefix)
+}
+
+// fileID returns the OpenAI file ID for a Gemini file name or URI.
+func fileID(name string) string {
+	return openaiFileIDPrefix + name[strings.LastIndex(name, "/")+1:]
+}
+
+// gcsURIPrefix is the prefix of the Cloud Storage URIs, which Vertex AI
+// references the files with, since it has no File API.
+const gcsURIPrefix = "gs://"
+
+// isFileURI reports whether the URL references a file of the backend of the
+// request: a file uploaded to the File API of the endpoint, or a Cloud
+// Storage object for Vertex AI.
+func (a *Adapter) isFileURI(ctx context.Context, url string) bool {
+	if a.vertexAIOf(ctx) != nil {
+		return strings.HasPrefix(url, gcsURIPrefix)
+	}
+
+	return strings.HasPrefix(url, a.baseURL()+"/files/")
+}
+
+// UploadFile uploads a file through the Gemini File API, and waits until it
+// is processed. Gemini deletes the files after 48 hours, and doesn't store
+// the purpose, which is only returned here.
+func (a *Adapter) UploadFile(ctx context.Context, filename, mimeType, purpose string, r io.Reader) (*openai.File, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := uploadFile(ctx, client, r, &genai.UploadFileOptions{
+		DisplayName: filename,
+		MIMEType:    mimeType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := toOpenaiFile(f)
+	res.Purpose = purpose
+
+	return &res, nil
+}
+
+// ListFiles lists the files uploaded with the API key.
+func (a *Adapter) ListFiles(ctx context.Context) ([]openai.File, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []openai.File{}
+
+	it := client.ListFiles(ctx)
+	for {
+		f, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, toOpenaiFile(f))
+	}
+
+	return res, nil
+}
+
+// GetFile returns the file with the given OpenAI file ID.
+func (a *Adapter) GetFile(ctx context.Context, id string) (*openai.File, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.GetFile(ctx, strings.TrimPrefix(id, openaiFileIDPrefix))
+	if err != nil {
+		return nil, toFileError(id, err)
+	}
+
+	res := toOpenaiFile(f)
+
+	return &res, nil
+}
+
+// DeleteFile deletes the file with the given OpenAI file ID.
+func (a *Adapter) DeleteFile(ctx context.Context, id string) error {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := client.DeleteFile(ctx, strings.TrimPrefix(id, openaiFileIDPrefix)); err != nil {
+		return toFileError(id, err)
+	}
+
+	return nil
+}
+
+// toFileError returns a not found error when the file doesn't exist. Gemini
+// returns 403 for the files of other API keys.
+func toFileError(id string, err error) error {
+	if code := HTTPStatusCode(err); code != http.StatusNotFound && code != http.StatusForbidden {
+		return err
+	}
+
+	return &openai.APIError{
+		Code:           "file_not_found",
+		Message:        "No such File object: " + id,
+		Type:           "invalid_request_error",
+		HTTPStatusCode: http.StatusNotFound,
+	}
+}
+
+var toOpenaiFileStatus = map[genai.FileState]string{
+	genai.FileStateProcessing: "uploaded",
+	genai.FileStateActive:     "processed",
+	genai.FileStateFailed:     "error",
+}
+
+func toOpenaiFile(f *genai.File) openai.File {
+	res := openai.File{
+		Bytes:     int(f.SizeBytes),
+		CreatedAt: f.CreateTime.Unix(),
+		ID:        fileID(f.Name),
+		FileName:  f.DisplayName,
+		Object:    "file",
+		Status:    toOpenaiFileStatus[f.State],
+	}
+	if f.Error != nil {
+		res.StatusDetails = f.Error.Error()
+	}
+
+	return res
+}
@@ -0,0 +1,181 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+const (
+	// defaultFileUploadThreshold is the size above which blobs are uploaded
+	// through the File API, since Gemini limits inline data to 20MB per
+	// request.
+	defaultFileUploadThreshold = 8 << 20
+
+	// filePollInterval is how often the state of an uploaded file is checked
+	// while it is processed, e.g. for videos.
+	filePollInterval = time.Second
+)
+
+// SetFileUploadThreshold sets the size in bytes above which attachments are
+// uploaded through the Gemini File API instead of being sent inline. A
+// negative threshold disables the uploads.
+func (a *Adapter) SetFileUploadThreshold(n int) {
+	a.update(func(s *adapterSettings) {
+		s.fileUploadThreshold = n
+	})
+}
+
+func (a *Adapter) uploadThreshold() int {
+	if n := a.settings().fileUploadThreshold; n != 0 {
+		return n
+	}
+
+	return defaultFileUploadThreshold
+}
+
+// uploadLargeBlobs replaces the blobs above the threshold with references to
+// files uploaded through the File API. The returned function deletes the
+// files once the request is done. Gemini also deletes them after 48 hours.
+func (a *Adapter) uploadLargeBlobs(ctx context.Context, contents []*genai.Content) (func(), error) {
+	threshold := a.uploadThreshold()
+	if threshold < 0 {
+		return func() {}, nil
+	}
+
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	cleanup := func() {
+		// Delete the files even if the request was canceled.
+		ctx := context.WithoutCancel(ctx)
+		for _, name := range names {
+			if err := client.DeleteFile(ctx, name); err != nil && a.logger != nil {
+				a.logger.ErrorContext(ctx, "delete file failed",
+					slog.String("name", name),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+	}
+
+	for _, c := range contents {
+		for i, p := range c.Parts {
+			blob, ok := p.(genai.Blob)
+			if !ok || len(blob.Data) <= threshold {
+				continue
+			}
+
+			f, err := uploadFile(ctx, client, bytes.NewReader(blob.Data), &genai.UploadFileOptions{
+				MIMEType: blob.MIMEType,
+			})
+			if f != nil {
+				names = append(names, f.Name)
+			}
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			c.Parts[i] = genai.FileData{
+				MIMEType: f.MIMEType,
+				URI:      f.URI,
+			}
+		}
+	}
+
+	return cleanup, nil
+}
+
+// prepareMedia fetches the remote media, and looks up the MIME types of the
+// files referenced by the request, since OpenAI file references only carry the
+// file ID. This is done before the model is selected, which depends on the
+// media.
+func (a *Adapter) prepareMedia(ctx context.Context, contents []*genai.Content) error {
+	if err := a.fetchMedia(ctx, contents); err != nil {
+		return err
+	}
+
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	return resolveFiles(ctx, client, contents)
+}
+
+// resolveFiles sets the MIME type of the file parts that don't have one.
+func resolveFiles(ctx context.Context, client *genai.Client, contents []*genai.Content) error {
+	for _, c := range contents {
+		for i, p := range c.Parts {
+			fd, ok := p.(genai.FileData)
+			if !ok || fd.MIMEType != "" {
+				continue
+			}
+
+			// The Cloud Storage objects are typed by their extension, since
+			// Vertex AI has no File API to look them up.
+			if strings.HasPrefix(fd.URI, gcsURIPrefix) {
+				fd.MIMEType = mime.TypeByExtension(path.Ext(fd.URI))
+				if fd.MIMEType == "" {
+					return invalidRequestError("invalid_file", "messages", "unknown MIME type of %s", fd.URI)
+				}
+
+				c.Parts[i] = fd
+				continue
+			}
+
+			f, err := client.GetFile(ctx, "files/"+fd.URI[strings.LastIndex(fd.URI, "/")+1:])
+			if err != nil {
+				return invalidRequestError("invalid_file", "messages", "file %s not found: %v", fileID(fd.URI), err)
+			}
+
+			fd.MIMEType = f.MIMEType
+			c.Parts[i] = fd
+		}
+	}
+
+	return nil
+}
+
+// uploadFile uploads the file and waits until it is processed.
+func uploadFile(ctx context.Context, client *genai.Client, r io.Reader, opts *genai.UploadFileOptions) (*genai.File, error) {
+	f, err := client.UploadFile(ctx, "", r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for f.State == genai.FileStateProcessing {
+		select {
+		case <-ctx.Done():
+			return f, ctx.Err()
+		case <-time.After(filePollInterval):
+		}
+
+		f, err = client.GetFile(ctx, f.Name)
+		if err != nil {
+			return f, err
+		}
+	}
+
+	if f.State == genai.FileStateFailed {
+		if f.Error != nil {
+			return f, fmt.Errorf("process file %s: %w", f.Name, f.Error)
+		}
+
+		return f, fmt.Errorf("process file %s: failed", f.Name)
+	}
+
+	return f, nil
+}
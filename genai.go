@@ -1,118 +1,375 @@
 package goai
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
 	openai "github.com/sashabaranov/go-openai"
 )
 
-const systemPrompt = "I will ask you a question. Please answer it."
+// defaultSystemPrompt is the user message prepended to the conversations that
+// don't start with one.
+const defaultSystemPrompt = "I will ask you a question. Please answer it."
 
 const (
 	genaiRoleUser  = "user"
 	genaiRoleModel = "model"
 )
 
-func buildContent(msgs []openai.ChatCompletionMessage) []*genai.Content {
-	msgs = mergeOpenaiMessages(msgs)
-	contents := toGenaiContents(msgs)
-	return reorderContentByRole(contents)
+func buildContent(msgs []openai.ChatCompletionMessage, systemPrompt string) ([]*genai.Content, error) {
+	msgs, err := mergeOpenaiMessages(msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := toGenaiContents(msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	contents = mergeGenaiContents(contents)
+	return reorderContentByRole(contents, systemPrompt)
 }
 
-func toGenaiContents(msgs []openai.ChatCompletionMessage) []*genai.Content {
+func toGenaiContents(msgs []openai.ChatCompletionMessage) ([]*genai.Content, error) {
+	// Tool messages only reference the tool call id, but Gemini expects the
+	// function name in the FunctionResponse.
+	names := make(map[string]string)
+	for _, msg := range msgs {
+		for _, tc := range msg.ToolCalls {
+			names[tc.ID] = tc.Function.Name
+		}
+	}
+
 	contents := make([]*genai.Content, len(msgs))
 
 	for i, msg := range msgs {
-		contents[i] = toGenaiContent(msg)
+		if msg.Role == openaiRoleTool && msg.Name == "" {
+			msg.Name = names[msg.ToolCallID]
+		}
+
+		c, err := toGenaiContent(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		contents[i] = c
 	}
 
-	return contents
+	return contents, nil
 }
 
-func toGenaiContent(msg openai.ChatCompletionMessage) *genai.Content {
+// mergeGenaiContents merges consecutive contents with the same role. Tool
+// results are not merged as text by mergeOpenaiMessages, so parallel tool
+// calls end up as separate contents that must be combined here.
+func mergeGenaiContents(contents []*genai.Content) []*genai.Content {
+	var res []*genai.Content
+
+	for _, c := range contents {
+		if n := len(res); n > 0 && res[n-1].Role == c.Role {
+			res[n-1].Parts = append(res[n-1].Parts, c.Parts...)
+			continue
+		}
+
+		res = append(res, c)
+	}
+
+	return res
+}
+
+func toGenaiContent(msg openai.ChatCompletionMessage) (*genai.Content, error) {
 	r := toGenaiRole[msg.Role]
 	c := msg.Content
 	mc := msg.MultiContent
 
 	var parts []genai.Part
-	if len(mc) == 0 {
-		parts = append(parts, genai.Text(c))
-	} else {
+	switch {
+	case msg.Role == openaiRoleTool:
+		parts = append(parts, genai.FunctionResponse{
+			Name:     msg.Name,
+			Response: toGenaiArgs(c),
+		})
+	case len(mc) == 0:
+		// Assistant messages with tool calls usually have no content.
+		if c != "" || len(msg.ToolCalls) == 0 {
+			parts = append(parts, genai.Text(c))
+		}
+	default:
 		parts = make([]genai.Part, len(mc))
 		for j, content := range mc {
-			parts[j] = toGenaiPart(content)
+			p, err := toGenaiPart(content)
+			if err != nil {
+				return nil, err
+			}
+
+			parts[j] = p
 		}
 	}
 
+	for _, tc := range msg.ToolCalls {
+		parts = append(parts, genai.FunctionCall{
+			Name: tc.Function.Name,
+			Args: toGenaiArgs(tc.Function.Arguments),
+		})
+	}
+
 	return &genai.Content{
 		Role:  r,
 		Parts: parts,
+	}, nil
+}
+
+// toGenaiArgs converts the JSON-encoded tool arguments or tool result into a
+// map. Gemini only accepts objects, so anything else is wrapped under the
+// "content" key.
+func toGenaiArgs(s string) map[string]any {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(s), &m); err != nil || m == nil {
+		return map[string]any{"content": s}
+	}
+
+	return m
+}
+
+var toGenaiType = map[string]genai.Type{
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+	"object":  genai.TypeObject,
+}
+
+// jsonSchema is the subset of JSON schema that Gemini understands.
+type jsonSchema struct {
+	Type        string                 `json:"type"`
+	Format      string                 `json:"format"`
+	Description string                 `json:"description"`
+	Nullable    bool                   `json:"nullable"`
+	Enum        []string               `json:"enum"`
+	Items       *jsonSchema            `json:"items"`
+	Properties  map[string]*jsonSchema `json:"properties"`
+	Required    []string               `json:"required"`
+}
+
+func toGenaiTools(tools []openai.Tool) []*genai.Tool {
+	var decls []*genai.FunctionDeclaration
+	for _, t := range tools {
+		if t.Type != openai.ToolTypeFunction {
+			continue
+		}
+
+		decls = append(decls, &genai.FunctionDeclaration{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			Parameters:  toGenaiSchema(t.Function.Parameters),
+		})
+	}
+
+	if len(decls) == 0 {
+		return nil
+	}
+
+	return []*genai.Tool{{FunctionDeclarations: decls}}
+}
+
+// toGenaiSchema converts the function parameters, which can be any value
+// that serializes to a JSON schema.
+func toGenaiSchema(params any) *genai.Schema {
+	if params == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+
+	var s *jsonSchema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil
+	}
+
+	// Gemini rejects objects without properties, which is how functions
+	// without parameters are usually declared.
+	if s == nil || (s.Type == "object" && len(s.Properties) == 0) {
+		return nil
+	}
+
+	return s.toGenai()
+}
+
+func (s *jsonSchema) toGenai() *genai.Schema {
+	if s == nil {
+		return nil
+	}
+
+	var props map[string]*genai.Schema
+	if len(s.Properties) > 0 {
+		props = make(map[string]*genai.Schema, len(s.Properties))
+		for k, v := range s.Properties {
+			props[k] = v.toGenai()
+		}
+	}
+
+	return &genai.Schema{
+		Type:        toGenaiType[s.Type],
+		Format:      s.Format,
+		Description: s.Description,
+		Nullable:    s.Nullable,
+		Enum:        s.Enum,
+		Items:       s.Items.toGenai(),
+		Properties:  props,
+		Required:    s.Required,
 	}
 }
 
-func toGenaiPart(mp openai.ChatMessagePart) genai.Part {
+func toGenaiPart(mp openai.ChatMessagePart) (genai.Part, error) {
 	switch mp.Type {
 	case openai.ChatMessagePartTypeText:
-		return genai.Text(mp.Text)
+		return genai.Text(mp.Text), nil
 
 	case openai.ChatMessagePartTypeImageURL:
+		if mp.ImageURL == nil {
+			return nil, invalidRequestError("invalid_image", "messages", "image_url is required")
+		}
+
+		// The MIME type of the files is looked up, and the remote images are
+		// fetched, before the request is sent. The file URIs are told apart
+		// from the remote images then, on the endpoint of the request.
+		if isRemoteURL(mp.ImageURL.URL) || strings.HasPrefix(mp.ImageURL.URL, gcsURIPrefix) {
+			return genai.FileData{URI: mp.ImageURL.URL}, nil
+		}
+
 		return toGenaiImageData(mp.ImageURL.URL)
 
 	default:
-		panic("unhandled type")
+		return nil, invalidRequestError("invalid_content", "messages", "unsupported content part type %q", mp.Type)
 	}
 }
 
-func toGenaiImageData(b64img string) genai.Part {
+func toGenaiImageData(b64img string) (genai.Part, error) {
 	mimeType, blob, err := decodeBase64Image(b64img)
 	if err != nil {
-		log.Fatalf("failed to decode base64 image: %v", err)
+		return nil, invalidRequestError("invalid_image", "messages", "failed to decode base64 image: %v", err)
+	}
+
+	// Other media, e.g. the input audio, is sent with its MIME type.
+	if !strings.HasPrefix(mimeType, "image/") {
+		return genai.Blob{MIMEType: mimeType, Data: blob}, nil
+	}
+
+	// Clients often mislabel the images, so the format is detected from the
+	// data instead.
+	mimeType = detectImageMIMEType(blob)
+	if !imageMIMETypes[mimeType] {
+		return nil, invalidRequestError("invalid_image", "messages", "unsupported image format %q, expected PNG, JPEG, WebP, HEIC or HEIF", mimeType)
 	}
 
 	format := strings.TrimPrefix(mimeType, "image/")
-	return genai.ImageData(format, blob)
+	return genai.ImageData(format, blob), nil
 }
 
 func isMultiModal(contents []*genai.Content) bool {
+	return countMedia(contents) > 0
+}
+
+// EstimatePromptTokens roughly estimates the prompt tokens of the request
+// without calling Gemini, see estimateTokens. It returns 0 for the invalid
+// requests, which the adapter rejects.
+func EstimatePromptTokens(req openai.ChatCompletionRequest) int {
+	if len(req.Messages) == 0 {
+		return 0
+	}
+
+	contents, err := buildContent(req.Messages, defaultSystemPrompt)
+	if err != nil {
+		return 0
+	}
+
+	return estimateTokens(contents)
+}
+
+// estimateTokens roughly estimates the number of tokens without calling the
+// CountTokens API, assuming 4 characters per token and 258 tokens per image.
+func estimateTokens(contents []*genai.Content) int {
+	var n int
 	for _, c := range contents {
 		for _, p := range c.Parts {
-			_, ok := p.(genai.Blob)
-			if ok {
-				return ok
+			switch t := p.(type) {
+			case genai.Text:
+				n += len(t) / 4
+			case genai.Blob:
+				n += 258
 			}
 		}
 	}
 
-	return false
+	return n
 }
 
-func mergeText(parts []genai.Part) string {
+// mergeText joins the texts of the parts, with the code executions as code
+// blocks. The parts that can't be returned as text, e.g. the images of the
+// newer models, fail rather than being dropped from the answer.
+func mergeText(parts []genai.Part) (string, error) {
 	texts := make([]string, len(parts))
 	for i, p := range parts {
-		t, ok := p.(genai.Text)
-		if !ok {
-			panic("part is not text")
+		switch t := p.(type) {
+		case genai.Text:
+			texts[i] = string(t)
+		case genai.FunctionCall:
+			// Converted to tool calls instead.
+		case *genai.ExecutableCode:
+			texts[i] = toCodeBlock(toCodeLanguage[t.Language], t.Code)
+		case *genai.CodeExecutionResult:
+			texts[i] = toCodeBlock("", t.Output)
+			if msg, ok := toCodeOutcome[t.Outcome]; ok {
+				texts[i] += msg + "\n"
+			}
+		default:
+			return "", fmt.Errorf("unsupported %T part in the response", p)
 		}
-
-		texts[i] = string(t)
 	}
 
-	return strings.Join(texts, "")
+	return strings.Join(texts, ""), nil
 }
 
-func reorderContentByRole(contents []*genai.Content) []*genai.Content {
+var toCodeLanguage = map[genai.ExecutableCodeLanguage]string{
+	genai.ExecutableCodePython: "python",
+}
+
+// toCodeOutcome describes the failed code executions.
+var toCodeOutcome = map[genai.CodeExecutionResultOutcome]string{
+	genai.CodeExecutionResultOutcomeFailed:           "Execution failed.",
+	genai.CodeExecutionResultOutcomeDeadlineExceeded: "Execution timed out.",
+}
+
+// toCodeBlock formats the code executed by Gemini, or its output, as a fenced
+// code block on its own lines.
+func toCodeBlock(lang, code string) string {
+	return "\n```" + lang + "\n" + strings.TrimSuffix(code, "\n") + "\n```\n"
+}
+
+// reorderContentByRole prepends the system prompt to the conversations that
+// start with the model, since Gemini expects the user to start. The last
+// message must be from the user, which Gemini answers.
+func reorderContentByRole(contents []*genai.Content, systemPrompt string) ([]*genai.Content, error) {
+	if len(contents) == 0 {
+		return nil, invalidRequestError("invalid_value", "messages", "messages must not be empty")
+	}
+
 	if contents[len(contents)-1].Role != genaiRoleUser {
-		panic("last message must be from user")
+		return nil, invalidRequestError("invalid_value", "messages", "the last message must be from the user, the system or a tool")
 	}
 
 	if contents[0].Role == genaiRoleUser {
-		return contents
+		return contents, nil
 	}
 
 	return append([]*genai.Content{{
 		Role:  genaiRoleUser,
 		Parts: []genai.Part{genai.Text(systemPrompt)},
-	}}, contents...)
+	}}, contents...), nil
 }
@@ -0,0 +1,37 @@
+package goai
+
+import (
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+func TestMergeText(t *testing.T) {
+	got, err := mergeText([]genai.Part{
+		genai.Text("Hello"),
+		genai.FunctionCall{Name: "get_weather"},
+		genai.Text(" world"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Hello world" {
+		t.Errorf("got %q, want %q", got, "Hello world")
+	}
+
+	// The parts without a text, e.g. the generated images, fail instead of
+	// being dropped from the answer.
+	_, err = mergeText([]genai.Part{genai.Text("Here is the image:"), genai.ImageData("png", []byte("png"))})
+	if err == nil {
+		t.Fatal("got no error for an image part")
+	}
+
+	_, err = toOpenaiResponse(&genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.FileData{URI: "gs://bucket/image.png"}}},
+		}},
+	})
+	if err == nil {
+		t.Fatal("got no error for a file part")
+	}
+}
@@ -0,0 +1,226 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var generationConfigContextKey contextKey = "generation_config"
+
+// generationConfig holds the generation config fields that are supported by
+// the Gemini API, but not by the genai package yet. They are added to the
+// request body by the generationConfigTransport.
+type generationConfig struct {
+	PresencePenalty  *float32 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequencyPenalty,omitempty"`
+	Seed             *int32   `json:"seed,omitempty"`
+	ResponseLogprobs bool     `json:"responseLogprobs,omitempty"`
+	Logprobs         *int32   `json:"logprobs,omitempty"`
+
+	// GoogleSearch is the name of the Google Search tool to add to the
+	// tools, outside of the generation config.
+	GoogleSearch string `json:"-"`
+}
+
+func (c generationConfig) empty() bool {
+	return c == generationConfig{}
+}
+
+func generationConfigContext(ctx context.Context, cfg generationConfig) context.Context {
+	if cfg.empty() {
+		return ctx
+	}
+
+	return context.WithValue(ctx, generationConfigContextKey, cfg)
+}
+
+// generationConfigTransport adds the generation config from the request
+// context to the generateContent requests. Since a custom HTTP client
+// disables the API key option, it also sets the API key.
+type generationConfigTransport struct {
+	apiKey string
+	base   http.RoundTripper
+
+	// unauthorized is called when Gemini rejects the API key.
+	unauthorized func()
+}
+
+func (t *generationConfigTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("x-goog-api-key", t.apiKey)
+
+	cfg, ok := r.Context().Value(generationConfigContextKey).(generationConfig)
+	if ok && r.Body != nil && isGenerateContent(r.URL.Path) {
+		body, err := withGenerationConfig(r.Body, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	res, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.unauthorized != nil && isUnauthorized(res) {
+		t.unauthorized()
+	}
+
+	g, ok := r.Context().Value(groundingContextKey).(*Groundings)
+	if ok && res.StatusCode == http.StatusOK && isGenerateContent(r.URL.Path) {
+		res.Body = g.tee(res.Body)
+	}
+
+	raw, ok := r.Context().Value(rawResponsesContextKey).(*RawResponses)
+	if ok && res.StatusCode == http.StatusOK && isGenerateContent(r.URL.Path) {
+		res.Body = raw.tee(res.Body)
+	}
+
+	lp, ok := r.Context().Value(logprobsContextKey).(*logprobsCollector)
+	if ok && res.StatusCode == http.StatusOK && isGenerateContent(r.URL.Path) {
+		if err := lp.readResponse(res); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// isUnauthorized reports whether the API key is rejected. Gemini rejects
+// the invalid keys with a 400 API_KEY_INVALID error, whose body is read
+// again by the client.
+func isUnauthorized(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	case http.StatusBadRequest:
+		b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(b))
+
+		return err == nil && bytes.Contains(b, []byte("API_KEY_INVALID"))
+	default:
+		return false
+	}
+}
+
+func isGenerateContent(path string) bool {
+	return strings.HasSuffix(path, ":generateContent") || strings.HasSuffix(path, ":streamGenerateContent")
+}
+
+func withGenerationConfig(rc io.ReadCloser, cfg generationConfig) ([]byte, error) {
+	defer rc.Close()
+
+	var body map[string]any
+	if err := json.NewDecoder(rc).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	gc, _ := body["generationConfig"].(map[string]any)
+	if gc == nil {
+		gc = make(map[string]any)
+	}
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &gc); err != nil {
+		return nil, err
+	}
+
+	body["generationConfig"] = gc
+
+	if cfg.GoogleSearch != "" {
+		tools, _ := body["tools"].([]any)
+		body["tools"] = append(tools, map[string]any{
+			cfg.GoogleSearch: map[string]any{},
+		})
+	}
+
+	return json.Marshal(body)
+}
+
+func toGenerationConfig(ctx context.Context, model string, req openai.ChatCompletionRequest) generationConfig {
+	var cfg generationConfig
+	if req.PresencePenalty != 0 {
+		cfg.PresencePenalty = &req.PresencePenalty
+	}
+
+	if req.FrequencyPenalty != 0 {
+		cfg.FrequencyPenalty = &req.FrequencyPenalty
+	}
+
+	if req.Seed != nil {
+		// The seed of the other models is dropped, see dropUnsupportedParams.
+		if supportsSeed(model) {
+			seed := int32(*req.Seed)
+			cfg.Seed = &seed
+		}
+	}
+
+	if extensionsFromContext(ctx).Grounding {
+		cfg.GoogleSearch = googleSearchTool(model)
+	}
+
+	if req.LogProbs {
+		cfg.ResponseLogprobs = true
+		if req.TopLogProbs > 0 {
+			n := int32(req.TopLogProbs)
+			cfg.Logprobs = &n
+		}
+	}
+
+	return cfg
+}
+
+// supportsPenalties reports whether the model accepts the presence and
+// frequency penalties, which are not available before the 002 versions of
+// Gemini 1.5.
+func supportsPenalties(model string) bool {
+	model = strings.TrimPrefix(model, "models/")
+
+	switch {
+	case strings.HasPrefix(model, "gemini-pro"),
+		strings.HasPrefix(model, "gemini-1.0-"),
+		strings.HasPrefix(model, "gemini-1.5-") && strings.HasSuffix(model, "-001"):
+		return false
+	default:
+		return true
+	}
+}
+
+// supportsSeed reports whether the model accepts the seed, which was added
+// together with the penalties.
+func supportsSeed(model string) bool {
+	return supportsPenalties(model)
+}
+
+func validatePenalties(model string, req openai.ChatCompletionRequest) error {
+	if supportsPenalties(model) {
+		return nil
+	}
+
+	if req.PresencePenalty != 0 {
+		return invalidParamError("presence_penalty", "presence_penalty is not supported by model %q", model)
+	}
+
+	if req.FrequencyPenalty != 0 {
+		return invalidParamError("frequency_penalty", "frequency_penalty is not supported by model %q", model)
+	}
+
+	return nil
+}
@@ -2,10 +2,15 @@ package goai
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
@@ -13,21 +18,15 @@ import (
 	"github.com/google/generative-ai-go/genai"
 	"github.com/google/uuid"
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 type contextKey string
 
-var (
-	// ApiKey context key.
-	apiKeyContextKey contextKey = "api_key"
-)
-
-func AuthContext(ctx context.Context, apiKey string) context.Context {
-	return context.WithValue(ctx, apiKeyContextKey, apiKey)
-}
-
 type openaiClient interface {
 	ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)
 	ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error)
@@ -35,93 +34,409 @@ type openaiClient interface {
 
 type Adapter struct {
 	openaiClient
-	clients sync.Map
-	logger  *slog.Logger
+	clients       *clientCache
+	logger        *slog.Logger
+	cache         Cache
+	contextCaches contextCaches
+	endpoint      string
+	transport     http.RoundTripper
+	httpClient    *http.Client
+	vertexAI      *VertexAI
+
+	// providers serve the models prefixed with their name, see
+	// RegisterProvider.
+	providers sync.Map
+
+	// vertexTransports share the tokens of the Vertex AI projects.
+	vertexTransports sync.Map
+
+	// mu serializes the updates of the settings, which are read without
+	// locking.
+	mu      sync.Mutex
+	current atomic.Pointer[adapterSettings]
+}
+
+// adapterSettings are the settings that can be changed while the adapter
+// serves requests, e.g. when the config is reloaded. They are replaced as a
+// whole rather than modified, so that the requests read them without locking.
+type adapterSettings struct {
+	modelMapping       map[string]string
+	modelPassthrough   bool
+	defaultModel       string
+	defaultVisionModel string
+	routes             []Route
+	systemPrompt       string
+	safetySettings     []*genai.SafetySetting
+	temperatureMode    TemperatureMode
+	maxTemperature     float32
+	paramMode          ParamMode
+
+	fileUploadThreshold int
+	admission           Admission
+	videoModel          string
+	retry               Retry
+	fallbacks           map[string][]string
+	payloadLogging      PayloadLogging
 }
 
 var _ openaiClient = (*Adapter)(nil)
 
 func NewAdapter() *Adapter {
-	return &Adapter{}
+	a := &Adapter{
+		cache:   NewMemoryCache(),
+		clients: newClientCache(),
+	}
+	a.current.Store(new(adapterSettings))
+
+	return a
+}
+
+// settings returns the current settings, which must not be modified.
+func (a *Adapter) settings() *adapterSettings {
+	return a.current.Load()
+}
+
+// update replaces the settings with a copy modified by fn.
+func (a *Adapter) update(fn func(s *adapterSettings)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := *a.current.Load()
+	fn(&s)
+	a.current.Store(&s)
 }
 
 func (a *Adapter) SetLogger(logger *slog.Logger) {
 	a.logger = logger
 }
 
-func (a *Adapter) Close() {
-	a.clients.Range(func(key, val any) bool {
-		_ = val.(*genai.Client).Close()
+// SetCache sets the cache of the model lists, e.g. a Redis cache shared by
+// the replicas. The clients are kept per process, since they hold the
+// connections.
+func (a *Adapter) SetCache(c Cache) {
+	a.cache = c
+}
 
-		// Continue iterating over the map.
-		return true
+// SetModelMapping sets the Gemini model to use for each requested model name.
+func (a *Adapter) SetModelMapping(m map[string]string) {
+	a.update(func(s *adapterSettings) {
+		s.modelMapping = m
 	})
 }
 
+// SetModelPassthrough uses the requested model name as is when it starts with
+// "gemini-", without validating it against the available models.
+func (a *Adapter) SetModelPassthrough(passthrough bool) {
+	a.update(func(s *adapterSettings) {
+		s.modelPassthrough = passthrough
+	})
+}
+
+// SetEndpoint sets the base URL of the Gemini API, e.g. a regional or
+// private endpoint, or the URL of a goaitest.Server. It must be set before
+// the first request.
+func (a *Adapter) SetEndpoint(endpoint string) {
+	a.endpoint = endpoint
+}
+
+// baseURL returns the base URL of the Gemini API calls that the genai
+// package does not support.
+func (a *Adapter) baseURL() string {
+	if a.endpoint == "" {
+		return geminiBaseURL
+	}
+
+	return strings.TrimRight(a.endpoint, "/") + "/v1beta"
+}
+
+// SetTransport sets the transport of the Gemini API calls, e.g. a
+// goaitest.Recorder, instead of http.DefaultTransport. It must be set before
+// the first request.
+func (a *Adapter) SetTransport(t http.RoundTripper) {
+	a.transport = t
+}
+
+// SetHTTPClient sets the HTTP client of the Gemini API calls, e.g. with a
+// proxy, custom CAs or the transport timeouts. The transport set with
+// SetTransport takes precedence over the one of the client. It must be set
+// before the first request.
+func (a *Adapter) SetHTTPClient(c *http.Client) {
+	a.httpClient = c
+}
+
+// newHTTPClient returns a copy of the HTTP client of the Gemini API calls,
+// with the transport set with SetTransport, which sends the calls to the
+// Vertex AI project if any.
+func (a *Adapter) newHTTPClient(vertex *VertexAI) *http.Client {
+	client := new(http.Client)
+	if a.httpClient != nil {
+		*client = *a.httpClient
+	}
+
+	if a.transport != nil {
+		client.Transport = a.transport
+	}
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport
+	}
+	if vertex != nil {
+		t, _ := a.vertexTransports.LoadOrStore(vertex.clientKey(), &vertexTransport{vertex: vertex, base: client.Transport})
+		client.Transport = t.(*vertexTransport)
+	}
+
+	return client
+}
+
+func (a *Adapter) Close() {
+	a.clients.close()
+}
+
+// Clients returns the number of Gemini clients, one per API key.
+func (a *Adapter) Clients() int {
+	return a.clients.stats().Clients
+}
+
 func (a *Adapter) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
-	contents := buildContent(req.Messages)
-	model, err := a.loadOrStoreModel(ctx, req, isMultiModal(contents))
+	ctx, span := startSpan(ctx, "goai.ChatCompletion", attribute.String("openai.model", req.Model))
+	res, err := a.chatCompletionOf(ctx, req)
+	endRequestSpan(ctx, span, err)
+
+	return res, err
+}
+
+func (a *Adapter) chatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	contents, err := a.convertMessages(ctx, req.Messages)
 	if err != nil {
 		return nil, err
 	}
 
-	contents, tail := pop(contents)
+	model, modelName, err := a.selectModel(ctx, req, contents)
+	if err != nil {
+		return nil, err
+	}
 
-	// Chat messages must have roles alternating between 'user' and 'model'.
-	sc := model.StartChat()
-	sc.History = contents
-	if a.logger != nil {
-		a.logger.Info("sendMessage",
-			slog.Any("contents", contents),
-			slog.Any("tail", tail),
-		)
+	cleanup, err := a.uploadLargeBlobs(ctx, contents)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	var logprobs *logprobsCollector
+	if req.LogProbs {
+		ctx, logprobs = logprobsContext(ctx)
 	}
 
-	// The send message must be from role `user`.
-	resp, err := sc.SendMessage(ctx, tail.Parts...)
+	cached := a.useContextCache(ctx, model, modelName, req.Messages, contents)
+
+	var resp *genai.GenerateContentResponse
+	modelName, err = a.withFallbacks(ctx, model, modelName, req, func(ctx context.Context, model *genai.GenerativeModel) error {
+		history, tail := a.chatHistory(ctx, model, contents, cached)
+
+		// The send message must be from role `user`.
+		var err error
+		resp, err = a.sendMessage(ctx, model, history, tail.Parts)
+		return err
+	})
+	if c, ok := blockedCandidate(err); ok {
+		// Return the filtered candidate, so that clients can see why.
+		resp, err = &genai.GenerateContentResponse{Candidates: []*genai.Candidate{c}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startSpan(ctx, "goai.convertResponse")
+	res, err := toOpenaiResponse(resp)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 
-	return toOpenaiResponse(resp)
+	res.SystemFingerprint = a.systemFingerprint(modelName)
+	if logprobs != nil {
+		setLogprobs(ctx, res, logprobs)
+	}
+
+	return res, nil
 }
 
+// ChatCompletionStream streams the response. Its span ends with the stream,
+// so that the slow streams can be told apart from a slow first chunk.
 func (a *Adapter) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
-	contents := buildContent(req.Messages)
-	model, err := a.loadOrStoreModel(ctx, req, isMultiModal(contents))
+	ctx, span := startSpan(ctx, "goai.ChatCompletionStream", attribute.String("openai.model", req.Model))
+	ch, err := a.chatCompletionStreamOf(ctx, req)
 	if err != nil {
+		endRequestSpan(ctx, span, err)
 		return nil, err
 	}
 
-	contents, tail := pop(contents)
+	return ch, nil
+}
 
-	// Chat messages must have roles alternating between 'user' and 'model'.
-	sc := model.StartChat()
-	sc.History = contents
-	if a.logger != nil {
-		a.logger.Info("sendMessage",
-			slog.Any("contents", contents),
-			slog.Any("tail", tail),
-		)
+func (a *Adapter) chatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	contents, err := a.convertMessages(ctx, req.Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	model, modelName, err := a.selectModel(ctx, req, contents)
+	if err != nil {
+		return nil, err
 	}
 
+	// The logprobs are read from the whole response, which is not possible
+	// when streaming.
+	if req.LogProbs {
+		if err := dropParam(ctx, a.paramMode(ctx), "logprobs", "logprobs is not supported when streaming"); err != nil {
+			return nil, err
+		}
+		req.LogProbs = false
+		req.TopLogProbs = 0
+	}
+
+	cleanup, err := a.uploadLargeBlobs(ctx, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := a.useContextCache(ctx, model, modelName, req.Messages, contents)
+
+	// The stream is started before returning, so that the failures before the
+	// first chunk can fall back to another model, and are returned otherwise.
+	var (
+		iter     *genai.GenerateContentResponseIterator
+		first    *genai.GenerateContentResponse
+		firstErr error
+	)
+	modelName, firstErr = a.withFallbacks(ctx, model, modelName, req, func(ctx context.Context, model *genai.GenerativeModel) error {
+		history, tail := a.chatHistory(ctx, model, contents, cached)
+
+		var err error
+		iter, first, err = a.sendMessageStream(ctx, model, history, tail.Parts)
+		return err
+	})
+	if _, ok := blockedCandidate(firstErr); !ok && firstErr != nil && firstErr != iterator.Done {
+		cleanup()
+		return nil, firstErr
+	}
+
+	// All chunks of a stream share the same id, created time and fingerprint.
+	id := "chatcmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+	fingerprint := a.systemFingerprint(modelName)
+
 	ch := make(chan openai.ChatCompletionStreamResponse)
 	go func() {
-		iter := sc.SendMessageStream(ctx, tail.Parts...)
+		defer cleanup()
+		defer close(ch)
+
+		var (
+			chunks    int
+			streamErr error
+		)
+		defer func() {
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(attribute.Int("goai.chunks", chunks))
+			endRequestSpan(ctx, span, streamErr)
+		}()
+
+		next := func() (*genai.GenerateContentResponse, error) {
+			if first != nil || firstErr != nil {
+				res, err := first, firstErr
+				first, firstErr = nil, nil
+				return res, err
+			}
+
+			return iter.Next()
+		}
+
+		// The number of tool calls streamed so far per candidate.
+		toolCalls := make(map[int32]int)
+
+		// Gemini chunks may split a multi-byte character.
+		runes := newRuneBuffer()
+
+		// The usage of the last chunk covers the whole response.
+		var usage *genai.UsageMetadata
+
+		// send stops when the consumer is gone, e.g. the client
+		// disconnected, which also cancels the upstream stream.
+		send := func(choices []openai.ChatCompletionStreamChoice, u *openai.Usage) bool {
+			select {
+			case ch <- openai.ChatCompletionStreamResponse{
+				ID:                id,
+				Object:            "chat.completion.chunk",
+				Created:           created,
+				Model:             req.Model,
+				Choices:           choices,
+				SystemFingerprint: fingerprint,
+				Usage:             u,
+			}:
+				return true
+			case <-ctx.Done():
+				streamErr = ctx.Err()
+				return false
+			}
+		}
 
 		for {
-			res, err := iter.Next()
-			if err == iterator.Done {
-				close(ch)
-				break
+			res, err := next()
+
+			var out [][]openai.ChatCompletionStreamChoice
+			if err == nil {
+				chunks++
+				if res.UsageMetadata != nil {
+					usage = res.UsageMetadata
+				}
+
+				// The parts that can't be converted end the stream, like
+				// an upstream error.
+				out, err = toOpenaiStreamChunks(res.Candidates, toolCalls)
+			} else if c, ok := blockedCandidate(err); ok {
+				// Send the filtered candidate, so that clients can see
+				// why, and end the stream.
+				var blocked [][]openai.ChatCompletionStreamChoice
+				blocked, err = toOpenaiStreamChunks([]*genai.Candidate{c}, toolCalls)
+				for _, choices := range blocked {
+					runes.complete(choices)
+					if !send(choices, nil) {
+						return
+					}
+				}
+				if err == nil {
+					err = iterator.Done
+				}
+			}
+
+			if err != nil {
+				// The error can't be returned once the stream started, so
+				// the stream ends with the content received so far.
+				if err != iterator.Done {
+					streamErr = err
+					if a.logger != nil {
+						a.logger.ErrorContext(ctx, "stream failed", slog.String("error", err.Error()))
+					}
+				}
+
+				if choices := runes.flush(); len(choices) > 0 {
+					if !send(choices, nil) {
+						return
+					}
+				}
+
+				if usage != nil && req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+					u := toOpenaiUsage(usage)
+					send([]openai.ChatCompletionStreamChoice{}, &u)
+				}
+
+				return
 			}
 
-			ch <- openai.ChatCompletionStreamResponse{
-				ID:      "cmpl-" + uuid.New().String(),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   req.Model,
-				Choices: toOpenaiStreamChoices(res.Candidates),
+			for _, choices := range out {
+				runes.complete(choices)
+				if !send(choices, nil) {
+					return
+				}
 			}
 		}
 	}()
@@ -129,45 +444,110 @@ func (a *Adapter) ChatCompletionStream(ctx context.Context, req openai.ChatCompl
 	return ch, nil
 }
 
+// convertMessages converts the OpenAI messages to Gemini contents, including
+// the remote media.
+func (a *Adapter) convertMessages(ctx context.Context, messages []openai.ChatCompletionMessage) ([]*genai.Content, error) {
+	ctx, span := startSpan(ctx, "goai.convertMessages", attribute.Int("openai.messages", len(messages)))
+	contents, err := buildContent(messages, a.prompt())
+	if err == nil {
+		a.logConversion(ctx, messages, contents)
+		err = a.prepareMedia(ctx, contents)
+	}
+	endSpan(span, err)
+
+	return contents, err
+}
+
+// selectModel picks the Gemini model of the request.
+func (a *Adapter) selectModel(ctx context.Context, req openai.ChatCompletionRequest, contents []*genai.Content) (*genai.GenerativeModel, string, error) {
+	ctx, span := startSpan(ctx, "goai.selectModel")
+	model, modelName, err := a.loadOrStoreModel(ctx, req, contents)
+	span.SetAttributes(attribute.String("gemini.model", modelName))
+	endSpan(span, err)
+
+	return model, modelName, err
+}
+
 func (a *Adapter) createClient(ctx context.Context) (*genai.Client, error) {
-	apiKey := ctx.Value(apiKeyContextKey).(string)
-	openaiClient, ok := a.clients.Load(apiKey)
+	apiKey := RequestInfoFromContext(ctx).APIKey
+	// The clients are keyed by the hash of the key, so that the keys are only
+	// held by the clients. The Vertex AI clients don't use the keys.
+	vertex := a.vertexAIOf(ctx)
+	clientKey := keyHash(apiKey)
+	if vertex != nil {
+		apiKey = ""
+		clientKey = vertex.clientKey()
+	}
+
+	openaiClient, ok := a.clients.get(clientKey)
 	if !ok {
-		g, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
-		if err != nil {
-			return nil, err
+		client := a.newHTTPClient(vertex)
+		client.Transport = &generationConfigTransport{
+			apiKey: apiKey,
+			// The clients of the invalid keys are not kept.
+			unauthorized: func() { a.clients.delete(clientKey) },
+			// Propagates the trace context to Gemini.
+			base: otelhttp.NewTransport(client.Transport),
 		}
 
-		c, loaded := a.clients.LoadOrStore(apiKey, g)
-		if loaded {
-			openaiClient = c
+		opts := []option.ClientOption{
+			option.WithHTTPClient(client),
+		}
+		if vertex == nil {
+			opts = append(opts, option.WithAPIKey(apiKey))
 		} else {
-			openaiClient = g
+			// The client of the cached contents doesn't use the HTTP
+			// client, and would look up the credentials otherwise.
+			opts = append(opts, option.WithoutAuthentication())
+		}
+		if a.endpoint != "" {
+			opts = append(opts, option.WithEndpoint(a.endpoint))
 		}
+
+		g, err := genai.NewClient(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		openaiClient = a.clients.add(clientKey, g)
 	}
 
-	return openaiClient.(*genai.Client), nil
+	return openaiClient, nil
 }
 
-func (a *Adapter) loadOrStoreModel(ctx context.Context, req openai.ChatCompletionRequest, isMultiModal bool) (*genai.GenerativeModel, error) {
+func (a *Adapter) loadOrStoreModel(ctx context.Context, req openai.ChatCompletionRequest, contents []*genai.Content) (*genai.GenerativeModel, string, error) {
 	openaiClient, err := a.createClient(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	isMultiModal := isMultiModal(contents)
+	modelName, err := a.admit(ctx, req, contents, a.modelName(ctx, openaiClient, req.Model, contents))
+	if err != nil {
+		return nil, "", err
 	}
+	modelName = a.withVideoSupport(ctx, modelName, contents)
+
+	info := RequestInfoFromContext(ctx)
+	info.Model = req.Model
+	info.GeminiModel = modelName
 
-	var model *genai.GenerativeModel
-	if isMultiModal {
-		model = openaiClient.GenerativeModel("gemini-pro-vision")
-	} else {
-		model = openaiClient.GenerativeModel("gemini-pro")
+	if err := validatePenalties(modelName, req); err != nil {
+		return nil, "", err
 	}
 
+	if err := validateLogprobs(req); err != nil {
+		return nil, "", err
+	}
+
+	model := openaiClient.GenerativeModel(modelName)
+
 	var (
 		// Gemini only supports 1 candidate for now.
 		candidateCount  = int32(1)
 		maxOutputTokens = int32(req.MaxTokens)
 		stopSequences   = req.Stop
-		temperature     = req.Temperature
+		temperature     = a.normalizeTemperature(req.Temperature)
 		topP            = req.TopP
 	)
 
@@ -176,6 +556,33 @@ func (a *Adapter) loadOrStoreModel(ctx context.Context, req openai.ChatCompletio
 	model.SetTemperature(temperature)
 	model.SetTopP(topP)
 	model.StopSequences = stopSequences
+	model.Tools = toGenaiTools(req.Tools)
+	ext := extensionsFromContext(ctx)
+	model.SafetySettings, err = withSafetySettings(a.settings().safetySettings, ext.SafetySettings)
+	if err != nil {
+		return nil, "", invalidRequestError("invalid_value", "google.safety_settings", "%v", err)
+	}
+
+	if ext.TopK != nil {
+		model.SetTopK(*ext.TopK)
+	}
+
+	if ext.CachedContent != "" {
+		model.CachedContentName = cachedContentName(strings.TrimPrefix(ext.CachedContent, "cachedContents/"))
+	}
+
+	if ext.CodeExecution {
+		model.Tools = append(model.Tools, &genai.Tool{
+			CodeExecution: &genai.CodeExecution{},
+		})
+	}
+
+	if err := a.dropUnsupportedParams(ctx, modelName, req); err != nil {
+		return nil, "", err
+	}
+	if temperature != req.Temperature {
+		addWarning(ctx, "normalized_parameter", "temperature %v was converted to %v", req.Temperature, temperature)
+	}
 
 	// Don't set if it is 0.
 	if topP == 0 {
@@ -187,17 +594,97 @@ func (a *Adapter) loadOrStoreModel(ctx context.Context, req openai.ChatCompletio
 	}
 
 	if a.logger != nil {
-		a.logger.Info("parameters",
+		a.logger.InfoContext(ctx, "parameters",
 			slog.Int("candidate_count", int(candidateCount)),
 			slog.Int("max_output_tokens", int(maxOutputTokens)),
-			slog.String("stop_sequences", strings.Join(stopSequences, " ")),
+			slog.Int("stop_sequences", len(stopSequences)),
 			slog.Float64("temperature", float64(temperature)),
 			slog.Float64("top_p", float64(topP)),
+			slog.Any("top_k", ext.TopK),
 			slog.Bool("isMultiModal", isMultiModal),
+			slog.String("model", modelName),
+		)
+	}
+
+	return model, modelName, nil
+}
+
+func (a *Adapter) modelName(ctx context.Context, client *genai.Client, name string, contents []*genai.Content) string {
+	if m, ok := a.route(ctx, name, contents); ok {
+		return m
+	}
+
+	s := a.settings()
+	if m, ok := s.modelMapping[name]; ok {
+		return m
+	}
+
+	if a.isGeminiModel(ctx, client, name) {
+		return name
+	}
+
+	fallback := s.defaultModel
+	if fallback == "" {
+		fallback = defaultModel
+	}
+	if isMultiModal(contents) {
+		fallback = s.defaultVisionModel
+		if fallback == "" {
+			fallback = defaultVisionModel
+		}
+	}
+
+	if name != fallback {
+		addWarning(ctx, "fallback_model", "model %q is not mapped, using %q", name, fallback)
+	}
+
+	return fallback
+}
+
+// systemFingerprint identifies the model and the adapter config that affect
+// the sampling, so that clients relying on the seed can detect changes.
+func (a *Adapter) systemFingerprint(model string) string {
+	h := sha256.New()
+	s := a.settings()
+	fmt.Fprintf(h, "%s\x00%s\x00%v", model, s.temperatureMode, s.maxTemperature)
+
+	return "fp_" + hex.EncodeToString(h.Sum(nil))[:10]
+}
+
+// blockedCandidate returns the candidate blocked by the safety filters. Its
+// content is empty.
+func blockedCandidate(err error) (*genai.Candidate, bool) {
+	var blocked *genai.BlockedError
+	if !errors.As(err, &blocked) || blocked.Candidate == nil {
+		return nil, false
+	}
+
+	c := *blocked.Candidate
+	if c.Content == nil {
+		c.Content = &genai.Content{Role: genaiRoleModel}
+	}
+
+	return &c, true
+}
+
+// chatHistory returns the history and the message to send to the model. The
+// contents without the cached prefix are only sent to the model that uses the
+// context cache.
+func (a *Adapter) chatHistory(ctx context.Context, model *genai.GenerativeModel, contents, cached []*genai.Content) ([]*genai.Content, *genai.Content) {
+	if model.CachedContentName != "" {
+		contents = cached
+	}
+	history, tail := pop(contents)
+
+	// Chat messages must have roles alternating between 'user' and 'model'.
+	if pl := a.settings().payloadLogging; a.logger != nil && pl.Enabled {
+		a.logger.InfoContext(ctx, "sendMessage",
+			pl.Attr("contents", history),
+			pl.Attr("tail", tail),
 		)
 	}
 
-	return model, nil
+	return history, tail
 }
 
 func pop[T any](vs []T) ([]T, T) {
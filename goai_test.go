@@ -0,0 +1,464 @@
+package goai_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	goai "github.com/alextanhongpin/go-gemini"
+	"github.com/alextanhongpin/go-gemini/goaitest"
+	"github.com/sashabaranov/go-openai"
+)
+
+func newTestAdapter(t *testing.T) (*goai.Adapter, *goaitest.Server, context.Context) {
+	t.Helper()
+
+	srv := goaitest.NewServer()
+	t.Cleanup(srv.Close)
+
+	a := goai.NewAdapter()
+	a.SetEndpoint(srv.URL)
+	t.Cleanup(a.Close)
+
+	return a, srv, goai.AuthContext(context.Background(), "test-key")
+}
+
+// skipUnreadableStreamEnd skips the tests that need the end of a Gemini
+// stream, which the genai client reads with a gax decoder that relies on
+// encoding/json returning the closing bracket of the array after a failed
+// Decode. With GOEXPERIMENT=jsonv2, it returns the decoding error instead, so
+// every stream ends with an error.
+func skipUnreadableStreamEnd(t *testing.T) {
+	t.Helper()
+
+	dec := json.NewDecoder(strings.NewReader(`[{}]`))
+	var v json.RawMessage
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&v); err == nil {
+		t.Fatal("decoded past the end of the array")
+	}
+
+	if tok, _ := dec.Token(); tok != json.Delim(']') {
+		t.Skip("the genai client can't read the end of the streams with this encoding/json")
+	}
+}
+
+func chatRequest(content string) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model: "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: content},
+		},
+	}
+}
+
+// readStream returns the content and the finish reason of the stream.
+func readStream(t *testing.T, ch chan openai.ChatCompletionStreamResponse) (string, openai.FinishReason, *openai.Usage) {
+	t.Helper()
+
+	var (
+		content string
+		reason  openai.FinishReason
+		usage   *openai.Usage
+	)
+	for chunk := range ch {
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			content += c.Delta.Content
+			if c.FinishReason != "" && c.FinishReason != openai.FinishReasonNull {
+				reason = c.FinishReason
+			}
+		}
+	}
+
+	return content, reason, usage
+}
+
+func TestChatCompletion(t *testing.T) {
+	skipUnreadableStreamEnd(t)
+
+	a, srv, ctx := newTestAdapter(t)
+	srv.Enqueue(goaitest.Response{
+		Chunks:           []string{"Hello", " world"},
+		PromptTokens:     3,
+		CompletionTokens: 2,
+	})
+
+	res, err := a.ChatCompletion(ctx, chatRequest("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.Choices[0].Message.Content; got != "Hello world" {
+		t.Errorf("content = %q, want %q", got, "Hello world")
+	}
+	if got := res.Choices[0].FinishReason; got != openai.FinishReasonStop {
+		t.Errorf("finish reason = %q, want %q", got, openai.FinishReasonStop)
+	}
+	if res.Usage.PromptTokens != 3 || res.Usage.CompletionTokens != 2 || res.Usage.TotalTokens != 5 {
+		t.Errorf("usage = %+v, want 3 prompt and 2 completion tokens", res.Usage)
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	if reqs[0].APIKey != "test-key" {
+		t.Errorf("api key = %q, want %q", reqs[0].APIKey, "test-key")
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	a, srv, ctx := newTestAdapter(t)
+	srv.Enqueue(goaitest.Response{
+		Chunks:           []string{"Hello", ",", " world"},
+		PromptTokens:     3,
+		CompletionTokens: 3,
+	})
+
+	req := chatRequest("hi")
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	ch, err := a.ChatCompletionStream(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, reason, usage := readStream(t, ch)
+	if content != "Hello, world" {
+		t.Errorf("content = %q, want %q", content, "Hello, world")
+	}
+	if reason != openai.FinishReasonStop {
+		t.Errorf("finish reason = %q, want %q", reason, openai.FinishReasonStop)
+	}
+	if usage == nil || usage.TotalTokens != 6 {
+		t.Errorf("usage = %+v, want 6 total tokens", usage)
+	}
+
+	if reqs := srv.Requests(); len(reqs) != 1 || !reqs[0].Stream {
+		t.Errorf("requests = %+v, want a single streamed request", reqs)
+	}
+}
+
+func TestChatCompletionUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		stream bool
+	}{
+		{"bad request", http.StatusBadRequest, false},
+		{"forbidden", http.StatusForbidden, false},
+		{"rate limited", http.StatusTooManyRequests, false},
+		{"unavailable", http.StatusServiceUnavailable, false},
+		{"stream rate limited", http.StatusTooManyRequests, true},
+		{"stream internal error", http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, srv, ctx := newTestAdapter(t)
+			srv.Enqueue(goaitest.Error(tt.status, "upstream failure"))
+
+			req := chatRequest("hi")
+
+			var err error
+			if tt.stream {
+				req.Stream = true
+				_, err = a.ChatCompletionStream(ctx, req)
+			} else {
+				_, err = a.ChatCompletion(ctx, req)
+			}
+			if err == nil {
+				t.Fatal("got no error")
+			}
+
+			if got := goai.HTTPStatusCode(err); got != tt.status {
+				t.Errorf("status = %d, want %d: %v", got, tt.status, err)
+			}
+		})
+	}
+}
+
+func TestChatCompletionFinishReasons(t *testing.T) {
+	tests := []struct {
+		name   string
+		reason string
+		want   openai.FinishReason
+	}{
+		{"max tokens", "MAX_TOKENS", openai.FinishReasonLength},
+		{"safety", "SAFETY", openai.FinishReasonContentFilter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipUnreadableStreamEnd(t)
+
+			a, srv, ctx := newTestAdapter(t)
+			srv.Enqueue(goaitest.Response{Chunks: []string{"Once", " upon"}, FinishReason: tt.reason})
+
+			res, err := a.ChatCompletion(ctx, chatRequest("tell me a story"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := res.Choices[0].FinishReason; got != tt.want {
+				t.Errorf("finish reason = %q, want %q", got, tt.want)
+			}
+		})
+
+		t.Run(tt.name+" stream", func(t *testing.T) {
+			a, srv, ctx := newTestAdapter(t)
+			srv.Enqueue(goaitest.Response{Chunks: []string{"Once", " upon"}, FinishReason: tt.reason})
+
+			req := chatRequest("tell me a story")
+			req.Stream = true
+
+			ch, err := a.ChatCompletionStream(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, got, _ := readStream(t, ch); got != tt.want {
+				t.Errorf("finish reason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatCompletionInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []openai.ChatCompletionMessage
+	}{
+		{"empty", nil},
+		{"unknown role", []openai.ChatCompletionMessage{{Role: "robot", Content: "hi"}}},
+		{"last message from the assistant", []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: "hi"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "hello"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, srv, ctx := newTestAdapter(t)
+
+			_, err := a.ChatCompletion(ctx, openai.ChatCompletionRequest{Model: "gpt-4o", Messages: tt.messages})
+
+			var apiErr *openai.APIError
+			if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusBadRequest {
+				t.Fatalf("error = %v, want a 400 invalid request error", err)
+			}
+			if n := len(srv.Requests()); n != 0 {
+				t.Errorf("got %d upstream requests, want 0", n)
+			}
+		})
+	}
+}
+
+func TestChatCompletionStreamCanceled(t *testing.T) {
+	a, srv, ctx := newTestAdapter(t)
+
+	req := chatRequest("hi")
+	req.Stream = true
+
+	// Warm up the client, which starts its own goroutines.
+	warmUp, err := a.ChatCompletionStream(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readStream(t, warmUp)
+	before := runtime.NumGoroutine()
+
+	srv.Enqueue(goaitest.Text("a", "b", "c", "d"))
+
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := a.ChatCompletionStream(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The consumer is gone after the first chunk.
+	<-ch
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("got %d goroutines after the cancel, want at most %d", n, before)
+	}
+}
+
+var record = flag.Bool("record", false, "record the fixtures of testdata/fixtures against goaitest.Server")
+
+// TestReplayFixtures replays the Gemini API interactions of testdata/fixtures
+// through the adapter. Run it with -record to record them again.
+func TestModerationsPartialFailure(t *testing.T) {
+	skipUnreadableStreamEnd(t)
+
+	a, srv, ctx := newTestAdapter(t)
+	srv.Enqueue(goaitest.Text("ok"), goaitest.Error(http.StatusBadRequest, "upstream failure"))
+
+	res, err := a.Moderations(ctx, []string{"hello", "world"})
+
+	var batchErr *goai.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("got %v, want a batch error", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Errors[0].Index != 1 {
+		t.Fatalf("errors = %+v, want the second input", batchErr.Errors)
+	}
+
+	// The failed input is flagged, so that it isn't taken as safe.
+	if res.Results[0].Flagged || !res.Results[1].Flagged {
+		t.Errorf("flagged = %t, %t, want false, true", res.Results[0].Flagged, res.Results[1].Flagged)
+	}
+}
+
+func TestCountPromptTokens(t *testing.T) {
+	a, srv, ctx := newTestAdapter(t)
+
+	req := chatRequest("how are you today")
+	for i := 0; i < 2; i++ {
+		n, err := a.CountPromptTokens(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Fatalf("got %d tokens, want 4", n)
+		}
+	}
+
+	// The second count is cached.
+	var counts int
+	for _, r := range srv.Requests() {
+		if r.CountTokens {
+			counts++
+		}
+	}
+	if counts != 1 {
+		t.Errorf("got %d CountTokens requests, want 1", counts)
+	}
+
+	// The models of the other providers are estimated by the caller.
+	if err := a.RegisterProvider("ollama", nil); err != nil {
+		t.Fatal(err)
+	}
+	req.Model = "ollama/llama3"
+	if _, err := a.CountPromptTokens(ctx, req); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("got %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestReplayFixtures(t *testing.T) {
+	const dir = "testdata/fixtures"
+
+	a := goai.NewAdapter()
+	t.Cleanup(a.Close)
+
+	mode := goaitest.RecorderModeReplay
+	if *record {
+		srv := goaitest.NewServer()
+		t.Cleanup(srv.Close)
+		srv.Enqueue(
+			goaitest.Response{Chunks: []string{"Paris is the capital", " of France."}, PromptTokens: 8, CompletionTokens: 7},
+			goaitest.Response{Chunks: []string{"One", ", two", ", three."}, PromptTokens: 5, CompletionTokens: 6},
+			goaitest.Response{Chunks: []string{"Once upon a"}, FinishReason: "MAX_TOKENS", PromptTokens: 4, CompletionTokens: 3},
+		)
+
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		a.SetEndpoint(srv.URL)
+		mode = goaitest.RecorderModeRecord
+	}
+	a.SetTransport(goaitest.NewRecorder(dir, mode, nil))
+
+	ctx := goai.AuthContext(context.Background(), "fixture-api-key")
+
+	t.Run("completion", func(t *testing.T) {
+		skipUnreadableStreamEnd(t)
+
+		res, err := a.ChatCompletion(ctx, chatRequest("What is the capital of France?"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := res.Choices[0].Message.Content, "Paris is the capital of France."; got != want {
+			t.Errorf("content = %q, want %q", got, want)
+		}
+		if res.Usage.TotalTokens != 15 {
+			t.Errorf("usage = %+v, want 15 total tokens", res.Usage)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		req := chatRequest("Count to three.")
+		req.Stream = true
+
+		ch, err := a.ChatCompletionStream(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, reason, _ := readStream(t, ch)
+		if want := "One, two, three."; content != want {
+			t.Errorf("content = %q, want %q", content, want)
+		}
+		if reason != openai.FinishReasonStop {
+			t.Errorf("finish reason = %q, want %q", reason, openai.FinishReasonStop)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		skipUnreadableStreamEnd(t)
+
+		req := chatRequest("Tell me a story.")
+		req.MaxTokens = 3
+
+		res, err := a.ChatCompletion(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := res.Choices[0].FinishReason; got != openai.FinishReasonLength {
+			t.Errorf("finish reason = %q, want %q", got, openai.FinishReasonLength)
+		}
+	})
+
+	// The API key must never be committed with the fixtures.
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no fixtures in %s", dir)
+	}
+	for _, name := range files {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte("fixture-api-key")) {
+			t.Errorf("%s contains the API key", name)
+		}
+	}
+}
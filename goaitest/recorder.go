@@ -0,0 +1,199 @@
+package goaitest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RecorderMode selects whether the Recorder calls the Gemini API.
+type RecorderMode string
+
+const (
+	// RecorderModeReplay serves the recorded interactions, and fails the
+	// requests that were not recorded.
+	RecorderModeReplay RecorderMode = "replay"
+
+	// RecorderModeRecord calls the Gemini API and records every interaction,
+	// replacing the previous recordings.
+	RecorderModeRecord RecorderMode = "record"
+
+	// RecorderModeAuto serves the recorded interactions, and records the
+	// ones that were not recorded yet.
+	RecorderModeAuto RecorderMode = "auto"
+)
+
+// Recorder is a transport that records the Gemini API interactions as JSON
+// fixtures in a directory on the first run, and replays them afterwards, so
+// that the integration tests of the proxy run deterministically without
+// network access:
+//
+//	rec := goaitest.NewRecorder("testdata/fixtures", goaitest.RecorderModeAuto, nil)
+//	a := goai.NewAdapter()
+//	a.SetTransport(rec)
+//
+// The interactions are identified by the method, URL and body of the
+// request, ignoring the whitespace of JSON bodies, and numbered when the
+// same request is sent again. The API key is not recorded.
+type Recorder struct {
+	dir  string
+	mode RecorderMode
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+// NewRecorder returns a recorder storing the fixtures in dir. The requests
+// are sent with base, or http.DefaultTransport when nil.
+func NewRecorder(dir string, mode RecorderMode, base http.RoundTripper) *Recorder {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Recorder{
+		dir:   dir,
+		mode:  mode,
+		base:  base,
+		calls: make(map[string]int),
+	}
+}
+
+// fixture is a recorded interaction.
+type fixture struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header"`
+		Body   string      `json:"body"`
+	} `json:"response"`
+}
+
+func (rec *Recorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// protojson adds random whitespace to the requests of the genai client,
+	// which changes with the binary, so the JSON bodies are compacted.
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) == nil {
+		body = compact.Bytes()
+	}
+
+	path := rec.fixturePath(r, body)
+	if rec.mode != RecorderModeRecord {
+		f, err := readFixture(path)
+		if err == nil {
+			return f.response(r), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) || rec.mode == RecorderModeReplay {
+			return nil, fmt.Errorf("goaitest: replay %s %s: %w", r.Method, r.URL.Path, err)
+		}
+	}
+
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	res, err := rec.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// The response is read in full, so the streams are only sent once they
+	// are complete.
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var f fixture
+	f.Request.Method = r.Method
+	f.Request.URL = r.URL.RequestURI()
+	f.Request.Body = string(body)
+	f.Response.Status = res.StatusCode
+	f.Response.Header = res.Header.Clone()
+	f.Response.Body = string(b)
+	if err := writeFixture(path, f); err != nil {
+		return nil, fmt.Errorf("goaitest: record %s %s: %w", r.Method, r.URL.Path, err)
+	}
+
+	return f.response(r), nil
+}
+
+// fixturePath returns the file of the interaction, named after the hash of
+// the request and the number of identical requests sent before.
+func (rec *Recorder) fixturePath(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	key := hex.EncodeToString(h.Sum(nil)[:8])
+
+	rec.mu.Lock()
+	n := rec.calls[key]
+	rec.calls[key]++
+	rec.mu.Unlock()
+
+	return filepath.Join(rec.dir, fmt.Sprintf("%s-%d.json", key, n))
+}
+
+func readFixture(path string) (*fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func writeFixture(path string, f fixture) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o644)
+}
+
+func (f *fixture) response(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Response.Status, http.StatusText(f.Response.Status)),
+		StatusCode:    f.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        f.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(f.Response.Body))),
+		ContentLength: int64(len(f.Response.Body)),
+		Request:       r,
+	}
+}
@@ -0,0 +1,324 @@
+// Package goaitest provides a fake Gemini API, to test the adapter end to end
+// without API keys:
+//
+//	srv := goaitest.NewServer()
+//	defer srv.Close()
+//	srv.Enqueue(goaitest.Text("Hello", " world"), goaitest.Error(429, "quota exceeded"))
+//
+//	a := goai.NewAdapter()
+//	a.SetEndpoint(srv.URL)
+//	res, err := a.ChatCompletion(goai.AuthContext(ctx, "test"), req)
+package goaitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Response is a canned response of the fake Gemini API.
+type Response struct {
+	// Chunks are the texts of the streamed chunks, which are joined for the
+	// requests that are not streamed.
+	Chunks []string
+
+	// FinishReason is the finish reason of the last chunk, e.g. STOP,
+	// MAX_TOKENS or SAFETY. Defaults to STOP.
+	FinishReason string
+
+	// PromptTokens and CompletionTokens are the usage of the response.
+	PromptTokens     int
+	CompletionTokens int
+
+	// Truncated ends the stream after the chunks without closing it, like a
+	// dropped connection.
+	Truncated bool
+
+	// Status fails the request with the status code and Message, e.g. 429
+	// or 503.
+	Status  int
+	Message string
+}
+
+// Text returns a response streamed in the chunks.
+func Text(chunks ...string) Response {
+	return Response{Chunks: chunks}
+}
+
+// Error returns a response failing with the status code.
+func Error(status int, message string) Response {
+	return Response{Status: status, Message: message}
+}
+
+// Request is a request received by the fake Gemini API.
+type Request struct {
+	// Model is the Gemini model of the request, e.g. "gemini-1.5-flash".
+	Model  string
+	Stream bool
+	APIKey string
+
+	// CountTokens is set for the CountTokens requests, which are counted
+	// from the words of the contents rather than answered.
+	CountTokens bool
+
+	// Body is the GenerateContentRequest in JSON.
+	Body json.RawMessage
+}
+
+// Server is a fake Gemini API. It serves the enqueued responses in order, and
+// echoes the last text of the request when there is none.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []Response
+	requests  []Request
+	models    []string
+}
+
+// NewServer starts a fake Gemini API, which must be closed.
+func NewServer() *Server {
+	s := &Server{
+		models: []string{"gemini-1.0-pro", "gemini-1.5-flash", "gemini-1.5-pro", "gemini-pro"},
+	}
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// Enqueue adds the responses of the next requests.
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses = append(s.responses, responses...)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// SetModels sets the models listed by the API.
+func (s *Server) SetModels(models ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.models = models
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1beta/")
+	switch {
+	case r.Method == http.MethodGet && path == "models":
+		s.listModels(w)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":generateContent"):
+		s.generateContent(w, r, strings.TrimSuffix(path, ":generateContent"), false)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":streamGenerateContent"):
+		s.generateContent(w, r, strings.TrimSuffix(path, ":streamGenerateContent"), true)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":countTokens"):
+		s.countTokens(w, r, strings.TrimSuffix(path, ":countTokens"))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not supported by the fake", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) listModels(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type model struct {
+		Name                       string   `json:"name"`
+		SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+	}
+
+	var res struct {
+		Models []model `json:"models"`
+	}
+	for _, name := range s.models {
+		res.Models = append(res.Models, model{
+			Name:                       "models/" + name,
+			SupportedGenerationMethods: []string{"generateContent", "countTokens"},
+		})
+	}
+
+	writeJSON(w, res)
+}
+
+type content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []part `json:"parts"`
+}
+
+type part struct {
+	Text string `json:"text,omitempty"`
+}
+
+type generateContentRequest struct {
+	Contents []content `json:"contents"`
+}
+
+func (s *Server) generateContent(w http.ResponseWriter, r *http.Request, model string, stream bool) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req generateContentRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Model:  strings.TrimPrefix(model, "models/"),
+		Stream: stream,
+		APIKey: r.Header.Get("x-goog-api-key"),
+		Body:   body,
+	})
+
+	res := Text("echo: " + lastText(req.Contents))
+	if len(s.responses) > 0 {
+		res = s.responses[0]
+		s.responses = s.responses[1:]
+	}
+	s.mu.Unlock()
+
+	if res.Status != 0 {
+		writeError(w, res.Status, res.Message)
+		return
+	}
+
+	chunks := res.Chunks
+	if !stream {
+		chunks = []string{strings.Join(chunks, "")}
+	}
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
+
+	if !stream {
+		writeJSON(w, res.chunk(chunks[0], true))
+		return
+	}
+
+	// The streams are a JSON array of responses.
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, "[")
+	for i, text := range chunks {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+
+		b, _ := json.Marshal(res.chunk(text, i == len(chunks)-1 && !res.Truncated))
+		w.Write(b)
+		w.(http.Flusher).Flush()
+	}
+	if res.Truncated {
+		// Drop the connection without closing the array.
+		panic(http.ErrAbortHandler)
+	}
+	fmt.Fprint(w, "]")
+}
+
+// countTokens counts a token per word of the contents.
+func (s *Server) countTokens(w http.ResponseWriter, r *http.Request, model string) {
+	var req struct {
+		GenerateContentRequest json.RawMessage `json:"generateContentRequest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var gcr generateContentRequest
+	if err := json.Unmarshal(req.GenerateContentRequest, &gcr); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{
+		Model:       strings.TrimPrefix(model, "models/"),
+		APIKey:      r.Header.Get("x-goog-api-key"),
+		CountTokens: true,
+		Body:        req.GenerateContentRequest,
+	})
+	s.mu.Unlock()
+
+	var n int
+	for _, c := range gcr.Contents {
+		for _, p := range c.Parts {
+			n += len(strings.Fields(p.Text))
+		}
+	}
+
+	writeJSON(w, map[string]int{"totalTokens": n})
+}
+
+// chunk returns a GenerateContentResponse with the text. The last chunk has
+// the finish reason and the usage.
+func (res Response) chunk(text string, last bool) map[string]any {
+	candidate := map[string]any{
+		"index": 0,
+		"content": content{
+			Role:  "model",
+			Parts: []part{{Text: text}},
+		},
+	}
+
+	chunk := map[string]any{"candidates": []any{candidate}}
+	if last {
+		reason := res.FinishReason
+		if reason == "" {
+			reason = "STOP"
+		}
+		candidate["finishReason"] = reason
+
+		chunk["usageMetadata"] = map[string]int{
+			"promptTokenCount":     res.PromptTokens,
+			"candidatesTokenCount": res.CompletionTokens,
+			"totalTokenCount":      res.PromptTokens + res.CompletionTokens,
+		}
+	}
+
+	return chunk
+}
+
+func lastText(contents []content) string {
+	for i := len(contents) - 1; i >= 0; i-- {
+		for j := len(contents[i].Parts) - 1; j >= 0; j-- {
+			if t := contents[i].Parts[j].Text; t != "" {
+				return t
+			}
+		}
+	}
+
+	return ""
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error in the format of the Google APIs.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": message,
+			"status":  strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_")),
+		},
+	})
+}
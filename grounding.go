@@ -0,0 +1,224 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var groundingContextKey contextKey = "grounding"
+
+// Grounding is the Google Search grounding of a choice.
+type Grounding struct {
+	Index            int        `json:"index"`
+	WebSearchQueries []string   `json:"web_search_queries,omitempty"`
+	Sources          []Source   `json:"sources"`
+	Citations        []Citation `json:"citations"`
+}
+
+// Source is a web page used to ground the response.
+type Source struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// Citation links a segment of the response text to its sources. The indices
+// are byte offsets in the text of the choice.
+type Citation struct {
+	StartIndex int       `json:"start_index"`
+	EndIndex   int       `json:"end_index"`
+	Text       string    `json:"text"`
+	Sources    []int     `json:"sources"`
+	Confidence []float32 `json:"confidence,omitempty"`
+}
+
+// geminiGroundingMetadata is the grounding metadata of a candidate, which the
+// genai package does not decode yet.
+type geminiGroundingMetadata struct {
+	WebSearchQueries []string `json:"webSearchQueries"`
+	GroundingChunks  []struct {
+		Web struct {
+			URI   string `json:"uri"`
+			Title string `json:"title"`
+		} `json:"web"`
+	} `json:"groundingChunks"`
+	GroundingSupports []struct {
+		Segment struct {
+			StartIndex int    `json:"startIndex"`
+			EndIndex   int    `json:"endIndex"`
+			Text       string `json:"text"`
+		} `json:"segment"`
+		GroundingChunkIndices []int     `json:"groundingChunkIndices"`
+		ConfidenceScores      []float32 `json:"confidenceScores"`
+	} `json:"groundingSupports"`
+}
+
+// Groundings collects the grounding of the choices from the raw responses,
+// see generationConfigTransport.
+type Groundings struct {
+	mu     sync.Mutex
+	bodies []*bytes.Buffer
+}
+
+// GroundingContext returns a context that collects the Google Search
+// grounding of the response, when it is enabled with the Grounding
+// extension.
+func GroundingContext(ctx context.Context) (context.Context, *Groundings) {
+	g := new(Groundings)
+	return context.WithValue(ctx, groundingContextKey, g), g
+}
+
+// tee copies the response body as it is read, so that streams are not
+// delayed.
+func (g *Groundings) tee(rc io.ReadCloser) io.ReadCloser {
+	buf := new(bytes.Buffer)
+
+	g.mu.Lock()
+	g.bodies = append(g.bodies, buf)
+	g.mu.Unlock()
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.TeeReader(rc, &lockedWriter{mu: &g.mu, w: buf}),
+		Closer: rc,
+	}
+}
+
+// List returns the grounding of the choices read so far. A nil Groundings
+// has no grounding.
+func (g *Groundings) List() []Grounding {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	byIndex := make(map[int]*Grounding)
+	for _, body := range g.bodies {
+		for _, chunk := range decodeChunks[groundingChunk](body.Bytes()) {
+			for _, cand := range chunk.Candidates {
+				if cand.GroundingMetadata == nil {
+					continue
+				}
+
+				gr, ok := byIndex[cand.Index]
+				if !ok {
+					gr = &Grounding{
+						Index:     cand.Index,
+						Sources:   []Source{},
+						Citations: []Citation{},
+					}
+					byIndex[cand.Index] = gr
+				}
+
+				gr.add(cand.GroundingMetadata)
+			}
+		}
+	}
+
+	res := make([]Grounding, 0, len(byIndex))
+	for _, gr := range byIndex {
+		res = append(res, *gr)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Index < res[j].Index
+	})
+
+	return res
+}
+
+func (g *Grounding) add(m *geminiGroundingMetadata) {
+	g.WebSearchQueries = append(g.WebSearchQueries, m.WebSearchQueries...)
+
+	// The chunk indices are relative to the chunks of the same response.
+	offset := len(g.Sources)
+	for _, c := range m.GroundingChunks {
+		g.Sources = append(g.Sources, Source{
+			Title: c.Web.Title,
+			URL:   c.Web.URI,
+		})
+	}
+
+	for _, s := range m.GroundingSupports {
+		sources := make([]int, len(s.GroundingChunkIndices))
+		for i, idx := range s.GroundingChunkIndices {
+			sources[i] = idx + offset
+		}
+
+		g.Citations = append(g.Citations, Citation{
+			StartIndex: s.Segment.StartIndex,
+			EndIndex:   s.Segment.EndIndex,
+			Text:       s.Segment.Text,
+			Sources:    sources,
+			Confidence: s.ConfidenceScores,
+		})
+	}
+}
+
+type groundingChunk struct {
+	Candidates []struct {
+		Index             int                      `json:"index"`
+		GroundingMetadata *geminiGroundingMetadata `json:"groundingMetadata"`
+	} `json:"candidates"`
+}
+
+// decodeChunks decodes the generateContent response, or the chunks of the
+// streamGenerateContent response, which is a JSON array. A truncated stream
+// returns the chunks read so far.
+func decodeChunks[T any](body []byte) []T {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var chunk T
+		if err := dec.Decode(&chunk); err != nil {
+			return nil
+		}
+
+		return []T{chunk}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil
+	}
+
+	var chunks []T
+	for dec.More() {
+		var chunk T
+		if err := dec.Decode(&chunk); err != nil {
+			break
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// googleSearchTool returns the Gemini tool for the Google Search grounding,
+// which was renamed in Gemini 2.
+func googleSearchTool(model string) string {
+	model = strings.TrimPrefix(model, "models/")
+	if strings.HasPrefix(model, "gemini-1.") || strings.HasPrefix(model, "gemini-pro") {
+		return "googleSearchRetrieval"
+	}
+
+	return "googleSearch"
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.w.Write(p)
+}
@@ -0,0 +1,149 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// geminiBaseURL is the Gemini API endpoint for the calls that the genai
+	// package does not support.
+	geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+	// defaultImageModel generates the images when the requested model is not
+	// an Imagen model.
+	defaultImageModel = "imagen-3.0-generate-002"
+
+	// maxImages is the maximum number of images Imagen generates per
+	// request.
+	maxImages = 4
+)
+
+// toImagenAspectRatio maps the OpenAI image sizes to the Imagen aspect
+// ratios. Imagen picks the resolution.
+var toImagenAspectRatio = map[string]string{
+	openai.CreateImageSize256x256:   "1:1",
+	openai.CreateImageSize512x512:   "1:1",
+	openai.CreateImageSize1024x1024: "1:1",
+	openai.CreateImageSize1792x1024: "16:9",
+	openai.CreateImageSize1024x1792: "9:16",
+}
+
+// Image is a generated image.
+type Image struct {
+	MIMEType string
+	Data     []byte
+}
+
+type imagenRequest struct {
+	Instances  []imagenInstance `json:"instances"`
+	Parameters imagenParameters `json:"parameters"`
+}
+
+type imagenInstance struct {
+	Prompt string `json:"prompt"`
+}
+
+type imagenParameters struct {
+	SampleCount int    `json:"sampleCount"`
+	AspectRatio string `json:"aspectRatio,omitempty"`
+}
+
+type imagenResponse struct {
+	Predictions []struct {
+		BytesBase64Encoded string `json:"bytesBase64Encoded"`
+		MIMEType           string `json:"mimeType"`
+	} `json:"predictions"`
+}
+
+// GenerateImages generates the images with Imagen. Models that are neither
+// mapped nor Imagen models use the default Imagen model.
+func (a *Adapter) GenerateImages(ctx context.Context, req openai.ImageRequest) ([]Image, error) {
+	if req.Prompt == "" {
+		return nil, invalidRequestError("missing_required_parameter", "prompt", "prompt is required")
+	}
+
+	n := max(req.N, 1)
+	if n > maxImages {
+		return nil, invalidRequestError("invalid_value", "n", "n must be between 1 and %d, got %d", maxImages, req.N)
+	}
+
+	var aspectRatio string
+	if req.Size != "" {
+		var ok bool
+		aspectRatio, ok = toImagenAspectRatio[req.Size]
+		if !ok {
+			return nil, invalidParamError("size", "size %q is not supported", req.Size)
+		}
+	}
+
+	model := defaultImageModel
+	if m, ok := a.settings().modelMapping[req.Model]; ok {
+		model = m
+	} else if strings.HasPrefix(req.Model, "imagen-") {
+		model = req.Model
+	}
+
+	body, err := json.Marshal(imagenRequest{
+		Instances: []imagenInstance{{Prompt: req.Prompt}},
+		Parameters: imagenParameters{
+			SampleCount: n,
+			AspectRatio: aspectRatio,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/models/%s:predict", a.baseURL(), model)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("x-goog-api-key", RequestInfoFromContext(ctx).APIKey)
+
+	res, err := a.newHTTPClient(a.vertexAIOf(ctx)).Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// Return a googleapi.Error, like the genai package.
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+
+	var ir imagenResponse
+	if err := json.NewDecoder(res.Body).Decode(&ir); err != nil {
+		return nil, err
+	}
+
+	images := make([]Image, 0, len(ir.Predictions))
+	for _, p := range ir.Predictions {
+		data, err := base64.StdEncoding.DecodeString(p.BytesBase64Encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, Image{
+			MIMEType: p.MIMEType,
+			Data:     data,
+		})
+	}
+
+	// Imagen filters the unsafe images without an error.
+	if len(images) == 0 {
+		return nil, invalidRequestError("content_policy_violation", "prompt", "no images were generated, the prompt may have been filtered")
+	}
+
+	return images, nil
+}
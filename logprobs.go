@@ -0,0 +1,160 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// maxTopLogprobs is the maximum number of top logprobs Gemini returns per
+// token.
+const maxTopLogprobs = 5
+
+var logprobsContextKey contextKey = "logprobs"
+
+// geminiLogprobs is the logprobs result of a candidate, which the genai
+// package does not decode yet.
+type geminiLogprobs struct {
+	TopCandidates []struct {
+		Candidates []geminiLogprob `json:"candidates"`
+	} `json:"topCandidates"`
+	ChosenCandidates []geminiLogprob `json:"chosenCandidates"`
+}
+
+type geminiLogprob struct {
+	Token          string  `json:"token"`
+	LogProbability float64 `json:"logProbability"`
+}
+
+// logprobsCollector collects the logprobs per candidate from the raw
+// response, see generationConfigTransport.
+type logprobsCollector struct {
+	mu         sync.Mutex
+	candidates map[int32]*openai.LogProbs
+}
+
+func logprobsContext(ctx context.Context) (context.Context, *logprobsCollector) {
+	c := &logprobsCollector{
+		candidates: make(map[int32]*openai.LogProbs),
+	}
+
+	return context.WithValue(ctx, logprobsContextKey, c), c
+}
+
+// collect reads the logprobs from the body of a streamGenerateContent
+// response, which is a JSON array of the response chunks.
+func (c *logprobsCollector) collect(body []byte) error {
+	var chunks []struct {
+		Candidates []struct {
+			Index          int32           `json:"index"`
+			LogprobsResult *geminiLogprobs `json:"logprobsResult"`
+		} `json:"candidates"`
+	}
+
+	// The generateContent response is a single chunk.
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		body = append(append([]byte("["), body...), ']')
+	}
+
+	if err := json.Unmarshal(body, &chunks); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, chunk := range chunks {
+		for _, cand := range chunk.Candidates {
+			if cand.LogprobsResult == nil {
+				continue
+			}
+
+			lp, ok := c.candidates[cand.Index]
+			if !ok {
+				lp = &openai.LogProbs{}
+				c.candidates[cand.Index] = lp
+			}
+
+			lp.Content = append(lp.Content, toOpenaiLogprobs(cand.LogprobsResult)...)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the logprobs of the candidate, or nil if the model did not
+// return any.
+func (c *logprobsCollector) Get(index int32) *openai.LogProbs {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.candidates[index]
+}
+
+func (c *logprobsCollector) readResponse(res *http.Response) error {
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	return c.collect(body)
+}
+
+func toOpenaiLogprobs(r *geminiLogprobs) []openai.LogProb {
+	res := make([]openai.LogProb, len(r.ChosenCandidates))
+	for i, c := range r.ChosenCandidates {
+		res[i] = openai.LogProb{
+			Token:       c.Token,
+			LogProb:     c.LogProbability,
+			TopLogProbs: []openai.TopLogProbs{},
+		}
+
+		if i >= len(r.TopCandidates) {
+			continue
+		}
+
+		top := r.TopCandidates[i].Candidates
+		res[i].TopLogProbs = make([]openai.TopLogProbs, len(top))
+		for j, t := range top {
+			res[i].TopLogProbs[j] = openai.TopLogProbs{
+				Token:   t.Token,
+				LogProb: t.LogProbability,
+			}
+		}
+	}
+
+	return res
+}
+
+func validateLogprobs(req openai.ChatCompletionRequest) error {
+	if req.TopLogProbs == 0 {
+		return nil
+	}
+
+	if !req.LogProbs {
+		return invalidParamError("top_logprobs", "top_logprobs requires logprobs to be true")
+	}
+
+	if req.TopLogProbs < 0 || req.TopLogProbs > maxTopLogprobs {
+		return invalidParamError("top_logprobs", "top_logprobs must be between 0 and %d, got %d", maxTopLogprobs, req.TopLogProbs)
+	}
+
+	return nil
+}
+
+func setLogprobs(ctx context.Context, res *openai.ChatCompletionResponse, lp *logprobsCollector) {
+	for i, c := range res.Choices {
+		res.Choices[i].LogProbs = lp.Get(int32(c.Index))
+		if res.Choices[i].LogProbs == nil {
+			addWarning(ctx, "missing_logprobs", "the model did not return logprobs for choice %d", c.Index)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package goai
+
+import (
+	"net/http"
+)
+
+// imageMIMETypes are the image formats supported by Gemini.
+var imageMIMETypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+	"image/heic": true,
+	"image/heif": true,
+}
+
+// videoMIMETypes are the video formats supported by Gemini.
+var videoMIMETypes = map[string]bool{
+	"video/mp4":       true,
+	"video/mpeg":      true,
+	"video/mov":       true,
+	"video/quicktime": true,
+	"video/avi":       true,
+	"video/x-flv":     true,
+	"video/mpg":       true,
+	"video/webm":      true,
+	"video/wmv":       true,
+	"video/3gpp":      true,
+}
+
+// heifBrands maps the ISO base media file brands to the HEIC and HEIF MIME
+// types, which http.DetectContentType does not detect.
+var heifBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"heif": "image/heif",
+}
+
+// detectImageMIMEType detects the MIME type of the image from its magic
+// bytes.
+func detectImageMIMEType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		if mimeType, ok := heifBrands[string(data[8:12])]; ok {
+			return mimeType
+		}
+	}
+
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,153 @@
+package goai
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+	"google.golang.org/api/iterator"
+)
+
+// modelsTTL is how long the list of available models is cached per API key.
+const modelsTTL = time.Hour
+
+// listModels returns the names of the models that support generating content,
+// e.g. "gemini-1.5-pro-latest". The list is cached per API key.
+func (a *Adapter) listModels(ctx context.Context, client *genai.Client) (map[string]bool, error) {
+	key := "models:" + keyHash(RequestInfoFromContext(ctx).APIKey)
+
+	b, ok, err := a.cache.Get(ctx, key)
+	if err != nil && a.logger != nil {
+		a.logger.ErrorContext(ctx, "get cached models failed", slog.String("error", err.Error()))
+	}
+
+	var names map[string]bool
+	if ok && json.Unmarshal(b, &names) == nil {
+		return names, nil
+	}
+
+	names = make(map[string]bool)
+	iter := client.ListModels(ctx)
+	for {
+		m, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.Contains(m.SupportedGenerationMethods, "generateContent") {
+			names[strings.TrimPrefix(m.Name, "models/")] = true
+		}
+	}
+
+	b, err = json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.cache.Set(ctx, key, b, modelsTTL); err != nil && a.logger != nil {
+		a.logger.ErrorContext(ctx, "cache models failed", slog.String("error", err.Error()))
+	}
+
+	return names, nil
+}
+
+// isGeminiModel reports whether the requested model is a Gemini model that
+// can be used as is.
+func (a *Adapter) isGeminiModel(ctx context.Context, client *genai.Client, name string) bool {
+	if !strings.HasPrefix(name, "gemini-") {
+		return false
+	}
+
+	// Vertex AI validates the model instead, since it doesn't list the
+	// models of the Gemini API.
+	if a.settings().modelPassthrough || a.vertexAIOf(ctx) != nil {
+		return true
+	}
+
+	names, err := a.listModels(ctx, client)
+	if err != nil {
+		// Let Gemini validate the model instead.
+		if a.logger != nil {
+			a.logger.ErrorContext(ctx, "list models failed", slog.String("error", err.Error()))
+		}
+
+		return true
+	}
+
+	if !names[name] {
+		addWarning(ctx, "unknown_model", "model %q is not available", name)
+		return false
+	}
+
+	return true
+}
+
+// Ping checks that Gemini is reachable with the API key of the context, by
+// listing the first model, e.g. for a readiness probe. With Vertex AI, it
+// counts the tokens of a text with the default model instead.
+func (a *Adapter) Ping(ctx context.Context) error {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.vertexAIOf(ctx) != nil {
+		model := a.settings().defaultModel
+		if model == "" {
+			model = defaultModel
+		}
+
+		_, err := client.GenerativeModel(model).CountTokens(ctx, genai.Text("ping"))
+		return err
+	}
+
+	if _, err := client.ListModels(ctx).Next(); err != nil && err != iterator.Done {
+		return err
+	}
+
+	return nil
+}
+
+// listGeminiModels returns the Gemini models that generate content or
+// embeddings, for the OpenAI list of models.
+func (a *Adapter) listGeminiModels(ctx context.Context) ([]openai.Model, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Vertex AI doesn't list the publisher models.
+	if a.vertexAIOf(ctx) != nil {
+		return nil, nil
+	}
+
+	var models []openai.Model
+	iter := client.ListModels(ctx)
+	for {
+		m, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.Contains(m.SupportedGenerationMethods, "generateContent") || slices.Contains(m.SupportedGenerationMethods, "embedContent") {
+			models = append(models, openai.Model{
+				ID:      strings.TrimPrefix(m.Name, "models/"),
+				Object:  "model",
+				OwnedBy: "google",
+			})
+		}
+	}
+
+	return models, nil
+}
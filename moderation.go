@@ -0,0 +1,140 @@
+package goai
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// moderationModel is the Gemini model that rates the moderation inputs.
+const moderationModel = "gemini-1.5-flash"
+
+// moderationCategories are the Gemini categories that are rated for every
+// request.
+var moderationCategories = []genai.HarmCategory{
+	genai.HarmCategoryHarassment,
+	genai.HarmCategoryHateSpeech,
+	genai.HarmCategorySexuallyExplicit,
+	genai.HarmCategoryDangerousContent,
+}
+
+// toModerationScore converts the probability of harm to a score, since
+// Gemini only rates the probability in buckets.
+var toModerationScore = map[genai.HarmProbability]float32{
+	genai.HarmProbabilityNegligible: 0.01,
+	genai.HarmProbabilityLow:        0.25,
+	genai.HarmProbabilityMedium:     0.6,
+	genai.HarmProbabilityHigh:       0.9,
+}
+
+// Moderations classifies the inputs with the Gemini safety ratings. The
+// inputs are sent with the strictest safety settings, so that any harm
+// blocks the prompt and returns its ratings.
+//
+// When only some inputs fail, the response is returned with a *BatchError,
+// and the results of the failed inputs are flagged, so that the clients that
+// ignore the errors don't take them as safe.
+func (a *Adapter) Moderations(ctx context.Context, inputs []string) (*openai.ModerationResponse, error) {
+	client, err := a.createClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	model := client.GenerativeModel(moderationModel)
+	model.SetMaxOutputTokens(1)
+	for _, c := range moderationCategories {
+		model.SafetySettings = append(model.SafetySettings, &genai.SafetySetting{
+			Category:  c,
+			Threshold: genai.HarmBlockLowAndAbove,
+		})
+	}
+
+	res := &openai.ModerationResponse{
+		ID:      "modr-" + uuid.New().String(),
+		Model:   moderationModel,
+		Results: make([]openai.Result, len(inputs)),
+	}
+
+	var batchErr BatchError
+	for i, input := range inputs {
+		ratings, err := rateContent(ctx, model, input)
+		if err != nil {
+			batchErr.Add(i, err)
+			res.Results[i] = openai.Result{Flagged: true}
+			continue
+		}
+
+		res.Results[i] = toModerationResult(ratings)
+	}
+
+	if len(batchErr.Errors) == len(inputs) {
+		return nil, batchErr.Err()
+	}
+
+	return res, batchErr.Err()
+}
+
+func rateContent(ctx context.Context, model *genai.GenerativeModel, input string) ([]*genai.SafetyRating, error) {
+	resp, err := model.GenerateContent(ctx, genai.Text(input))
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		if blocked.PromptFeedback != nil {
+			return blocked.PromptFeedback.SafetyRatings, nil
+		}
+
+		return blocked.Candidate.SafetyRatings, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ratings []*genai.SafetyRating
+	if resp.PromptFeedback != nil {
+		ratings = append(ratings, resp.PromptFeedback.SafetyRatings...)
+	}
+
+	for _, c := range resp.Candidates {
+		ratings = append(ratings, c.SafetyRatings...)
+	}
+
+	return ratings, nil
+}
+
+// toModerationResult maps the ratings to the OpenAI categories. Gemini's
+// dangerous content covers both self-harm and violence, and the
+// subcategories are not rated.
+func toModerationResult(ratings []*genai.SafetyRating) openai.Result {
+	var res openai.Result
+	for _, r := range ratings {
+		score := toModerationScore[r.Probability]
+		flagged := r.Blocked || r.Probability >= genai.HarmProbabilityMedium
+
+		switch r.Category {
+		case genai.HarmCategoryHarassment:
+			res.CategoryScores.Harassment = max(res.CategoryScores.Harassment, score)
+			res.Categories.Harassment = res.Categories.Harassment || flagged
+		case genai.HarmCategoryHateSpeech:
+			res.CategoryScores.Hate = max(res.CategoryScores.Hate, score)
+			res.Categories.Hate = res.Categories.Hate || flagged
+		case genai.HarmCategorySexuallyExplicit:
+			res.CategoryScores.Sexual = max(res.CategoryScores.Sexual, score)
+			res.Categories.Sexual = res.Categories.Sexual || flagged
+		case genai.HarmCategoryDangerousContent:
+			res.CategoryScores.SelfHarm = max(res.CategoryScores.SelfHarm, score)
+			res.Categories.SelfHarm = res.Categories.SelfHarm || flagged
+			res.CategoryScores.Violence = max(res.CategoryScores.Violence, score)
+			res.Categories.Violence = res.Categories.Violence || flagged
+		default:
+			continue
+		}
+
+		res.Flagged = res.Flagged || flagged
+	}
+
+	return res
+}
@@ -1,10 +1,12 @@
 package goai
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/google/uuid"
 	openai "github.com/sashabaranov/go-openai"
 )
 
@@ -17,16 +19,26 @@ var toOpenaiFinishReason = map[genai.FinishReason]openai.FinishReason{
 	genai.FinishReasonOther:       openai.FinishReasonNull,
 }
 
+// toOpenaiSeverity maps the probability of harm to the Azure OpenAI severity.
+var toOpenaiSeverity = map[genai.HarmProbability]string{
+	genai.HarmProbabilityNegligible: "safe",
+	genai.HarmProbabilityLow:        "low",
+	genai.HarmProbabilityMedium:     "medium",
+	genai.HarmProbabilityHigh:       "high",
+}
+
 const (
 	openaiRoleSystem    = "system"
 	openaiRoleAssistant = "assistant"
 	openaiRoleUser      = "user"
+	openaiRoleTool      = "tool"
 )
 
 var toGenaiRole = map[string]string{
 	openaiRoleSystem:    genaiRoleUser,
 	openaiRoleAssistant: genaiRoleModel,
 	openaiRoleUser:      genaiRoleUser,
+	openaiRoleTool:      genaiRoleUser,
 }
 
 var toOpenaiRole = map[string]string{
@@ -52,17 +64,17 @@ var toOpenaiRole = map[string]string{
 //	{role: "assistant", content: "hi\nthere"},
 //
 // ]
-func mergeOpenaiMessages(msgs []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+func mergeOpenaiMessages(msgs []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, error) {
 	var prevRole string
 	var res []openai.ChatCompletionMessage
 
-	for _, curr := range msgs {
+	for i, curr := range msgs {
 		role, ok := toGenaiRole[curr.Role]
 		if !ok {
-			log.Fatalf("unknown openai role: %q", curr.Role)
+			return nil, invalidRequestError("invalid_value", fmt.Sprintf("messages[%d].role", i), "unknown role %q", curr.Role)
 		}
 
-		if role == prevRole {
+		if role == prevRole && !hasToolContent(res[len(res)-1]) && !hasToolContent(curr) {
 			// Merge the content if the roles are similar.
 			prev := res[len(res)-1]
 
@@ -102,7 +114,14 @@ func mergeOpenaiMessages(msgs []openai.ChatCompletionMessage) []openai.ChatCompl
 		}
 	}
 
-	return res
+	return res, nil
+}
+
+// hasToolContent reports whether the message carries tool calls or a tool
+// result. These are converted to structured parts, so they must not be merged
+// as text.
+func hasToolContent(msg openai.ChatCompletionMessage) bool {
+	return msg.Role == openaiRoleTool || len(msg.ToolCalls) > 0
 }
 
 func toOpenaiResponse(resp *genai.GenerateContentResponse) (*openai.ChatCompletionResponse, error) {
@@ -113,42 +132,221 @@ func toOpenaiResponse(resp *genai.GenerateContentResponse) (*openai.ChatCompleti
 	for i, c := range resp.Candidates {
 		tokens += int(c.TokenCount)
 
-		res.Choices[i] = toOpenaiChoice(c)
+		choice, err := toOpenaiChoice(c)
+		if err != nil {
+			return nil, err
+		}
+		res.Choices[i] = choice
 	}
 
 	res.Usage.CompletionTokens = tokens
+	if resp.UsageMetadata != nil {
+		res.Usage = toOpenaiUsage(resp.UsageMetadata)
+	}
 
 	return &res, nil
 }
 
-func toOpenaiChoice(c *genai.Candidate) openai.ChatCompletionChoice {
+func toOpenaiUsage(m *genai.UsageMetadata) openai.Usage {
+	u := openai.Usage{
+		PromptTokens:     int(m.PromptTokenCount),
+		CompletionTokens: int(m.CandidatesTokenCount),
+		TotalTokens:      int(m.TotalTokenCount),
+	}
+	if m.CachedContentTokenCount > 0 {
+		u.PromptTokensDetails = &openai.PromptTokensDetails{
+			CachedTokens: int(m.CachedContentTokenCount),
+		}
+	}
+
+	return u
+}
+
+func toOpenaiChoice(c *genai.Candidate) (openai.ChatCompletionChoice, error) {
 	role := toOpenaiRole[c.Content.Role]
 	index := int(c.Index)
-	content := mergeText(c.Content.Parts)
+	content, err := mergeText(c.Content.Parts)
+	if err != nil {
+		return openai.ChatCompletionChoice{}, err
+	}
+
 	finishReason := toOpenaiFinishReason[c.FinishReason]
+	toolCalls := toOpenaiToolCalls(c)
+	if len(toolCalls) > 0 && finishReason == openai.FinishReasonStop {
+		finishReason = openai.FinishReasonToolCalls
+	}
 
 	return openai.ChatCompletionChoice{
 		Index: index,
 		Message: openai.ChatCompletionMessage{
-			Role:    role,
-			Content: content,
+			Role:      role,
+			Content:   content,
+			ToolCalls: toolCalls,
 		},
-		FinishReason: finishReason,
+		FinishReason:         finishReason,
+		ContentFilterResults: toOpenaiContentFilterResults(c.SafetyRatings),
+	}, nil
+}
+
+// toOpenaiContentFilterResults converts the safety ratings of the candidate.
+// Each OpenAI category has the highest severity of its Gemini categories.
+func toOpenaiContentFilterResults(ratings []*genai.SafetyRating) openai.ContentFilterResults {
+	var res openai.ContentFilterResults
+
+	for _, r := range ratings {
+		switch r.Category {
+		case genai.HarmCategoryHateSpeech, genai.HarmCategoryHarassment, genai.HarmCategoryDerogatory:
+			res.Hate.Filtered = res.Hate.Filtered || r.Blocked
+			res.Hate.Severity = maxSeverity(res.Hate.Severity, r.Probability)
+		case genai.HarmCategorySexuallyExplicit, genai.HarmCategorySexual:
+			res.Sexual.Filtered = res.Sexual.Filtered || r.Blocked
+			res.Sexual.Severity = maxSeverity(res.Sexual.Severity, r.Probability)
+		case genai.HarmCategoryViolence:
+			res.Violence.Filtered = res.Violence.Filtered || r.Blocked
+			res.Violence.Severity = maxSeverity(res.Violence.Severity, r.Probability)
+		case genai.HarmCategoryDangerousContent, genai.HarmCategoryDangerous, genai.HarmCategoryMedical:
+			res.SelfHarm.Filtered = res.SelfHarm.Filtered || r.Blocked
+			res.SelfHarm.Severity = maxSeverity(res.SelfHarm.Severity, r.Probability)
+		case genai.HarmCategoryToxicity:
+			res.Profanity.Filtered = res.Profanity.Filtered || r.Blocked
+			res.Profanity.Detected = res.Profanity.Detected || r.Probability >= genai.HarmProbabilityMedium
+		}
 	}
+
+	return res
+}
+
+// maxSeverity returns the higher of the severity and the probability of harm.
+func maxSeverity(severity string, p genai.HarmProbability) string {
+	for q, s := range toOpenaiSeverity {
+		if s == severity && q >= p {
+			return severity
+		}
+	}
+
+	if s, ok := toOpenaiSeverity[p]; ok {
+		return s
+	}
+
+	return severity
 }
 
-func toOpenaiStreamChoices(candidates []*genai.Candidate) []openai.ChatCompletionStreamChoice {
+func toOpenaiToolCalls(c *genai.Candidate) []openai.ToolCall {
+	fcs := c.FunctionCalls()
+	if len(fcs) == 0 {
+		return nil
+	}
+
+	toolCalls := make([]openai.ToolCall, len(fcs))
+	for i, fc := range fcs {
+		// The args are decoded from a protobuf struct, so they always
+		// marshal.
+		args, _ := json.Marshal(fc.Args)
+
+		toolCalls[i] = openai.ToolCall{
+			ID:   "call_" + uuid.New().String(),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      fc.Name,
+				Arguments: string(args),
+			},
+		}
+	}
+
+	return toolCalls
+}
+
+// toOpenaiStreamChunks converts the candidates into the choices of one or
+// more chunks. Function calls are streamed the way OpenAI does: a delta with
+// the tool call id and function name, followed by a delta with the arguments.
+// The finish reason is only sent after the last delta.
+//
+// toolCalls holds the number of tool calls already streamed per candidate,
+// since the tool call index spans the whole stream.
+func toOpenaiStreamChunks(candidates []*genai.Candidate, toolCalls map[int32]int) ([][]openai.ChatCompletionStreamChoice, error) {
+	choices, err := toOpenaiStreamChoices(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := [][]openai.ChatCompletionStreamChoice{choices}
+
+	for i, c := range candidates {
+		finishReason := choices[i].FinishReason
+
+		var deltas []openai.ChatCompletionStreamChoice
+		for _, tc := range toOpenaiToolCalls(c) {
+			index := toolCalls[c.Index]
+			toolCalls[c.Index]++
+
+			deltas = append(deltas,
+				openai.ChatCompletionStreamChoice{
+					Index: choices[i].Index,
+					Delta: openai.ChatCompletionStreamChoiceDelta{
+						ToolCalls: []openai.ToolCall{{
+							Index: &index,
+							ID:    tc.ID,
+							Type:  tc.Type,
+							Function: openai.FunctionCall{
+								Name: tc.Function.Name,
+							},
+						}},
+					},
+				},
+				openai.ChatCompletionStreamChoice{
+					Index: choices[i].Index,
+					Delta: openai.ChatCompletionStreamChoiceDelta{
+						ToolCalls: []openai.ToolCall{{
+							Index: &index,
+							Function: openai.FunctionCall{
+								Arguments: tc.Function.Arguments,
+							},
+						}},
+					},
+				},
+			)
+		}
+
+		// Gemini may finish in a later chunk without the function calls.
+		if toolCalls[c.Index] > 0 && finishReason == openai.FinishReasonStop {
+			finishReason = openai.FinishReasonToolCalls
+		}
+
+		if len(deltas) == 0 {
+			choices[i].FinishReason = finishReason
+			continue
+		}
+
+		choices[i].FinishReason = openai.FinishReasonNull
+		deltas[len(deltas)-1].FinishReason = finishReason
+		for _, d := range deltas {
+			chunks = append(chunks, []openai.ChatCompletionStreamChoice{d})
+		}
+	}
+
+	return chunks, nil
+}
+
+func toOpenaiStreamChoices(candidates []*genai.Candidate) ([]openai.ChatCompletionStreamChoice, error) {
 	choices := make([]openai.ChatCompletionStreamChoice, len(candidates))
 	for i, c := range candidates {
-		choices[i] = toOpenaiStreamChoice(c)
+		choice, err := toOpenaiStreamChoice(c)
+		if err != nil {
+			return nil, err
+		}
+		choices[i] = choice
 	}
 
-	return choices
+	return choices, nil
 }
 
-func toOpenaiStreamChoice(c *genai.Candidate) openai.ChatCompletionStreamChoice {
+func toOpenaiStreamChoice(c *genai.Candidate) (openai.ChatCompletionStreamChoice, error) {
 	index := int(c.Index)
-	content := mergeText(c.Content.Parts)
+	content, err := mergeText(c.Content.Parts)
+	if err != nil {
+		return openai.ChatCompletionStreamChoice{}, err
+	}
+
 	role := toOpenaiRole[c.Content.Role]
 	finishReason := toOpenaiFinishReason[c.FinishReason]
 
@@ -158,8 +356,7 @@ func toOpenaiStreamChoice(c *genai.Candidate) openai.ChatCompletionStreamChoice
 			Content: content,
 			Role:    role,
 		},
-		FinishReason: finishReason,
-		// TODO: Complete the rest of the fields.
-		// ContentFilterResults : ContentFilterResults
-	}
+		FinishReason:         finishReason,
+		ContentFilterResults: toOpenaiContentFilterResults(c.SafetyRatings),
+	}, nil
 }
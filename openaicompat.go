@@ -0,0 +1,88 @@
+package goai
+
+import (
+	"context"
+	"net/http"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// OpenAICompatible is the Provider of a server with the OpenAI API, e.g.
+// Ollama or the llama.cpp server, to which the requests are sent as is.
+type OpenAICompatible struct {
+	client *openai.Client
+}
+
+var _ Provider = (*OpenAICompatible)(nil)
+
+// NewOpenAICompatible returns the provider of the server at the base URL,
+// e.g. http://localhost:11434/v1 for Ollama. The API key is optional, and
+// the http client defaults to http.DefaultClient.
+func NewOpenAICompatible(baseURL, apiKey string, client *http.Client) *OpenAICompatible {
+	cfg := openai.DefaultConfig(apiKey)
+	cfg.BaseURL = baseURL
+	if client != nil {
+		cfg.HTTPClient = client
+	}
+
+	return &OpenAICompatible{client: openai.NewClientWithConfig(cfg)}
+}
+
+func (p *OpenAICompatible) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	req.Stream = false
+	res, err := p.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// ChatCompletionStream streams the response. The stream ends early when the
+// call fails once started.
+func (p *OpenAICompatible) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(ch)
+		defer stream.Close()
+
+		for {
+			// The stream ends with io.EOF.
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+
+			select {
+			case ch <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (p *OpenAICompatible) Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	res, err := p.client.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (p *OpenAICompatible) ListModels(ctx context.Context) ([]openai.Model, error) {
+	res, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Models, nil
+}
@@ -0,0 +1,152 @@
+package goai
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var paramModeContextKey contextKey = "param_mode"
+
+// ParamMode controls how the OpenAI parameters that Gemini doesn't support
+// are handled.
+type ParamMode string
+
+const (
+	// ParamModeLenient ignores the parameters, with a dropped_parameter
+	// warning. It is the default.
+	ParamModeLenient ParamMode = "lenient"
+
+	// ParamModeStrict rejects the requests with an unsupported_parameter
+	// error.
+	ParamModeStrict ParamMode = "strict"
+)
+
+func (m ParamMode) validate() error {
+	switch m {
+	case "", ParamModeLenient, ParamModeStrict:
+		return nil
+	default:
+		return fmt.Errorf("unknown param mode %q, expected lenient or strict", m)
+	}
+}
+
+// SetParamMode sets how the unsupported parameters are handled, unless the
+// context of the request sets it, see ParamModeContext.
+func (a *Adapter) SetParamMode(mode ParamMode) error {
+	if err := mode.validate(); err != nil {
+		return err
+	}
+
+	a.update(func(s *adapterSettings) {
+		s.paramMode = mode
+	})
+	return nil
+}
+
+// ParamModeContext sets how the unsupported parameters of the request are
+// handled, e.g. per API key.
+func ParamModeContext(ctx context.Context, mode ParamMode) context.Context {
+	return context.WithValue(ctx, paramModeContextKey, mode)
+}
+
+func paramModeFromContext(ctx context.Context) (ParamMode, bool) {
+	mode, ok := ctx.Value(paramModeContextKey).(ParamMode)
+	return mode, ok && mode != ""
+}
+
+func (a *Adapter) paramMode(ctx context.Context) ParamMode {
+	if mode, ok := paramModeFromContext(ctx); ok {
+		return mode
+	}
+
+	return a.settings().paramMode
+}
+
+// DropParams handles the parameters of the request that the adapter doesn't
+// read, e.g. the unknown fields of the request body, in the mode of the
+// context.
+func DropParams(ctx context.Context, params ...string) error {
+	mode, _ := paramModeFromContext(ctx)
+	for _, p := range params {
+		if err := dropParam(ctx, mode, p, "%s is not supported", p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropParam rejects the unsupported parameter in strict mode, and warns
+// that it is ignored otherwise.
+func dropParam(ctx context.Context, mode ParamMode, param, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if mode == ParamModeStrict {
+		return invalidParamError(param, "%s", msg)
+	}
+
+	w, ok := ctx.Value(warningsContextKey).(*Warnings)
+	if !ok {
+		return nil
+	}
+
+	w.add(Warning{
+		Code:    "dropped_parameter",
+		Message: msg + " and is ignored",
+		Param:   param,
+	})
+
+	return nil
+}
+
+// dropUnsupportedParams handles the request parameters that are not
+// supported by Gemini, or by the model.
+func (a *Adapter) dropUnsupportedParams(ctx context.Context, model string, req openai.ChatCompletionRequest) error {
+	mode := a.paramMode(ctx)
+	if req.N > 1 {
+		if err := dropParam(ctx, mode, "n", "n=%d is not supported", req.N); err != nil {
+			return err
+		}
+	}
+
+	if req.Seed != nil && !supportsSeed(model) {
+		if err := dropParam(ctx, mode, "seed", "seed is not supported by model %q", model); err != nil {
+			return err
+		}
+	}
+
+	params := []struct {
+		name string
+		set  bool
+	}{
+		{"logit_bias", len(req.LogitBias) > 0},
+		{"response_format", req.ResponseFormat != nil},
+		{"tool_choice", req.ToolChoice != nil},
+		{"functions", len(req.Functions) > 0},
+	}
+	for _, p := range params {
+		if !p.set {
+			continue
+		}
+
+		if err := dropParam(ctx, mode, p.name, "%s is not supported", p.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IgnoredParams returns the parameters of the dropped_parameter warnings.
+func IgnoredParams(warnings []Warning) []string {
+	var params []string
+	for _, w := range warnings {
+		if w.Code == "dropped_parameter" && w.Param != "" && !slices.Contains(params, w.Param) {
+			params = append(params, w.Param)
+		}
+	}
+
+	return params
+}
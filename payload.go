@@ -0,0 +1,109 @@
+package goai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/sashabaranov/go-openai"
+)
+
+// PayloadLogging logs the contents of the requests. They are not logged by
+// default, since they hold the user data.
+type PayloadLogging struct {
+	Enabled bool
+
+	// Limit truncates each logged payload to Limit bytes of JSON, 0 for no
+	// limit.
+	Limit int
+}
+
+// SetPayloadLogging logs the contents sent to Gemini.
+func (a *Adapter) SetPayloadLogging(pl PayloadLogging) {
+	a.update(func(s *adapterSettings) {
+		s.payloadLogging = pl
+	})
+}
+
+// Attr returns v as JSON, truncated to the limit.
+func (pl PayloadLogging) Attr(key string, v any) slog.Attr {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return slog.String(key, err.Error())
+	}
+
+	if pl.Limit > 0 && len(b) > pl.Limit {
+		return slog.String(key, fmt.Sprintf("%s... (%d bytes truncated)", b[:pl.Limit], len(b)-pl.Limit))
+	}
+
+	return slog.String(key, string(b))
+}
+
+// logConversion logs the merged OpenAI messages and the Gemini contents they
+// are converted to at the debug level, to troubleshoot the role mapping. Only
+// their roles and parts are logged, unless the payloads are.
+func (a *Adapter) logConversion(ctx context.Context, messages []openai.ChatCompletionMessage, contents []*genai.Content) {
+	if a.logger == nil || !a.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	// The messages are valid, since they were converted.
+	merged, _ := mergeOpenaiMessages(messages)
+	if pl := a.settings().payloadLogging; pl.Enabled {
+		a.logger.DebugContext(ctx, "convert messages",
+			pl.Attr("merged_messages", merged),
+			pl.Attr("contents", contents),
+		)
+
+		return
+	}
+
+	a.logger.DebugContext(ctx, "convert messages",
+		slog.Any("merged_messages", messageShapes(merged)),
+		slog.Any("contents", contentShapes(contents)),
+	)
+}
+
+// messageShapes describes the messages by role and parts, e.g.
+// "user: text, image_url".
+func messageShapes(messages []openai.ChatCompletionMessage) []string {
+	shapes := make([]string, len(messages))
+	for i, m := range messages {
+		var parts []string
+		if m.Content != "" {
+			parts = append(parts, "text")
+		}
+		for _, p := range m.MultiContent {
+			parts = append(parts, string(p.Type))
+		}
+		for range m.ToolCalls {
+			parts = append(parts, "tool_call")
+		}
+		if m.ToolCallID != "" {
+			parts = append(parts, "tool_result")
+		}
+
+		shapes[i] = m.Role + ": " + strings.Join(parts, ", ")
+	}
+
+	return shapes
+}
+
+// contentShapes describes the contents by role and part types, e.g.
+// "user: Text, Blob".
+func contentShapes(contents []*genai.Content) []string {
+	shapes := make([]string, len(contents))
+	for i, c := range contents {
+		parts := make([]string, len(c.Parts))
+		for j, p := range c.Parts {
+			parts[j] = strings.TrimPrefix(fmt.Sprintf("%T", p), "genai.")
+		}
+
+		shapes[i] = c.Role + ": " + strings.Join(parts, ", ")
+	}
+
+	return shapes
+}
@@ -0,0 +1,249 @@
+package goai
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GeminiProvider is the name of the Gemini provider, which serves the
+// models without a provider prefix.
+const GeminiProvider = "gemini"
+
+// Provider is a backend of the OpenAI API. The adapter converts the requests
+// for Gemini, and sends the requests of the models of the other providers as
+// is, e.g. "ollama/llama3" to the "ollama" provider with the model "llama3".
+type Provider interface {
+	ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error)
+	ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error)
+	Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error)
+	ListModels(ctx context.Context) ([]openai.Model, error)
+}
+
+// gemini is the Provider of the Gemini models, which the adapter serves.
+type gemini struct {
+	a *Adapter
+}
+
+func (g gemini) ChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	return g.a.chatCompletion(ctx, req)
+}
+
+func (g gemini) ChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	return g.a.chatCompletionStream(ctx, req)
+}
+
+func (g gemini) Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	return g.a.embeddings(ctx, req)
+}
+
+func (g gemini) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return g.a.listGeminiModels(ctx)
+}
+
+// registeredProvider is a provider with the patterns of the models that it
+// serves without the prefix.
+type registeredProvider struct {
+	Provider
+	patterns []string
+}
+
+// RegisterProvider serves the models prefixed with the name and a slash with
+// the provider. The model mapping can map the OpenAI models to them, e.g.
+// "claude-3-5-sonnet" to "anthropic/claude-3-5-sonnet-latest". The models
+// matching the patterns, e.g. "claude-*", are also sent to the provider as
+// is, see path.Match.
+func (a *Adapter) RegisterProvider(name string, p Provider, patterns ...string) error {
+	switch {
+	case name == "" || strings.Contains(name, "/"):
+		return fmt.Errorf("invalid provider name %q", name)
+	case name == GeminiProvider, name == "models", name == "tunedModels":
+		return fmt.Errorf("provider name %q is reserved", name)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("provider %s: invalid model pattern %q", name, pattern)
+		}
+	}
+
+	a.providers.Store(name, registeredProvider{Provider: p, patterns: patterns})
+	return nil
+}
+
+// providerNames returns the names of the registered providers, sorted.
+func (a *Adapter) providerNames() []string {
+	var names []string
+	a.providers.Range(func(key, _ any) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	return names
+}
+
+// providerOf returns the provider of the requested model, after the model
+// mapping, and the model name of the provider. The models without a
+// registered prefix or pattern are Gemini models.
+func (a *Adapter) providerOf(model string) (string, Provider, string) {
+	name := model
+	if m, ok := a.settings().modelMapping[model]; ok {
+		name = m
+	}
+
+	if prefix, rest, ok := strings.Cut(name, "/"); ok {
+		if p, ok := a.providers.Load(prefix); ok {
+			return prefix, p.(registeredProvider), rest
+		}
+	}
+
+	// The first provider by name whose pattern matches serves the model.
+	for _, provider := range a.providerNames() {
+		p, _ := a.providers.Load(provider)
+		for _, pattern := range p.(registeredProvider).patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return provider, p.(registeredProvider), name
+			}
+		}
+	}
+
+	// The Gemini models are mapped by the conversion, along with the
+	// routes.
+	return GeminiProvider, gemini{a}, model
+}
+
+// Embeddings returns the embeddings of the inputs with the provider of the
+// model.
+func (a *Adapter) Embeddings(ctx context.Context, req openai.EmbeddingRequest) (*openai.EmbeddingResponse, error) {
+	ctx, span := startSpan(ctx, "goai.Embeddings", attribute.String("openai.model", string(req.Model)))
+	requested := req.Model
+
+	provider, p, model := a.providerOf(string(req.Model))
+	if provider != GeminiProvider {
+		setProviderModel(ctx, string(requested), provider, model)
+		req.Model = openai.EmbeddingModel(model)
+	}
+
+	res, err := p.Embeddings(ctx, req)
+	if res != nil {
+		res.Model = requested
+	}
+	endRequestSpan(ctx, span, err)
+
+	return res, err
+}
+
+// ListModels returns the models of all the providers, the Gemini models and
+// the mapped models first. The models of the other providers are prefixed
+// with their name, and are skipped when they can't be listed.
+func (a *Adapter) ListModels(ctx context.Context) ([]openai.Model, error) {
+	models, err := a.listGeminiModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range a.settings().modelMapping {
+		models = append(models, openai.Model{
+			ID:      name,
+			Object:  "model",
+			OwnedBy: "gemini-proxy",
+		})
+	}
+
+	for _, name := range a.providerNames() {
+		p, _ := a.providers.Load(name)
+		ms, err := p.(registeredProvider).ListModels(ctx)
+		if err != nil {
+			if a.logger != nil {
+				a.logger.WarnContext(ctx, "list models failed", slog.String("provider", name), slog.String("error", err.Error()))
+			}
+			continue
+		}
+
+		for _, m := range ms {
+			m.ID = name + "/" + m.ID
+			models = append(models, m)
+		}
+	}
+
+	return models, nil
+}
+
+// chatCompletionOf sends the request to the provider of its model, which
+// returns the requested model in the response.
+func (a *Adapter) chatCompletionOf(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, error) {
+	provider, p, model := a.providerOf(req.Model)
+	if provider == GeminiProvider {
+		return p.ChatCompletion(ctx, req)
+	}
+
+	requested := req.Model
+	setProviderModel(ctx, requested, provider, model)
+
+	req.Model = model
+	res, err := p.ChatCompletion(ctx, req)
+	if res != nil {
+		res.Model = requested
+	}
+
+	return res, err
+}
+
+// chatCompletionStreamOf streams the response of the provider of the model.
+// The span of the request ends with the stream of the other providers,
+// like the Gemini streams.
+func (a *Adapter) chatCompletionStreamOf(ctx context.Context, req openai.ChatCompletionRequest) (chan openai.ChatCompletionStreamResponse, error) {
+	provider, p, model := a.providerOf(req.Model)
+	if provider == GeminiProvider {
+		return p.ChatCompletionStream(ctx, req)
+	}
+
+	requested := req.Model
+	setProviderModel(ctx, requested, provider, model)
+
+	req.Model = model
+	in, err := p.ChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(ch)
+
+		var chunks int
+		defer func() {
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(attribute.Int("goai.chunks", chunks))
+			endRequestSpan(ctx, span, nil)
+		}()
+
+		for res := range in {
+			chunks++
+			res.Model = requested
+
+			select {
+			case ch <- res:
+			case <-ctx.Done():
+				// The stream of the provider ends with the context.
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func setProviderModel(ctx context.Context, requested, provider, model string) {
+	info := RequestInfoFromContext(ctx)
+	info.Model = requested
+	info.GeminiModel = provider + "/" + model
+}
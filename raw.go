@@ -0,0 +1,60 @@
+package goai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+var rawResponsesContextKey contextKey = "raw_responses"
+
+// RawResponses collects the untranslated Gemini responses of a request, so
+// that the conversion bugs can be diagnosed, see generationConfigTransport.
+type RawResponses struct {
+	mu     sync.Mutex
+	bodies []*bytes.Buffer
+}
+
+// RawResponsesContext returns a context that collects the raw Gemini
+// responses of the request, including the ones of the retries and the
+// fallback models.
+func RawResponsesContext(ctx context.Context) (context.Context, *RawResponses) {
+	raw := new(RawResponses)
+	return context.WithValue(ctx, rawResponsesContextKey, raw), raw
+}
+
+func (r *RawResponses) tee(rc io.ReadCloser) io.ReadCloser {
+	buf := new(bytes.Buffer)
+
+	r.mu.Lock()
+	r.bodies = append(r.bodies, buf)
+	r.mu.Unlock()
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.TeeReader(rc, &lockedWriter{mu: &r.mu, w: buf}),
+		Closer: rc,
+	}
+}
+
+// List returns the GenerateContentResponse read so far, one per chunk of
+// the streams. A nil RawResponses has no response.
+func (r *RawResponses) List() []json.RawMessage {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var res []json.RawMessage
+	for _, body := range r.bodies {
+		res = append(res, decodeChunks[json.RawMessage](body.Bytes())...)
+	}
+
+	return res
+}
@@ -0,0 +1,55 @@
+package goai
+
+import "context"
+
+var requestInfoContextKey contextKey = "request_info"
+
+// RequestInfo is the metadata of a request, shared through the context by
+// the server middleware and the adapter.
+type RequestInfo struct {
+	// ID identifies the request in the logs.
+	ID string
+
+	// Tenant is the organization that sent the request.
+	Tenant string
+
+	// APIKey is the Gemini API key of the upstream calls.
+	APIKey string
+
+	// VirtualKey is the key the client authenticated with, when the proxy
+	// maps it to APIKey.
+	VirtualKey string
+
+	// Model is the requested model, and GeminiModel the model selected by
+	// the mapping and routing, which the adapter sets.
+	Model       string
+	GeminiModel string
+
+	// Retries is the number of retries of the transient Gemini failures.
+	Retries int
+}
+
+// RequestInfoContext stores the request info. The adapter records its
+// routing decision in it.
+func RequestInfoContext(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey, info)
+}
+
+// RequestInfoFromContext returns the request info, or an empty one if the
+// context has none.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, ok := ctx.Value(requestInfoContextKey).(*RequestInfo)
+	if !ok {
+		return new(RequestInfo)
+	}
+
+	return info
+}
+
+// AuthContext stores the Gemini API key in a copy of the request info.
+func AuthContext(ctx context.Context, apiKey string) context.Context {
+	info := *RequestInfoFromContext(ctx)
+	info.APIKey = apiKey
+
+	return RequestInfoContext(ctx, &info)
+}
@@ -0,0 +1,188 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultRetryMaxBackoff = 10 * time.Second
+)
+
+// Retry retries the transient Gemini failures, such as rate limits, server
+// errors and timeouts, with a jittered exponential backoff. Invalid requests
+// fail immediately.
+type Retry struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	// Retries are disabled when it is 0 or 1.
+	MaxAttempts int
+
+	// Backoff is the maximum wait before the first retry, doubled for every
+	// retry up to MaxBackoff. The wait is picked randomly up to the maximum,
+	// so that the clients don't retry in sync. Defaults to 500ms and 10s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// SetRetry sets the retry policy of the chat completions.
+func (a *Adapter) SetRetry(r Retry) {
+	if r.Backoff <= 0 {
+		r.Backoff = defaultRetryBackoff
+	}
+
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	a.update(func(s *adapterSettings) {
+		s.retry = r
+	})
+}
+
+// withRetry calls fn until it succeeds, fails with a permanent error or runs
+// out of attempts. The retries are counted in the request info.
+func (a *Adapter) withRetry(ctx context.Context, fn func() error) error {
+	retry := a.settings().retry
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= retry.MaxAttempts || !isRetryable(ctx, err) {
+			return err
+		}
+
+		backoff := retry.backoff(attempt)
+		if a.logger != nil {
+			a.logger.WarnContext(ctx, "retrying",
+				slog.Int("attempt", attempt),
+				slog.Duration("backoff", backoff),
+				slog.String("error", err.Error()),
+			)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		RequestInfoFromContext(ctx).Retries++
+	}
+}
+
+// backoff returns the jittered wait before the retry after the attempt.
+func (r Retry) backoff(attempt int) time.Duration {
+	d := r.MaxBackoff
+	if attempt < 32 {
+		d = min(r.MaxBackoff, r.Backoff<<(attempt-1))
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// isRetryable reports whether the error is transient. The deadline of the
+// request is not retried, since the caller gave up.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return false
+	}
+
+	switch HTTPStatusCode(err) {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// sendMessage sends the message in a new chat session for every attempt,
+// since the session keeps the failed message in its history.
+func (a *Adapter) sendMessage(ctx context.Context, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part) (*genai.GenerateContentResponse, error) {
+	ctx, span := startSpan(ctx, "goai.sendMessage", attribute.String("gemini.model", RequestInfoFromContext(ctx).GeminiModel))
+
+	var resp *genai.GenerateContentResponse
+	err := a.withRetry(ctx, func() error {
+		sc := model.StartChat()
+		sc.History = history
+
+		// SendMessage streams the response too, but merges the chunks
+		// without their usage, which is only complete in the last one.
+		iter := sc.SendMessageStream(ctx, parts...)
+
+		var usage *genai.UsageMetadata
+		for {
+			res, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if res.UsageMetadata != nil {
+				usage = res.UsageMetadata
+			}
+		}
+
+		resp = iter.MergedResponse()
+		if resp != nil && usage != nil {
+			resp.UsageMetadata = usage
+		}
+		return nil
+	})
+	endSpan(span, err)
+
+	return resp, err
+}
+
+// sendMessageStream starts the stream and returns its first chunk. The stream
+// is retried until the first chunk is received, since nothing was sent to the
+// client yet. Its span ends with the first chunk.
+func (a *Adapter) sendMessageStream(ctx context.Context, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part) (*genai.GenerateContentResponseIterator, *genai.GenerateContentResponse, error) {
+	_, span := startSpan(ctx, "goai.sendMessageStream", attribute.String("gemini.model", RequestInfoFromContext(ctx).GeminiModel))
+
+	var (
+		iter  *genai.GenerateContentResponseIterator
+		first *genai.GenerateContentResponse
+	)
+	err := a.withRetry(ctx, func() error {
+		sc := model.StartChat()
+		sc.History = history
+		iter = sc.SendMessageStream(ctx, parts...)
+
+		var err error
+		first, err = iter.Next()
+		return err
+	})
+	if err != iterator.Done {
+		endSpan(span, err)
+	} else {
+		span.End()
+	}
+
+	return iter, first, err
+}
@@ -0,0 +1,114 @@
+package goai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+var headerContextKey contextKey = "header"
+
+// HeaderContext stores the incoming request headers, so that routes can match
+// on them.
+func HeaderContext(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, headerContextKey, h)
+}
+
+// Route selects the Gemini model for the requests that match all of its
+// conditions. Empty conditions always match.
+type Route struct {
+	// Model is the Gemini model to use.
+	Model string `yaml:"model"`
+
+	// ModelPattern is a regular expression matching the requested model.
+	ModelPattern string `yaml:"model_pattern"`
+
+	// MinPromptTokens and MaxPromptTokens bound the estimated number of
+	// prompt tokens.
+	MinPromptTokens int `yaml:"min_prompt_tokens"`
+	MaxPromptTokens int `yaml:"max_prompt_tokens"`
+
+	// Images matches requests with or without images.
+	Images *bool `yaml:"images"`
+
+	// Header and HeaderValue match a request header.
+	Header      string `yaml:"header"`
+	HeaderValue string `yaml:"header_value"`
+
+	re *regexp.Regexp
+}
+
+func (r *Route) match(ctx context.Context, model string, promptTokens int, hasImages bool) bool {
+	if r.re != nil && !r.re.MatchString(model) {
+		return false
+	}
+
+	if r.MinPromptTokens > 0 && promptTokens < r.MinPromptTokens {
+		return false
+	}
+
+	if r.MaxPromptTokens > 0 && promptTokens > r.MaxPromptTokens {
+		return false
+	}
+
+	if r.Images != nil && *r.Images != hasImages {
+		return false
+	}
+
+	if r.Header != "" {
+		h, _ := ctx.Value(headerContextKey).(http.Header)
+		if h.Get(r.Header) != r.HeaderValue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetRoutes sets the routes to select the model from. The first matching route
+// wins, and takes precedence over the model mapping.
+func (a *Adapter) SetRoutes(routes []Route) error {
+	rs := make([]Route, len(routes))
+	for i, r := range routes {
+		if r.Model == "" {
+			return fmt.Errorf("route %d: model is required", i)
+		}
+
+		if r.ModelPattern != "" {
+			re, err := regexp.Compile(r.ModelPattern)
+			if err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+
+			r.re = re
+		}
+
+		rs[i] = r
+	}
+
+	a.update(func(s *adapterSettings) {
+		s.routes = rs
+	})
+	return nil
+}
+
+func (a *Adapter) route(ctx context.Context, model string, contents []*genai.Content) (string, bool) {
+	routes := a.settings().routes
+	if len(routes) == 0 {
+		return "", false
+	}
+
+	promptTokens := estimateTokens(contents)
+	hasImages := isMultiModal(contents)
+
+	for _, r := range routes {
+		if r.match(ctx, model, promptTokens, hasImages) {
+			return r.Model, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,54 @@
+package goai
+
+import "fmt"
+
+// openaiMaxTemperature is the upper bound of the OpenAI temperature.
+const openaiMaxTemperature = 2
+
+// TemperatureMode controls how the OpenAI temperature, which ranges from 0 to
+// 2, is converted to the Gemini temperature.
+type TemperatureMode string
+
+const (
+	// TemperatureModeNone sends the temperature as is.
+	TemperatureModeNone TemperatureMode = ""
+
+	// TemperatureModeClamp limits the temperature to the maximum.
+	TemperatureModeClamp TemperatureMode = "clamp"
+
+	// TemperatureModeScale scales the temperature linearly from 0-2 to
+	// 0-maximum.
+	TemperatureModeScale TemperatureMode = "scale"
+)
+
+// SetTemperatureMode sets how the temperature is converted for models whose
+// maximum temperature is maxTemperature, e.g. 1 for gemini-1.0-pro.
+func (a *Adapter) SetTemperatureMode(mode TemperatureMode, maxTemperature float32) error {
+	switch mode {
+	case TemperatureModeNone, TemperatureModeClamp, TemperatureModeScale:
+	default:
+		return fmt.Errorf("unknown temperature mode: %q", mode)
+	}
+
+	if mode != TemperatureModeNone && maxTemperature <= 0 {
+		return fmt.Errorf("invalid max temperature: %v", maxTemperature)
+	}
+
+	a.update(func(s *adapterSettings) {
+		s.temperatureMode = mode
+		s.maxTemperature = maxTemperature
+	})
+	return nil
+}
+
+func (a *Adapter) normalizeTemperature(t float32) float32 {
+	s := a.settings()
+	switch s.temperatureMode {
+	case TemperatureModeClamp:
+		return min(t, s.maxTemperature)
+	case TemperatureModeScale:
+		return min(t, openaiMaxTemperature) / openaiMaxTemperature * s.maxTemperature
+	default:
+		return t
+	}
+}
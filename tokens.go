@@ -0,0 +1,78 @@
+package goai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// promptTokensTTL is how long the prompt token counts are cached, so that the
+// retries and the regenerated answers don't count the same prompt again.
+const promptTokensTTL = 10 * time.Minute
+
+// CountPromptTokens counts the prompt tokens of the request with the
+// CountTokens API of its Gemini model, including the system instruction and
+// the tools. The counts are cached by model and prompt. The models of the
+// other providers return errors.ErrUnsupported, see EstimatePromptTokens.
+func (a *Adapter) CountPromptTokens(ctx context.Context, req openai.ChatCompletionRequest) (int, error) {
+	if provider, _, _ := a.providerOf(req.Model); provider != GeminiProvider {
+		return 0, fmt.Errorf("count the tokens of %s: %w", provider, errors.ErrUnsupported)
+	}
+
+	// The media are not uploaded nor fetched, so the requests with remote
+	// media fail to be counted.
+	contents, err := buildContent(req.Messages, a.prompt())
+	if err != nil {
+		return 0, err
+	}
+
+	model, modelName, err := a.selectModel(ctx, req, contents)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := json.Marshal(struct {
+		Model    string                         `json:"model"`
+		Prompt   string                         `json:"prompt"`
+		Messages []openai.ChatCompletionMessage `json:"messages"`
+		Tools    []openai.Tool                  `json:"tools,omitempty"`
+	}{modelName, a.prompt(), req.Messages, req.Tools})
+	if err != nil {
+		return 0, err
+	}
+
+	key := "tokens:" + keyHash(string(b))
+	v, ok, err := a.cache.Get(ctx, key)
+	if err != nil && a.logger != nil {
+		a.logger.ErrorContext(ctx, "get cached token count failed", slog.String("error", err.Error()))
+	}
+	if ok {
+		if n, err := strconv.Atoi(string(v)); err == nil {
+			return n, nil
+		}
+	}
+
+	var parts []genai.Part
+	for _, c := range contents {
+		parts = append(parts, c.Parts...)
+	}
+
+	res, err := model.CountTokens(ctx, parts...)
+	if err != nil {
+		return 0, err
+	}
+
+	n := int(res.TotalTokens)
+	if err := a.cache.Set(ctx, key, []byte(strconv.Itoa(n)), promptTokensTTL); err != nil && a.logger != nil {
+		a.logger.ErrorContext(ctx, "cache token count failed", slog.String("error", err.Error()))
+	}
+
+	return n, nil
+}
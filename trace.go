@@ -0,0 +1,41 @@
+package goai
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the adapter with the global tracer provider,
+// which drops them until the application registers one with
+// otel.SetTracerProvider.
+var tracer = otel.Tracer("github.com/alextanhongpin/go-gemini")
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span with the error, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// endRequestSpan ends the span of a chat request with the Gemini model that
+// served it and the retries.
+func endRequestSpan(ctx context.Context, span trace.Span, err error) {
+	info := RequestInfoFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("gemini.model", info.GeminiModel),
+		attribute.Int("gemini.retries", info.Retries),
+	)
+
+	endSpan(span, err)
+}
@@ -0,0 +1,74 @@
+package goai
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// runeBuffer holds back the trailing bytes of an incomplete UTF-8 sequence
+// per choice, until the next chunk completes it.
+type runeBuffer struct {
+	pending map[int]string
+}
+
+func newRuneBuffer() *runeBuffer {
+	return &runeBuffer{
+		pending: make(map[int]string),
+	}
+}
+
+// complete prepends the pending bytes to the content of the choices, and
+// holds back their incomplete trailing sequence. Finished choices are
+// flushed.
+func (b *runeBuffer) complete(choices []openai.ChatCompletionStreamChoice) {
+	for i, c := range choices {
+		s := b.pending[c.Index] + c.Delta.Content
+		n := incompleteSuffix(s)
+		if c.FinishReason != "" && c.FinishReason != openai.FinishReasonNull {
+			n = 0
+		}
+
+		choices[i].Delta.Content = strings.ToValidUTF8(s[:len(s)-n], string(utf8.RuneError))
+		b.pending[c.Index] = s[len(s)-n:]
+	}
+}
+
+// flush returns the choices with the remaining pending bytes, which can only
+// be invalid once the stream is done.
+func (b *runeBuffer) flush() []openai.ChatCompletionStreamChoice {
+	var choices []openai.ChatCompletionStreamChoice
+	for index, s := range b.pending {
+		if s == "" {
+			continue
+		}
+
+		choices = append(choices, openai.ChatCompletionStreamChoice{
+			Index: index,
+			Delta: openai.ChatCompletionStreamChoiceDelta{
+				Content: strings.ToValidUTF8(s, string(utf8.RuneError)),
+			},
+		})
+	}
+
+	return choices
+}
+
+// incompleteSuffix returns the length of the incomplete UTF-8 sequence at
+// the end of s.
+func incompleteSuffix(s string) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(s); i++ {
+		if !utf8.RuneStart(s[len(s)-i]) {
+			continue
+		}
+
+		if utf8.FullRuneInString(s[len(s)-i:]) {
+			return 0
+		}
+
+		return i
+	}
+
+	return 0
+}
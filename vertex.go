@@ -0,0 +1,200 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var vertexAIContextKey contextKey = "vertex_ai"
+
+// cloudPlatformScope is the OAuth scope of the Vertex AI calls.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// VertexAI is the Vertex AI project that serves the Gemini API calls instead
+// of the Gemini API, for the deployments that can't use the API keys. The
+// calls are authenticated with the Google credentials.
+type VertexAI struct {
+	Project string `json:"project" yaml:"project"`
+
+	// Location is the region of the calls, us-central1 by default, or
+	// global.
+	Location string `json:"location,omitempty" yaml:"location"`
+
+	// CredentialsFile is the JSON key of the service account. The
+	// application default credentials are used when empty.
+	CredentialsFile string `json:"credentials_file,omitempty" yaml:"credentials_file"`
+
+	// Endpoint replaces the regional endpoint, e.g. with a Private Service
+	// Connect one.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint"`
+}
+
+// Validate reports whether the project is set.
+func (v *VertexAI) Validate() error {
+	if v.Project == "" {
+		return errors.New("vertex ai: project is required")
+	}
+
+	return nil
+}
+
+func (v *VertexAI) location() string {
+	if v.Location == "" {
+		return "us-central1"
+	}
+
+	return v.Location
+}
+
+// endpoint returns the base URL of the Vertex AI calls.
+func (v *VertexAI) endpoint() string {
+	switch {
+	case v.Endpoint != "":
+		return strings.TrimRight(v.Endpoint, "/")
+	case v.location() == "global":
+		return "https://aiplatform.googleapis.com"
+	default:
+		return "https://" + v.location() + "-aiplatform.googleapis.com"
+	}
+}
+
+// clientKey identifies the clients of the project, which are shared by the
+// requests whatever their API key.
+func (v *VertexAI) clientKey() string {
+	return "vertex:" + v.Project + "/" + v.location() + "/" + v.CredentialsFile + "/" + v.Endpoint
+}
+
+func (v *VertexAI) tokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if v.CredentialsFile == "" {
+		creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("vertex ai: %w", err)
+		}
+
+		return creds.TokenSource, nil
+	}
+
+	b, err := os.ReadFile(v.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("vertex ai: %w", err)
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, b, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("vertex ai: %w", err)
+	}
+
+	return creds.TokenSource, nil
+}
+
+// SetVertexAI sends the Gemini API calls to the Vertex AI project, unless
+// the context of the request sets another backend, see VertexAIContext. A
+// nil VertexAI sends them to the Gemini API. It must be set before the first
+// request.
+func (a *Adapter) SetVertexAI(v *VertexAI) error {
+	if v != nil {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	a.vertexAI = v
+	return nil
+}
+
+// VertexAIContext sends the Gemini API calls of the request to the Vertex AI
+// project, e.g. per API key. A nil VertexAI sends them to the Gemini API with
+// the API key of the request.
+func VertexAIContext(ctx context.Context, v *VertexAI) context.Context {
+	return context.WithValue(ctx, vertexAIContextKey, v)
+}
+
+// vertexAIOf returns the Vertex AI project of the request, or nil for the
+// Gemini API.
+func (a *Adapter) vertexAIOf(ctx context.Context) *VertexAI {
+	if v, ok := ctx.Value(vertexAIContextKey).(*VertexAI); ok {
+		return v
+	}
+
+	return a.vertexAI
+}
+
+// vertexMethods are the Gemini API methods that Vertex AI serves, on the
+// publisher models of the project.
+var vertexMethods = []string{":generateContent", ":streamGenerateContent", ":countTokens", ":predict"}
+
+// vertexTransport sends the Gemini API calls to Vertex AI, authenticated
+// with the token of the credentials instead of the API key. The other calls,
+// e.g. of the File API, are not supported.
+type vertexTransport struct {
+	vertex *VertexAI
+	base   http.RoundTripper
+
+	once sync.Once
+	ts   oauth2.TokenSource
+	err  error
+}
+
+func (t *vertexTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	path, ok := t.path(r.URL.Path)
+	if !ok {
+		return nil, fmt.Errorf("vertex ai: %s %s is not supported", r.Method, r.URL.Path)
+	}
+
+	t.once.Do(func() {
+		t.ts, t.err = t.vertex.tokenSource(context.Background())
+	})
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	tok, err := t.ts.Token()
+	if err != nil {
+		return nil, fmt.Errorf("vertex ai: %w", err)
+	}
+
+	base := t.vertex.endpoint()
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	q := u.Query()
+	q.Del("key")
+	u.RawQuery = q.Encode()
+	if i := strings.Index(base, "://"); i >= 0 {
+		u.Scheme = base[:i]
+		u.Host = strings.SplitN(base[i+3:], "/", 2)[0]
+	}
+
+	r = r.Clone(r.Context())
+	r.URL = &u
+	r.Host = u.Host
+	r.Header.Del("x-goog-api-key")
+	tok.SetAuthHeader(r)
+
+	return t.base.RoundTrip(r)
+}
+
+// path returns the Vertex AI path of the Gemini API path, e.g.
+// /v1beta/models/gemini-1.5-pro:generateContent.
+func (t *vertexTransport) path(path string) (string, bool) {
+	_, model, ok := strings.Cut(path, "/models/")
+	if !ok || strings.Contains(model, "/") {
+		return "", false
+	}
+
+	for _, m := range vertexMethods {
+		if strings.HasSuffix(model, m) {
+			return fmt.Sprintf("/v1/projects/%s/locations/%s/publishers/google/models/%s", t.vertex.Project, t.vertex.location(), model), true
+		}
+	}
+
+	return "", false
+}
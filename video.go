@@ -0,0 +1,72 @@
+package goai
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// defaultVideoModel is used for the requests with videos when the selected
+// model doesn't support video.
+const defaultVideoModel = "gemini-1.5-flash"
+
+// SetVideoModel sets the model used for the requests with videos when the
+// selected model doesn't support video.
+func (a *Adapter) SetVideoModel(model string) {
+	a.update(func(s *adapterSettings) {
+		s.videoModel = model
+	})
+}
+
+// withVideoSupport returns the video model if the request has videos and the
+// model doesn't support them.
+func (a *Adapter) withVideoSupport(ctx context.Context, model string, contents []*genai.Content) string {
+	if !hasVideo(contents) || supportsVideo(model) {
+		return model
+	}
+
+	videoModel := a.settings().videoModel
+	if videoModel == "" {
+		videoModel = defaultVideoModel
+	}
+
+	addWarning(ctx, "video_model", "model %q does not support video, using %q", model, videoModel)
+	return videoModel
+}
+
+// supportsVideo reports whether the model accepts video, which the text only
+// Gemini 1.0 models and Gemma don't.
+func supportsVideo(model string) bool {
+	model = strings.TrimPrefix(model, "models/")
+
+	switch {
+	case strings.Contains(model, "vision"):
+		return true
+	case strings.HasPrefix(model, "gemini-pro"),
+		strings.HasPrefix(model, "gemini-1.0-"),
+		strings.HasPrefix(model, "gemma-"):
+		return false
+	default:
+		return true
+	}
+}
+
+func hasVideo(contents []*genai.Content) bool {
+	for _, c := range contents {
+		for _, p := range c.Parts {
+			switch t := p.(type) {
+			case genai.Blob:
+				if strings.HasPrefix(t.MIMEType, "video/") {
+					return true
+				}
+			case genai.FileData:
+				if strings.HasPrefix(t.MIMEType, "video/") {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,60 @@
+package goai
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Warmup creates the clients for the API keys, and sends a tiny generation
+// to every mapped and routed model, so that the first requests don't pay for
+// the connection setup.
+func (a *Adapter) Warmup(ctx context.Context, apiKeys []string) error {
+	var errs []error
+	for _, key := range apiKeys {
+		client, err := a.createClient(AuthContext(ctx, key))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, name := range a.warmupModels() {
+			model := client.GenerativeModel(name)
+			model.SetMaxOutputTokens(1)
+			if _, err := model.GenerateContent(ctx, genai.Text("hi")); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if a.logger != nil {
+				a.logger.Info("warmed up", slog.String("model", name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// warmupModels returns the distinct models of the mapping and routes.
+func (a *Adapter) warmupModels() []string {
+	s := a.settings()
+	seen := make(map[string]bool)
+	for _, m := range s.modelMapping {
+		seen[m] = true
+	}
+
+	for _, r := range s.routes {
+		seen[r.Model] = true
+	}
+
+	models := make([]string, 0, len(seen))
+	for m := range seen {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+
+	return models
+}
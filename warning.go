@@ -0,0 +1,58 @@
+package goai
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+var warningsContextKey contextKey = "warnings"
+
+// Warning describes how the proxy changed a request that could not be
+// converted as is, e.g. a dropped parameter.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Param is the dropped parameter, if any.
+	Param string `json:"param,omitempty"`
+}
+
+// Warnings collects the warnings raised while serving a request.
+type Warnings struct {
+	mu   sync.Mutex
+	list []Warning
+}
+
+func (w *Warnings) add(warning Warning) {
+	w.mu.Lock()
+	w.list = append(w.list, warning)
+	w.mu.Unlock()
+}
+
+// List returns the warnings collected so far.
+func (w *Warnings) List() []Warning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]Warning(nil), w.list...)
+}
+
+// WarningsContext returns a context that collects the warnings raised by the
+// Adapter.
+func WarningsContext(ctx context.Context) (context.Context, *Warnings) {
+	w := new(Warnings)
+	return context.WithValue(ctx, warningsContextKey, w), w
+}
+
+func addWarning(ctx context.Context, code, format string, args ...any) {
+	w, ok := ctx.Value(warningsContextKey).(*Warnings)
+	if !ok {
+		return
+	}
+
+	w.add(Warning{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}